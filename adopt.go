@@ -0,0 +1,69 @@
+package main
+
+import (
+	"flag"
+	"github.com/cromefire/fritzbox-cloudflare-dyndns/pkg/config"
+	"github.com/cromefire/fritzbox-cloudflare-dyndns/pkg/util"
+	"log/slog"
+	"os"
+)
+
+// runAdopt marks the existing records with the names given as arguments as
+// owned, all configured records if none are given, and returns the exit code.
+func runAdopt(args []string) int {
+	flags := flag.NewFlagSet("adopt", flag.ExitOnError)
+	configPath := flags.String("config", os.Getenv("CONFIG_FILE"), "path to a YAML or TOML config file")
+	jsonOutput := flags.Bool("json", false, "print the changes as JSON")
+	dryRun := flags.Bool("dry-run", false, "only print the records that would be adopted")
+	_ = flags.Parse(args)
+
+	logger := slog.Default()
+
+	cfg, err := config.Load(*configPath)
+
+	if err != nil {
+		logger.Error("Failed to load configuration", util.ErrorAttr(err))
+		return exitInvalidConfig
+	}
+
+	changes := make([]util.Change, 0)
+	opts := updaterOptions{
+		dryRun: *dryRun,
+		onChange: func(change util.Change) {
+			changes = append(changes, change)
+		},
+	}
+
+	updaters, err := startUpdaters(cfg, opts, logger)
+
+	if err != nil {
+		logger.Error("Failed to start updaters", util.ErrorAttr(err))
+		return exitFailed
+	}
+
+	code := exitSucceeded
+	adopted := false
+
+	for _, u := range updaters {
+		if u.adopt == nil {
+			continue
+		}
+
+		adopted = true
+		err := u.adopt(flags.Args())
+
+		if err != nil {
+			logger.Error("Failed to adopt records", slog.String("provider", u.provider), util.ErrorAttr(err))
+			code = exitFailed
+		}
+	}
+
+	if !adopted {
+		logger.Error("No provider supports adopting records")
+		return exitInvalidConfig
+	}
+
+	printChanges(changes, *jsonOutput)
+
+	return code
+}
@@ -0,0 +1,329 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	cf "github.com/cloudflare/cloudflare-go"
+	"github.com/cromefire/fritzbox-cloudflare-dyndns/pkg/cloudflare"
+	"github.com/cromefire/fritzbox-cloudflare-dyndns/pkg/config"
+	"github.com/cromefire/fritzbox-cloudflare-dyndns/pkg/polling"
+	"github.com/cromefire/fritzbox-cloudflare-dyndns/pkg/provider"
+	"io"
+	"log/slog"
+	"os"
+	"slices"
+	"time"
+)
+
+// CheckResult is the outcome of a single check.
+type CheckResult struct {
+	Check  string `json:"check"`
+	Target string `json:"target"`
+	Passed bool   `json:"passed"`
+	// Skipped checks weren't run, they don't fail the report
+	Skipped bool   `json:"skipped,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+// CheckReport is the outcome of all checks.
+type CheckReport struct {
+	Passed  bool          `json:"passed"`
+	Results []CheckResult `json:"results"`
+}
+
+func (r *CheckReport) add(check string, target string, err error) {
+	result := CheckResult{Check: check, Target: target, Passed: err == nil}
+
+	if err != nil {
+		result.Message = err.Error()
+		r.Passed = false
+	}
+
+	r.Results = append(r.Results, result)
+}
+
+// skip adds a check that wasn't run and why.
+func (r *CheckReport) skip(check string, target string, reason string) {
+	r.Results = append(r.Results, CheckResult{Check: check, Target: target, Passed: true, Skipped: true, Message: reason})
+}
+
+func (r *CheckReport) writeText(w io.Writer) {
+	for _, result := range r.Results {
+		state := "OK"
+		if result.Skipped {
+			state = "SKIP"
+		} else if !result.Passed {
+			state = "FAIL"
+		}
+
+		line := fmt.Sprintf("%-4s  %-10s  %s", state, result.Check, result.Target)
+		if result.Message != "" {
+			line += ": " + result.Message
+		}
+
+		_, _ = fmt.Fprintln(w, line)
+	}
+
+	if r.Passed {
+		_, _ = fmt.Fprintln(w, "All checks passed")
+	} else {
+		_, _ = fmt.Fprintln(w, "Some checks failed")
+	}
+}
+
+// runCheck validates the configuration and the access to the routers and
+// providers without changing any record. It returns the exit code.
+func runCheck(args []string) int {
+	flags := flag.NewFlagSet("check", flag.ExitOnError)
+	configPath := flags.String("config", os.Getenv("CONFIG_FILE"), "path to a YAML or TOML config file")
+	jsonOutput := flags.Bool("json", false, "print the report as JSON")
+	writeProbe := flags.Bool("write-probe", true, "check write access by creating and deleting a TXT record per Cloudflare zone, -write-probe=false only checks read access")
+	_ = flags.Parse(args)
+
+	// Only the report is printed
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	report := &CheckReport{Passed: true, Results: make([]CheckResult, 0)}
+
+	cfg, err := config.Load(*configPath)
+	report.add("config", *configPath, err)
+
+	code := exitInvalidConfig
+
+	if err == nil {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+		defer cancel()
+
+		checkRouters(ctx, report, cfg, logger)
+
+		for _, p := range cfg.Providers {
+			checkProvider(ctx, report, cfg, p, logger, *writeProbe)
+		}
+
+		code = exitSucceeded
+		if !report.Passed {
+			code = exitFailed
+		}
+	}
+
+	if *jsonOutput {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		_ = encoder.Encode(report)
+	} else {
+		report.writeText(os.Stdout)
+	}
+
+	return code
+}
+
+// checkRouters probes the SOAP API of the routers for the addresses the records
+// need. The SOAP client doesn't take a context, so its timeout is cut to the
+// deadline of the context.
+func checkRouters(ctx context.Context, report *CheckReport, cfg *config.Config, logger *slog.Logger) {
+	for _, router := range cfg.Sources.Routers {
+		fritzbox := polling.NewFritzBox(router, logger)
+
+		probe := func(target string, get func() error) {
+			if err := ctx.Err(); err != nil {
+				report.add("router", router.Name+" "+target, err)
+				return
+			}
+
+			if deadline, ok := ctx.Deadline(); ok {
+				fritzbox.Timeout = min(fritzbox.Timeout, time.Until(deadline))
+			}
+
+			report.add("router", router.Name+" "+target, get())
+		}
+
+		probed := false
+
+		if cfg.UsesWanIpv6() {
+			probe("WAN IPv6", func() error {
+				_, err := fritzbox.GetwanIpv6()
+				return err
+			})
+			probed = true
+		}
+
+		if cfg.UsesPrefix() {
+			probe("IPv6 prefix", func() error {
+				_, err := fritzbox.GetIpv6Prefix()
+				return err
+			})
+			probed = true
+		}
+
+		if cfg.UsesIpVersion(4) || !probed {
+			probe("WAN IPv4", func() error {
+				_, err := fritzbox.GetWanIpv4()
+				return err
+			})
+		}
+	}
+}
+
+func checkProvider(ctx context.Context, report *CheckReport, cfg *config.Config, p config.Provider, logger *slog.Logger, writeProbe bool) {
+	records := cfg.RecordsOf(p.Name)
+
+	switch p.Type {
+	case config.ProviderCloudflare:
+		checkCloudflare(ctx, report, p, records, writeProbe)
+	case config.ProviderCloudflareList:
+		cloudflareLists.check(ctx, report, cfg, p, records, logger)
+	case config.ProviderCloudflareGateway:
+		cloudflareGateway.check(ctx, report, cfg, p, records, logger)
+	case config.ProviderCloudflareLB:
+		cloudflareLB.check(ctx, report, cfg, p, records, logger)
+	case config.ProviderRoute53:
+		client, err := newRoute53Client(p, logger)
+
+		if err != nil {
+			report.add("provider", p.Name, err)
+			return
+		}
+
+		err = resolveRoute53Zones(client, providerRecords(cfg, records))
+		report.add("provider", p.Name+" zones", err)
+
+		if err == nil {
+			checkRecords(ctx, report, p.Name, client, records)
+		}
+	case config.ProviderPlugin:
+		pl := newPlugin(p, logger)
+		defer pl.Close()
+
+		checkRecords(ctx, report, p.Name, pl, records)
+	}
+}
+
+func checkCloudflare(ctx context.Context, report *CheckReport, p config.Provider, records []config.Record, writeProbe bool) {
+	type access struct {
+		credential cloudflare.Credential
+		api        *cf.API
+		zones      []cloudflare.Zone
+	}
+
+	accesses := make([]*access, 0)
+
+	for _, credential := range cloudflareCredentials(p) {
+		target := p.Name + " " + credential.Name
+		api, _, err := cloudflare.NewAPI(credential.Token, credential.Email, credential.Key)
+
+		if err != nil {
+			report.add("credential", target, err)
+			continue
+		}
+
+		if credential.Token != "" {
+			err = cloudflare.VerifyToken(ctx, api)
+			report.add("credential", target+" token", err)
+
+			if err != nil {
+				continue
+			}
+		}
+
+		a := &access{credential: credential, api: api}
+
+		// Records with a zone ID don't need the zones to be listed
+		if slices.ContainsFunc(records, func(record config.Record) bool { return !cloudflare.IsZoneId(record.Zone) }) {
+			a.zones, err = cloudflare.ListZones(ctx, api)
+			report.add("credential", target+" zones", err)
+
+			if err != nil {
+				continue
+			}
+		}
+
+		accesses = append(accesses, a)
+	}
+
+	type check struct {
+		access *access
+		zone   cloudflare.Zone
+	}
+
+	checked := make([]check, 0)
+
+	for _, record := range records {
+		candidates := slices.DeleteFunc(slices.Clone(accesses), func(a *access) bool {
+			return record.Credential != "" && a.credential.Name != record.Credential
+		})
+
+		if len(candidates) == 0 {
+			report.add("record", record.Name, errors.New("no usable credential"))
+			continue
+		}
+
+		// Like the updater, the first credential that can access the zone is used
+		zones := make([]cloudflare.Zone, 0)
+		for _, a := range candidates {
+			zones = append(zones, a.zones...)
+		}
+
+		zone, err := cloudflare.ZoneOf(record.Name, record.Zone, zones)
+
+		if err != nil {
+			report.add("record", record.Name, err)
+			continue
+		}
+
+		i := slices.IndexFunc(candidates, func(a *access) bool { return slices.Contains(a.zones, zone) })
+		c := check{access: candidates[max(i, 0)], zone: zone}
+
+		if !slices.Contains(checked, c) {
+			checked = append(checked, c)
+		}
+	}
+
+	for _, c := range checked {
+		name := c.zone.Name
+		if name == "" {
+			name = c.zone.Id
+		}
+
+		target := p.Name + " " + name + " (" + c.access.credential.Name + ")"
+		report.add("zone", target, cloudflare.CheckZone(ctx, c.access.api, c.zone, writeProbe))
+
+		if !writeProbe {
+			report.skip("zone", target+" write", "write access not verified, run without -write-probe=false")
+		}
+	}
+}
+
+// check resolves the resources of the records and checks that they can be read.
+func (a accountProvider[P]) check(ctx context.Context, report *CheckReport, cfg *config.Config, p config.Provider, records []config.Record, logger *slog.Logger) {
+	resources, err := a.newProvider(p, logger)
+
+	if err != nil {
+		report.add("provider", p.Name, err)
+		return
+	}
+
+	err = a.resolveRecords(resources, providerRecords(cfg, records))
+	report.add("provider", p.Name+" "+a.resources, err)
+
+	if err == nil {
+		checkRecords(ctx, report, p.Name, resources, records)
+	}
+}
+
+// checkRecords checks that the records of a generic provider can be read.
+func checkRecords(ctx context.Context, report *CheckReport, name string, p provider.Provider, records []config.Record) {
+	for _, record := range records {
+		for _, ipVersion := range record.IpVersions() {
+			recordType := "A"
+			if ipVersion == 6 {
+				recordType = "AAAA"
+			}
+
+			_, err := p.List(ctx, record.Name, recordType)
+			report.add("record", fmt.Sprintf("%s %s %s", name, record.Name, recordType), err)
+		}
+	}
+}
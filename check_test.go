@@ -0,0 +1,45 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"github.com/cromefire/fritzbox-cloudflare-dyndns/pkg/config"
+	"io"
+	"log/slog"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCheckReportSkip(t *testing.T) {
+	report := &CheckReport{Passed: true}
+	report.add("zone", "example.com", nil)
+	report.skip("zone", "example.com write", "not verified")
+
+	if !report.Passed {
+		t.Error("a skipped check failed the report")
+	}
+
+	out := &bytes.Buffer{}
+	report.writeText(out)
+
+	if !strings.Contains(out.String(), "SKIP  zone        example.com write: not verified") {
+		t.Errorf("report = %q, want the skipped check", out.String())
+	}
+}
+
+func TestCheckRoutersDeadline(t *testing.T) {
+	cfg := &config.Config{
+		Sources: config.Sources{Routers: []config.Router{{Name: "home", Url: "http://192.0.2.1:49000", Timeout: config.Duration{Duration: time.Hour}}}},
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	report := &CheckReport{Passed: true}
+	checkRouters(ctx, report, cfg, slog.New(slog.NewTextHandler(io.Discard, nil)))
+
+	if report.Passed || len(report.Results) != 1 || report.Results[0].Message != context.Canceled.Error() {
+		t.Errorf("report = %+v, want the router check canceled", report.Results)
+	}
+}
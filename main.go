@@ -4,133 +4,176 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
-	"github.com/cromefire/fritzbox-cloudflare-dyndns/pkg/cloudflare"
+	"flag"
+	"github.com/cromefire/fritzbox-cloudflare-dyndns/pkg/config"
 	"github.com/cromefire/fritzbox-cloudflare-dyndns/pkg/dyndns"
 	"github.com/cromefire/fritzbox-cloudflare-dyndns/pkg/polling"
+	"github.com/cromefire/fritzbox-cloudflare-dyndns/pkg/state"
 	"github.com/cromefire/fritzbox-cloudflare-dyndns/pkg/util"
 	"github.com/joho/godotenv"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"log/slog"
-	"net"
 	"net/http"
 	"os"
 	"os/signal"
-	"strings"
 	"syscall"
+	"time"
+)
+
+// Exit codes of the subcommands
+const (
+	exitSucceeded     = 0
+	exitFailed        = 1
+	exitInvalidConfig = 2
 )
 
 func main() {
 	// Load any env variables defined in .env.dev files
 	_ = godotenv.Load(".env", ".env.dev")
 
-	rootLogger := slog.Default()
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "check":
+			os.Exit(runCheck(os.Args[2:]))
+		case "sync":
+			os.Exit(runSync(os.Args[2:]))
+		case "plan":
+			os.Exit(runPlan(os.Args[2:]))
+		case "adopt":
+			os.Exit(runAdopt(os.Args[2:]))
+		}
+	}
 
-	updater, updateStatus := newUpdater(rootLogger)
-	updater.StartWorker()
+	configPath := flag.String("config", os.Getenv("CONFIG_FILE"), "path to a YAML or TOML config file")
+	watchInterval := flag.Duration("watch", 0, "interval to check the config file for changes, disabled if 0")
+	dryRun := flag.Bool("dry-run", os.Getenv("DRY_RUN") == "true", "only log the changes instead of making them")
+	flag.Parse()
 
-	ctx, cancel := context.WithCancelCause(context.Background())
+	rootLogger := slog.Default()
 
-	ipv6LocalAddress := os.Getenv("DEVICE_LOCAL_ADDRESS_IPV6")
+	if interval := os.Getenv("CONFIG_WATCH_INTERVAL"); interval != "" && *watchInterval == 0 {
+		v, err := time.ParseDuration(interval)
 
-	var localIp net.IP
-	if ipv6LocalAddress != "" {
-		localIp = net.ParseIP(ipv6LocalAddress)
-		if localIp == nil {
-			rootLogger.Error("Failed to parse IP from DEVICE_LOCAL_ADDRESS_IPV6, exiting")
-			return
+		if err != nil {
+			rootLogger.Warn("Failed to parse CONFIG_WATCH_INTERVAL, not watching the config file", util.ErrorAttr(err))
+		} else {
+			*watchInterval = v
 		}
-		rootLogger.Info("Using the IPv6 Prefix to construct the IPv6 Address")
 	}
 
-	bind := os.Getenv("METRICS_BIND")
-	pollStatus := polling.StartPollServer(updater.In, &localIp, rootLogger)
-	pushStatus := startPushServer(updater.In, &localIp, rootLogger, cancel)
-	status := util.Status{
-		Push:    pushStatus,
-		Poll:    pollStatus,
-		Updates: updateStatus,
+	cfg, err := config.Load(*configPath)
+
+	if err != nil {
+		rootLogger.Error("Failed to load configuration", util.ErrorAttr(err))
+		os.Exit(1)
 	}
-	if bind != "" {
-		token := readSecret("METRICS_TOKEN")
-		startMetricsServer(bind, rootLogger, status, token, cancel)
+
+	opts := updaterOptions{dryRun: *dryRun}
+
+	if *dryRun {
+		rootLogger.Warn("Dry run, no records are changed and no notifications are sent")
+	} else {
+		opts.notifier = newNotifier(cfg, rootLogger)
 	}
 
-	// Create a OS signal shutdown channel
-	shutdown := make(chan os.Signal)
+	if cfg.State.File != "" && !*dryRun {
+		opts.store, err = state.Open(cfg.State.File, rootLogger)
 
-	signal.Notify(shutdown, syscall.SIGTERM)
-	signal.Notify(shutdown, syscall.SIGINT)
+		if err != nil {
+			rootLogger.Error("Failed to load state", util.ErrorAttr(err))
+			os.Exit(1)
+		}
+	}
 
-	// Wait for either the context to finish or the shutdown signal
-	select {
-	case <-ctx.Done():
-		rootLogger.Error("Context closed", util.ErrorAttr(context.Cause(ctx)))
+	in := make(chan *util.IpUpdate, 10)
+	updaters, err := startUpdaters(cfg, opts, rootLogger)
+
+	if err != nil {
+		rootLogger.Error("Failed to start updaters", util.ErrorAttr(err))
 		os.Exit(1)
-	case <-shutdown:
-		break
 	}
 
-	rootLogger.Info("Shutdown detected")
-}
+	go fanOut(in, updaters)
 
-func newUpdater(logger *slog.Logger) (*cloudflare.Updater, []*util.UpdateStatus) {
-	const subsystem = "cf_updater"
-	logger = logger.With(util.SubsystemAttr(subsystem))
-	u := cloudflare.NewUpdater(slog.Default().With(util.SubsystemAttr(subsystem)), subsystem)
+	reload := newReloader(*configPath, cfg, updaters, rootLogger)
 
-	token := readSecret("CLOUDFLARE_API_TOKEN")
-	email := os.Getenv("CLOUDFLARE_API_EMAIL")
-	key := readSecret("CLOUDFLARE_API_KEY")
+	ctx, cancel := context.WithCancelCause(context.Background())
 
-	if token == "" {
-		if email == "" || key == "" {
-			logger.Info("Env CLOUDFLARE_API_TOKEN not found, disabling Cloudflare updates", util.SubsystemAttr(subsystem))
-			return u, nil
-		} else {
-			logger.Warn("Using deprecated credentials via the API key")
-		}
+	routerStatus := make([]*util.PollStatus, 0)
+	for _, router := range cfg.Sources.Routers {
+		routerStatus = append(routerStatus, polling.StartPollServer(in, router, cfg.UsesIpVersion(4), cfg.UsesWanIpv6(), cfg.UsesPrefix(), rootLogger))
 	}
 
-	ipv4Zone := os.Getenv("CLOUDFLARE_ZONES_IPV4")
-	ipv6Zone := os.Getenv("CLOUDFLARE_ZONES_IPV6")
-
-	if ipv4Zone == "" && ipv6Zone == "" {
-		logger.Warn("Env CLOUDFLARE_ZONES_IPV4 and CLOUDFLARE_ZONES_IPV6 not found, disabling Cloudflare updates", util.SubsystemAttr(subsystem))
-		return u, nil
+	pushStatus := startPushServer(cfg.Sources.Push, in, rootLogger, cancel)
+	status := func() util.Status {
+		status := util.Status{
+			Push:        pushStatus,
+			Routers:     routerStatus,
+			Updates:     reload.Statuses(),
+			Credentials: reload.CredentialStatuses(),
+			Zones:       reload.ZoneStatuses(),
+		}
+		if len(routerStatus) > 0 {
+			status.Poll = routerStatus[0]
+		}
+		return status
 	}
-
-	if ipv4Zone != "" {
-		u.SetIPv4Zones(ipv4Zone)
+	if cfg.Metrics.Bind != "" {
+		startMetricsServer(cfg.Metrics.Bind, rootLogger, status, cfg.Metrics.Token, cancel)
 	}
 
-	if ipv6Zone != "" {
-		u.SetIPv6Zones(ipv6Zone)
+	if *watchInterval > 0 {
+		if *configPath == "" {
+			rootLogger.Warn("No config file to watch")
+		} else {
+			go reload.Watch(*watchInterval)
+		}
 	}
 
-	var err error
-	var status []*util.UpdateStatus
+	// Create a OS signal shutdown channel
+	shutdown := make(chan os.Signal, 1)
 
-	if token != "" {
-		err, status = u.InitWithToken(token)
-	} else {
-		err, status = u.InitWithKey(email, key)
-	}
+	signal.Notify(shutdown, syscall.SIGTERM)
+	signal.Notify(shutdown, syscall.SIGINT)
 
-	if err != nil {
-		logger.Error("Failed to init Cloudflare updater, disabling Cloudflare updates")
-		os.Exit(1)
+	// SIGHUP reloads the records of the configuration
+	hangup := make(chan os.Signal, 1)
+
+	signal.Notify(hangup, syscall.SIGHUP)
+
+	// Wait for either the context to finish or the shutdown signal
+loop:
+	for {
+		select {
+		case <-ctx.Done():
+			rootLogger.Error("Context closed", util.ErrorAttr(context.Cause(ctx)))
+			os.Exit(1)
+		case <-hangup:
+			reload.Reload("SIGHUP")
+		case <-shutdown:
+			break loop
+		}
 	}
 
-	return u, status
+	rootLogger.Info("Shutdown detected")
+}
+
+// fanOut forwards every received update to all updaters.
+func fanOut(in <-chan *util.IpUpdate, updaters []*runningUpdater) {
+	for update := range in {
+		for _, u := range updaters {
+			u.in <- update
+		}
+	}
 }
 
-func startPushServer(out chan<- *net.IP, localIp *net.IP, logger *slog.Logger, cancel context.CancelCauseFunc) *util.PushStatus {
+func startPushServer(push config.Push, out chan<- *util.IpUpdate, logger *slog.Logger, cancel context.CancelCauseFunc) *util.PushStatus {
 	const subsystem = "push_server"
 	logger = logger.With(util.SubsystemAttr(subsystem))
-	bind := os.Getenv("DYNDNS_SERVER_BIND")
+	bind := push.Bind
 
 	if bind == "" {
-		logger.Info("Env DYNDNS_SERVER_BIND not found, disabling DynDns server")
+		logger.Info("No push server bind configured, disabling DynDns server")
 		return nil
 	}
 
@@ -138,9 +181,9 @@ func startPushServer(out chan<- *net.IP, localIp *net.IP, logger *slog.Logger, c
 		Succeeded: true,
 	}
 
-	server := dyndns.NewServer(out, localIp, logger, subsystem, &status)
-	server.Username = os.Getenv("DYNDNS_SERVER_USERNAME")
-	server.Password = readSecret("DYNDNS_SERVER_PASSWORD")
+	server := dyndns.NewServer(out, logger, subsystem, &status)
+	server.Username = push.Username
+	server.Password = push.Password
 
 	pushMux := http.NewServeMux()
 
@@ -162,14 +205,38 @@ func startPushServer(out chan<- *net.IP, localIp *net.IP, logger *slog.Logger, c
 	return &status
 }
 
-func startMetricsServer(bind string, logger *slog.Logger, status util.Status, token string, cancel context.CancelCauseFunc) {
+func startMetricsServer(bind string, logger *slog.Logger, status func() util.Status, token string, cancel context.CancelCauseFunc) {
 	const subsystem = "metrics"
 	logger = logger.With(util.SubsystemAttr(subsystem))
 	metricsMux := http.NewServeMux()
 	metricsMux.Handle("/metrics", promhttp.Handler())
 	metricsMux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		status := status()
 		w.Header().Set("Content-Type", "application/json; charset=utf-8")
-		if status.Poll != nil && !status.Poll.Succeeded {
+		anyRouterUnsuccessful := false
+		for _, r := range status.Routers {
+			if !r.Succeeded {
+				anyRouterUnsuccessful = true
+				break
+			}
+		}
+
+		anyPermissionMissing := false
+		for _, c := range status.Credentials {
+			if !c.Succeeded {
+				anyPermissionMissing = true
+				break
+			}
+		}
+
+		for _, z := range status.Zones {
+			if !z.Succeeded {
+				anyPermissionMissing = true
+				break
+			}
+		}
+
+		if anyRouterUnsuccessful || anyPermissionMissing {
 			w.WriteHeader(http.StatusServiceUnavailable)
 		} else if status.Push != nil && !status.Push.Succeeded {
 			w.WriteHeader(http.StatusServiceUnavailable)
@@ -218,23 +285,3 @@ func startMetricsServer(bind string, logger *slog.Logger, status util.Status, to
 
 	logger.Info("metrics server started", slog.String("addr", bind))
 }
-
-func readSecret(envName string) string {
-	secret := os.Getenv(envName)
-
-	if secret != "" {
-		slog.Info("Secret passed via environment variable " + envName + ". It's recommended to pass secrets via files, see https://github.com/cromefire/fritzbox-cloudflare-dyndns?tab=readme-ov-file#passing-secrets.")
-		return secret
-	}
-
-	passwordFilePath := os.Getenv(envName + "_FILE")
-	if passwordFilePath != "" {
-		content, err := os.ReadFile(passwordFilePath)
-		if err != nil {
-			slog.Error("Failed to read secret from file "+passwordFilePath, util.ErrorAttr(err))
-		} else {
-			secret = strings.TrimSuffix(strings.TrimSuffix(string(content), "\r\n"), "\n")
-		}
-	}
-	return secret
-}
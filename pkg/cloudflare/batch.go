@@ -0,0 +1,84 @@
+package cloudflare
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	cf "github.com/cloudflare/cloudflare-go"
+	"log/slog"
+	"net/http"
+	"slices"
+)
+
+// batchPatch is an update in a batch, which unlike a single update carries the
+// ID in the body.
+type batchPatch struct {
+	ID string `json:"id"`
+	cf.UpdateDNSRecordParams
+}
+
+// batchDelete is a deletion in a batch.
+type batchDelete struct {
+	ID string `json:"id"`
+}
+
+// batchRequest is the body of the batch DNS records endpoint, which applies
+// all changes in a single transaction.
+type batchRequest struct {
+	Posts   []cf.CreateDNSRecordParams `json:"posts,omitempty"`
+	Deletes []batchDelete              `json:"deletes,omitempty"`
+	Patches []batchPatch               `json:"patches,omitempty"`
+}
+
+type batchResult struct {
+	Posts []cf.DNSRecord `json:"posts"`
+}
+
+// applyBatch makes the changes of a zone in a single request and sets the IDs
+// of the created records.
+func (u *Updater) applyBatch(ctx context.Context, c *credential, zoneId string, changes []*plannedChange) error {
+	req := batchRequest{}
+	// posted holds the change of each post, for the record IDs
+	posted := make([]*plannedChange, 0)
+
+	for _, change := range changes {
+		switch {
+		case change.create != nil:
+			req.Posts = append(req.Posts, *change.create)
+			posted = append(posted, change)
+		case change.update != nil:
+			patch := batchPatch{ID: change.update.ID, UpdateDNSRecordParams: *change.update}
+
+			// A later update of the record, i.e. the other hint, builds on the earlier one
+			if i := slices.IndexFunc(req.Patches, func(p batchPatch) bool { return p.ID == patch.ID }); i >= 0 {
+				req.Patches[i] = patch
+			} else {
+				req.Patches = append(req.Patches, patch)
+			}
+		case change.delete != "":
+			req.Deletes = append(req.Deletes, batchDelete{ID: change.delete})
+		}
+	}
+
+	res, err := c.api.Raw(ctx, http.MethodPost, fmt.Sprintf("/zones/%s/dns_records/batch", zoneId), req, nil)
+	u.observe(c, err)
+
+	if err != nil {
+		return err
+	}
+
+	result := batchResult{}
+	err = json.Unmarshal(res.Result, &result)
+
+	if err != nil || len(result.Posts) != len(posted) {
+		// The changes were made, only the IDs of the new records are unknown
+		u.log.Warn("Unexpected batch response", slog.String("zone-id", zoneId))
+		return nil
+	}
+
+	for i, change := range posted {
+		change.RecordId = result.Posts[i].ID
+	}
+
+	return nil
+}
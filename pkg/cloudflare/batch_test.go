@@ -0,0 +1,127 @@
+package cloudflare
+
+import (
+	"context"
+	cf "github.com/cloudflare/cloudflare-go"
+	"github.com/cromefire/fritzbox-cloudflare-dyndns/pkg/util"
+	"net"
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+const testZoneId = "023e105f4ecef8ad9ca31a8372d0c353"
+
+var testZone = Zone{Id: testZoneId, Name: "example.com"}
+
+func ipv4Update(ip string) *util.IpUpdate {
+	return &util.IpUpdate{Source: "home", IpVersion: 4, Ip: net.ParseIP(ip)}
+}
+
+func TestBatch(t *testing.T) {
+	fake := newFakeCloudflare(t, testZone)
+	fake.add(testZoneId, cf.DNSRecord{Type: "A", Name: "vpn.example.com", Content: "192.0.2.1", TTL: 120})
+
+	u := newTestUpdater(t, fake, nil,
+		Record{Name: "home.example.com", IpVersion: 4},
+		Record{Name: "vpn.example.com", IpVersion: 4},
+		Record{Name: "nas.example.com", IpVersion: 4},
+	)
+
+	u.Handle(ipv4Update("192.0.2.2"))
+
+	// The changes of the zone are sent in a single request
+	if writes := fake.writes(); !reflect.DeepEqual(writes, []string{"POST /zones/" + testZoneId + "/dns_records/batch"}) {
+		t.Fatalf("requests = %v, want a single batch", writes)
+	}
+
+	if batch := fake.batches[0]; len(batch.Posts) != 2 || len(batch.Patches) != 1 || len(batch.Deletes) != 0 {
+		t.Errorf("batch = %+v, want 2 posts and a patch", batch)
+	}
+
+	// The IDs of the created records are taken from the response
+	for _, action := range u.actions {
+		records := matching(fake.list(testZoneId, "A"), "A", action.DnsRecord)
+
+		if len(records) != 1 || records[0].Content != "192.0.2.2" {
+			t.Fatalf("%s = %+v, want the address", action.DnsRecord, records)
+		}
+
+		if !reflect.DeepEqual(action.recordIds, []string{records[0].ID}) || action.last != "192.0.2.2" {
+			t.Errorf("%s = record IDs %v, last %q, want %s", action.DnsRecord, action.recordIds, action.last, records[0].ID)
+		}
+	}
+}
+
+func TestBatchSingleWrite(t *testing.T) {
+	fake := newFakeCloudflare(t, testZone)
+	fake.add(testZoneId, cf.DNSRecord{Type: "A", Name: "vpn.example.com", Content: "192.0.2.2", TTL: 120})
+
+	u := newTestUpdater(t, fake, nil,
+		Record{Name: "home.example.com", IpVersion: 4},
+		Record{Name: "vpn.example.com", IpVersion: 4},
+	)
+
+	u.Handle(ipv4Update("192.0.2.2"))
+
+	if writes := fake.writes(); !reflect.DeepEqual(writes, []string{"POST /zones/" + testZoneId + "/dns_records"}) {
+		t.Errorf("requests = %v, want a single create", writes)
+	}
+}
+
+func TestBatchFallback(t *testing.T) {
+	fake := newFakeCloudflare(t, testZone)
+	fake.fail["POST /zones/"+testZoneId+"/dns_records/batch"] = http.StatusBadRequest
+
+	u := newTestUpdater(t, fake, nil,
+		Record{Name: "home.example.com", IpVersion: 4},
+		Record{Name: "vpn.example.com", IpVersion: 4},
+	)
+
+	u.Handle(ipv4Update("192.0.2.2"))
+
+	want := []string{
+		"POST /zones/" + testZoneId + "/dns_records/batch",
+		"POST /zones/" + testZoneId + "/dns_records",
+		"POST /zones/" + testZoneId + "/dns_records",
+	}
+
+	if writes := fake.writes(); !reflect.DeepEqual(writes, want) {
+		t.Fatalf("requests = %v, want %v", writes, want)
+	}
+
+	for _, action := range u.actions {
+		if !action.status.Succeeded || len(action.recordIds) != 1 {
+			t.Errorf("%s = status %+v, record IDs %v, want it created", action.DnsRecord, action.status, action.recordIds)
+		}
+	}
+}
+
+func TestApplyBatchMergesPatches(t *testing.T) {
+	fake := newFakeCloudflare(t, testZone)
+	record := fake.add(testZoneId, cf.DNSRecord{Type: "HTTPS", Name: "home.example.com", TTL: 120})[0]
+
+	u := newTestUpdater(t, fake, nil)
+
+	first := cf.UpdateDNSRecordParams{ID: record.ID, Type: "HTTPS", Name: record.Name, Data: map[string]any{"value": `ipv4hint="192.0.2.1"`}}
+	second := cf.UpdateDNSRecordParams{ID: record.ID, Type: "HTTPS", Name: record.Name, Data: map[string]any{"value": `ipv4hint="192.0.2.1" ipv6hint="2001:db8::1"`}}
+	create := cf.CreateDNSRecordParams{Type: "A", Name: "home.example.com", Content: "192.0.2.1"}
+
+	changes := []*plannedChange{{update: &first}, {update: &second}, {create: &create}}
+	err := u.applyBatch(context.Background(), u.credentials[0], testZoneId, changes)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	batch := fake.batches[0]
+
+	// The later update of the record builds on the earlier one
+	if len(batch.Patches) != 1 || !reflect.DeepEqual(batch.Patches[0].Data, map[string]any{"value": `ipv4hint="192.0.2.1" ipv6hint="2001:db8::1"`}) {
+		t.Errorf("patches = %+v, want the later update", batch.Patches)
+	}
+
+	if changes[2].RecordId == "" {
+		t.Error("ID of the created record not set")
+	}
+}
@@ -0,0 +1,119 @@
+package cloudflare
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	cf "github.com/cloudflare/cloudflare-go"
+	"github.com/cromefire/fritzbox-cloudflare-dyndns/pkg/util"
+	"net/http"
+)
+
+// probeRecordName is the TXT record created and deleted to check write access.
+const probeRecordName = "_fritzbox-dyndns-check"
+
+// NewAPI creates a Cloudflare client with a token or, if it's empty, the
+// deprecated API key, and the rate limit its responses report.
+func NewAPI(token string, email string, key string) (*cf.API, *util.RateLimit, error) {
+	api, transport, err := newAPI(token, email, key)
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return api, &transport.RateLimit, nil
+}
+
+func newAPI(token string, email string, key string) (*cf.API, *rateLimitTransport, error) {
+	transport := &rateLimitTransport{base: http.DefaultTransport}
+	client := cf.HTTPClient(&http.Client{Transport: transport})
+
+	var api *cf.API
+	var err error
+
+	if token != "" {
+		api, err = cf.NewWithAPIToken(token, client)
+	} else {
+		api, err = cf.New(key, email, client)
+	}
+
+	return api, transport, err
+}
+
+// VerifyToken checks that the token of the client is active.
+func VerifyToken(ctx context.Context, api *cf.API) error {
+	res, err := api.VerifyAPIToken(ctx)
+
+	if err != nil {
+		return err
+	}
+
+	if res.Status != "active" {
+		return errors.New("token is " + res.Status)
+	}
+
+	return nil
+}
+
+// CheckZone checks that the DNS records of the zone can be read and, if
+// writeProbe is set, written. The write probe creates and deletes a real TXT
+// record named _fritzbox-dyndns-check in the zone.
+func CheckZone(ctx context.Context, api *cf.API, zone Zone, writeProbe bool) error {
+	zone, err := checkRead(ctx, api, zone)
+
+	if err != nil || !writeProbe {
+		return err
+	}
+
+	return checkWrite(ctx, api, zone)
+}
+
+// checkRead checks that the DNS records of the zone can be read and returns
+// the zone with its name.
+func checkRead(ctx context.Context, api *cf.API, zone Zone) (Zone, error) {
+	// Zones given by ID might not be listed
+	if zone.Name == "" {
+		details, err := api.ZoneDetails(ctx, zone.Id)
+
+		if err != nil {
+			return zone, fmt.Errorf("zone not accessible: %w", err)
+		}
+
+		zone.Name = details.Name
+	}
+
+	// A single record is enough, a page size stops the client from paging
+	// through all records of the zone
+	_, _, err := api.ListDNSRecords(ctx, cf.ZoneIdentifier(zone.Id), cf.ListDNSRecordsParams{Type: "A", ResultInfo: cf.ResultInfo{PerPage: 1}})
+
+	if err != nil {
+		return zone, fmt.Errorf("could not read DNS records: %w", err)
+	}
+
+	return zone, nil
+}
+
+// checkWrite checks that DNS records of the zone can be written by creating
+// and deleting a TXT record.
+func checkWrite(ctx context.Context, api *cf.API, zone Zone) error {
+	rc := cf.ZoneIdentifier(zone.Id)
+
+	record, err := api.CreateDNSRecord(ctx, rc, cf.CreateDNSRecordParams{
+		Type:    "TXT",
+		Name:    probeRecordName + "." + zone.Name,
+		Content: "fritzbox-cloudflare-dyndns write check",
+		TTL:     AutoTTL,
+	})
+
+	if err != nil {
+		return fmt.Errorf("could not write DNS records: %w", err)
+	}
+
+	err = api.DeleteDNSRecord(ctx, rc, record.ID)
+
+	if err != nil {
+		return fmt.Errorf("could not delete probe record %s: %w", record.Name, err)
+	}
+
+	return nil
+}
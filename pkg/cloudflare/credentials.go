@@ -0,0 +1,121 @@
+package cloudflare
+
+import (
+	"errors"
+	"fmt"
+	cf "github.com/cloudflare/cloudflare-go"
+	"github.com/cromefire/fritzbox-cloudflare-dyndns/pkg/util"
+	"log/slog"
+	"slices"
+	"time"
+)
+
+// DefaultCredential is the name of the credential passed without a name.
+const DefaultCredential = "default"
+
+// Credential is a named API token or, if the token is empty, a deprecated API
+// key. Records use the credential they name or the one that can access their
+// zone.
+type Credential struct {
+	Name  string
+	Token string
+	Email string
+	Key   string
+}
+
+// credential is the client of a Credential and the zones it can access.
+type credential struct {
+	name      string
+	api       *cf.API
+	rateLimit *rateLimitTransport
+	status    *util.CredentialStatus
+
+	// zones are the accessible zones, listed again after the zone refresh interval
+	zones       []Zone
+	zonesListed time.Time
+}
+
+// AddCredential adds a credential, it has to be called before the updater is
+// initialized. The first credential is used for records with a zone ID that
+// don't name one.
+func (u *Updater) AddCredential(cred Credential) error {
+	if cred.Name == "" {
+		cred.Name = DefaultCredential
+	}
+
+	if slices.ContainsFunc(u.credentials, func(c *credential) bool { return c.name == cred.Name }) {
+		return fmt.Errorf("credential %s is not unique", cred.Name)
+	}
+
+	api, rateLimit, err := newAPI(cred.Token, cred.Email, cred.Key)
+
+	if err != nil {
+		return fmt.Errorf("credential %s: %w", cred.Name, err)
+	}
+
+	u.credentials = append(u.credentials, &credential{
+		name:      cred.Name,
+		api:       api,
+		rateLimit: rateLimit,
+		status:    &util.CredentialStatus{Provider: u.name, Name: cred.Name, Succeeded: true},
+	})
+
+	return nil
+}
+
+// credential returns the credential with the name, nil if there is none.
+func (u *Updater) credential(name string) *credential {
+	for _, c := range u.credentials {
+		if c.name == name {
+			return c
+		}
+	}
+
+	return nil
+}
+
+// CredentialStatuses returns whether the last request of every credential was
+// authorized.
+func (u *Updater) CredentialStatuses() []*util.CredentialStatus {
+	u.credentialsLock.Lock()
+	defer u.credentialsLock.Unlock()
+
+	statuses := make([]*util.CredentialStatus, 0, len(u.credentials))
+	for _, c := range u.credentials {
+		status := *c.status
+		statuses = append(statuses, &status)
+	}
+
+	return statuses
+}
+
+// observe keeps whether the credential was authorized for a request. Other
+// errors don't tell anything about the credential and are ignored.
+func (u *Updater) observe(c *credential, err error) {
+	var authentication *cf.AuthenticationError
+	var authorization *cf.AuthorizationError
+
+	unauthorized := errors.As(err, &authentication) || errors.As(err, &authorization)
+
+	if err != nil && !unauthorized {
+		return
+	}
+
+	u.credentialsLock.Lock()
+	defer u.credentialsLock.Unlock()
+
+	c.status.Last = time.Now()
+
+	if !unauthorized {
+		c.status.Succeeded = true
+		c.status.Error = ""
+		return
+	}
+
+	if c.status.Succeeded {
+		u.log.Error("Credential was rejected", slog.String("credential", c.name), util.ErrorAttr(err))
+	}
+
+	c.status.Succeeded = false
+	c.status.Error = err.Error()
+}
@@ -0,0 +1,67 @@
+package cloudflare
+
+import (
+	cf "github.com/cloudflare/cloudflare-go"
+	"github.com/cromefire/fritzbox-cloudflare-dyndns/pkg/util"
+	"github.com/prometheus/client_golang/prometheus"
+	"testing"
+)
+
+func TestProviderName(t *testing.T) {
+	fake := newFakeCloudflare(t, testZone)
+	fake.add(testZoneId, cf.DNSRecord{Type: "A", Name: "vpn.example.com", Content: "192.0.2.1", TTL: 120})
+
+	u := NewUpdater(testLogger(), "work", "cf_work_updater")
+	u.SetRegisterer(prometheus.NewRegistry())
+
+	if err := u.AddCredential(Credential{Name: "personal", Token: "token"}); err != nil {
+		t.Fatal(err)
+	}
+
+	u.credentials[0].api, u.credentials[0].rateLimit = fake.api()
+	u.AddRecord(Record{Name: "home.example.com", IpVersion: 4})
+	u.AddRecord(Record{Name: "vpn.example.com", IpVersion: 4})
+
+	changes := make([]util.Change, 0)
+	u.SetChangeHandler(func(change util.Change) { changes = append(changes, change) })
+
+	if err, _ := u.Init(); err != nil {
+		t.Fatal(err)
+	}
+
+	u.Handle(ipv4Update("192.0.2.2"))
+
+	// Every status and change is reported with the name of the provider
+	if len(changes) != 2 {
+		t.Errorf("changes = %+v, want a create and an update", changes)
+	}
+
+	for _, change := range changes {
+		if change.Provider != "work" {
+			t.Errorf("provider of change %+v = %q, want work", change, change.Provider)
+		}
+	}
+
+	for _, status := range u.Statuses() {
+		if status.Provider != "work" {
+			t.Errorf("provider of status %+v = %q, want work", status, status.Provider)
+		}
+	}
+
+	for _, status := range u.CredentialStatuses() {
+		if status.Provider != "work" {
+			t.Errorf("provider of credential %s = %q, want work", status.Name, status.Provider)
+		}
+	}
+
+	zones := u.ZoneStatuses()
+	if len(zones) != 1 {
+		t.Errorf("zone statuses = %+v, want the zone of the records", zones)
+	}
+
+	for _, status := range zones {
+		if status.Provider != "work" {
+			t.Errorf("provider of zone %s = %q, want work", status.Zone, status.Provider)
+		}
+	}
+}
@@ -0,0 +1,121 @@
+package cloudflare
+
+import (
+	cf "github.com/cloudflare/cloudflare-go"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"reflect"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestParseDuplicatePolicy(t *testing.T) {
+	tests := map[string]DuplicatePolicy{
+		"":           DuplicatesUpdateAll,
+		"update-all": DuplicatesUpdateAll,
+		"keep-one":   DuplicatesKeepOne,
+		"fail":       DuplicatesFail,
+	}
+
+	for value, want := range tests {
+		got, err := ParseDuplicatePolicy(value)
+
+		if err != nil || got != want {
+			t.Errorf("ParseDuplicatePolicy(%q) = %q, %v, want %q", value, got, err, want)
+		}
+	}
+
+	if _, err := ParseDuplicatePolicy("keep-all"); err == nil {
+		t.Error("ParseDuplicatePolicy(keep-all) succeeded, want an error")
+	}
+}
+
+func TestKeeper(t *testing.T) {
+	at := func(second int) time.Time { return time.Date(2024, 1, 1, 0, 0, second, 0, time.UTC) }
+
+	old := cf.DNSRecord{ID: "old", Content: "192.0.2.1", CreatedOn: at(1)}
+	current := cf.DNSRecord{ID: "current", Content: "192.0.2.2", CreatedOn: at(2)}
+	published := cf.DNSRecord{ID: "published", Content: "192.0.2.3", CreatedOn: at(3)}
+
+	tests := []struct {
+		name      string
+		recordIds []string
+		records   []cf.DNSRecord
+		want      string
+	}{
+		{name: "published to before", recordIds: []string{"published"}, records: []cf.DNSRecord{old, current, published}, want: "published"},
+		{name: "with the content", records: []cf.DNSRecord{old, published, current}, want: "current"},
+		{name: "oldest", records: []cf.DNSRecord{published, old}, want: "old"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			action := &Action{recordIds: test.recordIds}
+
+			if got := keeper(action, test.records, "192.0.2.2"); got.ID != test.want {
+				t.Errorf("keeper = %s, want %s", got.ID, test.want)
+			}
+		})
+	}
+}
+
+func TestDuplicates(t *testing.T) {
+	duplicates := func() []cf.DNSRecord {
+		return []cf.DNSRecord{
+			{Type: "A", Name: "home.example.com", Content: "192.0.2.1", TTL: 120},
+			{Type: "A", Name: "home.example.com", Content: "192.0.2.2", TTL: 120},
+			{Type: "A", Name: "home.example.com", Content: "192.0.2.3", TTL: 120},
+		}
+	}
+
+	tests := []struct {
+		policy DuplicatePolicy
+		// want are the contents left, nil if the update fails
+		want []string
+	}{
+		{policy: DuplicatesUpdateAll, want: []string{"192.0.2.4", "192.0.2.4", "192.0.2.4"}},
+		{policy: DuplicatesKeepOne, want: []string{"192.0.2.4"}},
+		{policy: DuplicatesFail},
+	}
+
+	for _, test := range tests {
+		t.Run(string(test.policy), func(t *testing.T) {
+			fake := newFakeCloudflare(t, testZone)
+			fake.add(testZoneId, duplicates()...)
+
+			u := newTestUpdater(t, fake, nil, Record{
+				Name:          "home.example.com",
+				IpVersion:     4,
+				RecordOptions: RecordOptions{Duplicates: test.policy},
+			})
+
+			u.Handle(ipv4Update("192.0.2.4"))
+
+			contents := make([]string, 0)
+			for _, record := range fake.list(testZoneId, "A") {
+				contents = append(contents, record.Content)
+			}
+
+			action := u.actions[0]
+
+			if test.want == nil {
+				if action.status.Succeeded || !slices.Equal(contents, []string{"192.0.2.1", "192.0.2.2", "192.0.2.3"}) {
+					t.Errorf("status %+v, records %v, want it to fail without changes", action.status, contents)
+				}
+
+				if writes := fake.writes(); len(writes) != 0 {
+					t.Errorf("requests = %v, want none", writes)
+				}
+			} else if !action.status.Succeeded || !reflect.DeepEqual(contents, test.want) {
+				t.Errorf("status %+v, records %v, want %v", action.status, contents, test.want)
+			}
+
+			// The policy applied is counted
+			counter := u.duplicates.With(prometheus.Labels{"record": "home.example.com", "type": "A", "policy": string(test.policy)})
+			if count := testutil.ToFloat64(counter); count != 1 {
+				t.Errorf("duplicates_total = %v, want 1", count)
+			}
+		})
+	}
+}
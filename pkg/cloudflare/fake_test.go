@@ -0,0 +1,382 @@
+package cloudflare
+
+import (
+	"encoding/json"
+	"fmt"
+	cf "github.com/cloudflare/cloudflare-go"
+	"github.com/prometheus/client_golang/prometheus"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeCloudflare is a stand-in for the Cloudflare API keeping the zones and
+// their DNS records in memory.
+type fakeCloudflare struct {
+	t   *testing.T
+	URL string
+
+	lock    sync.Mutex
+	zones   []Zone
+	records map[string][]cf.DNSRecord
+	nextId  int
+	// requests are the method and path of every request in order
+	requests []string
+	// batches are the bodies of the batch requests
+	batches []batchRequest
+	// fail answers the requests whose method and path start with a key with
+	// its status
+	fail map[string]int
+	// retryAfter is the Retry-After header of failed requests
+	retryAfter string
+	// routes answer further requests by their method and path prefix
+	routes map[string]http.HandlerFunc
+}
+
+func newFakeCloudflare(t *testing.T, zones ...Zone) *fakeCloudflare {
+	fake := &fakeCloudflare{
+		t:       t,
+		zones:   zones,
+		records: make(map[string][]cf.DNSRecord),
+		fail:    make(map[string]int),
+		routes:  make(map[string]http.HandlerFunc),
+	}
+
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+	fake.URL = server.URL
+
+	return fake
+}
+
+// api creates a client of the fake that neither throttles nor retries
+// requests, and the rate limit its responses report.
+func (f *fakeCloudflare) api() (*cf.API, *rateLimitTransport) {
+	transport := &rateLimitTransport{base: http.DefaultTransport}
+	api, err := cf.NewWithAPIToken("token",
+		cf.BaseURL(f.URL),
+		cf.HTTPClient(&http.Client{Transport: transport}),
+		cf.UsingRateLimit(1000),
+		cf.UsingRetryPolicy(0, 0, 0),
+	)
+
+	if err != nil {
+		f.t.Fatal(err)
+	}
+
+	return api, transport
+}
+
+// add adds records to the zone and returns them with their IDs.
+func (f *fakeCloudflare) add(zoneId string, records ...cf.DNSRecord) []cf.DNSRecord {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	for i := range records {
+		f.nextId++
+		records[i].ID = fmt.Sprintf("record-%d", f.nextId)
+		records[i].CreatedOn = time.Date(2024, 1, 1, 0, 0, f.nextId, 0, time.UTC)
+		f.records[zoneId] = append(f.records[zoneId], records[i])
+	}
+
+	return records
+}
+
+// list returns the records of the zone with the type, all if empty.
+func (f *fakeCloudflare) list(zoneId string, recordType string) []cf.DNSRecord {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	records := make([]cf.DNSRecord, 0)
+	for _, record := range f.records[zoneId] {
+		if recordType == "" || record.Type == recordType {
+			records = append(records, record)
+		}
+	}
+
+	return records
+}
+
+// writes returns the requests that changed anything.
+func (f *fakeCloudflare) writes() []string {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	return slices.DeleteFunc(slices.Clone(f.requests), func(request string) bool {
+		return strings.HasPrefix(request, http.MethodGet)
+	})
+}
+
+// reset forgets the requests made so far.
+func (f *fakeCloudflare) reset() {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	f.requests = nil
+	f.batches = nil
+}
+
+func (f *fakeCloudflare) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	request := r.Method + " " + r.URL.Path
+	f.requests = append(f.requests, request)
+
+	for prefix, status := range f.fail {
+		if strings.HasPrefix(request, prefix) {
+			if f.retryAfter != "" {
+				w.Header().Set("Retry-After", f.retryAfter)
+			}
+
+			f.error(w, status, "request failed")
+			return
+		}
+	}
+
+	for prefix, route := range f.routes {
+		if strings.HasPrefix(request, prefix) {
+			// The routes take the lock themselves if they need it
+			f.lock.Unlock()
+			route(w, r)
+			f.lock.Lock()
+			return
+		}
+	}
+
+	path := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+
+	switch {
+	case request == "GET /user/tokens/verify":
+		f.result(w, map[string]string{"id": "token", "status": "active"})
+	case request == "GET /zones":
+		zones := make([]cf.Zone, 0, len(f.zones))
+		for _, zone := range f.zones {
+			zones = append(zones, cf.Zone{ID: zone.Id, Name: zone.Name})
+		}
+
+		f.result(w, zones)
+	case r.Method == http.MethodGet && len(path) == 2 && path[0] == "zones":
+		for _, zone := range f.zones {
+			if zone.Id == path[1] {
+				f.result(w, cf.Zone{ID: zone.Id, Name: zone.Name})
+				return
+			}
+		}
+
+		f.error(w, http.StatusNotFound, "zone not found")
+	case len(path) >= 3 && path[0] == "zones" && path[2] == "dns_records":
+		f.serveRecords(w, r, path[1], path[3:])
+	default:
+		f.t.Errorf("unexpected request %s", request)
+		f.error(w, http.StatusNotFound, "not found")
+	}
+}
+
+func (f *fakeCloudflare) serveRecords(w http.ResponseWriter, r *http.Request, zoneId string, path []string) {
+	switch {
+	case r.Method == http.MethodGet && len(path) == 0:
+		query := r.URL.Query()
+		records := make([]cf.DNSRecord, 0)
+
+		for _, record := range f.records[zoneId] {
+			if (query.Get("type") == "" || record.Type == query.Get("type")) && (query.Get("name") == "" || record.Name == query.Get("name")) {
+				records = append(records, record)
+			}
+		}
+
+		f.result(w, records)
+	case r.Method == http.MethodPost && len(path) == 0:
+		params := cf.CreateDNSRecordParams{}
+		f.decode(r, &params)
+		f.result(w, f.create(zoneId, params))
+	case r.Method == http.MethodPatch && len(path) == 1:
+		params := cf.UpdateDNSRecordParams{}
+		f.decode(r, &params)
+		params.ID = path[0]
+
+		if !f.update(zoneId, params) {
+			f.error(w, http.StatusNotFound, "record not found")
+			return
+		}
+
+		f.result(w, nil)
+	case r.Method == http.MethodDelete && len(path) == 1:
+		if !f.delete(zoneId, path[0]) {
+			f.error(w, http.StatusNotFound, "record not found")
+			return
+		}
+
+		f.result(w, map[string]string{"id": path[0]})
+	case r.Method == http.MethodPost && len(path) == 1 && path[0] == "batch":
+		req := batchRequest{}
+		f.decode(r, &req)
+		f.batches = append(f.batches, req)
+
+		// Like the API, the deletes are applied first and the posts last
+		for _, d := range req.Deletes {
+			f.delete(zoneId, d.ID)
+		}
+
+		for _, patch := range req.Patches {
+			patch.UpdateDNSRecordParams.ID = patch.ID
+			f.update(zoneId, patch.UpdateDNSRecordParams)
+		}
+
+		result := batchResult{Posts: make([]cf.DNSRecord, 0)}
+		for _, post := range req.Posts {
+			result.Posts = append(result.Posts, f.create(zoneId, post))
+		}
+
+		f.result(w, result)
+	default:
+		f.t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+		f.error(w, http.StatusNotFound, "not found")
+	}
+}
+
+func (f *fakeCloudflare) create(zoneId string, params cf.CreateDNSRecordParams) cf.DNSRecord {
+	f.nextId++
+	record := cf.DNSRecord{
+		ID:        fmt.Sprintf("record-%d", f.nextId),
+		Type:      params.Type,
+		Name:      params.Name,
+		Content:   params.Content,
+		Data:      params.Data,
+		TTL:       params.TTL,
+		Proxied:   params.Proxied,
+		Comment:   params.Comment,
+		Tags:      params.Tags,
+		CreatedOn: time.Date(2024, 1, 1, 0, 0, f.nextId, 0, time.UTC),
+	}
+
+	f.records[zoneId] = append(f.records[zoneId], record)
+
+	return record
+}
+
+func (f *fakeCloudflare) update(zoneId string, params cf.UpdateDNSRecordParams) bool {
+	i := slices.IndexFunc(f.records[zoneId], func(record cf.DNSRecord) bool { return record.ID == params.ID })
+
+	if i < 0 {
+		return false
+	}
+
+	record := &f.records[zoneId][i]
+
+	if params.Type != "" {
+		record.Type = params.Type
+	}
+
+	if params.Name != "" {
+		record.Name = params.Name
+	}
+
+	if params.Content != "" {
+		record.Content = params.Content
+	}
+
+	if params.Data != nil {
+		record.Data = params.Data
+	}
+
+	if params.TTL != 0 {
+		record.TTL = params.TTL
+	}
+
+	if params.Proxied != nil {
+		record.Proxied = params.Proxied
+	}
+
+	if params.Comment != nil {
+		record.Comment = *params.Comment
+	}
+
+	if params.Tags != nil {
+		record.Tags = params.Tags
+	}
+
+	return true
+}
+
+func (f *fakeCloudflare) delete(zoneId string, id string) bool {
+	records := f.records[zoneId]
+	f.records[zoneId] = slices.DeleteFunc(slices.Clone(records), func(record cf.DNSRecord) bool { return record.ID == id })
+
+	return len(f.records[zoneId]) < len(records)
+}
+
+func (f *fakeCloudflare) decode(r *http.Request, v any) {
+	err := json.NewDecoder(r.Body).Decode(v)
+
+	if err != nil {
+		f.t.Errorf("invalid body of %s %s: %v", r.Method, r.URL.Path, err)
+	}
+}
+
+func (f *fakeCloudflare) result(w http.ResponseWriter, result any) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]any{
+		"success":     true,
+		"errors":      []any{},
+		"messages":    []any{},
+		"result":      result,
+		"result_info": map[string]int{"page": 1, "per_page": 100, "total_pages": 1, "count": 1, "total_count": 1},
+	})
+}
+
+func (f *fakeCloudflare) error(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(map[string]any{
+		"success":  false,
+		"errors":   []map[string]any{{"code": 1000 + status, "message": message}},
+		"messages": []any{},
+		"result":   nil,
+	})
+}
+
+func testLogger() *slog.Logger {
+	return slog.New(slog.NewTextHandler(io.Discard, nil))
+}
+
+// newTestUpdater creates an updater publishing the records with a credential
+// of the fake, configure is called before it's initialized.
+func newTestUpdater(t *testing.T, fake *fakeCloudflare, configure func(u *Updater), records ...Record) *Updater {
+	t.Helper()
+
+	u := NewUpdater(testLogger(), "cloudflare", "cf_updater")
+	u.SetRegisterer(prometheus.NewRegistry())
+
+	err := u.AddCredential(Credential{Token: "token"})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	u.credentials[0].api, u.credentials[0].rateLimit = fake.api()
+
+	for _, record := range records {
+		u.AddRecord(record)
+	}
+
+	if configure != nil {
+		configure(u)
+	}
+
+	err, _ = u.Init()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fake.reset()
+
+	return u
+}
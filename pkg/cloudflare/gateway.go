@@ -0,0 +1,219 @@
+package cloudflare
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	cf "github.com/cloudflare/cloudflare-go"
+	"github.com/cromefire/fritzbox-cloudflare-dyndns/pkg/provider"
+	"github.com/cromefire/fritzbox-cloudflare-dyndns/pkg/util"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// GatewayProvider maintains the source networks of Zero Trust Gateway
+// locations, so DNS queries from the router's WAN IPv4 are attributed to the
+// location. The record name is the name of the location, the /32 of the
+// previous address among its networks is replaced by the one of the address.
+// Other networks of the location are left untouched.
+type GatewayProvider struct {
+	api       *cf.API
+	rateLimit *util.RateLimit
+	accountId string
+	log       *slog.Logger
+
+	// locations are the IDs of the locations by name
+	locations     map[string]string
+	locationsLock sync.Mutex
+}
+
+// gatewayNetwork is a source network of a location, the ID is assigned by
+// Cloudflare.
+type gatewayNetwork struct {
+	Network string `json:"network"`
+}
+
+func NewGatewayProvider(api *cf.API, rateLimit *util.RateLimit, accountId string, log *slog.Logger) *GatewayProvider {
+	return &GatewayProvider{
+		api:       api,
+		rateLimit: rateLimit,
+		accountId: accountId,
+		log:       log,
+		locations: make(map[string]string),
+	}
+}
+
+// LimitedUntil returns the end of the last rate limit of the API.
+func (p *GatewayProvider) LimitedUntil() time.Time {
+	return p.rateLimit.LimitedUntil()
+}
+
+// ResolveLocations makes sure a Gateway location exists for every name.
+func (p *GatewayProvider) ResolveLocations(ctx context.Context, names []string) error {
+	for _, name := range names {
+		id, err := p.locationId(ctx, name)
+
+		if err != nil {
+			return err
+		}
+
+		p.log.Info("Resolved Gateway location", slog.String("name", name), slog.String("location-id", id))
+	}
+
+	return nil
+}
+
+func (p *GatewayProvider) locationId(ctx context.Context, name string) (string, error) {
+	p.locationsLock.Lock()
+	defer p.locationsLock.Unlock()
+
+	if id, ok := p.locations[name]; ok {
+		return id, nil
+	}
+
+	locations, _, err := p.api.TeamsLocations(ctx, p.accountId)
+
+	if err != nil {
+		return "", fmt.Errorf("could not list Gateway locations: %w", err)
+	}
+
+	for _, location := range locations {
+		if location.Name == name {
+			p.locations[name] = location.ID
+			return location.ID, nil
+		}
+	}
+
+	return "", fmt.Errorf("no Gateway location named %s", name)
+}
+
+func (p *GatewayProvider) endpoint(id string) string {
+	return fmt.Sprintf("/accounts/%s/gateway/locations/%s", p.accountId, id)
+}
+
+// location returns the location as raw fields, so the update doesn't drop the
+// ones the client doesn't know.
+func (p *GatewayProvider) location(ctx context.Context, name string) (string, map[string]json.RawMessage, error) {
+	id, err := p.locationId(ctx, name)
+
+	if err != nil {
+		return "", nil, err
+	}
+
+	res, err := p.api.Raw(ctx, http.MethodGet, p.endpoint(id), nil, nil)
+
+	if err != nil {
+		return "", nil, fmt.Errorf("could not get Gateway location %s: %w", name, err)
+	}
+
+	var location map[string]json.RawMessage
+	err = json.Unmarshal(res.Result, &location)
+
+	if err != nil {
+		return "", nil, fmt.Errorf("could not parse Gateway location %s: %w", name, err)
+	}
+
+	return id, location, nil
+}
+
+func (p *GatewayProvider) List(ctx context.Context, name string, recordType string) ([]provider.Record, error) {
+	if recordType != "A" {
+		return []provider.Record{}, nil
+	}
+
+	_, location, err := p.location(ctx, name)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var networks []gatewayNetwork
+	if raw, ok := location["networks"]; ok {
+		err = json.Unmarshal(raw, &networks)
+
+		if err != nil {
+			return nil, fmt.Errorf("could not parse networks of %s: %w", name, err)
+		}
+	}
+
+	records := make([]provider.Record, 0, len(networks))
+	for _, network := range networks {
+		records = append(records, provider.Record{Name: name, Type: recordType, Content: strings.TrimSuffix(network.Network, "/32")})
+	}
+
+	return records, nil
+}
+
+// Upsert adds the /32 of the address to the networks of the location.
+func (p *GatewayProvider) Upsert(ctx context.Context, record provider.Record) error {
+	return p.Replace(ctx, record, "")
+}
+
+// Delete removes the /32 of the address of the record from the networks of
+// the location, the location itself is kept.
+func (p *GatewayProvider) Delete(ctx context.Context, record provider.Record) error {
+	return p.Replace(ctx, provider.Record{Name: record.Name, Type: record.Type}, record.Content)
+}
+
+// Replace replaces the /32 of the previous address among the networks of the
+// location by the one of the address, or removes it if the record has no
+// address.
+func (p *GatewayProvider) Replace(ctx context.Context, record provider.Record, previous string) error {
+	if record.Type != "A" {
+		if record.Content == "" {
+			return nil
+		}
+
+		return errors.New("gateway locations only support IPv4 networks")
+	}
+
+	id, location, err := p.location(ctx, record.Name)
+
+	if err != nil {
+		return err
+	}
+
+	// The networks are kept raw, so their other fields are kept as well
+	var networks []map[string]json.RawMessage
+	if raw, ok := location["networks"]; ok && string(raw) != "null" {
+		err = json.Unmarshal(raw, &networks)
+
+		if err != nil {
+			return fmt.Errorf("could not parse networks of %s: %w", record.Name, err)
+		}
+	}
+
+	replaced := make([]any, 0, len(networks)+1)
+	for _, network := range networks {
+		var cidr string
+		_ = json.Unmarshal(network["network"], &cidr)
+
+		if (previous != "" && cidr == previous+"/32") || (record.Content != "" && cidr == record.Content+"/32") {
+			continue
+		}
+
+		replaced = append(replaced, network)
+	}
+
+	if record.Content != "" {
+		replaced = append(replaced, gatewayNetwork{Network: record.Content + "/32"})
+	}
+
+	location["networks"], err = json.Marshal(replaced)
+
+	if err != nil {
+		return err
+	}
+
+	_, err = p.api.Raw(ctx, http.MethodPut, p.endpoint(id), location, nil)
+
+	if err != nil {
+		return fmt.Errorf("could not update networks of Gateway location %s: %w", record.Name, err)
+	}
+
+	return nil
+}
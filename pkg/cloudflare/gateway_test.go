@@ -0,0 +1,154 @@
+package cloudflare
+
+import (
+	"context"
+	"encoding/json"
+	cf "github.com/cloudflare/cloudflare-go"
+	"github.com/cromefire/fritzbox-cloudflare-dyndns/pkg/provider"
+	"net/http"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+// fakeGateway serves a single Gateway location of the account of the fake.
+type fakeGateway struct {
+	fake *fakeCloudflare
+
+	lock     sync.Mutex
+	location map[string]any
+}
+
+func newFakeGateway(fake *fakeCloudflare, networks ...string) *fakeGateway {
+	g := &fakeGateway{fake: fake, location: map[string]any{"id": "office", "name": "office", "client_default": true}}
+	g.setNetworks(networks...)
+
+	fake.routes["GET /accounts/"+testAccountId+"/gateway/locations"] = g.serve
+	fake.routes["PUT /accounts/"+testAccountId+"/gateway/locations/office"] = g.serve
+
+	return g
+}
+
+func (g *fakeGateway) setNetworks(networks ...string) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	list := make([]any, 0, len(networks))
+	for _, network := range networks {
+		list = append(list, map[string]any{"id": "id-" + network, "network": network})
+	}
+
+	g.location["networks"] = list
+}
+
+// networks returns the networks of the location.
+func (g *fakeGateway) networks() []string {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	networks := make([]string, 0)
+	for _, network := range g.location["networks"].([]any) {
+		networks = append(networks, network.(map[string]any)["network"].(string))
+	}
+
+	return networks
+}
+
+func (g *fakeGateway) serve(w http.ResponseWriter, r *http.Request) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	switch {
+	case r.Method == http.MethodGet && r.URL.Path == "/accounts/"+testAccountId+"/gateway/locations":
+		g.fake.result(w, []cf.TeamsLocation{{ID: "office", Name: "office"}})
+	case r.Method == http.MethodGet:
+		g.fake.result(w, g.location)
+	case r.Method == http.MethodPut:
+		location := make(map[string]any)
+		g.fake.decode(r, &location)
+
+		// Fields the client doesn't know are sent back
+		if location["client_default"] != true {
+			g.fake.t.Errorf("location = %v, want all fields", location)
+		}
+
+		g.location = location
+		g.fake.result(w, location)
+	}
+}
+
+func newTestGatewayProvider(t *testing.T, networks ...string) (*GatewayProvider, *fakeGateway) {
+	fake := newFakeCloudflare(t)
+	gateway := newFakeGateway(fake, networks...)
+	api, transport := fake.api()
+
+	return NewGatewayProvider(api, &transport.RateLimit, testAccountId, testLogger()), gateway
+}
+
+func TestGatewayProviderReplace(t *testing.T) {
+	tests := []struct {
+		name     string
+		content  string
+		previous string
+		want     []string
+	}{
+		{name: "previous address", content: "192.0.2.2", previous: "192.0.2.1", want: []string{"198.51.100.0/24", "192.0.2.2/32"}},
+		{name: "unknown previous address", content: "192.0.2.2", want: []string{"198.51.100.0/24", "192.0.2.1/32", "192.0.2.2/32"}},
+		{name: "same address", content: "192.0.2.1", previous: "192.0.2.1", want: []string{"198.51.100.0/24", "192.0.2.1/32"}},
+		{name: "withdrawn", previous: "192.0.2.1", want: []string{"198.51.100.0/24"}},
+		{name: "withdrawn without previous address", want: []string{"198.51.100.0/24", "192.0.2.1/32"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			p, gateway := newTestGatewayProvider(t, "198.51.100.0/24", "192.0.2.1/32")
+
+			err := p.Replace(context.Background(), provider.Record{Name: "office", Type: "A", Content: test.content}, test.previous)
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if networks := gateway.networks(); !reflect.DeepEqual(networks, test.want) {
+				t.Errorf("networks = %v, want %v", networks, test.want)
+			}
+		})
+	}
+}
+
+func TestGatewayProviderList(t *testing.T) {
+	p, _ := newTestGatewayProvider(t, "198.51.100.0/24", "192.0.2.1/32")
+
+	records, err := p.List(context.Background(), "office", "A")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []provider.Record{{Name: "office", Type: "A", Content: "198.51.100.0/24"}, {Name: "office", Type: "A", Content: "192.0.2.1"}}
+
+	if !reflect.DeepEqual(records, want) {
+		t.Errorf("records = %+v, want %+v", records, want)
+	}
+
+	if records, err := p.List(context.Background(), "office", "AAAA"); err != nil || len(records) != 0 {
+		t.Errorf("List(AAAA) = %+v, %v, want no records", records, err)
+	}
+}
+
+func TestGatewayProviderKeepsNetworkFields(t *testing.T) {
+	p, gateway := newTestGatewayProvider(t, "198.51.100.0/24")
+
+	err := p.Upsert(context.Background(), provider.Record{Name: "office", Type: "A", Content: "192.0.2.1"})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	raw, _ := json.Marshal(gateway.location["networks"])
+
+	// The ID of the other network is sent back with it
+	if want := `[{"id":"id-198.51.100.0/24","network":"198.51.100.0/24"},{"network":"192.0.2.1/32"}]`; string(raw) != want {
+		t.Errorf("networks = %s, want %s", raw, want)
+	}
+}
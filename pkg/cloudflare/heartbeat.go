@@ -0,0 +1,197 @@
+package cloudflare
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	cf "github.com/cloudflare/cloudflare-go"
+	"github.com/cromefire/fritzbox-cloudflare-dyndns/pkg/util"
+	"log/slog"
+	"slices"
+	"strings"
+	"time"
+)
+
+// DefaultHeartbeatInterval is the least time between two writes of the
+// heartbeat record of a zone if not configured
+const DefaultHeartbeatInterval = 10 * time.Minute
+
+// heartbeat is the state of the heartbeat record of a zone, it's only used
+// with the workLock held.
+type heartbeat struct {
+	// content is the last written content
+	content string
+	written time.Time
+	// pending is the write held back by the interval
+	pending *time.Timer
+}
+
+// SetHeartbeat makes the updater write a TXT record <label>.<zone> with the
+// time of the last change, the published addresses and the instance to every
+// zone whose records changed, at most once per interval. It has to be called
+// before the worker is started.
+func (u *Updater) SetHeartbeat(label string, interval time.Duration, instance string) {
+	if interval <= 0 {
+		interval = DefaultHeartbeatInterval
+	}
+
+	u.heartbeatLabel = strings.Trim(label, ".")
+	u.heartbeatInterval = interval
+	u.instance = instance
+}
+
+// heartbeatContent describes the published addresses of the zone, empty if
+// none were published yet.
+func (u *Updater) heartbeatContent(key string) string {
+	var changed time.Time
+	addresses := make(map[uint8][]string)
+
+	for _, action := range u.currentActions() {
+		if action.credential.name+"/"+action.CfZoneId != key || action.last == "" {
+			continue
+		}
+
+		if action.status.LastSuccess.After(changed) {
+			changed = action.status.LastSuccess
+		}
+
+		if !slices.Contains(addresses[action.IpVersion], action.last) {
+			addresses[action.IpVersion] = append(addresses[action.IpVersion], action.last)
+		}
+	}
+
+	if changed.IsZero() {
+		return ""
+	}
+
+	parts := []string{"updated=" + changed.UTC().Format(time.RFC3339)}
+
+	for _, ipVersion := range []uint8{4, 6} {
+		if len(addresses[ipVersion]) > 0 {
+			slices.Sort(addresses[ipVersion])
+			parts = append(parts, fmt.Sprintf("ipv%d=%s", ipVersion, strings.Join(addresses[ipVersion], ",")))
+		}
+	}
+
+	return strings.Join(append(parts, "instance="+u.instance), " ")
+}
+
+// beat writes the heartbeat record of the zone if its content changed. A
+// write less than the interval after the last one is held back until then,
+// the caller has to hold the workLock.
+func (u *Updater) beat(c *credential, zoneId string) {
+	if u.heartbeatLabel == "" {
+		return
+	}
+
+	key := c.name + "/" + zoneId
+
+	u.heartbeatsLock.Lock()
+	hb, ok := u.heartbeats[key]
+	if !ok {
+		hb = &heartbeat{}
+		u.heartbeats[key] = hb
+	}
+	u.heartbeatsLock.Unlock()
+
+	content := u.heartbeatContent(key)
+
+	// A pending write picks up the latest content when it's due
+	if content == "" || content == hb.content || hb.pending != nil {
+		return
+	}
+
+	wait := time.Until(hb.written.Add(u.heartbeatInterval))
+
+	if wait <= 0 {
+		hb.written = time.Now()
+		err := u.writeHeartbeat(c, zoneId, content)
+
+		if err == nil {
+			hb.content = content
+			return
+		}
+
+		u.log.Warn("Failed to write heartbeat record", slog.String("zone-id", zoneId), util.ErrorAttr(err))
+		wait = u.heartbeatInterval
+	}
+
+	hb.pending = time.AfterFunc(wait, func() {
+		u.workLock.Lock()
+		defer u.workLock.Unlock()
+
+		hb.pending = nil
+		u.beat(c, zoneId)
+	})
+}
+
+// writeHeartbeat creates or updates the heartbeat record of the zone.
+func (u *Updater) writeHeartbeat(c *credential, zoneId string, content string) error {
+	zoneName := u.zoneName(c, zoneId)
+
+	if zoneName == "" {
+		return errors.New("the name of the zone is unknown")
+	}
+
+	name := u.heartbeatLabel + "." + zoneName
+	hlog := u.log.With(slog.String("domain", name), slog.String("content", content))
+
+	if u.dryRun {
+		hlog.Info("Would write heartbeat record")
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), u.timeout)
+	defer cancel()
+
+	rc := cf.ZoneIdentifier(zoneId)
+	records, _, err := c.api.ListDNSRecords(ctx, rc, cf.ListDNSRecordsParams{Type: "TXT", Name: name})
+	u.observe(c, err)
+
+	if err != nil {
+		return fmt.Errorf("could not research heartbeat record: %w", err)
+	}
+
+	quoted := `"` + content + `"`
+
+	if len(records) == 0 {
+		_, err = c.api.CreateDNSRecord(ctx, rc, cf.CreateDNSRecordParams{Type: "TXT", Name: name, Content: quoted, TTL: DefaultTTL})
+	} else {
+		_, err = c.api.UpdateDNSRecord(ctx, rc, cf.UpdateDNSRecordParams{ID: records[0].ID, Type: "TXT", Name: name, Content: quoted, TTL: records[0].TTL})
+	}
+
+	u.observe(c, err)
+
+	if err != nil {
+		return fmt.Errorf("could not write heartbeat record: %w", err)
+	}
+
+	hlog.Info("Heartbeat record written")
+
+	return nil
+}
+
+// zoneName returns the name of the zone, empty if it's unknown as the zone
+// was configured by its ID and couldn't be read.
+func (u *Updater) zoneName(c *credential, zoneId string) string {
+	name := ""
+
+	u.zonesLock.Lock()
+	if i := slices.IndexFunc(c.zones, func(zone Zone) bool { return zone.Id == zoneId }); i >= 0 {
+		name = c.zones[i].Name
+	}
+	u.zonesLock.Unlock()
+
+	if name != "" {
+		return name
+	}
+
+	u.credentialsLock.Lock()
+	defer u.credentialsLock.Unlock()
+
+	if status, ok := u.zoneStatuses[c.name+"/"+zoneId]; ok && status.Zone != zoneId {
+		return status.Zone
+	}
+
+	return ""
+}
@@ -0,0 +1,140 @@
+package cloudflare
+
+import (
+	"github.com/cromefire/fritzbox-cloudflare-dyndns/pkg/util"
+	"net"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+// heartbeatOf returns the content of the heartbeat record of the zone, empty
+// if there's none.
+func heartbeatOf(t *testing.T, fake *fakeCloudflare) string {
+	t.Helper()
+
+	records := matching(fake.list(testZoneId, "TXT"), "TXT", "_dyndns.example.com")
+
+	switch len(records) {
+	case 0:
+		return ""
+	case 1:
+		return records[0].Content
+	default:
+		t.Fatalf("heartbeat records = %+v, want one", records)
+		return ""
+	}
+}
+
+func TestHeartbeatContent(t *testing.T) {
+	fake := newFakeCloudflare(t, testZone)
+	u := newTestUpdater(t, fake, nil,
+		Record{Name: "home.example.com", IpVersion: 4},
+		Record{Name: "vpn.example.com", IpVersion: 4},
+		Record{Name: "home.example.com", IpVersion: 6},
+		Record{Name: "nas.example.com", IpVersion: 6},
+	)
+	u.instance = "nas"
+	key := u.credentials[0].name + "/" + testZoneId
+
+	if content := u.heartbeatContent(key); content != "" {
+		t.Errorf("content = %q, want none before the first update", content)
+	}
+
+	at := time.Date(2024, 5, 1, 12, 0, 0, 0, time.FixedZone("CEST", 2*60*60))
+	for i, last := range []string{"192.0.2.1", "192.0.2.1", "2001:db8::2", "2001:db8::1"} {
+		u.actions[i].last = last
+		u.actions[i].status.LastSuccess = at.Add(-time.Duration(i) * time.Minute)
+	}
+
+	want := "updated=2024-05-01T10:00:00Z ipv4=192.0.2.1 ipv6=2001:db8::1,2001:db8::2 instance=nas"
+
+	if content := u.heartbeatContent(key); content != want {
+		t.Errorf("content = %q, want %q", content, want)
+	}
+
+	if content := u.heartbeatContent("other/" + testZoneId); content != "" {
+		t.Errorf("content of another credential = %q, want none", content)
+	}
+}
+
+func TestHeartbeat(t *testing.T) {
+	fake := newFakeCloudflare(t, testZone)
+	u := newTestUpdater(t, fake, func(u *Updater) { u.SetHeartbeat("_dyndns.", time.Hour, "nas") },
+		Record{Name: "home.example.com", IpVersion: 4},
+	)
+
+	u.Handle(ipv4Update("192.0.2.1"))
+
+	first := heartbeatOf(t, fake)
+	if !regexp.MustCompile(`^"updated=\S+ ipv4=192.0.2.1 instance=nas"$`).MatchString(first) {
+		t.Fatalf("heartbeat = %s, want the address", first)
+	}
+
+	// The next write is held back by the interval
+	u.Handle(ipv4Update("192.0.2.2"))
+
+	if content := heartbeatOf(t, fake); content != first {
+		t.Errorf("heartbeat = %s, want %s until the interval passed", content, first)
+	}
+
+	u.workLock.Lock()
+	u.heartbeatsLock.Lock()
+	pending := u.heartbeats[u.credentials[0].name+"/"+testZoneId].pending
+	u.heartbeatsLock.Unlock()
+	u.workLock.Unlock()
+
+	if pending == nil || !pending.Stop() {
+		t.Error("no pending heartbeat write")
+	}
+}
+
+func TestHeartbeatInterval(t *testing.T) {
+	fake := newFakeCloudflare(t, testZone)
+	u := newTestUpdater(t, fake, func(u *Updater) { u.SetHeartbeat("_dyndns", 50*time.Millisecond, "nas") },
+		Record{Name: "home.example.com", IpVersion: 4},
+		Record{Name: "home.example.com", IpVersion: 6},
+	)
+
+	u.Handle(ipv4Update("192.0.2.1"))
+	u.Handle(ipv4Update("192.0.2.2"))
+	u.Handle(&util.IpUpdate{Source: "home", IpVersion: 6, Ip: net.ParseIP("2001:db8::1")})
+
+	// The held back write has the latest content once the interval passed
+	deadline := time.Now().Add(time.Second)
+	for !strings.Contains(heartbeatOf(t, fake), "ipv4=192.0.2.2 ipv6=2001:db8::1") {
+		if time.Now().After(deadline) {
+			t.Fatalf("heartbeat = %s, want the latest addresses", heartbeatOf(t, fake))
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	writes := 0
+	for _, request := range fake.writes() {
+		if request == "POST /zones/"+testZoneId+"/dns_records" || strings.HasPrefix(request, "PATCH") {
+			writes++
+		}
+	}
+
+	// The A record is created and updated, the AAAA record created and the
+	// heartbeat written twice
+	if writes != 5 {
+		t.Errorf("requests = %v, want 5 writes", fake.writes())
+	}
+}
+
+func TestHeartbeatDryRun(t *testing.T) {
+	fake := newFakeCloudflare(t, testZone)
+	u := newTestUpdater(t, fake, func(u *Updater) {
+		u.SetHeartbeat("_dyndns", time.Hour, "nas")
+		u.SetDryRun(true)
+	}, Record{Name: "home.example.com", IpVersion: 4})
+
+	u.Handle(ipv4Update("192.0.2.1"))
+
+	if writes := fake.writes(); len(writes) != 0 {
+		t.Errorf("requests = %v, want none", writes)
+	}
+}
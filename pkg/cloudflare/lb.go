@@ -0,0 +1,229 @@
+package cloudflare
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	cf "github.com/cloudflare/cloudflare-go"
+	"github.com/cromefire/fritzbox-cloudflare-dyndns/pkg/provider"
+	"github.com/cromefire/fritzbox-cloudflare-dyndns/pkg/util"
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// PoolProvider maintains the address of an origin in a Cloudflare Load
+// Balancer pool. The record name is "<pool>/<origin>", the other origins and
+// settings of the pool are left untouched.
+type PoolProvider struct {
+	api       *cf.API
+	rateLimit *util.RateLimit
+	accountId string
+	log       *slog.Logger
+
+	// pools are the IDs of the pools by name
+	pools     map[string]string
+	poolsLock sync.Mutex
+}
+
+func NewPoolProvider(api *cf.API, rateLimit *util.RateLimit, accountId string, log *slog.Logger) *PoolProvider {
+	return &PoolProvider{
+		api:       api,
+		rateLimit: rateLimit,
+		accountId: accountId,
+		log:       log,
+		pools:     make(map[string]string),
+	}
+}
+
+// LimitedUntil returns the end of the last rate limit of the API.
+func (p *PoolProvider) LimitedUntil() time.Time {
+	return p.rateLimit.LimitedUntil()
+}
+
+// splitOrigin returns the pool and the origin of a record name.
+func splitOrigin(name string) (string, string, error) {
+	pool, origin, ok := strings.Cut(name, "/")
+
+	if !ok || pool == "" || origin == "" {
+		return "", "", fmt.Errorf("%s has to be <pool>/<origin>", name)
+	}
+
+	return pool, origin, nil
+}
+
+// ResolveOrigins makes sure a pool with the origin exists for every name.
+func (p *PoolProvider) ResolveOrigins(ctx context.Context, names []string) error {
+	for _, name := range names {
+		id, origins, err := p.origins(ctx, name)
+
+		if err != nil {
+			return err
+		}
+
+		if _, err := findOrigin(origins, name); err != nil {
+			return err
+		}
+
+		p.log.Info("Resolved load balancer origin", slog.String("name", name), slog.String("pool-id", id))
+	}
+
+	return nil
+}
+
+func (p *PoolProvider) poolId(ctx context.Context, name string) (string, error) {
+	p.poolsLock.Lock()
+	defer p.poolsLock.Unlock()
+
+	if id, ok := p.pools[name]; ok {
+		return id, nil
+	}
+
+	pools, err := p.api.ListLoadBalancerPools(ctx, cf.AccountIdentifier(p.accountId), cf.ListLoadBalancerPoolParams{})
+
+	if err != nil {
+		return "", fmt.Errorf("could not list load balancer pools: %w", err)
+	}
+
+	for _, pool := range pools {
+		if pool.Name == name {
+			p.pools[name] = pool.ID
+			return pool.ID, nil
+		}
+	}
+
+	return "", fmt.Errorf("no load balancer pool named %s", name)
+}
+
+func (p *PoolProvider) endpoint(id string) string {
+	return fmt.Sprintf("/accounts/%s/load_balancers/pools/%s", p.accountId, id)
+}
+
+// origins returns the pool ID and its origins as raw fields, so the update
+// doesn't drop the ones the client doesn't know.
+func (p *PoolProvider) origins(ctx context.Context, name string) (string, []map[string]json.RawMessage, error) {
+	pool, _, err := splitOrigin(name)
+
+	if err != nil {
+		return "", nil, err
+	}
+
+	id, err := p.poolId(ctx, pool)
+
+	if err != nil {
+		return "", nil, err
+	}
+
+	res, err := p.api.Raw(ctx, http.MethodGet, p.endpoint(id), nil, nil)
+
+	if err != nil {
+		return "", nil, fmt.Errorf("could not get load balancer pool %s: %w", pool, err)
+	}
+
+	var fields struct {
+		Origins []map[string]json.RawMessage `json:"origins"`
+	}
+	err = json.Unmarshal(res.Result, &fields)
+
+	if err != nil {
+		return "", nil, fmt.Errorf("could not parse load balancer pool %s: %w", pool, err)
+	}
+
+	return id, fields.Origins, nil
+}
+
+// findOrigin returns the index of the origin in the origins of the pool.
+func findOrigin(origins []map[string]json.RawMessage, name string) (int, error) {
+	pool, origin, _ := splitOrigin(name)
+
+	for i, fields := range origins {
+		var originName string
+
+		if json.Unmarshal(fields["name"], &originName) == nil && originName == origin {
+			return i, nil
+		}
+	}
+
+	return -1, fmt.Errorf("no origin named %s in load balancer pool %s", origin, pool)
+}
+
+func (p *PoolProvider) List(ctx context.Context, name string, recordType string) ([]provider.Record, error) {
+	_, origins, err := p.origins(ctx, name)
+
+	if err != nil {
+		return nil, err
+	}
+
+	i, err := findOrigin(origins, name)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var address string
+	var enabled bool
+	_ = json.Unmarshal(origins[i]["address"], &address)
+	_ = json.Unmarshal(origins[i]["enabled"], &enabled)
+
+	// The address of the other family belongs to the other record, a disabled
+	// origin has been withdrawn
+	if ip := net.ParseIP(address); !enabled || (ip != nil && (ip.To4() != nil) != (recordType == "A")) {
+		return []provider.Record{}, nil
+	}
+
+	return []provider.Record{{Name: name, Type: recordType, Content: address}}, nil
+}
+
+// Upsert sets the address of the origin and enables it again if it was
+// withdrawn.
+func (p *PoolProvider) Upsert(ctx context.Context, record provider.Record) error {
+	return p.updateOrigin(ctx, record.Name, func(fields map[string]json.RawMessage) error {
+		var err error
+		fields["address"], err = json.Marshal(record.Content)
+		fields["enabled"] = json.RawMessage("true")
+
+		return err
+	})
+}
+
+// Delete disables the origin, so the load balancer fails over to the other
+// origins. The pool keeps the last address.
+func (p *PoolProvider) Delete(ctx context.Context, record provider.Record) error {
+	return p.updateOrigin(ctx, record.Name, func(fields map[string]json.RawMessage) error {
+		fields["enabled"] = json.RawMessage("false")
+
+		return nil
+	})
+}
+
+func (p *PoolProvider) updateOrigin(ctx context.Context, name string, update func(fields map[string]json.RawMessage) error) error {
+	id, origins, err := p.origins(ctx, name)
+
+	if err != nil {
+		return err
+	}
+
+	i, err := findOrigin(origins, name)
+
+	if err != nil {
+		return err
+	}
+
+	err = update(origins[i])
+
+	if err != nil {
+		return err
+	}
+
+	// The origins are replaced as a whole, the others are sent back unchanged
+	_, err = p.api.Raw(ctx, http.MethodPatch, p.endpoint(id), map[string]any{"origins": origins}, nil)
+
+	if err != nil {
+		return fmt.Errorf("could not update origin %s: %w", name, err)
+	}
+
+	return nil
+}
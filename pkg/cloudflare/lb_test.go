@@ -0,0 +1,150 @@
+package cloudflare
+
+import (
+	"context"
+	cf "github.com/cloudflare/cloudflare-go"
+	"github.com/cromefire/fritzbox-cloudflare-dyndns/pkg/provider"
+	"net/http"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+// fakePools serves a single load balancer pool of the account of the fake.
+type fakePools struct {
+	fake *fakeCloudflare
+
+	lock    sync.Mutex
+	origins []any
+}
+
+func newFakePools(fake *fakeCloudflare) *fakePools {
+	pools := &fakePools{fake: fake, origins: []any{
+		map[string]any{"name": "home", "address": "192.0.2.1", "enabled": true, "weight": 1},
+		map[string]any{"name": "backup", "address": "198.51.100.1", "enabled": true, "weight": 0.5},
+	}}
+
+	fake.routes["GET /accounts/"+testAccountId+"/load_balancers/pools"] = pools.serve
+	fake.routes["PATCH /accounts/"+testAccountId+"/load_balancers/pools/web"] = pools.serve
+
+	return pools
+}
+
+// origin returns the fields of the origin.
+func (p *fakePools) origin(name string) map[string]any {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	for _, origin := range p.origins {
+		if origin.(map[string]any)["name"] == name {
+			return origin.(map[string]any)
+		}
+	}
+
+	return nil
+}
+
+func (p *fakePools) serve(w http.ResponseWriter, r *http.Request) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	switch {
+	case r.Method == http.MethodGet && r.URL.Path == "/accounts/"+testAccountId+"/load_balancers/pools":
+		p.fake.result(w, []cf.LoadBalancerPool{{ID: "web", Name: "web"}})
+	case r.Method == http.MethodGet:
+		p.fake.result(w, map[string]any{"id": "web", "name": "web", "origins": p.origins})
+	case r.Method == http.MethodPatch:
+		var fields struct {
+			Origins []any `json:"origins"`
+		}
+		p.fake.decode(r, &fields)
+
+		p.origins = fields.Origins
+		p.fake.result(w, map[string]any{"id": "web", "name": "web", "origins": p.origins})
+	}
+}
+
+func newTestPoolProvider(t *testing.T) (*PoolProvider, *fakePools) {
+	fake := newFakeCloudflare(t)
+	pools := newFakePools(fake)
+	api, transport := fake.api()
+
+	return NewPoolProvider(api, &transport.RateLimit, testAccountId, testLogger()), pools
+}
+
+func TestPoolProviderUpsert(t *testing.T) {
+	p, pools := newTestPoolProvider(t)
+
+	err := p.Upsert(context.Background(), provider.Record{Name: "web/home", Type: "A", Content: "192.0.2.2"})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]any{"name": "home", "address": "192.0.2.2", "enabled": true, "weight": float64(1)}
+	if origin := pools.origin("home"); !reflect.DeepEqual(origin, want) {
+		t.Errorf("origin = %v, want %v", origin, want)
+	}
+
+	// The other origin is sent back unchanged
+	if origin := pools.origin("backup"); !reflect.DeepEqual(origin, map[string]any{"name": "backup", "address": "198.51.100.1", "enabled": true, "weight": 0.5}) {
+		t.Errorf("other origin = %v, want it unchanged", origin)
+	}
+}
+
+func TestPoolProviderDelete(t *testing.T) {
+	p, pools := newTestPoolProvider(t)
+	ctx := context.Background()
+	record := provider.Record{Name: "web/home", Type: "A"}
+
+	if err := p.Delete(ctx, record); err != nil {
+		t.Fatal(err)
+	}
+
+	// The origin is disabled but keeps its address
+	if origin := pools.origin("home"); origin["enabled"] != false || origin["address"] != "192.0.2.1" {
+		t.Errorf("origin = %v, want it disabled", origin)
+	}
+
+	// A disabled origin is withdrawn
+	if records, err := p.List(ctx, "web/home", "A"); err != nil || len(records) != 0 {
+		t.Errorf("List() = %+v, %v, want no records", records, err)
+	}
+
+	record.Content = "192.0.2.1"
+	if err := p.Upsert(ctx, record); err != nil {
+		t.Fatal(err)
+	}
+
+	if origin := pools.origin("home"); origin["enabled"] != true {
+		t.Errorf("origin = %v, want it enabled again", origin)
+	}
+}
+
+func TestPoolProviderList(t *testing.T) {
+	p, _ := newTestPoolProvider(t)
+	ctx := context.Background()
+
+	records, err := p.List(ctx, "web/home", "A")
+
+	if err != nil || !reflect.DeepEqual(records, []provider.Record{{Name: "web/home", Type: "A", Content: "192.0.2.1"}}) {
+		t.Errorf("List(A) = %+v, %v, want the address", records, err)
+	}
+
+	// The IPv4 address doesn't belong to an AAAA record
+	if records, err := p.List(ctx, "web/home", "AAAA"); err != nil || len(records) != 0 {
+		t.Errorf("List(AAAA) = %+v, %v, want no records", records, err)
+	}
+
+	if _, err := p.List(ctx, "web/missing", "A"); err == nil {
+		t.Error("List() of a missing origin succeeded, want an error")
+	}
+
+	if _, err := p.List(ctx, "other/home", "A"); err == nil {
+		t.Error("List() of a missing pool succeeded, want an error")
+	}
+
+	if _, err := p.List(ctx, "web", "A"); err == nil {
+		t.Error("List() without an origin succeeded, want an error")
+	}
+}
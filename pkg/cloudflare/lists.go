@@ -0,0 +1,233 @@
+package cloudflare
+
+import (
+	"context"
+	"fmt"
+	cf "github.com/cloudflare/cloudflare-go"
+	"github.com/cromefire/fritzbox-cloudflare-dyndns/pkg/provider"
+	"github.com/cromefire/fritzbox-cloudflare-dyndns/pkg/util"
+	"log/slog"
+	"net"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+// ListProvider maintains the addresses of the router as items of account-level
+// Cloudflare IP Lists, i.e. for WAF rules. The record name is the name of the
+// list, IPv6 addresses are published as their /64 prefix. Only the items with
+// the owner marker in their comment are replaced, others are left untouched.
+type ListProvider struct {
+	api       *cf.API
+	rateLimit *util.RateLimit
+	accountId string
+	ownerId   string
+	log       *slog.Logger
+
+	// lists are the IDs of the lists by name
+	lists     map[string]string
+	listsLock sync.Mutex
+}
+
+func NewListProvider(api *cf.API, rateLimit *util.RateLimit, accountId string, ownerId string, log *slog.Logger) *ListProvider {
+	if ownerId == "" {
+		ownerId = DefaultOwnerId
+	}
+
+	return &ListProvider{
+		api:       api,
+		rateLimit: rateLimit,
+		accountId: accountId,
+		ownerId:   ownerId,
+		log:       log,
+		lists:     make(map[string]string),
+	}
+}
+
+// LimitedUntil returns the end of the last rate limit of the API.
+func (p *ListProvider) LimitedUntil() time.Time {
+	return p.rateLimit.LimitedUntil()
+}
+
+// ResolveLists makes sure an IP List exists for every name.
+func (p *ListProvider) ResolveLists(ctx context.Context, names []string) error {
+	for _, name := range names {
+		id, err := p.listId(ctx, name)
+
+		if err != nil {
+			return err
+		}
+
+		p.log.Info("Resolved IP list", slog.String("name", name), slog.String("list-id", id))
+	}
+
+	return nil
+}
+
+func (p *ListProvider) listId(ctx context.Context, name string) (string, error) {
+	p.listsLock.Lock()
+	defer p.listsLock.Unlock()
+
+	if id, ok := p.lists[name]; ok {
+		return id, nil
+	}
+
+	lists, err := p.api.ListLists(ctx, cf.AccountIdentifier(p.accountId), cf.ListListsParams{})
+
+	if err != nil {
+		return "", fmt.Errorf("could not list IP lists: %w", err)
+	}
+
+	for _, list := range lists {
+		if list.Name == name {
+			if list.Kind != cf.ListTypeIP {
+				return "", fmt.Errorf("list %s is a %s list, not an IP list", name, list.Kind)
+			}
+
+			p.lists[name] = list.ID
+			return list.ID, nil
+		}
+	}
+
+	return "", fmt.Errorf("no IP list named %s", name)
+}
+
+// marker identifies the items of the provider in their comment.
+func (p *ListProvider) marker() string {
+	return ownerMarker + "=" + p.ownerId
+}
+
+// commentTokens splits the comment of an item into its words, the marker is
+// followed by a comma.
+func commentTokens(comment string) []string {
+	return strings.FieldsFunc(comment, func(r rune) bool { return r == ',' || unicode.IsSpace(r) })
+}
+
+// items returns the owned items of the list with addresses of the record type.
+func (p *ListProvider) items(ctx context.Context, name string, recordType string) (string, []cf.ListItem, error) {
+	id, err := p.listId(ctx, name)
+
+	if err != nil {
+		return "", nil, err
+	}
+
+	items, err := p.api.ListListItems(ctx, cf.AccountIdentifier(p.accountId), cf.ListListItemsParams{ID: id})
+
+	if err != nil {
+		return "", nil, fmt.Errorf("could not list items of %s: %w", name, err)
+	}
+
+	owned := make([]cf.ListItem, 0, 1)
+
+	for _, item := range items {
+		if item.IP == nil || !hasMarker(commentTokens(item.Comment), p.marker()) {
+			continue
+		}
+
+		if strings.Contains(*item.IP, ":") == (recordType == "AAAA") {
+			owned = append(owned, item)
+		}
+	}
+
+	return id, owned, nil
+}
+
+func (p *ListProvider) List(ctx context.Context, name string, recordType string) ([]provider.Record, error) {
+	_, items, err := p.items(ctx, name, recordType)
+
+	if err != nil {
+		return nil, err
+	}
+
+	records := make([]provider.Record, 0, len(items))
+	for _, item := range items {
+		records = append(records, provider.Record{Name: name, Type: recordType, Content: *item.IP})
+	}
+
+	return records, nil
+}
+
+// Upsert replaces the owned items of the IP version by the address, the
+// comment holds the time of the update.
+func (p *ListProvider) Upsert(ctx context.Context, record provider.Record) error {
+	id, items, err := p.items(ctx, record.Name, record.Type)
+
+	if err != nil {
+		return err
+	}
+
+	// The content is normalized by the updater already, unless it's a single address
+	ip := p.Normalize(record.Type, record.Content, nil)
+	comment := fmt.Sprintf("%s, updated %s", p.marker(), time.Now().UTC().Format(time.RFC3339))
+
+	// The new item is added first, so the list is never without the address
+	_, err = p.api.CreateListItems(ctx, cf.AccountIdentifier(p.accountId), cf.ListCreateItemsParams{
+		ID:    id,
+		Items: []cf.ListItemCreateRequest{{IP: &ip, Comment: comment}},
+	})
+
+	if err != nil {
+		return fmt.Errorf("could not add %s to %s: %w", ip, record.Name, err)
+	}
+
+	// Items with the same address were replaced by the new one
+	stale := make([]cf.ListItem, 0, len(items))
+	for _, item := range items {
+		if *item.IP != ip {
+			stale = append(stale, item)
+		}
+	}
+
+	return p.delete(ctx, id, record.Name, stale)
+}
+
+// Delete removes the owned items of the IP version.
+func (p *ListProvider) Delete(ctx context.Context, record provider.Record) error {
+	id, items, err := p.items(ctx, record.Name, record.Type)
+
+	if err != nil {
+		return err
+	}
+
+	return p.delete(ctx, id, record.Name, items)
+}
+
+func (p *ListProvider) delete(ctx context.Context, id string, name string, items []cf.ListItem) error {
+	if len(items) == 0 {
+		return nil
+	}
+
+	deletes := make([]cf.ListItemDeleteItemRequest, 0, len(items))
+	for _, item := range items {
+		deletes = append(deletes, cf.ListItemDeleteItemRequest{ID: item.ID})
+	}
+
+	_, err := p.api.DeleteListItems(ctx, cf.AccountIdentifier(p.accountId), cf.ListDeleteItemsParams{
+		ID:    id,
+		Items: cf.ListItemDeleteRequest{Items: deletes},
+	})
+
+	if err != nil {
+		return fmt.Errorf("could not remove the previous items of %s: %w", name, err)
+	}
+
+	return nil
+}
+
+// Normalize returns the LAN prefix the router delegates for IPv6 addresses,
+// which the clients behind it use, or the /64 of the address if the router
+// reports no prefix.
+func (p *ListProvider) Normalize(recordType string, content string, prefix *net.IPNet) string {
+	ip := net.ParseIP(content)
+
+	if recordType != "AAAA" || ip == nil {
+		return content
+	}
+
+	if prefix != nil {
+		return (&net.IPNet{IP: prefix.IP.Mask(prefix.Mask), Mask: prefix.Mask}).String()
+	}
+
+	return (&net.IPNet{IP: ip.Mask(net.CIDRMask(64, 128)), Mask: net.CIDRMask(64, 128)}).String()
+}
@@ -0,0 +1,188 @@
+package cloudflare
+
+import (
+	"context"
+	"fmt"
+	cf "github.com/cloudflare/cloudflare-go"
+	"github.com/cromefire/fritzbox-cloudflare-dyndns/pkg/provider"
+	"net"
+	"net/http"
+	"reflect"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+)
+
+const testAccountId = "01a7362d577a6c3019a474fd6f485823"
+
+// fakeLists serves the IP Lists of the account of the fake.
+type fakeLists struct {
+	fake *fakeCloudflare
+
+	lock   sync.Mutex
+	lists  []cf.List
+	items  map[string][]cf.ListItem
+	nextId int
+}
+
+func newFakeLists(fake *fakeCloudflare, lists ...cf.List) *fakeLists {
+	l := &fakeLists{fake: fake, lists: lists, items: make(map[string][]cf.ListItem)}
+	fake.routes["GET /accounts/"+testAccountId+"/rules/lists"] = l.serve
+	fake.routes["POST /accounts/"+testAccountId+"/rules/lists"] = l.serve
+	fake.routes["DELETE /accounts/"+testAccountId+"/rules/lists"] = l.serve
+
+	return l
+}
+
+func (l *fakeLists) add(listId string, ip string, comment string) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	l.nextId++
+	l.items[listId] = append(l.items[listId], cf.ListItem{ID: fmt.Sprintf("item-%d", l.nextId), IP: &ip, Comment: comment})
+}
+
+// ips returns the addresses in the list with their comment.
+func (l *fakeLists) ips(listId string) []string {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	ips := make([]string, 0)
+	for _, item := range l.items[listId] {
+		ips = append(ips, *item.IP+" "+strings.Fields(item.Comment)[0])
+	}
+
+	return ips
+}
+
+func (l *fakeLists) serve(w http.ResponseWriter, r *http.Request) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	path := strings.Split(strings.TrimPrefix(r.URL.Path, "/accounts/"+testAccountId+"/rules/lists"), "/")
+
+	switch {
+	case r.Method == http.MethodGet && len(path) == 1:
+		l.fake.result(w, l.lists)
+	case r.Method == http.MethodGet && len(path) == 3 && path[1] == "bulk_operations":
+		l.fake.result(w, cf.ListBulkOperation{ID: path[2], Status: "completed"})
+	case r.Method == http.MethodGet && len(path) == 3 && path[2] == "items":
+		l.fake.result(w, l.items[path[1]])
+	case r.Method == http.MethodPost && len(path) == 3 && path[2] == "items":
+		items := make([]cf.ListItemCreateRequest, 0)
+		l.fake.decode(r, &items)
+
+		for _, item := range items {
+			l.nextId++
+			l.items[path[1]] = append(l.items[path[1]], cf.ListItem{ID: fmt.Sprintf("item-%d", l.nextId), IP: item.IP, Comment: item.Comment})
+		}
+
+		l.fake.result(w, map[string]string{"operation_id": "create"})
+	case r.Method == http.MethodDelete && len(path) == 3 && path[2] == "items":
+		deletes := cf.ListItemDeleteRequest{}
+		l.fake.decode(r, &deletes)
+
+		l.items[path[1]] = slices.DeleteFunc(l.items[path[1]], func(item cf.ListItem) bool {
+			return slices.Contains(deletes.Items, cf.ListItemDeleteItemRequest{ID: item.ID})
+		})
+
+		l.fake.result(w, map[string]string{"operation_id": "delete"})
+	default:
+		l.fake.t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+		l.fake.error(w, http.StatusNotFound, "not found")
+	}
+}
+
+func newTestListProvider(t *testing.T) (*ListProvider, *fakeLists) {
+	fake := newFakeCloudflare(t)
+	lists := newFakeLists(fake,
+		cf.List{ID: "office", Name: "office", Kind: cf.ListTypeIP},
+		cf.List{ID: "hosts", Name: "hosts", Kind: cf.ListTypeHostname},
+	)
+
+	api, transport := fake.api()
+
+	return NewListProvider(api, &transport.RateLimit, testAccountId, "home", testLogger()), lists
+}
+
+func TestListProviderList(t *testing.T) {
+	p, lists := newTestListProvider(t)
+	lists.add("office", "192.0.2.1", "dyndns-owner=home, updated 2024-01-01T00:00:00Z")
+	lists.add("office", "192.0.2.2", "dyndns-owner=home2, updated 2024-01-01T00:00:00Z")
+	lists.add("office", "192.0.2.3", "added by hand, dyndns-owner=home")
+	lists.add("office", "192.0.2.4", "dyndns-owner=homes")
+	lists.add("office", "192.0.2.5", "")
+	lists.add("office", "2001:db8::/64", "dyndns-owner=home")
+
+	records, err := p.List(context.Background(), "office", "A")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Only the items with the whole marker are owned, not those of longer owners
+	want := []provider.Record{
+		{Name: "office", Type: "A", Content: "192.0.2.1"},
+		{Name: "office", Type: "A", Content: "192.0.2.3"},
+	}
+
+	if !reflect.DeepEqual(records, want) {
+		t.Errorf("records = %+v, want %+v", records, want)
+	}
+}
+
+func TestListProviderListKind(t *testing.T) {
+	p, _ := newTestListProvider(t)
+
+	if _, err := p.List(context.Background(), "hosts", "A"); err == nil || !strings.Contains(err.Error(), "not an IP list") {
+		t.Errorf("List() = %v, want an error for the hostname list", err)
+	}
+
+	if _, err := p.List(context.Background(), "missing", "A"); err == nil {
+		t.Error("List() of a missing list succeeded, want an error")
+	}
+}
+
+func TestListProviderUpsert(t *testing.T) {
+	p, lists := newTestListProvider(t)
+	lists.add("office", "192.0.2.1", "dyndns-owner=home, updated 2024-01-01T00:00:00Z")
+	lists.add("office", "192.0.2.2", "dyndns-owner=home2")
+	lists.add("office", "2001:db8::/64", "dyndns-owner=home")
+
+	err := p.Upsert(context.Background(), provider.Record{Name: "office", Type: "A", Content: "192.0.2.3"})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The own item of the IP version is replaced, the others are kept
+	want := []string{"192.0.2.2 dyndns-owner=home2", "2001:db8::/64 dyndns-owner=home", "192.0.2.3 dyndns-owner=home,"}
+
+	if ips := lists.ips("office"); !reflect.DeepEqual(ips, want) {
+		t.Errorf("items = %v, want %v", ips, want)
+	}
+}
+
+func TestListProviderNormalize(t *testing.T) {
+	p := NewListProvider(nil, nil, testAccountId, "", testLogger())
+	_, prefix, _ := net.ParseCIDR("2001:db8:1:ff00::/56")
+
+	tests := []struct {
+		recordType string
+		content    string
+		prefix     *net.IPNet
+		want       string
+	}{
+		{recordType: "A", content: "192.0.2.1", want: "192.0.2.1"},
+		{recordType: "AAAA", content: "2001:db8:1:2:3:4:5:6", want: "2001:db8:1:2::/64"},
+		{recordType: "AAAA", content: "2001:db8:1:2:3:4:5:6", prefix: prefix, want: "2001:db8:1:ff00::/56"},
+		{recordType: "AAAA", content: "2001:db8:1:2::/64", want: "2001:db8:1:2::/64"},
+	}
+
+	for _, test := range tests {
+		if got := p.Normalize(test.recordType, test.content, test.prefix); got != test.want {
+			t.Errorf("Normalize(%s, %s, %v) = %s, want %s", test.recordType, test.content, test.prefix, got, test.want)
+		}
+	}
+}
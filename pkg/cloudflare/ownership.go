@@ -0,0 +1,351 @@
+package cloudflare
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	cf "github.com/cloudflare/cloudflare-go"
+	"github.com/cromefire/fritzbox-cloudflare-dyndns/pkg/util"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// Ownership controls how records created by the updater are marked, so
+// records created by hand or by other tools are never overwritten.
+type Ownership string
+
+const (
+	// OwnershipNone updates all records with a matching name
+	OwnershipNone Ownership = ""
+	// OwnershipComment marks the records in their comment
+	OwnershipComment Ownership = "comment"
+	// OwnershipTag marks the records with a tag, which needs a paid plan
+	OwnershipTag Ownership = "tag"
+	// OwnershipTxt marks the names with a TXT record, like external-dns does
+	OwnershipTxt Ownership = "txt"
+)
+
+// DefaultOwnerId identifies the updater in the markers if no owner ID is configured.
+const DefaultOwnerId = "default"
+
+const (
+	ownerMarker = "dyndns-owner"
+	ownerPrefix = "_dyndns-owner."
+	heritage    = "heritage=fritzbox-cloudflare-dyndns"
+)
+
+func ParseOwnership(value string) (Ownership, error) {
+	switch strings.ToLower(value) {
+	case "", "off", "none":
+		return OwnershipNone, nil
+	case "comment":
+		return OwnershipComment, nil
+	case "tag":
+		return OwnershipTag, nil
+	case "txt":
+		return OwnershipTxt, nil
+	default:
+		return OwnershipNone, fmt.Errorf("invalid ownership mode %q, has to be comment, tag, txt or off", value)
+	}
+}
+
+// SetOwnership makes the updater mark the records it creates and only update
+// marked ones, it has to be called before the worker is started.
+func (u *Updater) SetOwnership(ownership Ownership, ownerId string) {
+	if ownerId == "" {
+		ownerId = DefaultOwnerId
+	}
+
+	u.ownership = ownership
+	u.ownerId = ownerId
+}
+
+func (u *Updater) commentMarker() string {
+	return ownerMarker + "=" + u.ownerId
+}
+
+func (u *Updater) tagMarker() string {
+	return ownerMarker + ":" + u.ownerId
+}
+
+func (u *Updater) txtMarker() string {
+	return heritage + ",owner=" + u.ownerId
+}
+
+// owns reports whether the record is marked as owned by the updater.
+func (u *Updater) owns(record cf.DNSRecord, existing []cf.DNSRecord) bool {
+	switch u.ownership {
+	case OwnershipComment:
+		return hasMarker(strings.Fields(record.Comment), u.commentMarker())
+	case OwnershipTag:
+		return hasMarker(record.Tags, u.tagMarker())
+	case OwnershipTxt:
+		return u.hasOwnershipRecord(record.Name, existing)
+	default:
+		return true
+	}
+}
+
+func (u *Updater) hasOwnershipRecord(name string, existing []cf.DNSRecord) bool {
+	for _, record := range matching(existing, "TXT", ownerPrefix+name) {
+		if strings.Trim(record.Content, `"`) == u.txtMarker() {
+			return true
+		}
+	}
+
+	return false
+}
+
+// options returns the options of the action with the ownership marker, so it's
+// kept if the comment or tags are enforced.
+func (u *Updater) options(action *Action) RecordOptions {
+	options := action.Options
+
+	switch u.ownership {
+	case OwnershipComment:
+		if options.Comment != "" {
+			options.Comment = withMarker(options.Comment, u.commentMarker())
+		}
+	case OwnershipTag:
+		if options.Tags != nil {
+			options.Tags = append(slices.Clone(options.Tags), u.tagMarker())
+		}
+	}
+
+	return options
+}
+
+// createParams builds a new record of the action, which is marked as owned.
+func (u *Updater) createParams(action *Action, content string) cf.CreateDNSRecordParams {
+	return u.marked(u.options(action).createParams(action.recordType(), action.DnsRecord, content))
+}
+
+// marked adds the ownership marker to a new record.
+func (u *Updater) marked(params cf.CreateDNSRecordParams) cf.CreateDNSRecordParams {
+	switch u.ownership {
+	case OwnershipComment:
+		params.Comment = withMarker(params.Comment, u.commentMarker())
+	case OwnershipTag:
+		if !hasMarker(params.Tags, u.tagMarker()) {
+			params.Tags = append(params.Tags, u.tagMarker())
+		}
+	}
+
+	return params
+}
+
+// planOwnershipRecord plans the TXT record marking the name as owned, if the
+// ownership mode needs one and it doesn't exist yet.
+func (u *Updater) planOwnershipRecord(name string, existing []cf.DNSRecord) []plannedChange {
+	name = strings.TrimSuffix(name, ".")
+
+	if u.ownership != OwnershipTxt || u.hasOwnershipRecord(name, existing) {
+		return nil
+	}
+
+	params := cf.CreateDNSRecordParams{
+		Type:    "TXT",
+		Name:    ownerPrefix + name,
+		Content: u.txtMarker(),
+		TTL:     DefaultTTL,
+	}
+
+	return []plannedChange{{
+		Change: util.Change{
+			Action:   util.ChangeCreate,
+			Provider: u.name,
+			Domain:   params.Name,
+			Type:     params.Type,
+			Content:  params.Content,
+			Details:  []string{"ownership record of " + name},
+		},
+		create: &params,
+	}}
+}
+
+// planOwnershipRemoval plans deleting the TXT record marking the name as owned
+// once the records it guards are deleted. It's kept as long as other records
+// of the name remain, i.e. the A records if only the AAAA records are
+// withdrawn.
+func (u *Updater) planOwnershipRemoval(name string, existing []cf.DNSRecord, deleted []string) []plannedChange {
+	name = strings.TrimSuffix(name, ".")
+
+	if u.ownership != OwnershipTxt {
+		return nil
+	}
+
+	for _, record := range existing {
+		if record.Type != "TXT" && strings.EqualFold(record.Name, name) && !slices.Contains(deleted, record.ID) {
+			return nil
+		}
+	}
+
+	changes := make([]plannedChange, 0)
+
+	for _, record := range matching(existing, "TXT", ownerPrefix+name) {
+		if strings.Trim(record.Content, `"`) != u.txtMarker() {
+			continue
+		}
+
+		changes = append(changes, plannedChange{
+			Change: util.Change{
+				Action:   util.ChangeDelete,
+				Provider: u.name,
+				Domain:   record.Name,
+				Type:     record.Type,
+				Content:  record.Content,
+				RecordId: record.ID,
+				Details:  []string{"ownership record of " + name},
+			},
+			delete: record.ID,
+		})
+	}
+
+	return changes
+}
+
+// planAdoption plans marking the existing records of the action as owned.
+func (u *Updater) planAdoption(action *Action, existing []cf.DNSRecord) []plannedChange {
+	changes := make([]plannedChange, 0)
+
+	for _, record := range matching(existing, action.recordType(), action.DnsRecord) {
+		if u.owns(record, existing) {
+			continue
+		}
+
+		change := plannedChange{Change: util.Change{
+			Action:   util.ChangeAdopt,
+			Provider: u.name,
+			Domain:   action.DnsRecord,
+			Type:     record.Type,
+			Content:  record.Content,
+			RecordId: record.ID,
+		}}
+
+		// Only the marker is added, everything else is left as it is
+		params := RecordOptions{}.updateParams(record, record.Content)
+
+		switch u.ownership {
+		case OwnershipComment:
+			comment := withMarker(record.Comment, u.commentMarker())
+			params.Comment = &comment
+			change.Details = []string{fmt.Sprintf("comment %q -> %q", record.Comment, comment)}
+			change.update = &params
+		case OwnershipTag:
+			params.Tags = append(slices.Clone(record.Tags), u.tagMarker())
+			change.Details = []string{fmt.Sprintf("tags %v -> %v", record.Tags, params.Tags)}
+			change.update = &params
+		case OwnershipTxt:
+			change.Details = []string{"ownership record " + ownerPrefix + record.Name}
+		}
+
+		changes = append(changes, change)
+	}
+
+	if len(changes) > 0 {
+		changes = append(changes, u.planOwnershipRecord(action.DnsRecord, existing)...)
+	}
+
+	return changes
+}
+
+// Adopt marks the existing records of the actions with the names as owned, of
+// all actions if no names are given, so they are updated from then on.
+func (u *Updater) Adopt(names []string) error {
+	if u.ownership == OwnershipNone {
+		return errors.New("the ownership mode is disabled")
+	}
+
+	u.workLock.Lock()
+	defer u.workLock.Unlock()
+
+	jobs := make([]job, 0)
+
+	for _, action := range u.currentActions() {
+		if len(names) > 0 && !slices.ContainsFunc(names, func(name string) bool {
+			return strings.EqualFold(strings.TrimSuffix(name, "."), strings.TrimSuffix(action.DnsRecord, "."))
+		}) {
+			continue
+		}
+
+		jobs = append(jobs, job{action: action})
+	}
+
+	if len(jobs) == 0 {
+		return fmt.Errorf("no records named %s", strings.Join(names, ", "))
+	}
+
+	errs := make([]error, 0)
+	var errsLock sync.Mutex
+
+	u.eachZone(jobs, func(c *credential, zoneId string, jobs []job) {
+		err := u.adoptZone(c, zoneId, jobs)
+
+		if err != nil {
+			errsLock.Lock()
+			errs = append(errs, fmt.Errorf("zone %s: %w", zoneId, err))
+			errsLock.Unlock()
+		}
+	})
+
+	return errors.Join(errs...)
+}
+
+func (u *Updater) adoptZone(c *credential, zoneId string, jobs []job) error {
+	ctx, cancel := context.WithTimeout(context.Background(), u.timeout)
+	defer cancel()
+
+	existing, err := u.listZone(ctx, c, zoneId, jobs)
+
+	if err != nil {
+		return err
+	}
+
+	changes := make([]plannedChange, 0)
+
+	for _, j := range jobs {
+		adoption := u.planAdoption(j.action, existing)
+		existing = append(existing, plannedRecords(adoption)...)
+
+		for _, change := range adoption {
+			u.reportChange(u.actionLog(j.action), change.Change)
+		}
+
+		changes = append(changes, adoption...)
+	}
+
+	if u.dryRun {
+		return nil
+	}
+
+	return u.applyChanges(ctx, c, zoneId, changes)
+}
+
+// plannedRecords returns the records the changes create, so later plans of the
+// same zone see them.
+func plannedRecords(changes []plannedChange) []cf.DNSRecord {
+	records := make([]cf.DNSRecord, 0)
+
+	for _, change := range changes {
+		if change.create != nil {
+			records = append(records, cf.DNSRecord{Type: change.create.Type, Name: change.create.Name, Content: change.create.Content})
+		}
+	}
+
+	return records
+}
+
+// hasMarker reports whether one of the words of a comment or one of the tags
+// is the marker, so owner "home" doesn't claim the records of "home2".
+func hasMarker(tokens []string, marker string) bool {
+	return slices.Contains(tokens, marker)
+}
+
+func withMarker(comment string, marker string) string {
+	if hasMarker(strings.Fields(comment), marker) {
+		return comment
+	}
+
+	return strings.TrimSpace(comment + " " + marker)
+}
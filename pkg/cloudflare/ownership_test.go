@@ -0,0 +1,139 @@
+package cloudflare
+
+import (
+	cf "github.com/cloudflare/cloudflare-go"
+	"reflect"
+	"testing"
+)
+
+func TestOwns(t *testing.T) {
+	const name = "home.example.com"
+
+	txt := func(name string, content string) cf.DNSRecord {
+		return cf.DNSRecord{ID: "txt", Type: "TXT", Name: name, Content: content}
+	}
+
+	tests := []struct {
+		name      string
+		ownership Ownership
+		record    cf.DNSRecord
+		existing  []cf.DNSRecord
+		want      bool
+	}{
+		{name: "disabled", ownership: OwnershipNone, want: true},
+
+		{name: "comment", ownership: OwnershipComment, record: cf.DNSRecord{Comment: "dyndns-owner=home"}, want: true},
+		{name: "comment among words", ownership: OwnershipComment, record: cf.DNSRecord{Comment: "router  dyndns-owner=home\tcreated"}, want: true},
+		{name: "comment without marker", ownership: OwnershipComment, record: cf.DNSRecord{Comment: "router"}},
+		{name: "comment of a longer owner", ownership: OwnershipComment, record: cf.DNSRecord{Comment: "dyndns-owner=home2"}},
+		{name: "comment of a shorter owner", ownership: OwnershipComment, record: cf.DNSRecord{Comment: "dyndns-owner=hom"}},
+		{name: "comment with punctuation", ownership: OwnershipComment, record: cf.DNSRecord{Comment: "dyndns-owner=home,"}},
+		{name: "comment as tag", ownership: OwnershipComment, record: cf.DNSRecord{Tags: []string{"dyndns-owner:home"}}},
+
+		{name: "tag", ownership: OwnershipTag, record: cf.DNSRecord{Tags: []string{"env:prod", "dyndns-owner:home"}}, want: true},
+		{name: "tag of a longer owner", ownership: OwnershipTag, record: cf.DNSRecord{Tags: []string{"dyndns-owner:home2"}}},
+		{name: "tag as comment", ownership: OwnershipTag, record: cf.DNSRecord{Comment: "dyndns-owner=home"}},
+
+		{
+			name:      "txt",
+			ownership: OwnershipTxt,
+			record:    cf.DNSRecord{Type: "A", Name: name},
+			existing:  []cf.DNSRecord{txt("_dyndns-owner."+name, "heritage=fritzbox-cloudflare-dyndns,owner=home")},
+			want:      true,
+		},
+		{
+			name:      "txt quoted",
+			ownership: OwnershipTxt,
+			record:    cf.DNSRecord{Type: "A", Name: name},
+			existing:  []cf.DNSRecord{txt("_dyndns-owner."+name, `"heritage=fritzbox-cloudflare-dyndns,owner=home"`)},
+			want:      true,
+		},
+		{
+			name:      "txt of a longer owner",
+			ownership: OwnershipTxt,
+			record:    cf.DNSRecord{Type: "A", Name: name},
+			existing:  []cf.DNSRecord{txt("_dyndns-owner."+name, "heritage=fritzbox-cloudflare-dyndns,owner=home2")},
+		},
+		{
+			name:      "txt of another name",
+			ownership: OwnershipTxt,
+			record:    cf.DNSRecord{Type: "A", Name: name},
+			existing:  []cf.DNSRecord{txt("_dyndns-owner.vpn.example.com", "heritage=fritzbox-cloudflare-dyndns,owner=home")},
+		},
+		{
+			name:      "txt at the name",
+			ownership: OwnershipTxt,
+			record:    cf.DNSRecord{Type: "A", Name: name},
+			existing:  []cf.DNSRecord{txt(name, "heritage=fritzbox-cloudflare-dyndns,owner=home")},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			u := &Updater{}
+			u.SetOwnership(tt.ownership, "home")
+
+			if got := u.owns(tt.record, tt.existing); got != tt.want {
+				t.Errorf("owns() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWithMarker(t *testing.T) {
+	tests := []struct {
+		comment string
+		want    string
+	}{
+		{"", "dyndns-owner=home"},
+		{"router", "router dyndns-owner=home"},
+		{"dyndns-owner=home", "dyndns-owner=home"},
+		{"router dyndns-owner=home", "router dyndns-owner=home"},
+		{"dyndns-owner=home2", "dyndns-owner=home2 dyndns-owner=home"},
+	}
+
+	for _, tt := range tests {
+		if got := withMarker(tt.comment, "dyndns-owner=home"); got != tt.want {
+			t.Errorf("withMarker(%q) = %q, want %q", tt.comment, got, tt.want)
+		}
+	}
+}
+
+func TestPlanOwnershipRemoval(t *testing.T) {
+	const name = "home.example.com"
+
+	existing := []cf.DNSRecord{
+		{ID: "a", Type: "A", Name: name, Content: "192.0.2.1"},
+		{ID: "aaaa", Type: "AAAA", Name: name, Content: "2001:db8::1"},
+		{ID: "txt", Type: "TXT", Name: "_dyndns-owner." + name, Content: "heritage=fritzbox-cloudflare-dyndns,owner=home"},
+		{ID: "other", Type: "TXT", Name: "_dyndns-owner." + name, Content: "heritage=fritzbox-cloudflare-dyndns,owner=home2"},
+	}
+
+	tests := []struct {
+		name      string
+		ownership Ownership
+		deleted   []string
+		want      []string
+	}{
+		{name: "nothing deleted", ownership: OwnershipTxt},
+		{name: "records of the name remain", ownership: OwnershipTxt, deleted: []string{"aaaa"}},
+		{name: "last record deleted", ownership: OwnershipTxt, deleted: []string{"a", "aaaa"}, want: []string{"txt"}},
+		{name: "not in txt mode", ownership: OwnershipComment, deleted: []string{"a", "aaaa"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			u := &Updater{}
+			u.SetOwnership(tt.ownership, "home")
+
+			got := make([]string, 0)
+			for _, change := range u.planOwnershipRemoval(name+".", existing, tt.deleted) {
+				got = append(got, change.delete)
+			}
+
+			if (len(got) > 0 || len(tt.want) > 0) && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("planOwnershipRemoval() deletes %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
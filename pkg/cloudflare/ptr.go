@@ -0,0 +1,229 @@
+package cloudflare
+
+import (
+	"context"
+	"fmt"
+	cf "github.com/cloudflare/cloudflare-go"
+	"github.com/cromefire/fritzbox-cloudflare-dyndns/pkg/util"
+	"net"
+	"strings"
+)
+
+// reverseName returns the ip6.arpa name of the IPv6 address.
+func reverseName(ip net.IP) string {
+	ip = ip.To16()
+	nibbles := make([]string, 0, 2*len(ip))
+
+	for i := len(ip) - 1; i >= 0; i-- {
+		nibbles = append(nibbles, fmt.Sprintf("%x", ip[i]&0xf), fmt.Sprintf("%x", ip[i]>>4))
+	}
+
+	return strings.Join(nibbles, ".") + ".ip6.arpa"
+}
+
+// ptrChange is a change of a PTR record with the zone it's made in.
+type ptrChange struct {
+	plannedChange
+	zoneId string
+}
+
+// pointsTo reports whether the PTR record points to the name.
+func pointsTo(record cf.DNSRecord, name string) bool {
+	return strings.EqualFold(strings.TrimSuffix(record.Content, "."), name)
+}
+
+// applyPtr points the PTR record of the address in its ip6.arpa zone to the
+// name of the action. The owned PTR record of the previously published
+// address, i.e. of the previous prefix, is deleted, an empty content only
+// deletes that one.
+func (u *Updater) applyPtr(action *Action, content string) error {
+	c := action.credential
+	name := strings.ToLower(strings.TrimSuffix(action.DnsRecord, "."))
+
+	ctx, cancel := context.WithTimeout(context.Background(), u.timeout)
+	defer cancel()
+
+	zones, err := u.accessibleZones(ctx, c, false)
+
+	if err != nil {
+		return err
+	}
+
+	changes := make([]ptrChange, 0)
+
+	if ip := net.ParseIP(content); ip != nil {
+		planned, err := u.planPtr(ctx, action, zones, reverseName(ip), name)
+
+		if err != nil {
+			return err
+		}
+
+		changes = append(changes, planned...)
+	}
+
+	if previous := net.ParseIP(action.last); previous != nil && action.last != content {
+		planned, err := u.planPtrRemoval(ctx, action, zones, reverseName(previous), name)
+
+		if err != nil {
+			return err
+		}
+
+		changes = append(changes, planned...)
+	}
+
+	alog := u.actionLog(action)
+	for _, change := range changes {
+		u.reportChange(alog, change.Change)
+	}
+
+	if u.dryRun {
+		return nil
+	}
+
+	for _, change := range changes {
+		err := u.applyChanges(ctx, c, change.zoneId, []plannedChange{change.plannedChange})
+
+		if err != nil {
+			return fmt.Errorf("PTR record %s: %w", change.Domain, err)
+		}
+	}
+
+	return nil
+}
+
+// listName lists the records of the type with the name and, if the names are
+// marked by TXT records, the ownership records of the name.
+func (u *Updater) listName(ctx context.Context, c *credential, zoneId string, recordType string, name string) ([]cf.DNSRecord, error) {
+	existing, _, err := c.api.ListDNSRecords(ctx, cf.ZoneIdentifier(zoneId), cf.ListDNSRecordsParams{Type: recordType, Name: name})
+	u.observe(c, err)
+
+	if err != nil {
+		return nil, fmt.Errorf("could not research %s records: %w", recordType, err)
+	}
+
+	if u.ownership != OwnershipTxt {
+		return existing, nil
+	}
+
+	markers, _, err := c.api.ListDNSRecords(ctx, cf.ZoneIdentifier(zoneId), cf.ListDNSRecordsParams{Type: "TXT", Name: ownerPrefix + name})
+	u.observe(c, err)
+
+	if err != nil {
+		return nil, fmt.Errorf("could not research ownership records: %w", err)
+	}
+
+	return append(existing, markers...), nil
+}
+
+// planPtr plans the PTR record of the reverse name pointing to the name. A PTR
+// record of the reverse name pointing elsewhere belongs to the previous holder
+// of the address and is updated, if it's owned.
+func (u *Updater) planPtr(ctx context.Context, action *Action, zones []Zone, reverse string, name string) ([]ptrChange, error) {
+	zone, err := ZoneOf(reverse, "", zones)
+
+	if err != nil {
+		return nil, fmt.Errorf("could not find the reverse zone of %s: %w", reverse, err)
+	}
+
+	existing, err := u.listName(ctx, action.credential, zone.Id, "PTR", reverse)
+
+	if err != nil {
+		return nil, err
+	}
+
+	base := util.Change{Provider: u.name, Domain: reverse, Type: "PTR", Content: name}
+	records := matching(existing, "PTR", reverse)
+
+	for _, record := range records {
+		if pointsTo(record, name) {
+			change := base
+			change.Action = util.ChangeNoop
+			change.RecordId = record.ID
+
+			return []ptrChange{{zoneId: zone.Id, plannedChange: plannedChange{Change: change}}}, nil
+		}
+	}
+
+	for _, record := range records {
+		if !u.owns(record, existing) {
+			continue
+		}
+
+		change := base
+		change.Action = util.ChangeUpdate
+		change.RecordId = record.ID
+		change.Details = []string{fmt.Sprintf("content %s -> %s", record.Content, name)}
+		params := RecordOptions{}.updateParams(record, name)
+
+		return []ptrChange{{zoneId: zone.Id, plannedChange: plannedChange{Change: change, update: &params}}}, nil
+	}
+
+	if len(records) > 0 {
+		return nil, fmt.Errorf("PTR record %s points to %s and is not owned by %s", reverse, records[0].Content, u.ownerId)
+	}
+
+	change := base
+	change.Action = util.ChangeCreate
+	params := u.marked(u.options(action).createParams("PTR", reverse, name))
+	params.Proxied = nil
+
+	changes := []ptrChange{{zoneId: zone.Id, plannedChange: plannedChange{Change: change, create: &params}}}
+	for _, marker := range u.planOwnershipRecord(reverse, existing) {
+		changes = append(changes, ptrChange{zoneId: zone.Id, plannedChange: marker})
+	}
+
+	return changes, nil
+}
+
+// planPtrRemoval plans deleting the owned PTR records of the reverse name of
+// the previous address pointing to the name. Records of other names and
+// records not owned by the updater are left untouched.
+func (u *Updater) planPtrRemoval(ctx context.Context, action *Action, zones []Zone, reverse string, name string) ([]ptrChange, error) {
+	zone, err := ZoneOf(reverse, "", zones)
+
+	// There's nothing to clean up without access to the zone
+	if err != nil {
+		return nil, nil
+	}
+
+	existing, err := u.listName(ctx, action.credential, zone.Id, "PTR", reverse)
+
+	if err != nil {
+		return nil, err
+	}
+
+	changes := make([]ptrChange, 0)
+	deleted := make([]string, 0)
+
+	for _, record := range matching(existing, "PTR", reverse) {
+		if !pointsTo(record, name) {
+			continue
+		}
+
+		change := util.Change{
+			Action:   util.ChangeDelete,
+			Provider: u.name,
+			Domain:   reverse,
+			Type:     "PTR",
+			Content:  record.Content,
+			RecordId: record.ID,
+			Details:  []string{"PTR of the previous address"},
+		}
+
+		if !u.owns(record, existing) {
+			change.Action = util.ChangeConflict
+			change.Details = []string{fmt.Sprintf("not owned by %s, left in place", u.ownerId)}
+			changes = append(changes, ptrChange{zoneId: zone.Id, plannedChange: plannedChange{Change: change}})
+			continue
+		}
+
+		deleted = append(deleted, record.ID)
+		changes = append(changes, ptrChange{zoneId: zone.Id, plannedChange: plannedChange{Change: change, delete: record.ID}})
+	}
+
+	for _, marker := range u.planOwnershipRemoval(reverse, existing, deleted) {
+		changes = append(changes, ptrChange{zoneId: zone.Id, plannedChange: marker})
+	}
+
+	return changes, nil
+}
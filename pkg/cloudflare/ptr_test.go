@@ -0,0 +1,139 @@
+package cloudflare
+
+import (
+	cf "github.com/cloudflare/cloudflare-go"
+	"github.com/cromefire/fritzbox-cloudflare-dyndns/pkg/util"
+	"net"
+	"reflect"
+	"testing"
+)
+
+const reverseZoneId = "0123456789abcdef0123456789abcdef"
+
+var reverseZone = Zone{Id: reverseZoneId, Name: "8.b.d.0.1.0.0.2.ip6.arpa"}
+
+func ipv6Update(ip string) *util.IpUpdate {
+	return &util.IpUpdate{Source: "home", IpVersion: 6, Ip: net.ParseIP(ip)}
+}
+
+func TestReverseName(t *testing.T) {
+	want := "1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.ip6.arpa"
+
+	if got := reverseName(net.ParseIP("2001:db8::1")); got != want {
+		t.Errorf("reverseName = %s, want %s", got, want)
+	}
+}
+
+// ptrs returns the contents of the PTR records by name.
+func ptrs(fake *fakeCloudflare) map[string]string {
+	records := make(map[string]string)
+	for _, record := range fake.list(reverseZoneId, "PTR") {
+		records[record.Name] = record.Content
+	}
+
+	return records
+}
+
+func newTestPtrUpdater(t *testing.T, fake *fakeCloudflare) *Updater {
+	return newTestUpdater(t, fake, func(u *Updater) { u.SetOwnership(OwnershipComment, "home") }, Record{
+		Name:          "home.example.com",
+		IpVersion:     6,
+		RecordOptions: RecordOptions{Ptr: true, Withdraw: util.WithdrawDelete},
+	})
+}
+
+func TestPtr(t *testing.T) {
+	fake := newFakeCloudflare(t, testZone, reverseZone)
+	u := newTestPtrUpdater(t, fake)
+
+	first := reverseName(net.ParseIP("2001:db8::1"))
+	second := reverseName(net.ParseIP("2001:db8::2"))
+
+	u.Handle(ipv6Update("2001:db8::1"))
+
+	if records := ptrs(fake); !reflect.DeepEqual(records, map[string]string{first: "home.example.com"}) {
+		t.Fatalf("PTR records = %v, want the one of the address", records)
+	}
+
+	if record := fake.list(reverseZoneId, "PTR")[0]; record.Comment != "dyndns-owner=home" {
+		t.Errorf("comment = %q, want the owner marker", record.Comment)
+	}
+
+	// The PTR record of the previous address is deleted
+	u.Handle(ipv6Update("2001:db8::2"))
+
+	if records := ptrs(fake); !reflect.DeepEqual(records, map[string]string{second: "home.example.com"}) {
+		t.Errorf("PTR records = %v, want the one of the new address", records)
+	}
+
+	u.Handle(&util.IpUpdate{Source: "home", IpVersion: 6, Withdrawn: true})
+
+	if records := ptrs(fake); len(records) != 0 {
+		t.Errorf("PTR records = %v, want none", records)
+	}
+}
+
+func TestPtrOfOthers(t *testing.T) {
+	fake := newFakeCloudflare(t, testZone, reverseZone)
+	reverse := reverseName(net.ParseIP("2001:db8::1"))
+
+	// The address was held by another host, its PTR record isn't owned
+	fake.add(reverseZoneId, cf.DNSRecord{Type: "PTR", Name: reverse, Content: "other.example.com", TTL: 120})
+
+	u := newTestPtrUpdater(t, fake)
+	u.Handle(ipv6Update("2001:db8::1"))
+
+	if records := ptrs(fake); !reflect.DeepEqual(records, map[string]string{reverse: "other.example.com"}) {
+		t.Errorf("PTR records = %v, want the foreign one kept", records)
+	}
+
+	if action := u.actions[0]; action.status.Succeeded {
+		t.Errorf("status = %+v, want it failed", action.status)
+	}
+}
+
+func TestPtrTakeOver(t *testing.T) {
+	fake := newFakeCloudflare(t, testZone, reverseZone)
+	reverse := reverseName(net.ParseIP("2001:db8::1"))
+
+	// An owned PTR record pointing elsewhere is taken over
+	fake.add(reverseZoneId, cf.DNSRecord{Type: "PTR", Name: reverse, Content: "other.example.com", TTL: 120, Comment: "dyndns-owner=home"})
+
+	u := newTestPtrUpdater(t, fake)
+	u.Handle(ipv6Update("2001:db8::1"))
+
+	if records := ptrs(fake); !reflect.DeepEqual(records, map[string]string{reverse: "home.example.com"}) {
+		t.Errorf("PTR records = %v, want it updated", records)
+	}
+}
+
+func TestPtrWithoutReverseZone(t *testing.T) {
+	fake := newFakeCloudflare(t, testZone)
+	u := newTestPtrUpdater(t, fake)
+
+	u.Handle(ipv6Update("2001:db8::1"))
+
+	// The AAAA record is published, the missing reverse zone fails the update
+	if records := fake.list(testZoneId, "AAAA"); len(records) != 1 {
+		t.Errorf("AAAA records = %+v, want the address", records)
+	}
+
+	if action := u.actions[0]; action.status.Succeeded {
+		t.Errorf("status = %+v, want it failed", action.status)
+	}
+}
+
+func TestPtrDryRun(t *testing.T) {
+	fake := newFakeCloudflare(t, testZone, reverseZone)
+	u := newTestUpdater(t, fake, func(u *Updater) { u.SetDryRun(true) }, Record{
+		Name:          "home.example.com",
+		IpVersion:     6,
+		RecordOptions: RecordOptions{Ptr: true},
+	})
+
+	u.Handle(ipv6Update("2001:db8::1"))
+
+	if writes := fake.writes(); len(writes) != 0 {
+		t.Errorf("requests = %v, want none", writes)
+	}
+}
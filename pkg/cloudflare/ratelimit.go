@@ -0,0 +1,25 @@
+package cloudflare
+
+import (
+	"github.com/cromefire/fritzbox-cloudflare-dyndns/pkg/util"
+	"net/http"
+	"time"
+)
+
+// rateLimitTransport remembers until when the API is rate limited, as
+// cloudflare-go doesn't expose the Retry-After header of 429 responses.
+type rateLimitTransport struct {
+	base http.RoundTripper
+
+	util.RateLimit
+}
+
+func (t *rateLimitTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	res, err := t.base.RoundTrip(req)
+
+	if err == nil && res.StatusCode == http.StatusTooManyRequests {
+		t.Extend(util.ParseRetryAfter(res.Header.Get("Retry-After"), time.Now()))
+	}
+
+	return res, err
+}
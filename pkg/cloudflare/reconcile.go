@@ -0,0 +1,97 @@
+package cloudflare
+
+import (
+	"context"
+	"fmt"
+	"github.com/cromefire/fritzbox-cloudflare-dyndns/pkg/util"
+	"github.com/prometheus/client_golang/prometheus"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// SetReconcileInterval makes the worker check all records for drift in the
+// interval, it has to be called before the worker is started.
+func (u *Updater) SetReconcileInterval(interval time.Duration) {
+	u.reconcileInterval = interval
+}
+
+// Reconcile compares the records against the last published addresses and
+// repairs them if they were changed or deleted in the meantime.
+func (u *Updater) Reconcile() {
+	u.workLock.Lock()
+	defer u.workLock.Unlock()
+
+	u.log.Debug("Reconciling records")
+
+	jobs := make([]job, 0)
+
+	for _, action := range u.currentActions() {
+		// Records without a published address or with a pending retry are
+		// repaired by the next update
+		if action.last == "" || action.retry != nil {
+			continue
+		}
+
+		jobs = append(jobs, job{action: action, content: action.last})
+	}
+
+	drifted := make([]job, 0)
+	var driftedLock sync.Mutex
+
+	u.eachZone(jobs, func(c *credential, zoneId string, jobs []job) {
+		zoneDrifted := u.reconcileZone(c, zoneId, jobs)
+
+		driftedLock.Lock()
+		drifted = append(drifted, zoneDrifted...)
+		driftedLock.Unlock()
+	})
+
+	u.publish(drifted...)
+}
+
+// reconcileZone returns the jobs of the zone whose records drifted.
+func (u *Updater) reconcileZone(c *credential, zoneId string, jobs []job) []job {
+	ctx, cancel := context.WithTimeout(context.Background(), u.timeout)
+	defer cancel()
+
+	existing, err := u.listZone(ctx, c, zoneId, jobs)
+
+	if err != nil {
+		u.log.Warn("Failed to check for drift", slog.String("zone-id", zoneId), util.ErrorAttr(err))
+		return nil
+	}
+
+	drifted := make([]job, 0)
+
+	for _, j := range jobs {
+		drift := make([]string, 0)
+
+		for _, change := range u.plan(j.action, existing, j.content) {
+			// Ownership records are recreated along with the record
+			if change.Type != j.action.recordType() {
+				continue
+			}
+
+			switch change.Action {
+			case util.ChangeCreate:
+				drift = append(drift, "record missing")
+			case util.ChangeUpdate:
+				drift = append(drift, change.Details...)
+			case util.ChangeDelete:
+				drift = append(drift, "duplicate record "+change.RecordId)
+			}
+		}
+
+		if len(drift) == 0 {
+			continue
+		}
+
+		u.actionLog(j.action).Warn("Drift detected, repairing record", slog.Any("drift", drift))
+		u.drifts.With(prometheus.Labels{"record": j.action.DnsRecord, "ip_version": fmt.Sprint(j.action.IpVersion), "type": j.action.recordType()}).Inc()
+
+		drifted = append(drifted, j)
+	}
+
+	return drifted
+}
@@ -0,0 +1,213 @@
+package cloudflare
+
+import (
+	"fmt"
+	cf "github.com/cloudflare/cloudflare-go"
+	"github.com/cromefire/fritzbox-cloudflare-dyndns/pkg/util"
+	"net"
+	"slices"
+	"strings"
+)
+
+const (
+	// DefaultTTL is used for new records if no TTL is configured
+	DefaultTTL = 120
+	// AutoTTL lets Cloudflare choose the TTL
+	AutoTTL = 1
+)
+
+// ProxiedMode controls the proxy status (orange cloud) of a record.
+type ProxiedMode string
+
+const (
+	ProxiedKeep ProxiedMode = "keep"
+	ProxiedOn   ProxiedMode = "on"
+	ProxiedOff  ProxiedMode = "off"
+)
+
+// DuplicatePolicy controls what happens if several records exist for a name.
+type DuplicatePolicy string
+
+const (
+	// DuplicatesUpdateAll updates all records to the same address
+	DuplicatesUpdateAll DuplicatePolicy = "update-all"
+	// DuplicatesKeepOne updates one record and deletes the others
+	DuplicatesKeepOne DuplicatePolicy = "keep-one"
+	// DuplicatesFail leaves the records untouched and fails the update
+	DuplicatesFail DuplicatePolicy = "fail"
+)
+
+// RecordOptions are applied when a record is created and, if Enforce is set,
+// also when an existing record is updated.
+type RecordOptions struct {
+	// TTL in seconds, 0 means unset and AutoTTL lets Cloudflare decide
+	TTL     int
+	Proxied ProxiedMode
+	Comment string
+	// Tags in the name:value format, nil means unset
+	Tags    []string
+	Enforce bool
+	// Duplicates is the policy for several records with the name
+	Duplicates DuplicatePolicy
+	// Withdraw is what happens to the records if the router loses the address
+	Withdraw util.WithdrawMode
+	// Fallback is the address published if the address is withdrawn
+	Fallback net.IP
+	// Ptr maintains the PTR record of the IPv6 address in its ip6.arpa zone
+	Ptr bool
+}
+
+// Record is a single record definition the updater maintains.
+type Record struct {
+	Name      string
+	IpVersion uint8
+	// Type is HTTPS or SVCB to maintain the address hints of existing records,
+	// the A or AAAA record of the IP version if empty
+	Type string
+	// Source restricts the record to updates of one source, any if empty
+	Source string
+	// InterfaceId makes the record point to a device in the IPv6 prefix
+	InterfaceId net.IP
+	// Zone is the name or ID of the zone of the record, the accessible zone
+	// with the longest matching name if empty
+	Zone string
+	// Credential is the name of the credential to publish the record with,
+	// the one that can access the zone if empty
+	Credential string
+	RecordOptions
+}
+
+func ParseProxiedMode(value string) (ProxiedMode, error) {
+	switch strings.ToLower(value) {
+	case "", "keep":
+		return ProxiedKeep, nil
+	case "on", "true", "yes":
+		return ProxiedOn, nil
+	case "off", "false", "no":
+		return ProxiedOff, nil
+	default:
+		return ProxiedKeep, fmt.Errorf("invalid proxied mode %q, has to be on, off or keep", value)
+	}
+}
+
+func ParseDuplicatePolicy(value string) (DuplicatePolicy, error) {
+	switch strings.ToLower(value) {
+	case "", "update-all", "all":
+		return DuplicatesUpdateAll, nil
+	case "keep-one", "one":
+		return DuplicatesKeepOne, nil
+	case "fail":
+		return DuplicatesFail, nil
+	default:
+		return DuplicatesUpdateAll, fmt.Errorf("invalid duplicates policy %q, has to be update-all, keep-one or fail", value)
+	}
+}
+
+func (o RecordOptions) createParams(recordType string, name string, content string) cf.CreateDNSRecordParams {
+	ttl := o.TTL
+	if ttl == 0 {
+		ttl = DefaultTTL
+	}
+
+	proxied := o.Proxied == ProxiedOn
+
+	return cf.CreateDNSRecordParams{
+		Type:    recordType,
+		Name:    name,
+		Content: content,
+		Proxied: &proxied,
+		TTL:     ttl,
+		Comment: o.Comment,
+		Tags:    o.Tags,
+	}
+}
+
+// updateParams builds the update for an existing record, which keeps its
+// settings unless the options are enforced.
+func (o RecordOptions) updateParams(record cf.DNSRecord, content string) cf.UpdateDNSRecordParams {
+	// Ensure we submit all required fields even if they did not change, otherwise
+	// cloudflare-go might revert them to default values.
+	params := cf.UpdateDNSRecordParams{
+		ID:      record.ID,
+		Type:    record.Type,
+		Name:    record.Name,
+		Content: content,
+		TTL:     record.TTL,
+		Proxied: record.Proxied,
+		Tags:    record.Tags,
+	}
+
+	// Records with structured data like HTTPS are updated by their data
+	if record.Data != nil {
+		params.Content = ""
+		params.Data = record.Data
+	}
+
+	if !o.Enforce {
+		return params
+	}
+
+	if o.TTL != 0 {
+		params.TTL = o.TTL
+	}
+
+	if o.Proxied != ProxiedKeep {
+		proxied := o.Proxied == ProxiedOn
+		params.Proxied = &proxied
+	}
+
+	if o.Comment != "" {
+		params.Comment = &o.Comment
+	}
+
+	if o.Tags != nil {
+		params.Tags = o.Tags
+	}
+
+	return params
+}
+
+// drift describes how the record differs from the content and options. The
+// differences that are corrected by an update are returned as fixed, the
+// ones that are kept because the options aren't enforced as kept.
+func (o RecordOptions) drift(record cf.DNSRecord, content string) (fixed []string, kept []string) {
+	if record.Content != content {
+		fixed = append(fixed, fmt.Sprintf("content %s -> %s", record.Content, content))
+	}
+
+	differences := make([]string, 0)
+
+	// Proxied records always have an automatic TTL
+	proxied := record.Proxied != nil && *record.Proxied
+
+	if o.TTL != 0 && !proxied && record.TTL != o.TTL {
+		differences = append(differences, fmt.Sprintf("ttl %d -> %d", record.TTL, o.TTL))
+	}
+
+	if o.Proxied != ProxiedKeep && proxied != (o.Proxied == ProxiedOn) {
+		differences = append(differences, fmt.Sprintf("proxied %t -> %t", proxied, o.Proxied == ProxiedOn))
+	}
+
+	if o.Comment != "" && record.Comment != o.Comment {
+		differences = append(differences, fmt.Sprintf("comment %q -> %q", record.Comment, o.Comment))
+	}
+
+	if o.Tags != nil && !sameTags(record.Tags, o.Tags) {
+		differences = append(differences, fmt.Sprintf("tags %v -> %v", record.Tags, o.Tags))
+	}
+
+	if o.Enforce {
+		return append(fixed, differences...), kept
+	}
+
+	return fixed, differences
+}
+
+func sameTags(a []string, b []string) bool {
+	a = slices.Clone(a)
+	b = slices.Clone(b)
+	slices.Sort(a)
+	slices.Sort(b)
+
+	return slices.Equal(a, b)
+}
@@ -0,0 +1,88 @@
+package cloudflare
+
+import (
+	cf "github.com/cloudflare/cloudflare-go"
+	"reflect"
+	"testing"
+)
+
+func TestDrift(t *testing.T) {
+	proxied := true
+	record := cf.DNSRecord{
+		Content: "192.0.2.1",
+		TTL:     300,
+		Comment: "router",
+		Tags:    []string{"b:2", "a:1"},
+	}
+
+	tests := []struct {
+		name    string
+		options RecordOptions
+		record  cf.DNSRecord
+		content string
+		fixed   []string
+		kept    []string
+	}{
+		{name: "up to date", options: RecordOptions{TTL: 300, Comment: "router", Tags: []string{"a:1", "b:2"}}, content: "192.0.2.1"},
+		{name: "content", content: "192.0.2.2", fixed: []string{"content 192.0.2.1 -> 192.0.2.2"}},
+		{
+			name:    "options kept",
+			options: RecordOptions{TTL: 60, Proxied: ProxiedOn, Comment: "home", Tags: []string{"a:1"}},
+			content: "192.0.2.1",
+			kept:    []string{"ttl 300 -> 60", "proxied false -> true", `comment "router" -> "home"`, "tags [b:2 a:1] -> [a:1]"},
+		},
+		{
+			name:    "options enforced",
+			options: RecordOptions{TTL: 60, Proxied: ProxiedOn, Enforce: true},
+			content: "192.0.2.2",
+			fixed:   []string{"content 192.0.2.1 -> 192.0.2.2", "ttl 300 -> 60", "proxied false -> true"},
+		},
+		{
+			name:    "ttl of a proxied record",
+			options: RecordOptions{TTL: 60, Proxied: ProxiedKeep, Enforce: true},
+			record:  cf.DNSRecord{Content: "192.0.2.1", TTL: 1, Proxied: &proxied},
+			content: "192.0.2.1",
+		},
+		{name: "unset options", options: RecordOptions{Proxied: ProxiedKeep, Enforce: true}, content: "192.0.2.1"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := record
+			if tt.record.Content != "" {
+				r = tt.record
+			}
+
+			if tt.options.Proxied == "" {
+				tt.options.Proxied = ProxiedKeep
+			}
+
+			fixed, kept := tt.options.drift(r, tt.content)
+
+			if (len(fixed) > 0 || len(tt.fixed) > 0) && !reflect.DeepEqual(fixed, tt.fixed) {
+				t.Errorf("drift() fixed = %q, want %q", fixed, tt.fixed)
+			}
+
+			if (len(kept) > 0 || len(tt.kept) > 0) && !reflect.DeepEqual(kept, tt.kept) {
+				t.Errorf("drift() kept = %q, want %q", kept, tt.kept)
+			}
+		})
+	}
+}
+
+func TestUpdateParams(t *testing.T) {
+	proxied := false
+	record := cf.DNSRecord{ID: "a", Type: "A", Name: "home.example.com", Content: "192.0.2.1", TTL: 300, Proxied: &proxied, Tags: []string{"a:1"}}
+
+	kept := RecordOptions{TTL: 60, Proxied: ProxiedOn, Comment: "home", Tags: []string{"b:2"}}.updateParams(record, "192.0.2.2")
+
+	if kept.TTL != 300 || *kept.Proxied || kept.Comment != nil || !reflect.DeepEqual(kept.Tags, record.Tags) || kept.Content != "192.0.2.2" {
+		t.Errorf("updateParams() = %+v, want the settings of the record", kept)
+	}
+
+	enforced := RecordOptions{TTL: 60, Proxied: ProxiedOn, Comment: "home", Tags: []string{"b:2"}, Enforce: true}.updateParams(record, "192.0.2.2")
+
+	if enforced.TTL != 60 || !*enforced.Proxied || *enforced.Comment != "home" || !reflect.DeepEqual(enforced.Tags, []string{"b:2"}) {
+		t.Errorf("updateParams() = %+v, want the options", enforced)
+	}
+}
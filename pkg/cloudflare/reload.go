@@ -0,0 +1,126 @@
+package cloudflare
+
+import (
+	"fmt"
+	"github.com/cromefire/fritzbox-cloudflare-dyndns/pkg/util"
+	"github.com/prometheus/client_golang/prometheus"
+	"log/slog"
+	"slices"
+)
+
+// PrepareReload resolves the zones and credentials of the new records and compares them to
+// the current ones. Nothing is changed until the returned reload is applied.
+func (u *Updater) PrepareReload(records []Record) (*util.Reload, error) {
+	targets, err := u.resolveTargets(records)
+
+	if err != nil {
+		return nil, err
+	}
+
+	current := make(map[string]*Action)
+	for _, action := range u.currentActions() {
+		current[actionKey(action.DnsRecord, action.Type, action.IpVersion)] = action
+	}
+
+	reload := &util.Reload{Changes: make([]string, 0)}
+	next := make([]*Action, 0, len(records))
+	// pending actions have to be run against the last known addresses
+	pending := make([]*Action, 0)
+	added := make([]*Action, 0)
+
+	for i, record := range records {
+		key := actionKey(record.Name, record.Type, record.IpVersion)
+		existing, ok := current[key]
+		delete(current, key)
+
+		if ok && sameRecord(existing.record(), record) && existing.CfZoneId == targets[i].zoneId && existing.credential == targets[i].credential {
+			next = append(next, existing)
+			continue
+		}
+
+		a := u.newAction(record, targets[i])
+
+		if ok {
+			// Keep the metrics and status of the record
+			a.updates = existing.updates
+			a.status = existing.status
+			reload.Changes = append(reload.Changes, "changed "+key)
+		} else {
+			added = append(added, a)
+			reload.Changes = append(reload.Changes, "added "+key)
+		}
+
+		next = append(next, a)
+		pending = append(pending, a)
+	}
+
+	removed := make([]*Action, 0, len(current))
+	for key, action := range current {
+		removed = append(removed, action)
+		reload.Changes = append(reload.Changes, "removed "+key)
+	}
+
+	slices.Sort(reload.Changes)
+
+	reload.Apply = func() {
+		u.workLock.Lock()
+		defer u.workLock.Unlock()
+
+		u.actionsLock.Lock()
+		u.records = records
+		u.actions = next
+		u.actionsLock.Unlock()
+
+		for _, action := range removed {
+			u.registerer.Unregister(action.updates)
+			u.drifts.Delete(prometheus.Labels{"record": action.DnsRecord, "ip_version": fmt.Sprint(action.IpVersion), "type": action.recordType()})
+			u.conflicts.Delete(prometheus.Labels{"record": action.DnsRecord, "type": action.recordType()})
+			u.duplicates.DeletePartialMatch(prometheus.Labels{"record": action.DnsRecord, "type": action.recordType()})
+		}
+
+		for _, action := range added {
+			err := u.registerer.Register(action.updates)
+
+			if err != nil {
+				u.log.Warn("Failed to register metrics", slog.String("record", action.DnsRecord), util.ErrorAttr(err))
+			}
+		}
+
+		// Missing permissions are reported, the records fail on their own
+		_ = u.verifyZones(pending)
+		u.pruneZoneStatuses()
+
+		for _, update := range u.lastUpdates {
+			u.handle(update, pending)
+		}
+	}
+
+	return reload, nil
+}
+
+func actionKey(name string, recordType string, ipVersion uint8) string {
+	if recordType != "" {
+		return fmt.Sprintf("%s/%s/IPv%d", name, recordType, ipVersion)
+	}
+
+	return fmt.Sprintf("%s/IPv%d", name, ipVersion)
+}
+
+func sameRecord(a Record, b Record) bool {
+	return a.Name == b.Name &&
+		a.IpVersion == b.IpVersion &&
+		a.Type == b.Type &&
+		a.Source == b.Source &&
+		a.InterfaceId.Equal(b.InterfaceId) &&
+		a.Zone == b.Zone &&
+		a.Credential == b.Credential &&
+		a.TTL == b.TTL &&
+		a.Proxied == b.Proxied &&
+		a.Comment == b.Comment &&
+		slices.Equal(a.Tags, b.Tags) &&
+		a.Enforce == b.Enforce &&
+		a.Duplicates == b.Duplicates &&
+		a.Withdraw == b.Withdraw &&
+		a.Fallback.Equal(b.Fallback) &&
+		a.Ptr == b.Ptr
+}
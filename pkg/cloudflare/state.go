@@ -0,0 +1,56 @@
+package cloudflare
+
+import (
+	"fmt"
+	"github.com/cromefire/fritzbox-cloudflare-dyndns/pkg/state"
+)
+
+// definition identifies the configuration of the action in the state, a
+// changed record is published again even if the address is the same.
+func (a *Action) definition() string {
+	return fmt.Sprintf("%s %v %+v", a.Source, a.InterfaceId, a.Options)
+}
+
+// restore continues with the state of the previous run, a pending retry is
+// armed once the worker is started.
+func (u *Updater) restore(action *Action) {
+	record, ok := u.store.Get(action.status.Provider, action.DnsRecord, action.Type, action.IpVersion)
+
+	if !ok {
+		return
+	}
+
+	if record.Definition == action.definition() {
+		action.last = record.Last
+		action.recordIds = record.RecordIds
+	}
+
+	action.status.LastSuccess = record.LastSuccess
+	action.status.LastFailure = record.LastFailure
+	action.status.Succeeded = !record.LastFailure.After(record.LastSuccess)
+
+	if action.status.Succeeded {
+		action.status.Last = record.LastSuccess
+	} else {
+		action.status.Last = record.LastFailure
+	}
+
+	if record.Retry != nil {
+		action.setRetry(record.Retry)
+	}
+}
+
+func (u *Updater) saveState(action *Action) {
+	u.store.Set(state.Record{
+		Provider:    action.status.Provider,
+		Domain:      action.DnsRecord,
+		IpVersion:   action.IpVersion,
+		Type:        action.Type,
+		Definition:  action.definition(),
+		Last:        action.last,
+		RecordIds:   action.recordIds,
+		LastSuccess: action.status.LastSuccess,
+		LastFailure: action.status.LastFailure,
+		Retry:       action.retry,
+	})
+}
@@ -0,0 +1,231 @@
+package cloudflare
+
+import (
+	"encoding/json"
+	"fmt"
+	cf "github.com/cloudflare/cloudflare-go"
+	"github.com/cromefire/fritzbox-cloudflare-dyndns/pkg/util"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// svcbData is the data of an HTTPS or SVCB record, the SvcParams are kept in
+// their presentation format.
+type svcbData struct {
+	Priority uint16 `json:"priority"`
+	Target   string `json:"target"`
+	Value    string `json:"value"`
+}
+
+// svcParamKeys are the numbers of the known SvcParamKeys, which order the
+// SvcParams.
+var svcParamKeys = map[string]int{
+	"mandatory":       0,
+	"alpn":            1,
+	"no-default-alpn": 2,
+	"port":            3,
+	"ipv4hint":        4,
+	"ech":             5,
+	"ipv6hint":        6,
+}
+
+// isHintType reports whether records of the type carry the addresses as hints
+// instead of their content.
+func isHintType(recordType string) bool {
+	return recordType == "HTTPS" || recordType == "SVCB"
+}
+
+// hintKey is the SvcParamKey holding the addresses of the action.
+func (a *Action) hintKey() string {
+	return fmt.Sprintf("ipv%dhint", a.IpVersion)
+}
+
+func parseSvcbData(record cf.DNSRecord) (svcbData, error) {
+	data := svcbData{}
+	raw, err := json.Marshal(record.Data)
+
+	if err == nil {
+		err = json.Unmarshal(raw, &data)
+	}
+
+	if err != nil || record.Data == nil {
+		return data, fmt.Errorf("unreadable %s data: %v", record.Type, record.Data)
+	}
+
+	return data, nil
+}
+
+// svcParams splits SvcParams into their key=value pairs, quoted values may
+// contain spaces.
+func svcParams(value string) []string {
+	params := make([]string, 0)
+	quoted := false
+	start := -1
+
+	for i, r := range value {
+		switch {
+		case r == '"':
+			quoted = !quoted
+		case r == ' ' && !quoted:
+			if start >= 0 {
+				params = append(params, value[start:i])
+				start = -1
+			}
+
+			continue
+		}
+
+		if start < 0 {
+			start = i
+		}
+	}
+
+	if start >= 0 {
+		params = append(params, value[start:])
+	}
+
+	return params
+}
+
+// svcParamNumber returns the number of the key of the SvcParam.
+func svcParamNumber(param string) int {
+	key, _, _ := strings.Cut(param, "=")
+
+	if number, ok := svcParamKeys[key]; ok {
+		return number
+	}
+
+	if number, err := strconv.Atoi(strings.TrimPrefix(key, "key")); err == nil {
+		return number
+	}
+
+	return 1 << 16
+}
+
+// hint returns the addresses of the key in the SvcParams, empty if unset.
+func hint(value string, key string) string {
+	for _, param := range svcParams(value) {
+		if k, v, _ := strings.Cut(param, "="); k == key {
+			return strings.Trim(v, `"`)
+		}
+	}
+
+	return ""
+}
+
+// withHint sets the addresses of the key in the SvcParams, an empty address
+// removes the key. The other SvcParams are left as they are.
+func withHint(value string, key string, ip string) string {
+	params := slices.DeleteFunc(svcParams(value), func(param string) bool {
+		k, _, _ := strings.Cut(param, "=")
+		return k == key
+	})
+
+	if ip != "" {
+		param := key + `="` + ip + `"`
+		i := slices.IndexFunc(params, func(p string) bool { return svcParamNumber(p) > svcParamNumber(param) })
+
+		if i < 0 {
+			i = len(params)
+		}
+
+		params = slices.Insert(params, i, param)
+	}
+
+	return strings.Join(params, " ")
+}
+
+// sameHint reports whether the hint is the address.
+func sameHint(hint string, ip string) bool {
+	a := net.ParseIP(hint)
+	b := net.ParseIP(ip)
+
+	if a == nil || b == nil {
+		return hint == ip
+	}
+
+	return a.Equal(b)
+}
+
+// planHints compares the address hints of the HTTPS or SVCB records of the
+// action against the content, an empty content removes them. The records are
+// never created or deleted, their priority, target and other SvcParams are
+// kept.
+func (u *Updater) planHints(action *Action, existing []cf.DNSRecord, content string) []plannedChange {
+	recordType := action.recordType()
+	key := action.hintKey()
+	options := u.options(action)
+
+	base := util.Change{Provider: u.name, Domain: action.DnsRecord, Type: recordType, Content: content}
+	changes := make([]plannedChange, 0)
+
+	for _, record := range matching(existing, recordType, action.DnsRecord) {
+		change := plannedChange{Change: base}
+		change.RecordId = record.ID
+		change.Action = util.ChangeNoop
+
+		if !u.owns(record, existing) {
+			change.Action = util.ChangeConflict
+			change.Details = []string{fmt.Sprintf("not owned by %s, adopt it to take ownership", u.ownerId)}
+			changes = append(changes, change)
+			continue
+		}
+
+		data, err := parseSvcbData(record)
+
+		if err != nil {
+			change.Action = util.ChangeConflict
+			change.Details = []string{err.Error()}
+			changes = append(changes, change)
+			continue
+		}
+
+		fixed, kept := options.drift(record, record.Content)
+
+		if current := hint(data.Value, key); !sameHint(current, content) {
+			fixed = append([]string{fmt.Sprintf("%s %q -> %q", key, current, content)}, fixed...)
+		}
+
+		if len(fixed) > 0 {
+			change.Action = util.ChangeUpdate
+			data.Value = withHint(data.Value, key, content)
+			params := options.updateParams(record, record.Content)
+			params.Data = data
+			change.update = &params
+		}
+
+		change.Details = append(change.Details, fixed...)
+		for _, difference := range kept {
+			change.Details = append(change.Details, difference+" (not enforced)")
+		}
+
+		changes = append(changes, change)
+	}
+
+	return changes
+}
+
+// updatedRecords returns the existing records with the data of the updates and
+// without the deleted ones, so the hints of the other IP version and the
+// withdrawals planned later in the same zone build on them.
+func updatedRecords(existing []cf.DNSRecord, changes []plannedChange) []cf.DNSRecord {
+	existing = slices.DeleteFunc(slices.Clone(existing), func(record cf.DNSRecord) bool {
+		return record.ID != "" && slices.ContainsFunc(changes, func(change plannedChange) bool { return change.delete == record.ID })
+	})
+
+	for _, change := range changes {
+		if change.update == nil || change.update.Data == nil {
+			continue
+		}
+
+		for i := range existing {
+			if existing[i].ID == change.update.ID {
+				existing[i].Data = change.update.Data
+			}
+		}
+	}
+
+	return existing
+}
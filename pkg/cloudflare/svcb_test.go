@@ -0,0 +1,139 @@
+package cloudflare
+
+import (
+	cf "github.com/cloudflare/cloudflare-go"
+	"github.com/cromefire/fritzbox-cloudflare-dyndns/pkg/util"
+	"net"
+	"reflect"
+	"testing"
+)
+
+func TestSvcParams(t *testing.T) {
+	tests := map[string][]string{
+		"":                                   {},
+		`alpn="h2,h3"`:                       {`alpn="h2,h3"`},
+		`alpn=h2  port=8443`:                 {"alpn=h2", "port=8443"},
+		`no-default-alpn ech="a b" key65=1 `: {"no-default-alpn", `ech="a b"`, "key65=1"},
+	}
+
+	for value, want := range tests {
+		if got := svcParams(value); !reflect.DeepEqual(got, want) {
+			t.Errorf("svcParams(%q) = %q, want %q", value, got, want)
+		}
+	}
+}
+
+func TestHint(t *testing.T) {
+	const value = `alpn="h2" ipv4hint="192.0.2.1" ipv6hint=2001:db8::1`
+
+	if got := hint(value, "ipv4hint"); got != "192.0.2.1" {
+		t.Errorf("ipv4hint = %q, want 192.0.2.1", got)
+	}
+
+	if got := hint(value, "ipv6hint"); got != "2001:db8::1" {
+		t.Errorf("ipv6hint = %q, want 2001:db8::1", got)
+	}
+
+	if got := hint(`alpn="h2"`, "ipv4hint"); got != "" {
+		t.Errorf("unset ipv4hint = %q, want empty", got)
+	}
+}
+
+func TestWithHint(t *testing.T) {
+	tests := []struct {
+		name  string
+		value string
+		key   string
+		ip    string
+		want  string
+	}{
+		{name: "empty", key: "ipv4hint", ip: "192.0.2.1", want: `ipv4hint="192.0.2.1"`},
+		{name: "ordered by key", value: `alpn="h2" ech="abc" ipv6hint="2001:db8::1"`, key: "ipv4hint", ip: "192.0.2.1", want: `alpn="h2" ipv4hint="192.0.2.1" ech="abc" ipv6hint="2001:db8::1"`},
+		{name: "replaced", value: `alpn="h2" ipv4hint="192.0.2.1" port=8443`, key: "ipv4hint", ip: "192.0.2.2", want: `alpn="h2" port=8443 ipv4hint="192.0.2.2"`},
+		{name: "removed", value: `alpn="h2" ipv6hint="2001:db8::1" key65=1`, key: "ipv6hint", want: `alpn="h2" key65=1`},
+		{name: "before unknown keys", value: `alpn="h2" key65=1`, key: "ipv6hint", ip: "2001:db8::1", want: `alpn="h2" ipv6hint="2001:db8::1" key65=1`},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := withHint(test.value, test.key, test.ip); got != test.want {
+				t.Errorf("withHint = %s, want %s", got, test.want)
+			}
+		})
+	}
+}
+
+func TestSameHint(t *testing.T) {
+	if !sameHint("2001:db8:0::1", "2001:db8::1") {
+		t.Error("sameHint of two forms of an address = false, want true")
+	}
+
+	if sameHint("192.0.2.1", "192.0.2.2") || sameHint("", "192.0.2.1") || !sameHint("", "") {
+		t.Error("sameHint of different addresses = true, want false")
+	}
+}
+
+func TestHints(t *testing.T) {
+	fake := newFakeCloudflare(t, testZone)
+	fake.add(testZoneId, cf.DNSRecord{
+		Type: "HTTPS",
+		Name: "home.example.com",
+		TTL:  120,
+		Data: map[string]any{"priority": 1, "target": ".", "value": `alpn="h2,h3" ipv4hint="192.0.2.1"`},
+	})
+
+	u := newTestUpdater(t, fake, nil,
+		Record{Name: "home.example.com", IpVersion: 4, Type: "HTTPS", RecordOptions: RecordOptions{Withdraw: util.WithdrawDelete}},
+		Record{Name: "home.example.com", IpVersion: 6, Type: "HTTPS"},
+	)
+
+	value := func() string {
+		records := fake.list(testZoneId, "HTTPS")
+
+		if len(records) != 1 {
+			t.Fatalf("records = %+v, want the HTTPS record", records)
+		}
+
+		data, err := parseSvcbData(records[0])
+
+		if err != nil || data.Priority != 1 || data.Target != "." {
+			t.Fatalf("data = %+v, %v, want the priority and target kept", data, err)
+		}
+
+		return data.Value
+	}
+
+	u.Handle(ipv4Update("192.0.2.2"))
+	u.Handle(&util.IpUpdate{Source: "home", IpVersion: 6, Ip: net.ParseIP("2001:db8::1")})
+
+	if got := value(); got != `alpn="h2,h3" ipv4hint="192.0.2.2" ipv6hint="2001:db8::1"` {
+		t.Errorf("value = %s, want both hints", got)
+	}
+
+	// A withdrawn address only removes its hint, the record is kept
+	u.Handle(&util.IpUpdate{Source: "home", IpVersion: 4, Withdrawn: true})
+
+	if got := value(); got != `alpn="h2,h3" ipv6hint="2001:db8::1"` {
+		t.Errorf("value = %s, want the IPv6 hint", got)
+	}
+
+	if writes := fake.writes(); len(writes) != 3 {
+		t.Errorf("requests = %v, want three updates", writes)
+	}
+}
+
+func TestHintsWithoutRecord(t *testing.T) {
+	fake := newFakeCloudflare(t, testZone)
+	u := newTestUpdater(t, fake, nil, Record{Name: "home.example.com", IpVersion: 4, Type: "HTTPS"})
+
+	u.Handle(ipv4Update("192.0.2.2"))
+
+	// The HTTPS record isn't created
+	if writes := fake.writes(); len(writes) != 0 {
+		t.Errorf("requests = %v, want none", writes)
+	}
+
+	if action := u.actions[0]; action.status.Succeeded {
+		t.Errorf("status = %+v, want it failed", action.status)
+	}
+}
@@ -2,58 +2,157 @@ package cloudflare
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	cf "github.com/cloudflare/cloudflare-go"
+	"github.com/cromefire/fritzbox-cloudflare-dyndns/pkg/notify"
+	"github.com/cromefire/fritzbox-cloudflare-dyndns/pkg/state"
 	"github.com/cromefire/fritzbox-cloudflare-dyndns/pkg/util"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
-	"golang.org/x/net/publicsuffix"
 	"log/slog"
 	"net"
+	"slices"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
+const (
+	// DefaultWorkers is the number of zones updated at once if not configured
+	DefaultWorkers = 4
+	// DefaultTimeout is the deadline of the requests of an action if not configured
+	DefaultTimeout = time.Minute
+)
+
 type Action struct {
 	DnsRecord string
 	CfZoneId  string
-	IpVersion uint8
+	// Zone is the configured zone name or ID, found by the record name if empty
+	Zone string
+	// Credential is the configured credential name, the one that can access
+	// the zone if empty
+	Credential string
+	IpVersion  uint8
+	// Type is HTTPS or SVCB to maintain the address hints, the A or AAAA
+	// record if empty
+	Type    string
+	Options RecordOptions
+	// Source restricts the action to updates of one source, any if empty
+	Source string
+	// InterfaceId makes the action publish the address of a device in the IPv6 prefix
+	InterfaceId net.IP
 
+	// last is the most recently published address
+	last    string
 	updates prometheus.Summary
 	status  *util.UpdateStatus
+	// retry is the pending retry of a failed update
+	retry *util.RetryStatus
+	// retrying is whether there is a retry, for the metrics which are read
+	// without the workLock
+	retrying atomic.Bool
+	// recordIds are the IDs of the records last published to
+	recordIds []string
+	// credential is the credential the records are published with
+	credential *credential
 }
 
 type Updater struct {
-	ipv4Zones []string
-	ipv6Zones []string
+	records []Record
+
+	actions     []*Action
+	actionsLock sync.RWMutex
+	// workLock is held while updates are processed
+	workLock sync.Mutex
+	// lastUpdates holds the most recent update per source and IP version
+	lastUpdates map[string]*util.IpUpdate
+
+	isInit   bool
+	log      *slog.Logger
+	notifier *notify.Notifier
+	store    *state.Store
+
+	credentials []*credential
+	// credentialsLock guards the statuses of the credentials and zones
+	credentialsLock sync.Mutex
+
+	// writeProbe probes the write access to the zones when they are verified
+	writeProbe bool
+	// failFast fails the initialization if permissions are missing
+	failFast bool
+	// zoneStatuses are the verified permissions by credential and zone ID
+	zoneStatuses map[string]*util.ZoneStatus
+	permissions  *prometheus.GaugeVec
+
+	reconcileInterval time.Duration
+	drifts            *prometheus.CounterVec
+
+	// workers is the number of zones updated at once
+	workers int
+	// timeout is the deadline of the requests of an action
+	timeout time.Duration
+
+	// ownership is how the records of the updater are marked
+	ownership Ownership
+	ownerId   string
+	conflicts *prometheus.CounterVec
+
+	duplicates *prometheus.CounterVec
 
-	actions []*Action
+	// heartbeatLabel is the label of the heartbeat records in the zones, none
+	// are written if empty
+	heartbeatLabel    string
+	heartbeatInterval time.Duration
+	// instance names the updater in the heartbeat records
+	instance       string
+	heartbeats     map[string]*heartbeat
+	heartbeatsLock sync.Mutex
 
-	isInit bool
-	api    *cf.API
-	log    *slog.Logger
+	// zonesLock guards the accessible zones of the credentials
+	zonesLock           sync.Mutex
+	zoneRefreshInterval time.Duration
 
-	In chan *net.IP
+	// changeLock serializes the calls of onChange
+	changeLock sync.Mutex
 
-	lastIpv4 *net.IP
-	lastIpv6 *net.IP
+	// dryRun only reports the changes without making them
+	dryRun   bool
+	onChange func(change util.Change)
 
-	subsystem string
+	In chan *util.IpUpdate
+
+	// name is the name of the provider, which tells apart the metrics of
+	// several Cloudflare providers
+	name       string
+	subsystem  string
+	registerer prometheus.Registerer
 }
 
-func NewUpdater(log *slog.Logger, subsystem string) *Updater {
+func NewUpdater(log *slog.Logger, name string, subsystem string) *Updater {
 	return &Updater{
-		isInit:    false,
-		In:        make(chan *net.IP, 10),
-		log:       log.With(slog.String("module", "cloudflare")),
-		ipv4Zones: make([]string, 0),
-		ipv6Zones: make([]string, 0),
-		subsystem: subsystem,
+		isInit:      false,
+		In:          make(chan *util.IpUpdate, 10),
+		log:         log.With(slog.String("module", "cloudflare")),
+		records:     make([]Record, 0),
+		lastUpdates: make(map[string]*util.IpUpdate),
+
+		zoneStatuses: make(map[string]*util.ZoneStatus),
+		heartbeats:   make(map[string]*heartbeat),
+		workers:      DefaultWorkers,
+		timeout:      DefaultTimeout,
+
+		zoneRefreshInterval: DefaultZoneRefreshInterval,
+		name:                name,
+		subsystem:           subsystem,
+		registerer:          prometheus.DefaultRegisterer,
 	}
 }
 
-func (u Updater) makeSummary(labels prometheus.Labels) prometheus.Summary {
-	return promauto.NewSummary(prometheus.SummaryOpts{
+// makeSummary creates the summary of an action, it has to be registered separately.
+func (u *Updater) makeSummary(labels prometheus.Labels) prometheus.Summary {
+	return prometheus.NewSummary(prometheus.SummaryOpts{
 		Subsystem:   util.MakePromSubsystem(u.subsystem),
 		Name:        "update_seconds",
 		Help:        "A summary of the push server executions",
@@ -62,234 +161,933 @@ func (u Updater) makeSummary(labels prometheus.Labels) prometheus.Summary {
 	})
 }
 
-func (u *Updater) SetIPv4Zones(zones string) {
-	u.ipv4Zones = strings.Split(zones, ",")
+// SetRegisterer sets where the metrics are registered, the default registry if
+// not called. It has to be called before the updater is initialized.
+func (u *Updater) SetRegisterer(registerer prometheus.Registerer) {
+	u.registerer = registerer
+}
+
+// AddRecord adds a record to update, it has to be called before the updater is initialized.
+func (u *Updater) AddRecord(record Record) {
+	u.records = append(u.records, record)
+}
+
+func (u *Updater) SetNotifier(notifier *notify.Notifier) {
+	u.notifier = notifier
+}
+
+// SetStore sets where the state of the records is kept across restarts.
+func (u *Updater) SetStore(store *state.Store) {
+	u.store = store
+}
+
+// SetDryRun makes the updater only report the changes it would make.
+func (u *Updater) SetDryRun(dryRun bool) {
+	u.dryRun = dryRun
+}
+
+// SetChangeHandler sets a function called with every planned change, the
+// calls are serialized even if zones are updated concurrently.
+func (u *Updater) SetChangeHandler(handler func(change util.Change)) {
+	u.onChange = handler
+}
+
+// SetWorkers sets the number of zones updated at once, the default if not positive.
+func (u *Updater) SetWorkers(workers int) {
+	if workers <= 0 {
+		workers = DefaultWorkers
+	}
+
+	u.workers = workers
 }
 
-func (u *Updater) SetIPv6Zones(zones string) {
-	u.ipv6Zones = strings.Split(zones, ",")
+// SetTimeout sets the deadline of the requests of an action, the default if
+// not positive.
+func (u *Updater) SetTimeout(timeout time.Duration) {
+	if timeout <= 0 {
+		timeout = DefaultTimeout
+	}
+
+	u.timeout = timeout
 }
 
 func (u *Updater) InitWithToken(token string) (error, []*util.UpdateStatus) {
-	api, err := cf.NewWithAPIToken(token)
+	err := u.AddCredential(Credential{Token: token})
 
 	if err != nil {
 		return err, nil
 	}
 
-	return u.init(api)
+	return u.Init()
 }
 
 func (u *Updater) InitWithKey(email string, key string) (error, []*util.UpdateStatus) {
-	api, err := cf.New(key, email)
+	err := u.AddCredential(Credential{Email: email, Key: key})
 
 	if err != nil {
 		return err, nil
 	}
 
-	return u.init(api)
+	return u.Init()
 }
 
-func (u *Updater) init(api *cf.API) (error, []*util.UpdateStatus) {
-	// Create unique list of zones and fetch their Cloudflare zone IDs
-	zoneIdMap := make(map[string]string)
+// Init resolves the zones and credentials of the records with the added
+// credentials.
+func (u *Updater) Init() (error, []*util.UpdateStatus) {
+	if len(u.credentials) == 0 {
+		return errors.New("no credentials"), nil
+	}
+
+	err := u.verifyCredentials()
 
-	for _, val := range u.ipv4Zones {
-		zoneIdMap[val] = ""
+	if err != nil && u.failFast {
+		return err, nil
 	}
 
-	for _, val := range u.ipv6Zones {
-		zoneIdMap[val] = ""
+	targets, err := u.resolveTargets(u.records)
+
+	if err != nil {
+		return err, nil
 	}
 
-	for val := range zoneIdMap {
-		zone, err := publicsuffix.EffectiveTLDPlusOne(val)
+	// All collectors exist before the first update or retry can run
+	factory := promauto.With(u.registerer)
 
-		if err != nil {
-			return err, nil
-		}
+	u.permissions = factory.NewGaugeVec(prometheus.GaugeOpts{
+		Subsystem:   util.MakePromSubsystem(u.subsystem),
+		Name:        "zone_permissions_verified",
+		Help:        "Whether the credential has the permissions the records of the zone need, 1 if so",
+		ConstLabels: prometheus.Labels{"provider": u.name},
+	}, []string{"zone", "credential"})
 
-		id, err := api.ZoneIDByName(zone)
+	u.drifts = factory.NewCounterVec(prometheus.CounterOpts{
+		Subsystem:   util.MakePromSubsystem(u.subsystem),
+		Name:        "drift_detected_total",
+		Help:        "The number of times a record was found changed or missing",
+		ConstLabels: prometheus.Labels{"provider": u.name},
+	}, []string{"record", "ip_version", "type"})
 
-		if err != nil {
-			return err, nil
-		}
+	u.conflicts = factory.NewCounterVec(prometheus.CounterOpts{
+		Subsystem:   util.MakePromSubsystem(u.subsystem),
+		Name:        "ownership_conflicts_total",
+		Help:        "The number of times a record was left untouched because it isn't owned by the updater",
+		ConstLabels: prometheus.Labels{"provider": u.name},
+	}, []string{"record", "type"})
 
-		zoneIdMap[val] = id
-	}
+	u.duplicates = factory.NewCounterVec(prometheus.CounterOpts{
+		Subsystem:   util.MakePromSubsystem(u.subsystem),
+		Name:        "duplicates_total",
+		Help:        "The number of times several records were found for a name, by the policy applied",
+		ConstLabels: prometheus.Labels{"provider": u.name},
+	}, []string{"record", "type", "policy"})
+
+	factory.NewGaugeFunc(prometheus.GaugeOpts{
+		Subsystem:   util.MakePromSubsystem(u.subsystem),
+		Name:        "pending_retries",
+		Help:        "The number of failed updates waiting for a retry",
+		ConstLabels: prometheus.Labels{"provider": u.name},
+	}, u.pendingRetries)
 
 	statusVec := []*util.UpdateStatus{}
 
 	// Now create an updater action list
-	for _, val := range u.ipv4Zones {
-		zoneId := zoneIdMap[val]
-		labels := prometheus.Labels{"record": val, "ip_version": "4"}
-		updates := u.makeSummary(labels)
-		status := util.UpdateStatus{Domain: val, IpVersion: 4, Succeeded: true}
-		statusVec = append(statusVec, &status)
-
-		a := &Action{
-			DnsRecord: val,
-			CfZoneId:  zoneId,
-			IpVersion: 4,
-			updates:   updates,
-			status:    &status,
-		}
+	for i, val := range u.records {
+		a := u.newAction(val, targets[i])
+		u.registerer.MustRegister(a.updates)
+		statusVec = append(statusVec, a.status)
 
 		u.actions = append(u.actions, a)
 	}
 
-	for _, val := range u.ipv6Zones {
-		zoneId := zoneIdMap[val]
-		labels := prometheus.Labels{"record": val, "ip_version": "6"}
-		updates := u.makeSummary(labels)
-		status := util.UpdateStatus{Domain: val, IpVersion: 4, Succeeded: true}
-		statusVec = append(statusVec, &status)
+	err = u.verifyZones(u.actions)
 
-		a := &Action{
-			DnsRecord: val,
-			CfZoneId:  zoneId,
-			IpVersion: 6,
-			updates:   updates,
-			status:    &status,
-		}
+	if err != nil && u.failFast {
+		return err, nil
+	}
 
-		u.actions = append(u.actions, a)
+	// The retries of the previous run are armed by StartWorker
+	for _, a := range u.actions {
+		u.restore(a)
 	}
 
-	u.api = api
 	u.isInit = true
 
 	return nil, statusVec
 }
 
+func (u *Updater) newAction(record Record, t target) *Action {
+	a := &Action{
+		DnsRecord:   record.Name,
+		CfZoneId:    t.zoneId,
+		Zone:        record.Zone,
+		Credential:  record.Credential,
+		credential:  t.credential,
+		IpVersion:   record.IpVersion,
+		Type:        record.Type,
+		Options:     record.RecordOptions,
+		Source:      record.Source,
+		InterfaceId: record.InterfaceId,
+		status:      &util.UpdateStatus{Provider: u.name, Domain: record.Name, IpVersion: record.IpVersion, Type: record.Type, Succeeded: true},
+	}
+
+	a.updates = u.makeSummary(prometheus.Labels{"provider": u.name, "record": record.Name, "ip_version": fmt.Sprint(record.IpVersion), "type": a.recordType()})
+
+	return a
+}
+
+// record returns the definition the action was created from.
+func (a *Action) record() Record {
+	return Record{
+		Name:          a.DnsRecord,
+		IpVersion:     a.IpVersion,
+		Type:          a.Type,
+		Zone:          a.Zone,
+		Credential:    a.Credential,
+		Source:        a.Source,
+		InterfaceId:   a.InterfaceId,
+		RecordOptions: a.Options,
+	}
+}
+
+// Statuses returns the statuses of all current actions.
+func (u *Updater) Statuses() []*util.UpdateStatus {
+	u.actionsLock.RLock()
+	defer u.actionsLock.RUnlock()
+
+	statusVec := make([]*util.UpdateStatus, 0, len(u.actions))
+	for _, action := range u.actions {
+		statusVec = append(statusVec, action.status)
+	}
+
+	return statusVec
+}
+
 func (u *Updater) StartWorker() {
 	if !u.isInit {
 		return
 	}
 
+	// Retries of the previous run only run once the updater is set up
+	for _, action := range u.currentActions() {
+		if action.retry != nil {
+			u.armRetry(action, action.retry)
+		}
+	}
+
 	go u.spawnWorker()
 }
 
 func (u *Updater) spawnWorker() {
+	// A nil channel disables reconciliation
+	var reconcile <-chan time.Time
+
+	if u.reconcileInterval > 0 {
+		ticker := time.NewTicker(u.reconcileInterval)
+		defer ticker.Stop()
+		reconcile = ticker.C
+	}
+
+	zoneRefresh := time.NewTicker(u.zoneRefreshInterval)
+	defer zoneRefresh.Stop()
+
 	for {
 		select {
-		case ip := <-u.In:
-			if ip.To4() == nil {
-				if u.lastIpv6 != nil && u.lastIpv6.Equal(*ip) {
-					continue
-				}
-			} else {
-				if u.lastIpv4 != nil && u.lastIpv4.Equal(*ip) {
-					continue
+		case update := <-u.In:
+			u.log.Info("Received update request", slog.String("source", update.Source), slog.Any("ip", update.Ip), slog.Any("prefix", update.Prefix))
+
+			u.Handle(update)
+		case <-reconcile:
+			u.Reconcile()
+		case <-zoneRefresh.C:
+			u.RefreshZones()
+		}
+	}
+}
+
+// Handle publishes the update to the records and returns once it's done.
+func (u *Updater) Handle(update *util.IpUpdate) {
+	u.workLock.Lock()
+	defer u.workLock.Unlock()
+
+	u.lastUpdates[lastUpdateKey(update)] = update
+	u.handle(update, u.currentActions())
+}
+
+// handle runs the actions matching the update, the caller has to hold the workLock.
+func (u *Updater) handle(update *util.IpUpdate, actions []*Action) {
+	jobs := make([]job, 0, len(actions))
+
+	for _, action := range actions {
+		// Skip actions mismatching IP version or source
+		if action.IpVersion != update.IpVersion || (action.Source != "" && action.Source != update.Source) {
+			continue
+		}
+
+		content, ok := update.Content(action.InterfaceId, action.Options.Withdraw, action.Options.Fallback)
+
+		// Skip if the update lacks the information for this action or nothing changed
+		if !ok || (content != "" && action.last == content) {
+			continue
+		}
+
+		// A failed update of the same address is left to its retry
+		if action.retry != nil && action.retry.Content == content {
+			continue
+		}
+
+		jobs = append(jobs, job{action: action, content: content})
+	}
+
+	u.publish(jobs...)
+}
+
+// job is an address to publish to the records of an action, an empty content
+// deletes them as the address was withdrawn.
+type job struct {
+	action  *Action
+	content string
+}
+
+// publish publishes the jobs of up to workers zones at once and schedules
+// retries for the failed ones, the caller has to hold the workLock. It only
+// returns once all jobs are done, so a record never sees an older address
+// after a newer one.
+func (u *Updater) publish(jobs ...job) {
+	u.eachZone(jobs, u.publishZone)
+}
+
+// eachZone groups the jobs by zone and credential and runs fn for up to
+// workers zones at once.
+func (u *Updater) eachZone(jobs []job, fn func(c *credential, zoneId string, jobs []job)) {
+	zones := make([]string, 0)
+	byZone := make(map[string][]job)
+
+	for _, j := range jobs {
+		key := j.action.credential.name + "/" + j.action.CfZoneId
+
+		if _, ok := byZone[key]; !ok {
+			zones = append(zones, key)
+		}
+
+		byZone[key] = append(byZone[key], j)
+	}
+
+	run := func(key string) {
+		jobs := byZone[key]
+		fn(jobs[0].action.credential, jobs[0].action.CfZoneId, jobs)
+	}
+
+	// A single zone doesn't need a goroutine
+	if len(zones) == 1 {
+		run(zones[0])
+		return
+	}
+
+	workers := make(chan struct{}, u.workers)
+	var wg sync.WaitGroup
+
+	for _, key := range zones {
+		workers <- struct{}{}
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+			defer func() { <-workers }()
+
+			run(key)
+		}()
+	}
+
+	wg.Wait()
+}
+
+func (u *Updater) publishZone(c *credential, zoneId string, jobs []job) {
+	start := time.Now()
+	errs := u.applyZone(c, zoneId, jobs)
+	duration := time.Since(start)
+
+	for i, j := range jobs {
+		// The PTR records live in their own zones, they follow the record
+		if errs[i] == nil && j.action.Options.Ptr {
+			errs[i] = u.applyPtr(j.action, j.content)
+		}
+
+		u.finish(j, errs[i], duration)
+	}
+
+	u.beat(c, zoneId)
+}
+
+// finish records the result of a job and schedules a retry if it failed.
+func (u *Updater) finish(j job, err error, duration time.Duration) {
+	action := j.action
+	defer u.saveState(action)
+
+	action.status.Last = time.Now()
+	action.status.Succeeded = err == nil
+
+	event := notify.Event{
+		Provider:  u.name,
+		Domain:    action.DnsRecord,
+		IpVersion: action.IpVersion,
+		Content:   j.content,
+	}
+
+	if err != nil {
+		action.status.LastFailure = action.status.Last
+		u.actionLog(action).Error("Action failed", util.ErrorAttr(err))
+
+		event.Type = notify.EventUpdateFailed
+		event.Error = err.Error()
+		u.notifier.Notify(event)
+
+		u.scheduleRetry(action, j.content, err)
+		return
+	}
+
+	action.status.LastSuccess = action.status.Last
+	action.updates.Observe(duration.Seconds())
+
+	event.Type = notify.EventUpdateSucceeded
+	if j.content == "" {
+		event.Type = notify.EventRecordsWithdrawn
+	}
+	u.notifier.Notify(event)
+
+	// Supersedes the retry of an older address as well
+	action.setRetry(nil)
+	action.last = j.content
+}
+
+// actionLog creates a detailed sub-logger for the action.
+func (u *Updater) actionLog(action *Action) *slog.Logger {
+	return u.log.With(slog.String("domain", actionKey(action.DnsRecord, action.Type, action.IpVersion)))
+}
+
+func (u *Updater) scheduleRetry(action *Action, content string, err error) {
+	retry := util.NextRetry(action.retry, content, err, action.credential.rateLimit.LimitedUntil())
+	action.setRetry(retry)
+
+	u.log.Info("Retrying update", slog.String("domain", action.DnsRecord), slog.Int("attempt", retry.Attempt), slog.Time("next", retry.Next))
+
+	u.armRetry(action, retry)
+}
+
+// armRetry runs the retry when it's due.
+func (u *Updater) armRetry(action *Action, retry *util.RetryStatus) {
+	time.AfterFunc(time.Until(retry.Next), func() {
+		u.workLock.Lock()
+		defer u.workLock.Unlock()
+
+		// Skip retries that were superseded or whose record was removed
+		if action.retry != retry || !slices.Contains(u.currentActions(), action) {
+			return
+		}
+
+		u.publish(job{action: action, content: retry.Content})
+	})
+}
+
+// setRetry sets the pending retry of the action, nil if there is none. The
+// caller has to hold the workLock.
+func (a *Action) setRetry(retry *util.RetryStatus) {
+	a.retry = retry
+	a.status.Retry = retry
+	a.retrying.Store(retry != nil)
+}
+
+func (u *Updater) pendingRetries() float64 {
+	pending := 0
+
+	for _, action := range u.currentActions() {
+		if action.retrying.Load() {
+			pending++
+		}
+	}
+
+	return float64(pending)
+}
+
+func (u *Updater) currentActions() []*Action {
+	u.actionsLock.RLock()
+	defer u.actionsLock.RUnlock()
+
+	return slices.Clone(u.actions)
+}
+
+func lastUpdateKey(update *util.IpUpdate) string {
+	return fmt.Sprintf("%s/%d", update.Source, update.IpVersion)
+}
+
+func (a *Action) recordType() string {
+	if a.Type != "" {
+		return a.Type
+	}
+
+	if a.IpVersion == 6 {
+		return "AAAA"
+	}
+
+	return "A"
+}
+
+// plannedChange is a change with the request that makes it, if any.
+type plannedChange struct {
+	util.Change
+	create *cf.CreateDNSRecordParams
+	update *cf.UpdateDNSRecordParams
+	// delete is the ID of the record to delete
+	delete string
+}
+
+// writes reports whether the change needs a request.
+func (c plannedChange) writes() bool {
+	return c.create != nil || c.update != nil || c.delete != ""
+}
+
+// listZone lists the records of the zone with the types of the jobs.
+func (u *Updater) listZone(ctx context.Context, c *credential, zoneId string, jobs []job) ([]cf.DNSRecord, error) {
+	types := make([]string, 0, 3)
+	for _, j := range jobs {
+		if !slices.Contains(types, j.action.recordType()) {
+			types = append(types, j.action.recordType())
+		}
+	}
+
+	if u.ownership == OwnershipTxt {
+		// A withdrawal only deletes the ownership record if no records of the
+		// other IP version are left
+		if slices.ContainsFunc(jobs, func(j job) bool { return j.content == "" }) {
+			for _, recordType := range []string{"A", "AAAA"} {
+				if !slices.Contains(types, recordType) {
+					types = append(types, recordType)
 				}
 			}
-			u.log.Info("Received update request", slog.Any("ip", ip))
+		}
 
-			for _, action := range u.actions {
-				timer := prometheus.NewTimer(action.updates)
+		types = append(types, "TXT")
+	}
 
-				// Skip IPv6 action mismatching IP version
-				if ip.To4() == nil && action.IpVersion != 6 {
-					continue
-				}
+	existing := make([]cf.DNSRecord, 0)
 
-				// Skip IPv4 action mismatching IP version
-				if ip.To4() != nil && action.IpVersion == 6 {
-					continue
-				}
+	for _, recordType := range types {
+		records, _, err := c.api.ListDNSRecords(ctx, cf.ZoneIdentifier(zoneId), cf.ListDNSRecordsParams{Type: recordType})
+		u.observe(c, err)
+
+		if err != nil {
+			return nil, fmt.Errorf("could not research DNS records: %w", err)
+		}
 
-				// Create detailed sub-logger for this action
-				alog := u.log.With(slog.String("domain", fmt.Sprintf("%s/IPv%d", action.DnsRecord, action.IpVersion)))
+		existing = append(existing, records...)
+	}
 
-				// Decide record type on ip version
-				var recordType string
+	return existing, nil
+}
 
-				if ip.To4() == nil {
-					recordType = "AAAA"
-				} else {
-					recordType = "A"
-				}
+// matching returns the records with the type and name.
+func matching(existing []cf.DNSRecord, recordType string, name string) []cf.DNSRecord {
+	records := make([]cf.DNSRecord, 0, 1)
 
-				ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	for _, record := range existing {
+		if record.Type == recordType && strings.EqualFold(record.Name, strings.TrimSuffix(name, ".")) {
+			records = append(records, record)
+		}
+	}
 
-				rc := cf.ZoneIdentifier(action.CfZoneId)
+	return records
+}
 
-				// Research all current records matching the current scheme
-				records, _, err := u.api.ListDNSRecords(ctx, rc, cf.ListDNSRecordsParams{
-					Type: recordType,
-					Name: action.DnsRecord,
-				})
+// plan compares the records of the action among the existing records of its
+// zone against the content. Records not owned by the updater are reported as
+// conflicts and left untouched.
+func (u *Updater) plan(action *Action, existing []cf.DNSRecord, content string) []plannedChange {
+	if isHintType(action.recordType()) {
+		return u.planHints(action, existing, content)
+	}
 
-				if err != nil {
-					alog.Error("Action failed, could not research DNS records", util.ErrorAttr(err))
-					action.status.Last = time.Now()
-					action.status.Succeeded = false
-					continue
-				}
+	if content == "" {
+		return u.planWithdrawal(action, existing)
+	}
 
-				// Create record if none were found
-				if len(records) == 0 {
-					alog.Info("Creating DNS record")
-
-					proxied := false
-
-					_, err := u.api.CreateDNSRecord(ctx, rc, cf.CreateDNSRecordParams{
-						Type:    recordType,
-						Name:    action.DnsRecord,
-						Content: ip.String(),
-						Proxied: &proxied,
-						TTL:     120,
-					})
-
-					if err != nil {
-						alog.Error("Action failed, could not create DNS record", util.ErrorAttr(err))
-						action.status.Last = time.Now()
-						action.status.Succeeded = false
-						continue
-					}
-				}
+	recordType := action.recordType()
+	options := u.options(action)
+	records := matching(existing, recordType, action.DnsRecord)
 
-				// Update existing records
-				for _, record := range records {
-					alog.Info("Updating DNS record", slog.Any("record-id", record.ID))
-
-					if record.Content == ip.String() {
-						action.status.Last = time.Now()
-						action.status.Succeeded = true
-						continue
-					}
-
-					// Ensure we submit all required fields even if they did not change,otherwise
-					// cloudflare-go might revert them to default values.
-					_, err := u.api.UpdateDNSRecord(ctx, rc, cf.UpdateDNSRecordParams{
-						ID:      record.ID,
-						Content: ip.String(),
-						TTL:     record.TTL,
-						Proxied: record.Proxied,
-					})
-
-					if err != nil {
-						alog.Error("Action failed, could not update DNS record", util.ErrorAttr(err))
-						action.status.Last = time.Now()
-						action.status.Succeeded = false
-						continue
-					}
-				}
+	base := util.Change{Provider: u.name, Domain: action.DnsRecord, Type: recordType, Content: content}
+
+	changes := make([]plannedChange, 0, len(records)+1)
+	owned := make([]cf.DNSRecord, 0, len(records))
+
+	for _, record := range records {
+		if u.owns(record, existing) {
+			owned = append(owned, record)
+			continue
+		}
+
+		change := base
+		change.RecordId = record.ID
+		change.Action = util.ChangeConflict
+		change.Details = []string{fmt.Sprintf("not owned by %s, adopt it to take ownership", u.ownerId)}
+		changes = append(changes, plannedChange{Change: change})
+	}
+
+	// Create record if none were found, but never next to foreign ones
+	if len(records) == 0 {
+		change := base
+		change.Action = util.ChangeCreate
+		params := u.createParams(action, content)
+		changes = append(changes, plannedChange{Change: change, create: &params})
+
+		return append(changes, u.planOwnershipRecord(action.DnsRecord, existing)...)
+	}
+
+	keep := ""
+	if len(owned) > 1 && options.Duplicates == DuplicatesKeepOne {
+		keep = keeper(action, owned, content).ID
+	}
+
+	for _, record := range owned {
+		change := plannedChange{Change: base}
+		change.RecordId = record.ID
+		change.Action = util.ChangeNoop
+
+		if len(owned) > 1 {
+			change.Details = append(change.Details, fmt.Sprintf("duplicate record, %d in total", len(owned)))
+		}
+
+		switch {
+		case len(owned) > 1 && options.Duplicates == DuplicatesFail:
+			change.Action = util.ChangeDuplicate
+			changes = append(changes, change)
+			continue
+		case keep != "" && record.ID != keep:
+			change.Action = util.ChangeDelete
+			change.Content = record.Content
+			change.Details = append(change.Details, "keeping "+keep)
+			change.delete = record.ID
+			changes = append(changes, change)
+			continue
+		}
+
+		fixed, kept := options.drift(record, content)
+
+		if len(fixed) > 0 {
+			change.Action = util.ChangeUpdate
+			params := options.updateParams(record, content)
+			change.update = &params
+		}
+
+		change.Details = append(change.Details, fixed...)
+		for _, difference := range kept {
+			change.Details = append(change.Details, difference+" (not enforced)")
+		}
+
+		changes = append(changes, change)
+	}
+
+	return changes
+}
+
+// planWithdrawal plans deleting the records of the action and, once no
+// records of the name are left, their ownership record.
+func (u *Updater) planWithdrawal(action *Action, existing []cf.DNSRecord) []plannedChange {
+	changes := make([]plannedChange, 0)
+	deleted := make([]string, 0)
+
+	for _, record := range matching(existing, action.recordType(), action.DnsRecord) {
+		change := plannedChange{Change: util.Change{
+			Action:   util.ChangeDelete,
+			Provider: u.name,
+			Domain:   action.DnsRecord,
+			Type:     record.Type,
+			Content:  record.Content,
+			RecordId: record.ID,
+			Details:  []string{"address withdrawn"},
+		}}
+
+		if u.owns(record, existing) {
+			change.delete = record.ID
+			deleted = append(deleted, record.ID)
+		} else {
+			change.Action = util.ChangeConflict
+			change.Details = []string{fmt.Sprintf("not owned by %s, adopt it to take ownership", u.ownerId)}
+		}
+
+		changes = append(changes, change)
+	}
+
+	// The HTTPS or SVCB records of the name aren't listed with the addresses
+	// but need the ownership record as well
+	if slices.ContainsFunc(u.currentActions(), func(other *Action) bool {
+		return isHintType(other.recordType()) && strings.EqualFold(other.DnsRecord, action.DnsRecord)
+	}) {
+		return changes
+	}
+
+	return append(changes, u.planOwnershipRemoval(action.DnsRecord, existing, deleted)...)
+}
+
+// keeper picks the duplicate record to keep, preferring the one published to
+// before, then one with the content and then the oldest.
+func keeper(action *Action, records []cf.DNSRecord, content string) cf.DNSRecord {
+	records = slices.Clone(records)
+
+	slices.SortStableFunc(records, func(a cf.DNSRecord, b cf.DNSRecord) int {
+		if c := compareBool(slices.Contains(action.recordIds, a.ID), slices.Contains(action.recordIds, b.ID)); c != 0 {
+			return c
+		}
+
+		if c := compareBool(a.Content == content, b.Content == content); c != 0 {
+			return c
+		}
+
+		return a.CreatedOn.Compare(b.CreatedOn)
+	})
+
+	return records[0]
+}
+
+// compareBool sorts true before false.
+func compareBool(a bool, b bool) int {
+	switch {
+	case a == b:
+		return 0
+	case a:
+		return -1
+	default:
+		return 1
+	}
+}
+
+// publishesTo reports whether the change publishes the address of the action.
+func (c plannedChange) publishesTo(action *Action) bool {
+	return c.Type == action.recordType() && slices.Contains([]string{util.ChangeCreate, util.ChangeUpdate, util.ChangeNoop}, c.Action)
+}
+
+// planError returns why the changes don't publish the address of the action,
+// nil if they do.
+func planError(action *Action, changes []plannedChange) error {
+	duplicates := 0
+	for _, change := range changes {
+		if change.Action == util.ChangeDuplicate {
+			duplicates++
+		}
+	}
+
+	if duplicates > 0 {
+		return fmt.Errorf("%d duplicate %s records, remove them or change the duplicates policy", duplicates, action.DnsRecord)
+	}
+
+	if isHintType(action.recordType()) && len(changes) == 0 {
+		return fmt.Errorf("no %s record %s to set the %s of, create it first", action.recordType(), action.DnsRecord, action.hintKey())
+	}
+
+	if !slices.ContainsFunc(changes, func(change plannedChange) bool { return change.publishesTo(action) }) {
+		return fmt.Errorf("all %s records are owned by others, adopt them to take ownership", action.DnsRecord)
+	}
+
+	return nil
+}
+
+// countDuplicates logs and counts if the changes found duplicate records.
+func (u *Updater) countDuplicates(action *Action, changes []plannedChange) {
+	// Several HTTPS or SVCB records of a name are alternatives, not duplicates
+	if isHintType(action.recordType()) {
+		return
+	}
+
+	records := 0
+	for _, change := range changes {
+		if change.Type == action.recordType() && change.RecordId != "" && change.Action != util.ChangeConflict {
+			records++
+		}
+	}
+
+	if records < 2 {
+		return
+	}
+
+	policy := action.Options.Duplicates
+	if policy == "" {
+		policy = DuplicatesUpdateAll
+	}
+
+	u.actionLog(action).Warn("Duplicate records found", slog.Int("records", records), slog.String("policy", string(policy)))
+	u.duplicates.With(prometheus.Labels{"record": action.DnsRecord, "type": action.recordType(), "policy": string(policy)}).Inc()
+}
+
+// applyZone plans and applies the jobs of a zone, the changes are sent as a
+// single batch if possible. It returns the error of every job.
+func (u *Updater) applyZone(c *credential, zoneId string, jobs []job) []error {
+	errs := make([]error, len(jobs))
+
+	// The listing and the batch share a deadline, the individual requests of
+	// every job get their own
+	ctx, cancel := context.WithTimeout(context.Background(), u.timeout)
+	defer cancel()
+
+	existing, err := u.listZone(ctx, c, zoneId, jobs)
+
+	if err != nil {
+		for i := range errs {
+			errs[i] = err
+		}
+
+		return errs
+	}
+
+	planned := make([][]plannedChange, len(jobs))
+	writes := 0
+
+	for i, j := range jobs {
+		planned[i] = u.plan(j.action, existing, j.content)
+		existing = append(updatedRecords(existing, planned[i]), plannedRecords(planned[i])...)
+
+		for _, change := range planned[i] {
+			u.reportChange(u.actionLog(j.action), change.Change)
+
+			if change.writes() {
+				writes++
+			}
+		}
+
+		// Withdrawals don't publish anything
+		if j.content != "" {
+			u.countDuplicates(j.action, planned[i])
+			errs[i] = planError(j.action, planned[i])
+		}
+	}
+
+	if u.dryRun {
+		return errs
+	}
+
+	if writes > 1 {
+		changes := make([]*plannedChange, 0, writes)
+		for i := range planned {
+			for k := range planned[i] {
+				changes = append(changes, &planned[i][k])
+			}
+		}
+
+		err := u.applyBatch(ctx, c, zoneId, changes)
+
+		if err == nil {
+			u.setRecordIds(jobs, planned, errs)
+			return errs
+		}
+
+		u.log.Warn("Batch update failed, falling back to individual requests", slog.String("zone-id", zoneId), util.ErrorAttr(err))
+	}
+
+	for i := range jobs {
+		if errs[i] == nil {
+			errs[i] = u.applyJob(c, zoneId, planned[i])
+		}
+	}
+
+	u.setRecordIds(jobs, planned, errs)
+
+	return errs
+}
+
+// applyJob applies the changes of a job with its own deadline.
+func (u *Updater) applyJob(c *credential, zoneId string, changes []plannedChange) error {
+	ctx, cancel := context.WithTimeout(context.Background(), u.timeout)
+	defer cancel()
+
+	return u.applyChanges(ctx, c, zoneId, changes)
+}
+
+// applyChanges makes the changes one request at a time and sets the IDs of the
+// created records.
+func (u *Updater) applyChanges(ctx context.Context, c *credential, zoneId string, changes []plannedChange) error {
+	rc := cf.ZoneIdentifier(zoneId)
+
+	for i, change := range changes {
+		switch {
+		case change.create != nil:
+			record, err := c.api.CreateDNSRecord(ctx, rc, *change.create)
+			u.observe(c, err)
+
+			if err != nil {
+				return fmt.Errorf("could not create DNS record: %w", err)
+			}
 
-				cancel()
+			changes[i].RecordId = record.ID
+		case change.update != nil:
+			_, err := c.api.UpdateDNSRecord(ctx, rc, *change.update)
+			u.observe(c, err)
 
-				action.status.Last = time.Now()
-				action.status.Succeeded = true
+			if err != nil {
+				return fmt.Errorf("could not update DNS record: %w", err)
+			}
+		case change.delete != "":
+			err := c.api.DeleteDNSRecord(ctx, rc, change.delete)
+			u.observe(c, err)
 
-				timer.ObserveDuration()
+			if err != nil {
+				return fmt.Errorf("could not delete DNS record: %w", err)
 			}
+		}
+	}
+
+	return nil
+}
 
-			if ip.To4() == nil {
-				u.lastIpv6 = ip
-			} else {
-				u.lastIpv4 = ip
+// setRecordIds keeps the IDs of the records the successful jobs published to.
+func (u *Updater) setRecordIds(jobs []job, planned [][]plannedChange, errs []error) {
+	for i, j := range jobs {
+		if errs[i] != nil {
+			continue
+		}
+
+		recordIds := make([]string, 0, len(planned[i]))
+		for _, change := range planned[i] {
+			if change.publishesTo(j.action) {
+				recordIds = append(recordIds, change.RecordId)
 			}
 		}
+
+		j.action.recordIds = recordIds
+	}
+}
+
+func (u *Updater) reportChange(alog *slog.Logger, change util.Change) {
+	if u.onChange != nil {
+		u.changeLock.Lock()
+		u.onChange(change)
+		u.changeLock.Unlock()
+	}
+
+	attrs := []any{slog.Any("details", change.Details)}
+	if change.RecordId != "" {
+		attrs = append(attrs, slog.Any("record-id", change.RecordId))
+	}
+
+	switch {
+	case change.Action == util.ChangeCreate && u.dryRun:
+		alog.Info("Would create DNS record", attrs...)
+	case change.Action == util.ChangeCreate:
+		alog.Info("Creating DNS record", attrs...)
+	case change.Action == util.ChangeUpdate && u.dryRun:
+		alog.Info("Would update DNS record", attrs...)
+	case change.Action == util.ChangeUpdate:
+		alog.Info("Updating DNS record", attrs...)
+	case change.Action == util.ChangeConflict:
+		alog.Warn("DNS record is not owned, leaving it untouched", attrs...)
+		u.conflicts.With(prometheus.Labels{"record": change.Domain, "type": change.Type}).Inc()
+	case change.Action == util.ChangeDelete && u.dryRun:
+		alog.Info("Would delete DNS record", attrs...)
+	case change.Action == util.ChangeDelete:
+		alog.Info("Deleting DNS record", attrs...)
+	case change.Action == util.ChangeDuplicate:
+		alog.Warn("Duplicate DNS record, leaving it untouched", attrs...)
+	case change.Action == util.ChangeAdopt && u.dryRun:
+		alog.Info("Would adopt DNS record", attrs...)
+	case change.Action == util.ChangeAdopt:
+		alog.Info("Adopting DNS record", attrs...)
+	case u.dryRun:
+		alog.Info("DNS record is up to date", attrs...)
 	}
 }
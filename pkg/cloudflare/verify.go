@@ -0,0 +1,181 @@
+package cloudflare
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/cromefire/fritzbox-cloudflare-dyndns/pkg/util"
+	"github.com/prometheus/client_golang/prometheus"
+	"log/slog"
+	"slices"
+	"time"
+)
+
+// SetVerification sets whether the write access to the zones is probed and
+// whether missing permissions fail the initialization, it has to be called
+// before the updater is initialized. The write probe creates and deletes a
+// real TXT record in every zone, so it's off by default and never runs in a
+// dry run.
+func (u *Updater) SetVerification(writeProbe bool, failFast bool) {
+	u.writeProbe = writeProbe
+	u.failFast = failFast
+}
+
+// verifyCredentials checks that the tokens are active. API keys can't be
+// verified.
+func (u *Updater) verifyCredentials() error {
+	ctx, cancel := context.WithTimeout(context.Background(), u.timeout)
+	defer cancel()
+
+	errs := make([]error, 0)
+
+	for _, c := range u.credentials {
+		if c.api.APIToken == "" {
+			continue
+		}
+
+		err := VerifyToken(ctx, c.api)
+
+		u.credentialsLock.Lock()
+		c.status.Last = time.Now()
+		c.status.Succeeded = err == nil
+		c.status.Error = ""
+		if err != nil {
+			c.status.Error = err.Error()
+		}
+		u.credentialsLock.Unlock()
+
+		if err != nil {
+			u.log.Error("Token verification failed", slog.String("credential", c.name), util.ErrorAttr(err))
+			errs = append(errs, fmt.Errorf("credential %s: %w", c.name, err))
+			continue
+		}
+
+		u.log.Info("Token verified", slog.String("credential", c.name))
+	}
+
+	return errors.Join(errs...)
+}
+
+// verifyZones checks the permissions of the credentials in the zones of the
+// actions that weren't verified before.
+func (u *Updater) verifyZones(actions []*Action) error {
+	errs := make([]error, 0)
+
+	for _, action := range actions {
+		key := action.credential.name + "/" + action.CfZoneId
+
+		u.credentialsLock.Lock()
+		_, verified := u.zoneStatuses[key]
+		u.credentialsLock.Unlock()
+
+		if verified {
+			continue
+		}
+
+		err := u.verifyZone(key, action.credential, action.CfZoneId)
+
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+func (u *Updater) verifyZone(key string, c *credential, zoneId string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), u.timeout)
+	defer cancel()
+
+	zone := Zone{Id: zoneId}
+
+	u.zonesLock.Lock()
+	if i := slices.IndexFunc(c.zones, func(zone Zone) bool { return zone.Id == zoneId }); i >= 0 {
+		zone = c.zones[i]
+	}
+	u.zonesLock.Unlock()
+
+	status := &util.ZoneStatus{Provider: u.name, Credential: c.name, Zone: zone.Id, Last: time.Now()}
+	zone, err := checkRead(ctx, c.api, zone)
+	status.Read = err == nil
+
+	if zone.Name != "" {
+		status.Zone = zone.Name
+	}
+
+	// The probe record would be a change
+	if err == nil && u.writeProbe && !u.dryRun {
+		err = checkWrite(ctx, c.api, zone)
+		write := err == nil
+		status.Write = &write
+	}
+
+	status.Succeeded = err == nil
+	if err != nil {
+		status.Error = err.Error()
+	}
+
+	u.credentialsLock.Lock()
+	u.zoneStatuses[key] = status
+	u.credentialsLock.Unlock()
+
+	labels := prometheus.Labels{"zone": status.Zone, "credential": c.name}
+	u.permissions.With(labels).Set(gauge(status.Succeeded))
+
+	zlog := u.log.With(slog.String("zone", status.Zone), slog.String("credential", c.name))
+
+	if err != nil {
+		zlog.Error("Missing permissions for zone", slog.Bool("read", status.Read), util.ErrorAttr(err))
+		return fmt.Errorf("zone %s: %w", status.Zone, err)
+	}
+
+	zlog.Info("Permissions for zone verified", slog.Bool("write-probed", status.Write != nil))
+
+	return nil
+}
+
+// pruneZoneStatuses forgets the zones no action is published to anymore.
+func (u *Updater) pruneZoneStatuses() {
+	used := make(map[string]bool)
+	for _, action := range u.currentActions() {
+		used[action.credential.name+"/"+action.CfZoneId] = true
+	}
+
+	u.credentialsLock.Lock()
+	defer u.credentialsLock.Unlock()
+
+	for key, status := range u.zoneStatuses {
+		if !used[key] {
+			delete(u.zoneStatuses, key)
+			u.permissions.Delete(prometheus.Labels{"zone": status.Zone, "credential": status.Credential})
+		}
+	}
+}
+
+// ZoneStatuses returns the permissions of the credentials in the verified
+// zones.
+func (u *Updater) ZoneStatuses() []*util.ZoneStatus {
+	u.credentialsLock.Lock()
+	defer u.credentialsLock.Unlock()
+
+	statuses := make([]*util.ZoneStatus, 0, len(u.zoneStatuses))
+	for _, status := range u.zoneStatuses {
+		copied := *status
+		statuses = append(statuses, &copied)
+	}
+
+	slices.SortFunc(statuses, func(a *util.ZoneStatus, b *util.ZoneStatus) int {
+		return cmp.Or(cmp.Compare(a.Zone, b.Zone), cmp.Compare(a.Credential, b.Credential))
+	})
+
+	return statuses
+}
+
+func gauge(ok bool) float64 {
+	if ok {
+		return 1
+	}
+
+	return 0
+}
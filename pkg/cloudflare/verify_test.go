@@ -0,0 +1,64 @@
+package cloudflare
+
+import (
+	cf "github.com/cloudflare/cloudflare-go"
+	"net/http"
+	"reflect"
+	"slices"
+	"testing"
+)
+
+func TestVerifyZone(t *testing.T) {
+	tests := []struct {
+		name       string
+		writeProbe bool
+		dryRun     bool
+		writes     []string
+	}{
+		{name: "read only"},
+		// The probe of the initialization was record-1
+		{name: "write probe", writeProbe: true, writes: []string{
+			"POST /zones/" + testZoneId + "/dns_records",
+			"DELETE /zones/" + testZoneId + "/dns_records/record-2",
+		}},
+		{name: "write probe in dry run", writeProbe: true, dryRun: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fake := newFakeCloudflare(t, testZone)
+			u := newTestUpdater(t, fake, func(u *Updater) {
+				u.SetVerification(test.writeProbe, false)
+				u.SetDryRun(test.dryRun)
+			}, Record{Name: "home.example.com", IpVersion: 4})
+
+			u.credentialsLock.Lock()
+			clear(u.zoneStatuses)
+			u.credentialsLock.Unlock()
+
+			queries := make([]string, 0)
+			fake.routes["GET /zones/"+testZoneId+"/dns_records"] = func(w http.ResponseWriter, r *http.Request) {
+				queries = append(queries, r.URL.RawQuery)
+				fake.result(w, []cf.DNSRecord{})
+			}
+
+			if err := u.verifyZones(u.actions); err != nil {
+				t.Fatal(err)
+			}
+
+			// The records are read with a single request of a single record
+			if !reflect.DeepEqual(queries, []string{"page=1&per_page=1&type=A"}) {
+				t.Errorf("queries = %v, want a single page of one record", queries)
+			}
+
+			if writes := fake.writes(); !slices.Equal(writes, test.writes) {
+				t.Errorf("requests = %v, want %v", writes, test.writes)
+			}
+
+			status := u.ZoneStatuses()[0]
+			if !status.Succeeded || !status.Read || (status.Write != nil) != (test.writeProbe && !test.dryRun) {
+				t.Errorf("status = %+v, want it verified", status)
+			}
+		})
+	}
+}
@@ -0,0 +1,85 @@
+package cloudflare
+
+import (
+	cf "github.com/cloudflare/cloudflare-go"
+	"github.com/cromefire/fritzbox-cloudflare-dyndns/pkg/util"
+	"net"
+	"reflect"
+	"testing"
+)
+
+func TestWithdraw(t *testing.T) {
+	tests := []struct {
+		withdraw util.WithdrawMode
+		// want are the contents left
+		want []string
+	}{
+		{withdraw: util.WithdrawKeep, want: []string{"192.0.2.1"}},
+		{withdraw: util.WithdrawDelete, want: []string{}},
+		{withdraw: util.WithdrawFallback, want: []string{"198.51.100.1"}},
+	}
+
+	for _, test := range tests {
+		t.Run(string(test.withdraw), func(t *testing.T) {
+			fake := newFakeCloudflare(t, testZone)
+			fake.add(testZoneId, cf.DNSRecord{Type: "A", Name: "home.example.com", Content: "192.0.2.1", TTL: 120})
+
+			u := newTestUpdater(t, fake, nil, Record{
+				Name:          "home.example.com",
+				IpVersion:     4,
+				RecordOptions: RecordOptions{Withdraw: test.withdraw, Fallback: net.ParseIP("198.51.100.1")},
+			})
+
+			u.Handle(&util.IpUpdate{Source: "home", IpVersion: 4, Withdrawn: true})
+
+			contents := make([]string, 0)
+			for _, record := range fake.list(testZoneId, "A") {
+				contents = append(contents, record.Content)
+			}
+
+			if !reflect.DeepEqual(contents, test.want) {
+				t.Errorf("records = %v, want %v", contents, test.want)
+			}
+		})
+	}
+}
+
+func TestPlanWithdrawal(t *testing.T) {
+	fake := newFakeCloudflare(t, testZone)
+	u := newTestUpdater(t, fake, func(u *Updater) { u.SetOwnership(OwnershipTxt, "home") }, Record{
+		Name:          "home.example.com",
+		IpVersion:     4,
+		RecordOptions: RecordOptions{Withdraw: util.WithdrawDelete},
+	})
+
+	owned := cf.DNSRecord{ID: "owned", Type: "A", Name: "home.example.com", Content: "192.0.2.1"}
+	aaaa := cf.DNSRecord{ID: "aaaa", Type: "AAAA", Name: "home.example.com", Content: "2001:db8::1"}
+	txt := cf.DNSRecord{ID: "txt", Type: "TXT", Name: "_dyndns-owner.home.example.com", Content: u.txtMarker()}
+
+	deleted := func(changes []plannedChange) []string {
+		ids := make([]string, 0)
+		for _, change := range changes {
+			if change.Action == util.ChangeDelete {
+				ids = append(ids, change.delete)
+			}
+		}
+
+		return ids
+	}
+
+	// The AAAA record is left alone and still needs the ownership record
+	if ids := deleted(u.planWithdrawal(u.actions[0], []cf.DNSRecord{owned, aaaa, txt})); !reflect.DeepEqual(ids, []string{"owned"}) {
+		t.Errorf("deleted = %v, want the A record", ids)
+	}
+
+	// The ownership record goes with the last record of the name
+	if ids := deleted(u.planWithdrawal(u.actions[0], []cf.DNSRecord{owned, txt})); !reflect.DeepEqual(ids, []string{"owned", "txt"}) {
+		t.Errorf("deleted = %v, want the A and ownership records", ids)
+	}
+
+	// Without the ownership record the A record isn't owned and kept
+	changes := u.planWithdrawal(u.actions[0], []cf.DNSRecord{owned})
+	if len(changes) != 1 || changes[0].Action != util.ChangeConflict || changes[0].delete != "" {
+		t.Errorf("changes = %+v, want a conflict", changes)
+	}
+}
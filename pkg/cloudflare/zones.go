@@ -0,0 +1,281 @@
+package cloudflare
+
+import (
+	"context"
+	"fmt"
+	cf "github.com/cloudflare/cloudflare-go"
+	"github.com/cromefire/fritzbox-cloudflare-dyndns/pkg/util"
+	"log/slog"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+)
+
+// DefaultZoneRefreshInterval is how often the accessible zones are listed again
+// if no interval is configured.
+const DefaultZoneRefreshInterval = time.Hour
+
+var zoneIdPattern = regexp.MustCompile("^[0-9a-f]{32}$")
+
+// Zone is a Cloudflare zone records can be in.
+type Zone struct {
+	Id   string
+	Name string
+}
+
+// IsZoneId reports whether the zone is given by its ID instead of its name.
+func IsZoneId(zone string) bool {
+	return zoneIdPattern.MatchString(strings.ToLower(zone))
+}
+
+// ListZones lists all zones the client can access.
+func ListZones(ctx context.Context, api *cf.API) ([]Zone, error) {
+	res, err := api.ListZones(ctx)
+
+	if err != nil {
+		return nil, fmt.Errorf("could not list zones: %w", err)
+	}
+
+	zones := make([]Zone, 0, len(res))
+	for _, zone := range res {
+		zones = append(zones, Zone{Id: zone.ID, Name: strings.ToLower(zone.Name)})
+	}
+
+	return zones, nil
+}
+
+// ZoneOf returns the zone of the record: the explicit zone, given as name or
+// ID, or else the zone with the longest name the record name ends with, so
+// delegated subzones take precedence over their parent.
+func ZoneOf(name string, explicit string, zones []Zone) (Zone, error) {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	explicit = strings.ToLower(strings.TrimSuffix(explicit, "."))
+
+	if zoneIdPattern.MatchString(explicit) {
+		i := slices.IndexFunc(zones, func(zone Zone) bool { return zone.Id == explicit })
+
+		// Zone IDs work without access to the list of zones
+		if i < 0 {
+			return Zone{Id: explicit}, nil
+		}
+
+		return zones[i], nil
+	}
+
+	if explicit != "" {
+		i := slices.IndexFunc(zones, func(zone Zone) bool { return zone.Name == explicit })
+
+		if i < 0 {
+			return Zone{}, fmt.Errorf("zone %s is not accessible", explicit)
+		}
+
+		return zones[i], nil
+	}
+
+	match := Zone{}
+
+	for _, zone := range zones {
+		if (name == zone.Name || strings.HasSuffix(name, "."+zone.Name)) && len(zone.Name) > len(match.Name) {
+			match = zone
+		}
+	}
+
+	if match.Id == "" {
+		return Zone{}, fmt.Errorf("no accessible zone contains %s", name)
+	}
+
+	return match, nil
+}
+
+// SetZoneRefreshInterval sets how often the accessible zones are listed again
+// to pick up new or re-created zones, the default if not positive. It has to
+// be called before the worker is started.
+func (u *Updater) SetZoneRefreshInterval(interval time.Duration) {
+	if interval <= 0 {
+		interval = DefaultZoneRefreshInterval
+	}
+
+	u.zoneRefreshInterval = interval
+}
+
+// accessibleZones returns the cached zones of the credential, which are listed
+// again if they are older than the refresh interval or refresh is set.
+func (u *Updater) accessibleZones(ctx context.Context, c *credential, refresh bool) ([]Zone, error) {
+	u.zonesLock.Lock()
+	defer u.zonesLock.Unlock()
+
+	if !refresh && c.zones != nil && time.Since(c.zonesListed) < u.zoneRefreshInterval {
+		return c.zones, nil
+	}
+
+	zones, err := ListZones(ctx, c.api)
+	u.observe(c, err)
+
+	if err != nil {
+		return nil, fmt.Errorf("credential %s: %w", c.name, err)
+	}
+
+	c.zones = zones
+	c.zonesListed = time.Now()
+
+	return zones, nil
+}
+
+// target is the zone a record is published to and the credential used for it.
+type target struct {
+	zoneId     string
+	credential *credential
+}
+
+// resolveTargets returns the zone and credential of every record. Records
+// naming a credential only look for their zone among its zones, others use the
+// credential that can access the zone with the longest matching name or, if
+// they have a zone ID, the first credential.
+func (u *Updater) resolveTargets(records []Record) ([]target, error) {
+	targets, errs := u.resolve(records, false)
+
+	for i, err := range errs {
+		if err != nil {
+			return nil, fmt.Errorf("record %s: %w", records[i].Name, err)
+		}
+	}
+
+	return targets, nil
+}
+
+// resolve returns the target or the error of every record, the zones of every
+// credential are listed at most once and again if refresh is set.
+func (u *Updater) resolve(records []Record, refresh bool) ([]target, []error) {
+	ctx, cancel := context.WithTimeout(context.Background(), u.timeout)
+	defer cancel()
+
+	targets := make([]target, len(records))
+	errs := make([]error, len(records))
+
+	listed := make(map[*credential][]Zone)
+	failed := make(map[*credential]error)
+
+	zonesOf := func(c *credential) ([]Zone, error) {
+		if err, ok := failed[c]; ok {
+			return nil, err
+		}
+
+		if zones, ok := listed[c]; ok {
+			return zones, nil
+		}
+
+		zones, err := u.accessibleZones(ctx, c, refresh)
+
+		if err != nil {
+			failed[c] = err
+			return nil, err
+		}
+
+		listed[c] = zones
+		return zones, nil
+	}
+
+	for i, record := range records {
+		targets[i], errs[i] = u.resolveRecord(record, zonesOf)
+	}
+
+	return targets, errs
+}
+
+func (u *Updater) resolveRecord(record Record, zonesOf func(c *credential) ([]Zone, error)) (target, error) {
+	candidates := u.credentials
+
+	if record.Credential != "" {
+		c := u.credential(record.Credential)
+
+		if c == nil {
+			return target{}, fmt.Errorf("unknown credential %s", record.Credential)
+		}
+
+		candidates = []*credential{c}
+	}
+
+	// Records with a zone ID don't need the zones to be listed
+	if IsZoneId(record.Zone) {
+		zone, _ := ZoneOf(record.Name, record.Zone, nil)
+		return target{zoneId: zone.Id, credential: candidates[0]}, nil
+	}
+
+	zones := make([]Zone, 0)
+	owners := make(map[string]*credential)
+
+	for _, c := range candidates {
+		cZones, err := zonesOf(c)
+
+		if err != nil {
+			return target{}, err
+		}
+
+		for _, zone := range cZones {
+			// The first credential wins if several can access the zone
+			if _, ok := owners[zone.Id]; !ok {
+				owners[zone.Id] = c
+				zones = append(zones, zone)
+			}
+		}
+	}
+
+	zone, err := ZoneOf(record.Name, record.Zone, zones)
+
+	if err != nil {
+		return target{}, err
+	}
+
+	return target{zoneId: zone.Id, credential: owners[zone.Id]}, nil
+}
+
+// RefreshZones lists the accessible zones again and moves records to their
+// new zone, i.e. if a subzone was delegated or a zone re-created. The moved
+// records are published again with the last known addresses.
+func (u *Updater) RefreshZones() {
+	u.workLock.Lock()
+	defer u.workLock.Unlock()
+
+	actions := u.currentActions()
+
+	if !slices.ContainsFunc(actions, func(action *Action) bool { return !IsZoneId(action.Zone) }) {
+		return
+	}
+
+	records := make([]Record, 0, len(actions))
+	for _, action := range actions {
+		records = append(records, action.record())
+	}
+
+	targets, errs := u.resolve(records, true)
+	moved := make([]*Action, 0)
+
+	for i, action := range actions {
+		if errs[i] != nil {
+			u.actionLog(action).Warn("Zone of record not found, keeping the previous one", util.ErrorAttr(errs[i]))
+			continue
+		}
+
+		t := targets[i]
+
+		if t.zoneId == action.CfZoneId && t.credential == action.credential {
+			continue
+		}
+
+		u.actionLog(action).Info("Zone of record changed", slog.String("zone-id", t.zoneId), slog.String("credential", t.credential.name))
+
+		action.CfZoneId = t.zoneId
+		action.credential = t.credential
+		action.last = ""
+		action.recordIds = nil
+		moved = append(moved, action)
+	}
+
+	_ = u.verifyZones(moved)
+	u.pruneZoneStatuses()
+
+	for _, update := range u.lastUpdates {
+		u.handle(update, moved)
+	}
+}
@@ -0,0 +1,121 @@
+package cloudflare
+
+import (
+	"context"
+	"testing"
+)
+
+func TestZoneOf(t *testing.T) {
+	const (
+		parentId = "0123456789abcdef0123456789abcdef"
+		subId    = "fedcba9876543210fedcba9876543210"
+		otherId  = "00000000000000000000000000000001"
+		unlisted = "11111111111111111111111111111111"
+	)
+
+	zones := []Zone{
+		{Id: parentId, Name: "example.com"},
+		{Id: subId, Name: "home.example.com"},
+		{Id: otherId, Name: "ample.com"},
+	}
+
+	tests := []struct {
+		name     string
+		record   string
+		explicit string
+		want     Zone
+		err      bool
+	}{
+		{name: "apex", record: "example.com", want: zones[0]},
+		{name: "subdomain", record: "www.example.com", want: zones[0]},
+		{name: "trailing dot and case", record: "WWW.Example.com.", want: zones[0]},
+		{name: "longest match", record: "nas.home.example.com", want: zones[1]},
+		{name: "apex of the subzone", record: "home.example.com", want: zones[1]},
+		{name: "label boundary", record: "myhome.example.com", want: zones[0]},
+		{name: "label boundary of the parent", record: "sample.com", err: true},
+		{name: "suffix of another zone", record: "ample.com", want: zones[2]},
+		{name: "no match", record: "example.org", err: true},
+		{name: "explicit name", record: "nas.home.example.com", explicit: "example.com.", want: zones[0]},
+		{name: "explicit id", record: "nas.home.example.com", explicit: parentId, want: zones[0]},
+		{name: "explicit unlisted id", record: "www.example.org", explicit: unlisted, want: Zone{Id: unlisted}},
+		{name: "explicit inaccessible name", record: "www.example.org", explicit: "example.org", err: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			zone, err := ZoneOf(tt.record, tt.explicit, zones)
+
+			if tt.err {
+				if err == nil {
+					t.Errorf("ZoneOf() = %+v, want an error", zone)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if zone != tt.want {
+				t.Errorf("ZoneOf() = %+v, want %+v", zone, tt.want)
+			}
+		})
+	}
+}
+
+func TestRefreshZones(t *testing.T) {
+	const subId = "fedcba9876543210fedcba9876543210"
+
+	fake := newFakeCloudflare(t, testZone)
+	u := newTestUpdater(t, fake, nil, Record{Name: "home.example.com", IpVersion: 4})
+
+	if u.actions[0].CfZoneId != testZoneId {
+		t.Fatalf("zone = %s, want %s", u.actions[0].CfZoneId, testZoneId)
+	}
+
+	u.Handle(ipv4Update("192.0.2.1"))
+
+	// The name is delegated to its own zone
+	fake.lock.Lock()
+	fake.zones = append(fake.zones, Zone{Id: subId, Name: "home.example.com"})
+	fake.lock.Unlock()
+
+	u.RefreshZones()
+
+	if u.actions[0].CfZoneId != subId {
+		t.Fatalf("zone = %s, want %s", u.actions[0].CfZoneId, subId)
+	}
+
+	// The record is published to the new zone with the last address
+	if records := fake.list(subId, "A"); len(records) != 1 || records[0].Content != "192.0.2.1" {
+		t.Errorf("records of the subzone = %+v, want the address", records)
+	}
+}
+
+func TestAccessibleZonesCached(t *testing.T) {
+	fake := newFakeCloudflare(t, testZone)
+	u := newTestUpdater(t, fake, nil)
+	c := u.credentials[0]
+
+	for range 2 {
+		if _, err := u.accessibleZones(context.Background(), c, false); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err := u.accessibleZones(context.Background(), c, true); err != nil {
+		t.Fatal(err)
+	}
+
+	listed := 0
+	for _, request := range fake.requests {
+		if request == "GET /zones" {
+			listed++
+		}
+	}
+
+	// The second call uses the cache, only the refresh lists the zones again
+	if listed != 2 {
+		t.Errorf("zones listed %d times, want twice", listed)
+	}
+}
@@ -0,0 +1,664 @@
+package config
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/BurntSushi/toml"
+	"github.com/cromefire/fritzbox-cloudflare-dyndns/pkg/util"
+	"gopkg.in/yaml.v3"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	ProviderCloudflare = "cloudflare"
+	ProviderRoute53    = "route53"
+	ProviderPlugin     = "plugin"
+	// ProviderCloudflareList maintains items of Cloudflare IP Lists named by the records
+	ProviderCloudflareList = "cloudflare-list"
+	// ProviderCloudflareGateway maintains the networks of Zero Trust Gateway locations named by the records
+	ProviderCloudflareGateway = "cloudflare-gateway"
+	// ProviderCloudflareLB maintains the address of load balancer origins named "<pool>/<origin>" by the records
+	ProviderCloudflareLB = "cloudflare-lb"
+)
+
+// DefaultCredential is the name of the token or key of a Cloudflare provider
+// itself.
+const DefaultCredential = "default"
+
+// Config describes everything the service does. It's read from a YAML or TOML
+// file and/or the legacy environment variables, see Load.
+type Config struct {
+	Sources       Sources        `yaml:"sources" toml:"sources"`
+	Devices       []Device       `yaml:"devices" toml:"devices"`
+	Providers     []Provider     `yaml:"providers" toml:"providers"`
+	Records       []Record       `yaml:"records" toml:"records"`
+	Metrics       Metrics        `yaml:"metrics" toml:"metrics"`
+	Notifications []Notification `yaml:"notifications" toml:"notifications"`
+	State         State          `yaml:"state" toml:"state"`
+}
+
+// Sources are the ways new addresses are received.
+type Sources struct {
+	Push    Push     `yaml:"push" toml:"push"`
+	Routers []Router `yaml:"routers" toml:"routers"`
+}
+
+// Push configures the DynDNS server the FRITZ!Box pushes updates to, it's
+// disabled if Bind is empty.
+type Push struct {
+	Bind     string `yaml:"bind" toml:"bind"`
+	Username string `yaml:"username" toml:"username"`
+	Password string `yaml:"password" toml:"password"`
+}
+
+// Router is a FRITZ!Box polled via its SOAP API.
+type Router struct {
+	Name     string   `yaml:"name" toml:"name"`
+	Url      string   `yaml:"url" toml:"url"`
+	Timeout  Duration `yaml:"timeout" toml:"timeout"`
+	Interval Duration `yaml:"interval" toml:"interval"`
+}
+
+// Device is a host in the LAN whose IPv6 address is built from the prefix
+// and its interface ID, like ::1234:5678:90ab:cdef.
+type Device struct {
+	Name        string `yaml:"name" toml:"name"`
+	InterfaceId string `yaml:"interfaceId" toml:"interfaceId"`
+}
+
+type Provider struct {
+	Name string `yaml:"name" toml:"name"`
+	Type string `yaml:"type" toml:"type"`
+
+	// Cloudflare
+	Token string `yaml:"token" toml:"token"`
+	Email string `yaml:"email" toml:"email"`
+	Key   string `yaml:"key" toml:"key"`
+	// Credentials are further named tokens or keys, i.e. for zones of
+	// different accounts
+	Credentials []Credential `yaml:"credentials" toml:"credentials"`
+	// ReconcileInterval is how often all records are checked for drift, never if 0
+	ReconcileInterval Duration `yaml:"reconcileInterval" toml:"reconcileInterval"`
+	// ZoneRefreshInterval is how often the accessible zones are listed again, an hour if 0
+	ZoneRefreshInterval Duration `yaml:"zoneRefreshInterval" toml:"zoneRefreshInterval"`
+	// Workers is the number of zones updated at once, 4 if 0
+	Workers int `yaml:"workers" toml:"workers"`
+	// Timeout is the deadline of the requests of a record, a minute if 0
+	Timeout Duration `yaml:"timeout" toml:"timeout"`
+	// Ownership is how records are marked as created by the updater, comment,
+	// tag or txt, all matching records are updated if empty
+	Ownership string `yaml:"ownership" toml:"ownership"`
+	// OwnerId tells apart several instances sharing a zone
+	OwnerId string `yaml:"ownerId" toml:"ownerId"`
+	// WriteProbe checks the write access to the zones at start by creating
+	// and deleting a TXT record, nothing is written if unset
+	WriteProbe bool `yaml:"writeProbe" toml:"writeProbe"`
+	// Heartbeat is the label of a TXT record in every zone, i.e. _dyndns, with
+	// the last change, the published addresses and the instance
+	Heartbeat string `yaml:"heartbeat" toml:"heartbeat"`
+	// HeartbeatInterval is the least time between two writes of a heartbeat
+	// record, 10 minutes if 0
+	HeartbeatInterval Duration `yaml:"heartbeatInterval" toml:"heartbeatInterval"`
+	// FailOnMissingPermissions stops the start if a token is invalid or lacks
+	// permissions for a zone
+	FailOnMissingPermissions bool `yaml:"failOnMissingPermissions" toml:"failOnMissingPermissions"`
+	// AccountId is the account of account-level resources like IP Lists,
+	// Gateway locations and load balancer pools
+	AccountId string `yaml:"accountId" toml:"accountId"`
+
+	// Route 53
+	AccessKeyId     string `yaml:"accessKeyId" toml:"accessKeyId"`
+	SecretAccessKey string `yaml:"secretAccessKey" toml:"secretAccessKey"`
+	SessionToken    string `yaml:"sessionToken" toml:"sessionToken"`
+	CredentialsFile string `yaml:"credentialsFile" toml:"credentialsFile"`
+	Profile         string `yaml:"profile" toml:"profile"`
+	Endpoint        string `yaml:"endpoint" toml:"endpoint"`
+	Region          string `yaml:"region" toml:"region"`
+	WaitForSync     bool   `yaml:"waitForSync" toml:"waitForSync"`
+
+	// Plugin
+	Command []string `yaml:"command" toml:"command"`
+	Env     []string `yaml:"env" toml:"env"`
+}
+
+// Credential is a named Cloudflare token or deprecated API key. The token or
+// key of the provider itself is named "default".
+type Credential struct {
+	Name  string `yaml:"name" toml:"name"`
+	Token string `yaml:"token" toml:"token"`
+	Email string `yaml:"email" toml:"email"`
+	Key   string `yaml:"key" toml:"key"`
+}
+
+// Record is a DNS record kept up to date with the addresses of the sources.
+type Record struct {
+	Name     string `yaml:"name" toml:"name"`
+	Provider string `yaml:"provider" toml:"provider"`
+	Ipv4     bool   `yaml:"ipv4" toml:"ipv4"`
+	Ipv6     bool   `yaml:"ipv6" toml:"ipv6"`
+	// Source restricts the record to updates of one router or "push"
+	Source string `yaml:"source" toml:"source"`
+	// Device makes the AAAA record point to a device instead of the router
+	Device string `yaml:"device" toml:"device"`
+	// Zone is the name or ID of the Cloudflare zone, found by the name if empty
+	Zone string `yaml:"zone" toml:"zone"`
+	// Credential is the name of the Cloudflare credential, the one that can
+	// access the zone if empty
+	Credential string `yaml:"credential" toml:"credential"`
+	// Type is HTTPS or SVCB to maintain the address hints of existing
+	// Cloudflare records instead of the A and AAAA records
+	Type string `yaml:"type" toml:"type"`
+
+	TTL     TTL      `yaml:"ttl" toml:"ttl"`
+	Proxied string   `yaml:"proxied" toml:"proxied"`
+	Comment string   `yaml:"comment" toml:"comment"`
+	Tags    []string `yaml:"tags" toml:"tags"`
+	Enforce bool     `yaml:"enforce" toml:"enforce"`
+	// Duplicates is what happens to several records with the name, update-all,
+	// keep-one or fail
+	Duplicates string `yaml:"duplicates" toml:"duplicates"`
+	// Withdraw is what happens to the record if the router loses its address,
+	// keep, delete or fallback
+	Withdraw     string `yaml:"withdraw" toml:"withdraw"`
+	FallbackIpv4 string `yaml:"fallbackIpv4" toml:"fallbackIpv4"`
+	FallbackIpv6 string `yaml:"fallbackIpv6" toml:"fallbackIpv6"`
+	// Ptr maintains the PTR record of the IPv6 address in an ip6.arpa zone on
+	// Cloudflare
+	Ptr bool `yaml:"ptr" toml:"ptr"`
+}
+
+// Fallback returns the fallback address of the IP version, nil if unset.
+func (r Record) Fallback(ipVersion uint8) net.IP {
+	if ipVersion == 4 {
+		return net.ParseIP(r.FallbackIpv4)
+	}
+
+	return net.ParseIP(r.FallbackIpv6)
+}
+
+// IpVersions returns the IP versions the record is enabled for.
+func (r Record) IpVersions() []uint8 {
+	versions := make([]uint8, 0, 2)
+
+	if r.Ipv4 {
+		versions = append(versions, 4)
+	}
+
+	if r.Ipv6 {
+		versions = append(versions, 6)
+	}
+
+	return versions
+}
+
+// Metrics configures the metrics and health check server, it's disabled if
+// Bind is empty.
+type Metrics struct {
+	Bind  string `yaml:"bind" toml:"bind"`
+	Token string `yaml:"token" toml:"token"`
+}
+
+// State configures where the state is kept across restarts, it's only kept in
+// memory if File is empty.
+type State struct {
+	File string `yaml:"file" toml:"file"`
+}
+
+// Notification is a webhook called on record updates.
+type Notification struct {
+	Url string `yaml:"url" toml:"url"`
+	// Events to send, all if empty
+	Events []string `yaml:"events" toml:"events"`
+}
+
+// Duration is a time.Duration read from strings like "30s".
+type Duration struct {
+	time.Duration
+}
+
+func (d *Duration) UnmarshalText(text []byte) error {
+	v, err := time.ParseDuration(string(text))
+
+	if err != nil {
+		return err
+	}
+
+	d.Duration = v
+	return nil
+}
+
+func (d Duration) MarshalText() ([]byte, error) {
+	return []byte(d.String()), nil
+}
+
+// TTL is a TTL in seconds, where "auto" is represented as 1.
+type TTL int
+
+func (t *TTL) UnmarshalText(text []byte) error {
+	v, err := ParseTTL(string(text))
+
+	if err != nil {
+		return err
+	}
+
+	*t = TTL(v)
+	return nil
+}
+
+func (t TTL) MarshalText() ([]byte, error) {
+	if t == 1 {
+		return []byte("auto"), nil
+	}
+
+	return []byte(strconv.Itoa(int(t))), nil
+}
+
+// ParseTTL parses a TTL in seconds or "auto".
+func ParseTTL(value string) (int, error) {
+	if strings.EqualFold(value, "auto") {
+		return 1, nil
+	}
+
+	ttl, err := strconv.Atoi(value)
+
+	if err != nil {
+		return 0, fmt.Errorf("invalid TTL %q", value)
+	}
+
+	if ttl != 1 && (ttl < 30 || ttl > 86400) {
+		return 0, fmt.Errorf("TTL %d out of range, has to be auto or between 30 and 86400", ttl)
+	}
+
+	return ttl, nil
+}
+
+// Load reads the config file (if path isn't empty), resolves the ${...}
+// references, applies the environment variables on top and validates the
+// result.
+func Load(path string) (*Config, error) {
+	cfg := &Config{}
+
+	if path != "" {
+		err := readFile(path, cfg)
+
+		if err != nil {
+			return nil, fmt.Errorf("failed to read config file %s: %w", path, err)
+		}
+
+		err = expandReferences(cfg)
+
+		if err != nil {
+			return nil, fmt.Errorf("failed to resolve references in %s: %w", path, err)
+		}
+	}
+
+	err := applyEnv(cfg)
+
+	if err != nil {
+		return nil, err
+	}
+
+	err = cfg.Validate()
+
+	if err != nil {
+		return nil, err
+	}
+
+	return cfg, nil
+}
+
+func readFile(path string, cfg *Config) error {
+	content, err := os.ReadFile(path)
+
+	if err != nil {
+		return err
+	}
+
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".toml":
+		_, err = toml.Decode(string(content), cfg)
+	case ".yaml", ".yml", ".json":
+		decoder := yaml.NewDecoder(bytes.NewReader(content))
+		decoder.KnownFields(true)
+		err = decoder.Decode(cfg)
+	default:
+		err = errors.New("unsupported file extension, use .yaml, .yml or .toml")
+	}
+
+	return err
+}
+
+// Validate checks the references between the sections and all values that
+// can be checked offline.
+func (c *Config) Validate() error {
+	errs := make([]error, 0)
+	fail := func(format string, args ...any) {
+		errs = append(errs, fmt.Errorf(format, args...))
+	}
+
+	routers := make([]string, 0)
+	for i, router := range c.Sources.Routers {
+		if router.Name == "" {
+			fail("router %d: name is required", i)
+		} else if slices.Contains(routers, router.Name) || router.Name == "push" {
+			fail("router %s: name is not unique", router.Name)
+		}
+		routers = append(routers, router.Name)
+
+		if _, err := url.ParseRequestURI(router.Url); err != nil {
+			fail("router %s: invalid url: %w", router.Name, err)
+		}
+
+		if router.Interval.Duration <= 0 {
+			fail("router %s: interval is required", router.Name)
+		}
+	}
+
+	devices := make([]string, 0)
+	for i, device := range c.Devices {
+		if device.Name == "" {
+			fail("device %d: name is required", i)
+		} else if slices.Contains(devices, device.Name) {
+			fail("device %s: name is not unique", device.Name)
+		}
+		devices = append(devices, device.Name)
+
+		if ip := net.ParseIP(device.InterfaceId); ip == nil || ip.To4() != nil {
+			fail("device %s: invalid IPv6 interface ID %q", device.Name, device.InterfaceId)
+		}
+	}
+
+	providers := make([]string, 0)
+	for i, provider := range c.Providers {
+		if provider.Name == "" {
+			fail("provider %d: name is required", i)
+		} else if slices.Contains(providers, provider.Name) {
+			fail("provider %s: name is not unique", provider.Name)
+		}
+		providers = append(providers, provider.Name)
+
+		switch provider.Type {
+		case ProviderCloudflare:
+			if provider.Token == "" && (provider.Email == "" || provider.Key == "") && len(provider.Credentials) == 0 {
+				fail("provider %s: token, email and key or credentials are required", provider.Name)
+			}
+
+			credentials := make([]string, 0)
+			if provider.Token != "" || provider.Key != "" {
+				credentials = append(credentials, DefaultCredential)
+			}
+
+			for i, credential := range provider.Credentials {
+				if credential.Name == "" {
+					fail("provider %s: credential %d: name is required", provider.Name, i)
+				} else if slices.Contains(credentials, credential.Name) {
+					fail("provider %s: credential %s: name is not unique", provider.Name, credential.Name)
+				}
+				credentials = append(credentials, credential.Name)
+
+				if credential.Token == "" && (credential.Email == "" || credential.Key == "") {
+					fail("provider %s: credential %s: token or email and key are required", provider.Name, credential.Name)
+				}
+			}
+
+			if provider.ReconcileInterval.Duration < 0 {
+				fail("provider %s: reconcileInterval must not be negative", provider.Name)
+			}
+
+			if provider.ZoneRefreshInterval.Duration < 0 {
+				fail("provider %s: zoneRefreshInterval must not be negative", provider.Name)
+			}
+
+			if provider.HeartbeatInterval.Duration < 0 {
+				fail("provider %s: heartbeatInterval must not be negative", provider.Name)
+			}
+
+			if strings.ContainsAny(provider.Heartbeat, " \t\"") || (provider.Heartbeat != "" && strings.Trim(provider.Heartbeat, ".") == "") {
+				fail("provider %s: invalid heartbeat label %q", provider.Name, provider.Heartbeat)
+			}
+
+			if provider.Workers < 0 {
+				fail("provider %s: workers must not be negative", provider.Name)
+			}
+
+			if provider.Timeout.Duration < 0 {
+				fail("provider %s: timeout must not be negative", provider.Name)
+			}
+
+			if !slices.Contains([]string{"", "off", "comment", "tag", "txt"}, provider.Ownership) {
+				fail("provider %s: ownership must be comment, tag, txt or off", provider.Name)
+			}
+		case ProviderCloudflareList, ProviderCloudflareGateway, ProviderCloudflareLB:
+			if provider.Token == "" && (provider.Email == "" || provider.Key == "") {
+				fail("provider %s: token or email and key are required", provider.Name)
+			}
+
+			if provider.AccountId == "" {
+				fail("provider %s: accountId is required", provider.Name)
+			}
+
+			// The account is accessed with the token or key of the provider only
+			if len(provider.Credentials) > 0 {
+				fail("provider %s: credentials are only supported by Cloudflare providers, use token or email and key", provider.Name)
+			}
+		case ProviderRoute53:
+			if provider.AccessKeyId != "" && provider.SecretAccessKey == "" {
+				fail("provider %s: secretAccessKey is required with accessKeyId", provider.Name)
+			}
+		case ProviderPlugin:
+			if len(provider.Command) == 0 {
+				fail("provider %s: command is required", provider.Name)
+			}
+		default:
+			fail("provider %s: unknown type %q", provider.Name, provider.Type)
+		}
+	}
+
+	// Providers publish their records independently, so only a provider can't
+	// have a record twice
+	type recordKey struct {
+		provider   string
+		name       string
+		recordType string
+		ipVersion  uint8
+	}
+	seen := make(map[recordKey]bool)
+
+	for i, record := range c.Records {
+		name := record.Name
+		if name == "" {
+			fail("record %d: name is required", i)
+			name = strconv.Itoa(i)
+		}
+
+		if provider := c.Provider(record.Provider); provider == nil {
+			fail("record %s: unknown provider %q", name, record.Provider)
+		} else {
+			if provider.Type == ProviderCloudflareGateway && record.Ipv6 {
+				fail("record %s: Gateway locations only support IPv4", name)
+			}
+
+			if provider.Type == ProviderCloudflareLB {
+				if pool, origin, ok := strings.Cut(record.Name, "/"); !ok || pool == "" || origin == "" {
+					fail("record %s: load balancer origins have to be named <pool>/<origin>", name)
+				}
+
+				if record.Ipv4 && record.Ipv6 {
+					fail("record %s: a load balancer origin has a single address, enable either ipv4 or ipv6", name)
+				}
+			}
+
+			if record.Ptr && provider.Type != ProviderCloudflare {
+				fail("record %s: ptr is only supported by Cloudflare providers", name)
+			}
+
+			if record.Type != "" && provider.Type != ProviderCloudflare {
+				fail("record %s: type is only supported by Cloudflare providers", name)
+			}
+
+			if record.Credential != "" && provider.Type != ProviderCloudflare {
+				fail("record %s: credential is only supported by Cloudflare providers", name)
+			} else if record.Credential != "" && !provider.HasCredential(record.Credential) {
+				fail("record %s: unknown credential %q of provider %s", name, record.Credential, provider.Name)
+			}
+
+			for _, ipVersion := range record.IpVersions() {
+				key := recordKey{provider: provider.Name, name: record.Name, recordType: strings.ToUpper(record.Type), ipVersion: ipVersion}
+
+				if seen[key] {
+					fail("record %s: defined more than once for IPv%d of provider %s", name, ipVersion, provider.Name)
+				}
+				seen[key] = true
+			}
+		}
+
+		if !record.Ipv4 && !record.Ipv6 {
+			fail("record %s: at least one of ipv4 and ipv6 has to be enabled", name)
+		}
+
+		if record.Source != "" && record.Source != "push" && !slices.Contains(routers, record.Source) {
+			fail("record %s: unknown source %q", name, record.Source)
+		}
+
+		if record.Device != "" && !slices.Contains(devices, record.Device) {
+			fail("record %s: unknown device %q", name, record.Device)
+		}
+
+		switch strings.ToUpper(record.Type) {
+		case "":
+		case "HTTPS", "SVCB":
+			if proxied := strings.ToLower(record.Proxied); proxied != "" && proxied != "keep" {
+				fail("record %s: %s records can't be proxied", name, strings.ToUpper(record.Type))
+			}
+		default:
+			fail("record %s: invalid type %q, has to be HTTPS or SVCB", name, record.Type)
+		}
+
+		if record.Ptr && (!record.Ipv6 || record.Type != "") {
+			fail("record %s: ptr needs an AAAA record, enable ipv6 and leave the type empty", name)
+		}
+
+		switch strings.ToLower(record.Proxied) {
+		case "", "keep", "on", "off", "true", "false":
+		default:
+			fail("record %s: invalid proxied mode %q, has to be on, off or keep", name, record.Proxied)
+		}
+
+		if ip := net.ParseIP(record.FallbackIpv4); record.FallbackIpv4 != "" && (ip == nil || ip.To4() == nil) {
+			fail("record %s: fallbackIpv4 has to be an IPv4 address", name)
+		}
+
+		if ip := net.ParseIP(record.FallbackIpv6); record.FallbackIpv6 != "" && (ip == nil || ip.To4() != nil) {
+			fail("record %s: fallbackIpv6 has to be an IPv6 address", name)
+		}
+
+		withdraw, err := util.ParseWithdrawMode(record.Withdraw)
+
+		if err != nil {
+			fail("record %s: %v", name, err)
+		}
+
+		for _, ipVersion := range record.IpVersions() {
+			if withdraw == util.WithdrawFallback && record.Fallback(ipVersion) == nil {
+				fail("record %s: fallbackIpv%d is required to withdraw to a fallback", name, ipVersion)
+			}
+		}
+	}
+
+	if len(errs) > 0 {
+		return errors.Join(errs...)
+	}
+
+	return nil
+}
+
+// Provider returns the provider with the given name.
+func (c *Config) Provider(name string) *Provider {
+	for i := range c.Providers {
+		if c.Providers[i].Name == name {
+			return &c.Providers[i]
+		}
+	}
+
+	return nil
+}
+
+// HasCredential reports whether the Cloudflare provider has a credential with
+// the name.
+func (p *Provider) HasCredential(name string) bool {
+	if name == DefaultCredential && (p.Token != "" || p.Key != "") {
+		return true
+	}
+
+	return slices.ContainsFunc(p.Credentials, func(credential Credential) bool { return credential.Name == name })
+}
+
+// Device returns the device with the given name.
+func (c *Config) Device(name string) *Device {
+	for i := range c.Devices {
+		if c.Devices[i].Name == name {
+			return &c.Devices[i]
+		}
+	}
+
+	return nil
+}
+
+// RecordsOf returns all records of a provider.
+func (c *Config) RecordsOf(provider string) []Record {
+	records := make([]Record, 0)
+
+	for _, record := range c.Records {
+		if record.Provider == provider {
+			records = append(records, record)
+		}
+	}
+
+	return records
+}
+
+// UsesIpVersion reports whether any record needs addresses of the IP version.
+func (c *Config) UsesIpVersion(ipVersion uint8) bool {
+	for _, record := range c.Records {
+		if (ipVersion == 4 && record.Ipv4) || (ipVersion == 6 && record.Ipv6) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// UsesPrefix reports whether any AAAA record points to a device or any IP
+// List holds the IPv6 prefix and therefore the prefix is needed.
+func (c *Config) UsesPrefix() bool {
+	for _, record := range c.Records {
+		if record.Ipv6 && record.Device != "" {
+			return true
+		}
+
+		if p := c.Provider(record.Provider); record.Ipv6 && p != nil && p.Type == ProviderCloudflareList {
+			return true
+		}
+	}
+
+	return false
+}
+
+// UsesWanIpv6 reports whether any AAAA record points to the router itself.
+func (c *Config) UsesWanIpv6() bool {
+	for _, record := range c.Records {
+		if record.Ipv6 && record.Device == "" {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,129 @@
+package config
+
+import (
+	"testing"
+)
+
+func TestParseTTL(t *testing.T) {
+	tests := []struct {
+		value string
+		want  int
+		err   bool
+	}{
+		{value: "auto", want: 1},
+		{value: "AUTO", want: 1},
+		{value: "1", want: 1},
+		{value: "30", want: 30},
+		{value: "86400", want: 86400},
+		{value: "29", err: true},
+		{value: "86401", err: true},
+		{value: "0", err: true},
+		{value: "", err: true},
+		{value: "5m", err: true},
+	}
+
+	for _, tt := range tests {
+		ttl, err := ParseTTL(tt.value)
+
+		if tt.err {
+			if err == nil {
+				t.Errorf("ParseTTL(%q) = %d, want an error", tt.value, ttl)
+			}
+			continue
+		}
+
+		if err != nil || ttl != tt.want {
+			t.Errorf("ParseTTL(%q) = %d, %v, want %d", tt.value, ttl, err, tt.want)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	base := func() *Config {
+		return &Config{
+			Providers: []Provider{
+				{Name: "home", Type: ProviderCloudflare, Token: "token"},
+				{Name: "work", Type: ProviderCloudflare, Token: "token"},
+				{Name: "aws", Type: ProviderRoute53},
+				{Name: "lists", Type: ProviderCloudflareList, Token: "token", AccountId: "account"},
+			},
+		}
+	}
+
+	tests := []struct {
+		name    string
+		records []Record
+		err     string
+	}{
+		{
+			name:    "record on two providers of a type",
+			records: []Record{{Name: "www.example.com", Provider: "home", Ipv4: true}, {Name: "www.example.com", Provider: "work", Ipv4: true}},
+		},
+		{
+			name:    "record on providers of two types",
+			records: []Record{{Name: "www.example.com", Provider: "home", Ipv4: true}, {Name: "www.example.com", Provider: "aws", Ipv4: true}},
+		},
+		{
+			name:    "record twice on a provider",
+			records: []Record{{Name: "www.example.com", Provider: "home", Ipv4: true}, {Name: "www.example.com", Provider: "home", Ipv4: true, Ipv6: true}},
+			err:     "record www.example.com: defined more than once for IPv4 of provider home",
+		},
+		{
+			name:    "record and its hints",
+			records: []Record{{Name: "www.example.com", Provider: "home", Ipv4: true}, {Name: "www.example.com", Provider: "home", Ipv4: true, Type: "HTTPS"}},
+		},
+		{
+			name:    "unknown provider",
+			records: []Record{{Name: "www.example.com", Provider: "other", Ipv4: true}},
+			err:     `record www.example.com: unknown provider "other"`,
+		},
+		{
+			name:    "no ip version",
+			records: []Record{{Name: "www.example.com", Provider: "home"}},
+			err:     "record www.example.com: at least one of ipv4 and ipv6 has to be enabled",
+		},
+		{
+			name:    "unknown credential",
+			records: []Record{{Name: "www.example.com", Provider: "home", Ipv4: true, Credential: "other"}},
+			err:     `record www.example.com: unknown credential "other" of provider home`,
+		},
+		{
+			name:    "credential of an account provider",
+			records: []Record{{Name: "home", Provider: "lists", Ipv4: true, Credential: "default"}},
+			err:     "record home: credential is only supported by Cloudflare providers",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := base()
+			cfg.Records = tt.records
+
+			err := cfg.Validate()
+
+			if tt.err == "" && err != nil {
+				t.Errorf("Validate() = %v, want no error", err)
+			} else if tt.err != "" && (err == nil || err.Error() != tt.err) {
+				t.Errorf("Validate() = %v, want %q", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestValidateAccountCredentials(t *testing.T) {
+	for _, providerType := range []string{ProviderCloudflareList, ProviderCloudflareGateway, ProviderCloudflareLB} {
+		cfg := &Config{Providers: []Provider{{
+			Name:        "account",
+			Type:        providerType,
+			Token:       "token",
+			AccountId:   "account",
+			Credentials: []Credential{{Name: "work", Token: "token"}},
+		}}}
+
+		want := "provider account: credentials are only supported by Cloudflare providers, use token or email and key"
+
+		if err := cfg.Validate(); err == nil || err.Error() != want {
+			t.Errorf("Validate() of %s = %v, want %q", providerType, err, want)
+		}
+	}
+}
@@ -0,0 +1,635 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"github.com/cromefire/fritzbox-cloudflare-dyndns/pkg/util"
+	"log/slog"
+	"net"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// legacyRouterName is the router configured by the FRITZBOX_ENDPOINT_* variables
+	legacyRouterName = "fritzbox"
+	// legacyDeviceName is the device configured by DEVICE_LOCAL_ADDRESS_IPV6
+	legacyDeviceName = "local"
+)
+
+// applyEnv applies the environment variables on top of the config. They
+// override the respective values of the config file and keep setups
+// configured only via the environment working as before.
+func applyEnv(cfg *Config) error {
+	errs := make([]error, 0)
+
+	applyPushEnv(cfg)
+
+	err := applyRouterEnv(cfg)
+	if err != nil {
+		errs = append(errs, err)
+	}
+
+	applyMetricsEnv(cfg)
+	overrideString(&cfg.State.File, "STATE_FILE")
+
+	records := make([]Record, 0)
+
+	r, err := applyCloudflareEnv(cfg)
+	records = append(records, r...)
+	if err != nil {
+		errs = append(errs, err)
+	}
+
+	r, err = applyCloudflareListEnv(cfg)
+	records = append(records, r...)
+	if err != nil {
+		errs = append(errs, err)
+	}
+
+	r, err = applyCloudflareGatewayEnv(cfg)
+	records = append(records, r...)
+	if err != nil {
+		errs = append(errs, err)
+	}
+
+	r, err = applyCloudflareLBEnv(cfg)
+	records = append(records, r...)
+	if err != nil {
+		errs = append(errs, err)
+	}
+
+	r, err = applyRoute53Env(cfg)
+	records = append(records, r...)
+	if err != nil {
+		errs = append(errs, err)
+	}
+
+	r, err = applyPluginEnv(cfg)
+	records = append(records, r...)
+	if err != nil {
+		errs = append(errs, err)
+	}
+
+	// The legacy device applies to all AAAA records configured via the environment
+	if localAddress := os.Getenv("DEVICE_LOCAL_ADDRESS_IPV6"); localAddress != "" {
+		setDevice(cfg, Device{Name: legacyDeviceName, InterfaceId: localAddress})
+
+		for i := range records {
+			if records[i].Ipv6 {
+				records[i].Device = legacyDeviceName
+			}
+		}
+
+		slog.Info("Using the IPv6 Prefix to construct the IPv6 Address")
+	}
+
+	cfg.Records = append(cfg.Records, records...)
+
+	return errors.Join(errs...)
+}
+
+func applyPushEnv(cfg *Config) {
+	if bind := os.Getenv("DYNDNS_SERVER_BIND"); bind != "" {
+		cfg.Sources.Push.Bind = bind
+	}
+
+	if username := os.Getenv("DYNDNS_SERVER_USERNAME"); username != "" {
+		cfg.Sources.Push.Username = username
+	}
+
+	if password := ReadSecret("DYNDNS_SERVER_PASSWORD"); password != "" {
+		cfg.Sources.Push.Password = password
+	}
+}
+
+func applyRouterEnv(cfg *Config) error {
+	// Polling was only ever enabled by setting the interval, the Docker image
+	// sets the URL by default.
+	interval := os.Getenv("FRITZBOX_ENDPOINT_INTERVAL")
+
+	if interval == "" {
+		return nil
+	}
+
+	var router *Router
+	for i := range cfg.Sources.Routers {
+		if cfg.Sources.Routers[i].Name == legacyRouterName {
+			router = &cfg.Sources.Routers[i]
+		}
+	}
+
+	if router == nil {
+		cfg.Sources.Routers = append(cfg.Sources.Routers, Router{
+			Name:    legacyRouterName,
+			Url:     "http://fritz.box:49000",
+			Timeout: Duration{5 * time.Second},
+		})
+		router = &cfg.Sources.Routers[len(cfg.Sources.Routers)-1]
+	}
+
+	if endpointUrl := os.Getenv("FRITZBOX_ENDPOINT_URL"); endpointUrl != "" {
+		router.Url = strings.TrimRight(endpointUrl, "/")
+	}
+
+	v, err := time.ParseDuration(interval)
+
+	if err != nil {
+		slog.Warn("Failed to parse FRITZBOX_ENDPOINT_INTERVAL, using defaults", util.ErrorAttr(err))
+		v = 300 * time.Second
+	}
+
+	router.Interval = Duration{v}
+
+	if timeout := os.Getenv("FRITZBOX_ENDPOINT_TIMEOUT"); timeout != "" {
+		v, err := time.ParseDuration(timeout)
+
+		if err != nil {
+			slog.Warn("Failed to parse FRITZBOX_ENDPOINT_TIMEOUT, using defaults", util.ErrorAttr(err))
+		} else {
+			router.Timeout = Duration{v}
+		}
+	}
+
+	return nil
+}
+
+func applyMetricsEnv(cfg *Config) {
+	if bind := os.Getenv("METRICS_BIND"); bind != "" {
+		cfg.Metrics.Bind = bind
+	}
+
+	if token := ReadSecret("METRICS_TOKEN"); token != "" {
+		cfg.Metrics.Token = token
+	}
+}
+
+func applyCloudflareEnv(cfg *Config) ([]Record, error) {
+	token := ReadSecret("CLOUDFLARE_API_TOKEN")
+	email := os.Getenv("CLOUDFLARE_API_EMAIL")
+	key := ReadSecret("CLOUDFLARE_API_KEY")
+
+	if token != "" || (email != "" && key != "") {
+		provider := ensureProvider(cfg, ProviderCloudflare, ProviderCloudflare)
+
+		if token != "" {
+			provider.Token = token
+		} else {
+			provider.Email = email
+			provider.Key = key
+		}
+	}
+
+	err := applyCloudflareCredentialsEnv(cfg)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if interval := os.Getenv("CLOUDFLARE_RECONCILE_INTERVAL"); interval != "" && cfg.Provider(ProviderCloudflare) != nil {
+		v, err := time.ParseDuration(interval)
+
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse CLOUDFLARE_RECONCILE_INTERVAL: %w", err)
+		}
+
+		cfg.Provider(ProviderCloudflare).ReconcileInterval = Duration{v}
+	}
+
+	if interval := os.Getenv("CLOUDFLARE_ZONE_REFRESH_INTERVAL"); interval != "" && cfg.Provider(ProviderCloudflare) != nil {
+		v, err := time.ParseDuration(interval)
+
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse CLOUDFLARE_ZONE_REFRESH_INTERVAL: %w", err)
+		}
+
+		cfg.Provider(ProviderCloudflare).ZoneRefreshInterval = Duration{v}
+	}
+
+	if interval := os.Getenv("CLOUDFLARE_HEARTBEAT_INTERVAL"); interval != "" && cfg.Provider(ProviderCloudflare) != nil {
+		v, err := time.ParseDuration(interval)
+
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse CLOUDFLARE_HEARTBEAT_INTERVAL: %w", err)
+		}
+
+		cfg.Provider(ProviderCloudflare).HeartbeatInterval = Duration{v}
+	}
+
+	if workers := os.Getenv("CLOUDFLARE_WORKERS"); workers != "" && cfg.Provider(ProviderCloudflare) != nil {
+		v, err := strconv.Atoi(workers)
+
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse CLOUDFLARE_WORKERS: %w", err)
+		}
+
+		cfg.Provider(ProviderCloudflare).Workers = v
+	}
+
+	if timeout := os.Getenv("CLOUDFLARE_TIMEOUT"); timeout != "" && cfg.Provider(ProviderCloudflare) != nil {
+		v, err := time.ParseDuration(timeout)
+
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse CLOUDFLARE_TIMEOUT: %w", err)
+		}
+
+		cfg.Provider(ProviderCloudflare).Timeout = Duration{v}
+	}
+
+	if provider := cfg.Provider(ProviderCloudflare); provider != nil {
+		if ownership := os.Getenv("CLOUDFLARE_OWNERSHIP"); ownership != "" {
+			provider.Ownership = ownership
+		}
+
+		if ownerId := os.Getenv("CLOUDFLARE_OWNER_ID"); ownerId != "" {
+			provider.OwnerId = ownerId
+		}
+
+		if heartbeat := os.Getenv("CLOUDFLARE_HEARTBEAT"); heartbeat != "" {
+			provider.Heartbeat = heartbeat
+		}
+
+		if writeProbe := os.Getenv("CLOUDFLARE_WRITE_PROBE"); writeProbe != "" {
+			provider.WriteProbe = writeProbe == "true"
+		}
+
+		if failFast := os.Getenv("CLOUDFLARE_FAIL_ON_MISSING_PERMISSIONS"); failFast != "" {
+			provider.FailOnMissingPermissions = failFast == "true"
+		}
+	}
+
+	return envRecords(cfg, "CLOUDFLARE", ProviderCloudflare, 0)
+}
+
+// applyCloudflareCredentialsEnv adds the credentials listed in
+// CLOUDFLARE_CREDENTIALS, whose token or key is read from the variables
+// suffixed with the upper-case name, i.e. CLOUDFLARE_API_TOKEN_WORK.
+func applyCloudflareCredentialsEnv(cfg *Config) error {
+	names := os.Getenv("CLOUDFLARE_CREDENTIALS")
+
+	if names == "" {
+		return nil
+	}
+
+	provider := ensureProvider(cfg, ProviderCloudflare, ProviderCloudflare)
+
+	for _, name := range strings.Split(names, ",") {
+		name = strings.TrimSpace(name)
+
+		if name == "" {
+			continue
+		}
+
+		suffix := "_" + strings.ToUpper(strings.ReplaceAll(name, "-", "_"))
+		credential := Credential{
+			Name:  name,
+			Token: ReadSecret("CLOUDFLARE_API_TOKEN" + suffix),
+			Email: os.Getenv("CLOUDFLARE_API_EMAIL" + suffix),
+			Key:   ReadSecret("CLOUDFLARE_API_KEY" + suffix),
+		}
+
+		if credential.Token == "" && (credential.Email == "" || credential.Key == "") {
+			return fmt.Errorf("no token or key found for credential %s, set CLOUDFLARE_API_TOKEN%s", name, suffix)
+		}
+
+		i := slices.IndexFunc(provider.Credentials, func(c Credential) bool { return c.Name == name })
+
+		if i >= 0 {
+			provider.Credentials[i] = credential
+		} else {
+			provider.Credentials = append(provider.Credentials, credential)
+		}
+	}
+
+	return nil
+}
+
+// applyCloudflareListEnv adds the IP Lists of CLOUDFLARE_LISTS_IPV4 and
+// CLOUDFLARE_LISTS_IPV6, which are maintained with the Cloudflare credentials.
+func applyCloudflareListEnv(cfg *Config) ([]Record, error) {
+	records := make([]Record, 0)
+
+	for _, ipVersion := range []uint8{4, 6} {
+		lists, provider := accountEnvRecords(cfg, fmt.Sprintf("CLOUDFLARE_LISTS_IPV%d", ipVersion), ProviderCloudflareList, ipVersion)
+
+		if provider != nil {
+			provider.OwnerId = cfg.Provider(ProviderCloudflare).OwnerId
+		}
+
+		records = append(records, lists...)
+	}
+
+	return records, nil
+}
+
+// applyCloudflareGatewayEnv adds the Gateway locations of
+// CLOUDFLARE_GATEWAY_LOCATIONS, which are maintained with the Cloudflare
+// credentials.
+func applyCloudflareGatewayEnv(cfg *Config) ([]Record, error) {
+	records, _ := accountEnvRecords(cfg, "CLOUDFLARE_GATEWAY_LOCATIONS", ProviderCloudflareGateway, 4)
+
+	return records, nil
+}
+
+// accountEnvRecords parses the comma-separated names of account-level
+// resources in the variable as records of the IP version. Their provider of
+// the type uses the credentials of the Cloudflare provider and is returned to
+// be set up further, nil if the variable is empty or there are no credentials.
+func accountEnvRecords(cfg *Config, envName string, providerType string, ipVersion uint8) ([]Record, *Provider) {
+	records := make([]Record, 0)
+	names := os.Getenv(envName)
+
+	if names == "" {
+		return records, nil
+	}
+
+	dns := cfg.Provider(ProviderCloudflare)
+
+	if dns == nil {
+		slog.Info("No credentials for " + envName + " found, disabling " + providerType + " updates")
+		return records, nil
+	}
+
+	provider := ensureProvider(cfg, providerType, providerType)
+	provider.Token = dns.Token
+	provider.Email = dns.Email
+	provider.Key = dns.Key
+	overrideString(&provider.AccountId, "CLOUDFLARE_ACCOUNT_ID")
+
+	for _, name := range strings.Split(names, ",") {
+		if name = strings.TrimSpace(name); name == "" {
+			continue
+		}
+
+		records = append(records, Record{
+			Name:     name,
+			Provider: providerType,
+			Ipv4:     ipVersion == 4,
+			Ipv6:     ipVersion == 6,
+		})
+	}
+
+	return records, provider
+}
+
+// applyCloudflareLBEnv adds the load balancer origins of
+// CLOUDFLARE_LB_ORIGINS_IPV4 and CLOUDFLARE_LB_ORIGINS_IPV6, which are
+// maintained with the Cloudflare credentials.
+func applyCloudflareLBEnv(cfg *Config) ([]Record, error) {
+	records := make([]Record, 0)
+
+	for _, ipVersion := range []uint8{4, 6} {
+		origins, _ := accountEnvRecords(cfg, fmt.Sprintf("CLOUDFLARE_LB_ORIGINS_IPV%d", ipVersion), ProviderCloudflareLB, ipVersion)
+		records = append(records, origins...)
+	}
+
+	return records, nil
+}
+
+func applyRoute53Env(cfg *Config) ([]Record, error) {
+	ipv4Zone := os.Getenv("ROUTE53_ZONES_IPV4")
+	ipv6Zone := os.Getenv("ROUTE53_ZONES_IPV6")
+
+	if ipv4Zone != "" || ipv6Zone != "" || cfg.Provider(ProviderRoute53) != nil {
+		provider := ensureProvider(cfg, ProviderRoute53, ProviderRoute53)
+
+		if accessKeyId := os.Getenv("AWS_ACCESS_KEY_ID"); accessKeyId != "" {
+			provider.AccessKeyId = accessKeyId
+			provider.SecretAccessKey = ReadSecret("AWS_SECRET_ACCESS_KEY")
+			provider.SessionToken = ReadSecret("AWS_SESSION_TOKEN")
+		}
+
+		overrideString(&provider.CredentialsFile, "AWS_SHARED_CREDENTIALS_FILE")
+		overrideString(&provider.Profile, "AWS_PROFILE")
+		overrideString(&provider.Endpoint, "ROUTE53_ENDPOINT")
+		overrideString(&provider.Region, "AWS_REGION")
+
+		if wait := os.Getenv("ROUTE53_WAIT_FOR_SYNC"); wait != "" {
+			provider.WaitForSync = wait == "true"
+		}
+	}
+
+	ttl, err := envTTL("ROUTE53_TTL")
+
+	if err != nil {
+		return nil, err
+	}
+
+	return envRecords(cfg, "ROUTE53", ProviderRoute53, ttl)
+}
+
+func applyPluginEnv(cfg *Config) ([]Record, error) {
+	command := strings.Fields(os.Getenv("PLUGIN_COMMAND"))
+
+	name := os.Getenv("PLUGIN_NAME")
+	if name == "" {
+		name = ProviderPlugin
+	}
+
+	if len(command) > 0 {
+		provider := ensureProvider(cfg, name, ProviderPlugin)
+		provider.Command = command
+	}
+
+	ttl, err := envTTL("PLUGIN_TTL")
+
+	if err != nil {
+		return nil, err
+	}
+
+	return envRecords(cfg, "PLUGIN", name, ttl)
+}
+
+// envRecords parses the <prefix>_ZONES_IPV4 and <prefix>_ZONES_IPV6 lists.
+func envRecords(cfg *Config, prefix string, provider string, ttl int) ([]Record, error) {
+	records := make([]Record, 0)
+
+	for _, ipVersion := range []uint8{4, 6} {
+		envName := fmt.Sprintf("%s_ZONES_IPV%d", prefix, ipVersion)
+		list := os.Getenv(envName)
+
+		if list == "" {
+			continue
+		}
+
+		if cfg.Provider(provider) == nil {
+			slog.Info("No credentials for " + envName + " found, disabling " + provider + " updates")
+			continue
+		}
+
+		parsed, err := ParseRecordList(list)
+
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse %s: %w", envName, err)
+		}
+
+		for _, record := range parsed {
+			record.Provider = provider
+			record.Ipv4 = ipVersion == 4
+			record.Ipv6 = ipVersion == 6
+
+			if record.TTL == 0 {
+				record.TTL = TTL(ttl)
+			}
+
+			records = append(records, record)
+		}
+	}
+
+	return records, nil
+}
+
+// ParseRecordList parses a comma-separated list of records, each optionally
+// followed by |-separated options, i.e.
+//
+//	www.example.com|proxied=on|ttl=auto|tags=env:home;owner:me,vpn.example.com
+func ParseRecordList(list string) ([]Record, error) {
+	records := make([]Record, 0)
+
+	for _, entry := range strings.Split(list, ",") {
+		parts := strings.Split(strings.TrimSpace(entry), "|")
+		record := Record{Name: parts[0]}
+
+		if record.Name == "" {
+			return nil, errors.New("empty record name in " + list)
+		}
+
+		for _, option := range parts[1:] {
+			key, value, _ := strings.Cut(option, "=")
+			err := record.setOption(key, value)
+
+			if err != nil {
+				return nil, fmt.Errorf("invalid option for %s: %w", record.Name, err)
+			}
+		}
+
+		records = append(records, record)
+	}
+
+	return records, nil
+}
+
+func (r *Record) setOption(key string, value string) error {
+	switch strings.ToLower(strings.TrimSpace(key)) {
+	case "ttl":
+		return r.TTL.UnmarshalText([]byte(value))
+	case "proxied":
+		r.Proxied = value
+	case "comment":
+		r.Comment = value
+	case "tags":
+		r.Tags = make([]string, 0)
+		for _, tag := range strings.Split(value, ";") {
+			if tag = strings.TrimSpace(tag); tag != "" {
+				r.Tags = append(r.Tags, tag)
+			}
+		}
+	case "enforce":
+		enforce, err := strconv.ParseBool(value)
+
+		if err != nil {
+			return err
+		}
+
+		r.Enforce = enforce
+	case "zone":
+		r.Zone = value
+	case "credential":
+		r.Credential = value
+	case "type":
+		r.Type = value
+	case "ptr":
+		ptr, err := strconv.ParseBool(value)
+
+		if err != nil {
+			return err
+		}
+
+		r.Ptr = ptr
+	case "duplicates":
+		r.Duplicates = value
+	case "withdraw":
+		r.Withdraw = value
+	case "fallback":
+		ip := net.ParseIP(value)
+
+		if ip == nil {
+			return errors.New("invalid fallback address " + value)
+		}
+
+		if ip.To4() != nil {
+			r.FallbackIpv4 = value
+		} else {
+			r.FallbackIpv6 = value
+		}
+	default:
+		return errors.New("unknown option " + key)
+	}
+
+	return nil
+}
+
+func envTTL(envName string) (int, error) {
+	value := os.Getenv(envName)
+
+	if value == "" {
+		return 0, nil
+	}
+
+	ttl, err := strconv.Atoi(value)
+
+	if err != nil {
+		return 0, fmt.Errorf("failed to parse %s: %w", envName, err)
+	}
+
+	return ttl, nil
+}
+
+func ensureProvider(cfg *Config, name string, providerType string) *Provider {
+	if provider := cfg.Provider(name); provider != nil {
+		return provider
+	}
+
+	cfg.Providers = append(cfg.Providers, Provider{Name: name, Type: providerType})
+	return &cfg.Providers[len(cfg.Providers)-1]
+}
+
+func setDevice(cfg *Config, device Device) {
+	if existing := cfg.Device(device.Name); existing != nil {
+		*existing = device
+		return
+	}
+
+	cfg.Devices = append(cfg.Devices, device)
+}
+
+func overrideString(target *string, envName string) {
+	if value := os.Getenv(envName); value != "" {
+		*target = value
+	}
+}
+
+// ReadSecret reads a secret from the environment variable or from the file
+// the <envName>_FILE variable points to.
+func ReadSecret(envName string) string {
+	secret := os.Getenv(envName)
+
+	if secret != "" {
+		slog.Info("Secret passed via environment variable " + envName + ". It's recommended to pass secrets via files, see https://github.com/cromefire/fritzbox-cloudflare-dyndns?tab=readme-ov-file#passing-secrets.")
+		return secret
+	}
+
+	passwordFilePath := os.Getenv(envName + "_FILE")
+	if passwordFilePath != "" {
+		content, err := os.ReadFile(passwordFilePath)
+		if err != nil {
+			slog.Error("Failed to read secret from file "+passwordFilePath, util.ErrorAttr(err))
+		} else {
+			secret = trimNewline(string(content))
+		}
+	}
+	return secret
+}
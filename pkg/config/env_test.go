@@ -0,0 +1,77 @@
+package config
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseRecordList(t *testing.T) {
+	tests := []struct {
+		name string
+		list string
+		want []Record
+		err  bool
+	}{
+		{
+			name: "single",
+			list: "www.example.com",
+			want: []Record{{Name: "www.example.com"}},
+		},
+		{
+			name: "several with spaces",
+			list: "www.example.com, vpn.example.com ,nas.example.com",
+			want: []Record{{Name: "www.example.com"}, {Name: "vpn.example.com"}, {Name: "nas.example.com"}},
+		},
+		{
+			name: "options",
+			list: "www.example.com|proxied=on|ttl=auto|tags=env:home; owner:me ;|comment=router,vpn.example.com|TTL=300|enforce=true",
+			want: []Record{
+				{Name: "www.example.com", Proxied: "on", TTL: 1, Tags: []string{"env:home", "owner:me"}, Comment: "router"},
+				{Name: "vpn.example.com", TTL: 300, Enforce: true},
+			},
+		},
+		{
+			name: "zone, credential and type",
+			list: "www.example.com|zone=example.com|credential=work|type=HTTPS",
+			want: []Record{{Name: "www.example.com", Zone: "example.com", Credential: "work", Type: "HTTPS"}},
+		},
+		{
+			name: "withdrawal and duplicates",
+			list: "www.example.com|withdraw=fallback|fallback=192.0.2.1|fallback=2001:db8::1|duplicates=keep-one|ptr=true",
+			want: []Record{{Name: "www.example.com", Withdraw: "fallback", FallbackIpv4: "192.0.2.1", FallbackIpv6: "2001:db8::1", Duplicates: "keep-one", Ptr: true}},
+		},
+		{
+			name: "empty tags",
+			list: "www.example.com|tags=",
+			want: []Record{{Name: "www.example.com", Tags: []string{}}},
+		},
+		{name: "empty list", list: "", err: true},
+		{name: "empty entry", list: "www.example.com,,vpn.example.com", err: true},
+		{name: "trailing comma", list: "www.example.com,", err: true},
+		{name: "unknown option", list: "www.example.com|color=blue", err: true},
+		{name: "invalid ttl", list: "www.example.com|ttl=10", err: true},
+		{name: "invalid enforce", list: "www.example.com|enforce=maybe", err: true},
+		{name: "invalid fallback", list: "www.example.com|fallback=home", err: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			records, err := ParseRecordList(tt.list)
+
+			if tt.err {
+				if err == nil {
+					t.Errorf("ParseRecordList() = %+v, want an error", records)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !reflect.DeepEqual(records, tt.want) {
+				t.Errorf("ParseRecordList() = %+v, want %+v", records, tt.want)
+			}
+		})
+	}
+}
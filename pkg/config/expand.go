@@ -0,0 +1,89 @@
+package config
+
+import (
+	"errors"
+	"os"
+	"reflect"
+	"regexp"
+	"strings"
+)
+
+// referencePattern matches ${NAME} (environment variable) and ${FILE:/path}
+// (file content) references.
+var referencePattern = regexp.MustCompile(`\$\{([^}]+)}`)
+
+// expandReferences replaces the references in all string values of the config.
+func expandReferences(cfg *Config) error {
+	return expandValue(reflect.ValueOf(cfg).Elem())
+}
+
+func expandValue(v reflect.Value) error {
+	switch v.Kind() {
+	case reflect.String:
+		expanded, err := Expand(v.String())
+
+		if err != nil {
+			return err
+		}
+
+		v.SetString(expanded)
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			if !v.Type().Field(i).IsExported() {
+				continue
+			}
+
+			err := expandValue(v.Field(i))
+
+			if err != nil {
+				return err
+			}
+		}
+	case reflect.Slice:
+		for i := 0; i < v.Len(); i++ {
+			err := expandValue(v.Index(i))
+
+			if err != nil {
+				return err
+			}
+		}
+	default:
+		// Nothing to expand
+	}
+
+	return nil
+}
+
+// Expand resolves the ${NAME} and ${FILE:/path} references in a value.
+func Expand(value string) (string, error) {
+	var errs []error
+
+	expanded := referencePattern.ReplaceAllStringFunc(value, func(match string) string {
+		ref := referencePattern.FindStringSubmatch(match)[1]
+
+		if path, ok := strings.CutPrefix(ref, "FILE:"); ok {
+			content, err := os.ReadFile(path)
+
+			if err != nil {
+				errs = append(errs, err)
+				return ""
+			}
+
+			return trimNewline(string(content))
+		}
+
+		content, ok := os.LookupEnv(ref)
+
+		if !ok {
+			errs = append(errs, errors.New("environment variable "+ref+" is not set"))
+		}
+
+		return content
+	})
+
+	return expanded, errors.Join(errs...)
+}
+
+func trimNewline(s string) string {
+	return strings.TrimSuffix(strings.TrimSuffix(s, "\r\n"), "\n")
+}
@@ -12,8 +12,7 @@ import (
 
 type Server struct {
 	log            *slog.Logger
-	out            chan<- *net.IP
-	localIp        *net.IP
+	out            chan<- *util.IpUpdate
 	pushExecutions prometheus.Summary
 	status         *util.PushStatus
 
@@ -21,7 +20,7 @@ type Server struct {
 	Password string
 }
 
-func NewServer(out chan<- *net.IP, localIp *net.IP, log *slog.Logger, subsystem string, status *util.PushStatus) *Server {
+func NewServer(out chan<- *util.IpUpdate, log *slog.Logger, subsystem string, status *util.PushStatus) *Server {
 	pushExecutions := promauto.NewSummary(prometheus.SummaryOpts{
 		Subsystem:  util.MakePromSubsystem(subsystem),
 		Name:       "execution_seconds",
@@ -31,7 +30,6 @@ func NewServer(out chan<- *net.IP, localIp *net.IP, log *slog.Logger, subsystem
 	return &Server{
 		log:            log.With(slog.String("module", "dyndns")),
 		out:            out,
-		localIp:        localIp,
 		pushExecutions: pushExecutions,
 		status:         status,
 	}
@@ -85,64 +83,48 @@ func (s *Server) Handler(w http.ResponseWriter, r *http.Request) {
 		ipv4 := net.ParseIP(v4Str)
 		if ipv4 != nil && ipv4.To4() != nil {
 			s.log.Info("Forwarding update request for IPv4", slog.Any("ipv4", ipv4))
-			s.out <- &ipv4
+			s.out <- &util.IpUpdate{Source: util.SourcePush, IpVersion: 4, Ip: ipv4}
 		} else {
 			s.log.Warn("Failed to parse IPv4 address", slog.String("input", v4Str))
 			success = false
 		}
 	}
 
-	if *s.localIp == nil {
-		// Parse IPv6
-		v6Str := params.Get("v6")
-		if v6Str == "" {
-			s.log.Warn("No IPv6 can be set as the `v6` parameter was not supplied")
+	update := util.IpUpdate{Source: util.SourcePush, IpVersion: 6}
+
+	// Parse IPv6
+	v6Str := params.Get("v6")
+	if v6Str == "" {
+		s.log.Warn("No IPv6 can be set as the `v6` parameter was not supplied")
+	} else {
+		ipv6 := net.ParseIP(v6Str)
+		if ipv6 != nil && ipv6.To4() == nil {
+			update.Ip = ipv6
 		} else {
-			ipv6 := net.ParseIP(v6Str)
-			if ipv6 != nil && ipv6.To4() == nil {
-				s.log.Info("Forwarding update request for IPv6", slog.Any("ipv6", ipv6))
-				s.out <- &ipv6
-			} else {
-				s.log.Warn("Failed to parse IPv6 address", slog.String("input", v6Str))
-				success = false
-			}
+			s.log.Warn("Failed to parse IPv6 address", slog.String("input", v6Str))
+			success = false
 		}
+	}
+
+	// Parse Prefix
+	prefixStr := params.Get("prefix")
+	if prefixStr == "" {
+		s.log.Debug("No IPv6 for devices can be calculated as the `prefix` parameter was not supplied")
 	} else {
-		// Parse Prefix
-		prefixStr := params.Get("prefix")
-		if prefixStr == "" {
-			s.log.Warn("No IPv6 can be calculated and set as the `prefix` parameter was not supplied")
+		_, prefix, err := net.ParseCIDR(prefixStr)
+		if err != nil {
+			s.log.Warn("Failed to parse prefix", slog.String("input", prefixStr), util.ErrorAttr(err))
+			success = false
 		} else {
-			_, prefix, err := net.ParseCIDR(prefixStr)
-			if err != nil {
-				s.log.Warn("Failed to parse prefix", slog.String("input", prefixStr), util.ErrorAttr(err))
-				success = false
-			} else {
-
-				constructedIp := make(net.IP, net.IPv6len)
-				copy(constructedIp, prefix.IP)
-
-				maskLen, _ := prefix.Mask.Size()
-
-				for i := 0; i < net.IPv6len; i++ {
-					b := constructedIp[i]
-					lb := (*s.localIp)[i]
-					var mask byte = 0b00000000
-					for j := 0; j < 8; j++ {
-						if (i*8 + j) >= maskLen {
-							mask += 0b00000001 << (7 - j)
-						}
-					}
-					b += lb & mask
-					constructedIp[i] = b
-				}
-
-				s.log.Info("Forwarding update request for IPv6", slog.Any("prefix", prefix), slog.Any("ipv6", constructedIp))
-				s.out <- &constructedIp
-			}
+			update.Prefix = prefix
 		}
 	}
 
+	if update.Ip != nil || update.Prefix != nil {
+		s.log.Info("Forwarding update request for IPv6", slog.Any("ipv6", update.Ip), slog.Any("prefix", update.Prefix))
+		s.out <- &update
+	}
+
 	if success {
 		w.WriteHeader(http.StatusAccepted)
 	} else {
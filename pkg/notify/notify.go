@@ -0,0 +1,105 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/cromefire/fritzbox-cloudflare-dyndns/pkg/util"
+	"log/slog"
+	"net/http"
+	"slices"
+	"time"
+)
+
+const (
+	EventUpdateSucceeded = "update_succeeded"
+	EventUpdateFailed    = "update_failed"
+	// EventRecordsWithdrawn is sent when the records of a lost address are deleted
+	EventRecordsWithdrawn = "records_withdrawn"
+)
+
+// Event is sent as JSON to the webhooks.
+type Event struct {
+	Type      string    `json:"type"`
+	Time      time.Time `json:"time"`
+	Provider  string    `json:"provider"`
+	Domain    string    `json:"domain"`
+	IpVersion uint8     `json:"ipVersion"`
+	Content   string    `json:"content"`
+	Error     string    `json:"error,omitempty"`
+}
+
+type Webhook struct {
+	Url string
+	// Events to send, all if empty
+	Events []string
+}
+
+// Notifier delivers events to webhooks in the background.
+type Notifier struct {
+	hooks  []Webhook
+	client *http.Client
+	log    *slog.Logger
+}
+
+func NewNotifier(hooks []Webhook, log *slog.Logger) *Notifier {
+	return &Notifier{
+		hooks:  hooks,
+		client: &http.Client{Timeout: 30 * time.Second},
+		log:    log.With(slog.String("module", "notify")),
+	}
+}
+
+// Notify sends the event to all interested webhooks without blocking. It's
+// safe to call on a nil Notifier.
+func (n *Notifier) Notify(event Event) {
+	if n == nil {
+		return
+	}
+
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+
+	for _, hook := range n.hooks {
+		if len(hook.Events) > 0 && !slices.Contains(hook.Events, event.Type) {
+			continue
+		}
+
+		go n.send(hook, event)
+	}
+}
+
+func (n *Notifier) send(hook Webhook, event Event) {
+	body, err := json.Marshal(event)
+
+	if err != nil {
+		n.log.Error("Failed to encode notification", util.ErrorAttr(err))
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, hook.Url, bytes.NewReader(body))
+
+	if err != nil {
+		n.log.Error("Failed to create notification request", util.ErrorAttr(err))
+		return
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+
+	res, err := n.client.Do(req)
+
+	if err != nil {
+		n.log.Warn("Failed to send notification", util.ErrorAttr(err))
+		return
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		n.log.Warn("Notification rejected", util.ErrorAttr(fmt.Errorf("HTTP %d", res.StatusCode)))
+	}
+}
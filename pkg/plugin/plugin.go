@@ -0,0 +1,265 @@
+package plugin
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/cromefire/fritzbox-cloudflare-dyndns/pkg/provider"
+	"github.com/cromefire/fritzbox-cloudflare-dyndns/pkg/util"
+	"io"
+	"log/slog"
+	"os"
+	"os/exec"
+	"sync"
+	"time"
+)
+
+const (
+	MethodList   = "list"
+	MethodUpsert = "upsert"
+	MethodDelete = "delete"
+)
+
+// Request is written as a single JSON line to the stdin of the plugin.
+type Request struct {
+	Id     uint64          `json:"id"`
+	Method string          `json:"method"`
+	Record provider.Record `json:"record"`
+}
+
+// Response is expected as a single JSON line on the stdout of the plugin for
+// every request. Records is only used for list requests, a non-empty Error
+// fails the request. RetryAfter is the number of seconds a rate limited
+// request shouldn't be retried.
+type Response struct {
+	Id         uint64            `json:"id"`
+	Records    []provider.Record `json:"records,omitempty"`
+	Error      string            `json:"error,omitempty"`
+	RetryAfter int               `json:"retryAfter,omitempty"`
+}
+
+// Plugin is a provider.Provider backed by an external executable speaking
+// JSON lines over stdin/stdout. The process is started on the first request,
+// kept running for subsequent ones and restarted if it exits or misbehaves.
+type Plugin struct {
+	Command string
+	Args    []string
+	Env     []string
+
+	log *slog.Logger
+
+	lock      sync.Mutex
+	cmd       *exec.Cmd
+	stdin     io.WriteCloser
+	responses chan Response
+	nextId    uint64
+
+	rateLimit util.RateLimit
+}
+
+func NewPlugin(command string, args []string, log *slog.Logger) *Plugin {
+	return &Plugin{
+		Command: command,
+		Args:    args,
+		log:     log.With(slog.String("module", "plugin"), slog.String("command", command)),
+	}
+}
+
+func (p *Plugin) start() error {
+	cmd := exec.Command(p.Command, p.Args...)
+	cmd.Env = append(os.Environ(), p.Env...)
+
+	stdin, err := cmd.StdinPipe()
+
+	if err != nil {
+		return err
+	}
+
+	stdout, err := cmd.StdoutPipe()
+
+	if err != nil {
+		return err
+	}
+
+	cmd.Stderr = &logWriter{log: p.log}
+
+	err = cmd.Start()
+
+	if err != nil {
+		return err
+	}
+
+	p.log.Info("Started plugin", slog.Int("pid", cmd.Process.Pid))
+
+	responses := make(chan Response)
+
+	go func() {
+		scanner := bufio.NewScanner(stdout)
+		scanner.Buffer(make([]byte, 0, 64*1024), 4*1024*1024)
+
+		for scanner.Scan() {
+			res := Response{}
+			err := json.Unmarshal(scanner.Bytes(), &res)
+
+			if err != nil {
+				p.log.Warn("Ignoring malformed plugin output", slog.String("line", scanner.Text()), util.ErrorAttr(err))
+				continue
+			}
+
+			responses <- res
+		}
+
+		if err := scanner.Err(); err != nil {
+			p.log.Error("Failed to read plugin output", util.ErrorAttr(err))
+		}
+
+		// The pending request fails and stops the plugin, which lets Wait
+		// return even if it's still running
+		close(responses)
+
+		// Wait closes stdout, so it may only be called once all output is read
+		err := cmd.Wait()
+		p.log.Info("Plugin exited", util.ErrorAttr(err))
+	}()
+
+	p.cmd = cmd
+	p.stdin = stdin
+	p.responses = responses
+
+	return nil
+}
+
+func (p *Plugin) stop() {
+	if p.cmd == nil {
+		return
+	}
+
+	_ = p.stdin.Close()
+	_ = p.cmd.Process.Kill()
+
+	// Drain remaining output so the reader goroutine can finish
+	go func(responses chan Response) {
+		for range responses {
+		}
+	}(p.responses)
+
+	p.cmd = nil
+	p.stdin = nil
+	p.responses = nil
+}
+
+// Close stops the plugin process if it's running.
+func (p *Plugin) Close() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	p.stop()
+}
+
+func (p *Plugin) call(ctx context.Context, method string, record provider.Record) (Response, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if p.cmd == nil {
+		err := p.start()
+
+		if err != nil {
+			return Response{}, fmt.Errorf("failed to start plugin: %w", err)
+		}
+	}
+
+	p.nextId++
+	req := Request{Id: p.nextId, Method: method, Record: record}
+
+	line, err := json.Marshal(req)
+
+	if err != nil {
+		return Response{}, err
+	}
+
+	_, err = p.stdin.Write(append(line, '\n'))
+
+	if err != nil {
+		p.stop()
+		return Response{}, fmt.Errorf("failed to write to plugin: %w", err)
+	}
+
+	for {
+		select {
+		case res, ok := <-p.responses:
+			if !ok {
+				p.stop()
+				return Response{}, errors.New("plugin exited unexpectedly")
+			}
+
+			// Skip late answers to requests that timed out earlier
+			if res.Id != req.Id {
+				continue
+			}
+
+			if res.RetryAfter > 0 {
+				p.rateLimit.Extend(time.Now().Add(time.Duration(res.RetryAfter) * time.Second))
+			}
+
+			if res.Error != "" {
+				return res, errors.New(res.Error)
+			}
+
+			return res, nil
+		case <-ctx.Done():
+			// The plugin is in an unknown state now, so start over next time
+			p.stop()
+			return Response{}, ctx.Err()
+		}
+	}
+}
+
+// LimitedUntil returns until when the plugin asked not to retry requests.
+func (p *Plugin) LimitedUntil() time.Time {
+	return p.rateLimit.LimitedUntil()
+}
+
+func (p *Plugin) List(ctx context.Context, name string, recordType string) ([]provider.Record, error) {
+	res, err := p.call(ctx, MethodList, provider.Record{Name: name, Type: recordType})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return res.Records, nil
+}
+
+func (p *Plugin) Upsert(ctx context.Context, record provider.Record) error {
+	_, err := p.call(ctx, MethodUpsert, record)
+	return err
+}
+
+func (p *Plugin) Delete(ctx context.Context, record provider.Record) error {
+	_, err := p.call(ctx, MethodDelete, record)
+	return err
+}
+
+// logWriter forwards the stderr of the plugin to the logger line by line.
+type logWriter struct {
+	log *slog.Logger
+	buf []byte
+}
+
+func (w *logWriter) Write(b []byte) (int, error) {
+	w.buf = append(w.buf, b...)
+
+	for {
+		i := bytes.IndexByte(w.buf, '\n')
+		if i < 0 {
+			break
+		}
+
+		w.log.Info("Plugin output", slog.String("line", string(w.buf[:i])))
+		w.buf = w.buf[i+1:]
+	}
+
+	return len(b), nil
+}
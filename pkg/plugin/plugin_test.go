@@ -0,0 +1,192 @@
+package plugin
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/cromefire/fritzbox-cloudflare-dyndns/pkg/provider"
+	"io"
+	"log/slog"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+const pluginModeEnv = "PLUGIN_TEST_MODE"
+
+// TestMain runs the test binary as a plugin if the mode is set.
+func TestMain(m *testing.M) {
+	if mode := os.Getenv(pluginModeEnv); mode != "" {
+		runPlugin(mode)
+		os.Exit(0)
+	}
+
+	os.Exit(m.Run())
+}
+
+// runPlugin keeps the records in memory. It answers every request with some
+// noise first: a log line on stderr, a malformed line and a late answer to an
+// earlier request. In the "exit" mode it exits after the first answer, in the
+// "hang" mode it never answers.
+func runPlugin(mode string) {
+	records := map[string][]provider.Record{}
+	scanner := bufio.NewScanner(os.Stdin)
+	out := json.NewEncoder(os.Stdout)
+
+	for scanner.Scan() {
+		req := Request{}
+		err := json.Unmarshal(scanner.Bytes(), &req)
+
+		if err != nil {
+			_, _ = fmt.Fprintln(os.Stderr, "invalid request:", err)
+			os.Exit(1)
+		}
+
+		if mode == "hang" {
+			continue
+		}
+
+		_, _ = fmt.Fprintln(os.Stderr, "handling", req.Method, req.Record.Name)
+		_, _ = fmt.Println("not json")
+		_ = out.Encode(Response{Id: req.Id - 1, Error: "late answer"})
+
+		key := req.Record.Name + "/" + req.Record.Type
+		res := Response{Id: req.Id}
+
+		switch req.Method {
+		case MethodList:
+			res.Records = records[key]
+		case MethodUpsert:
+			if req.Record.Content == "" {
+				res.Error = "missing content"
+			} else if req.Record.Content == "limited" {
+				res.Error = "rate limited"
+				res.RetryAfter = 60
+			} else {
+				records[key] = []provider.Record{req.Record}
+			}
+		case MethodDelete:
+			delete(records, key)
+		default:
+			res.Error = "unknown method " + req.Method
+		}
+
+		_ = out.Encode(res)
+
+		if mode == "exit" {
+			return
+		}
+	}
+}
+
+func newTestPlugin(t *testing.T, mode string) *Plugin {
+	p := NewPlugin(os.Args[0], []string{"-test.run=^$"}, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	p.Env = []string{pluginModeEnv + "=" + mode}
+	t.Cleanup(p.Close)
+
+	return p
+}
+
+func TestPluginProtocol(t *testing.T) {
+	p := newTestPlugin(t, "records")
+	ctx := context.Background()
+	record := provider.Record{Name: "home.example.com", Type: "A", Content: "192.0.2.1", TTL: 60}
+
+	steps := []struct {
+		name    string
+		call    func() error
+		records []provider.Record
+		err     string
+	}{
+		{name: "list empty"},
+		{name: "upsert", call: func() error { return p.Upsert(ctx, record) }, records: []provider.Record{record}},
+		{name: "upsert error", call: func() error { return p.Upsert(ctx, provider.Record{Name: record.Name, Type: "A"}) }, records: []provider.Record{record}, err: "missing content"},
+		{name: "delete", call: func() error { return p.Delete(ctx, record) }},
+	}
+
+	for _, step := range steps {
+		if step.call != nil {
+			err := step.call()
+
+			if (step.err == "" && err != nil) || (step.err != "" && (err == nil || err.Error() != step.err)) {
+				t.Fatalf("%s: error %v, want %q", step.name, err, step.err)
+			}
+		}
+
+		records, err := p.List(ctx, record.Name, record.Type)
+
+		if err != nil {
+			t.Fatalf("%s: %v", step.name, err)
+		}
+
+		if (len(records) > 0 || len(step.records) > 0) && !reflect.DeepEqual(records, step.records) {
+			t.Errorf("%s: List() = %v, want %v", step.name, records, step.records)
+		}
+	}
+}
+
+func TestPluginRestart(t *testing.T) {
+	p := newTestPlugin(t, "exit")
+	ctx := context.Background()
+	record := provider.Record{Name: "home.example.com", Type: "A", Content: "192.0.2.1"}
+
+	err := p.Upsert(ctx, record)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The plugin exited after answering, so the next request fails
+	err = p.Upsert(ctx, record)
+
+	if err == nil {
+		t.Fatal("Upsert() succeeded after the plugin exited")
+	}
+
+	// and the one after that starts it again, which lost the records
+	records, err := p.List(ctx, record.Name, record.Type)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(records) != 0 {
+		t.Errorf("List() = %v, want no records", records)
+	}
+}
+
+func TestPluginTimeout(t *testing.T) {
+	p := newTestPlugin(t, "hang")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+
+	_, err := p.List(ctx, "home.example.com", "A")
+
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("List() = %v, want %v", err, context.DeadlineExceeded)
+	}
+
+	// The plugin was stopped and is started again for the next request
+	if p.cmd != nil {
+		t.Error("plugin still running after the timeout")
+	}
+}
+
+func TestPluginRetryAfter(t *testing.T) {
+	p := newTestPlugin(t, "records")
+	before := time.Now()
+
+	err := p.Upsert(context.Background(), provider.Record{Name: "home.example.com", Type: "A", Content: "limited"})
+
+	if err == nil || err.Error() != "rate limited" {
+		t.Fatalf("Upsert() = %v, want the rate limit", err)
+	}
+
+	if until := p.LimitedUntil(); until.Before(before.Add(time.Minute)) || until.After(time.Now().Add(time.Minute)) {
+		t.Errorf("LimitedUntil() = %s, want a minute from now", until)
+	}
+}
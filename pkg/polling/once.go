@@ -0,0 +1,69 @@
+package polling
+
+import (
+	"errors"
+	"fmt"
+	"github.com/cromefire/fritzbox-cloudflare-dyndns/pkg/config"
+	"github.com/cromefire/fritzbox-cloudflare-dyndns/pkg/util"
+	"log/slog"
+)
+
+// PollOnce polls the WAN addresses from the router a single time. The
+// updates of all addresses that could be polled are returned alongside the
+// errors of the others. Like the poll server, addresses the router reports as
+// missing are returned as withdrawn.
+func PollOnce(router config.Router, useIpv4 bool, useWanIpv6 bool, usePrefix bool, logger *slog.Logger) ([]*util.IpUpdate, error) {
+	fritzbox := NewFritzBox(router, logger)
+	updates := make([]*util.IpUpdate, 0, 2)
+	errs := make([]error, 0)
+
+	if useIpv4 {
+		ipv4, err := fritzbox.GetWanIpv4()
+
+		if err != nil {
+			errs = append(errs, fmt.Errorf("failed to poll WAN IPv4: %w", err))
+		} else if ipv4 == nil || ipv4.IsUnspecified() {
+			updates = append(updates, &util.IpUpdate{Source: router.Name, IpVersion: 4, Withdrawn: true})
+		} else {
+			updates = append(updates, &util.IpUpdate{Source: router.Name, IpVersion: 4, Ip: ipv4})
+		}
+	}
+
+	update := util.IpUpdate{Source: router.Name, IpVersion: 6}
+	// withdrawnV6 is set if an address is missing and unknownV6 if one
+	// couldn't be polled, which then might just as well be missing
+	withdrawnV6 := false
+	unknownV6 := false
+
+	if useWanIpv6 {
+		ipv6, err := fritzbox.GetwanIpv6()
+
+		if err != nil {
+			errs = append(errs, fmt.Errorf("failed to poll WAN IPv6: %w", err))
+			unknownV6 = true
+		} else {
+			update.Ip = ipv6
+			withdrawnV6 = ipv6 == nil
+		}
+	}
+
+	if usePrefix {
+		prefix, err := fritzbox.GetIpv6Prefix()
+
+		if err != nil {
+			errs = append(errs, fmt.Errorf("failed to poll IPv6 Prefix: %w", err))
+			unknownV6 = true
+		} else {
+			update.Prefix = prefix
+			withdrawnV6 = withdrawnV6 || prefix == nil
+		}
+	}
+
+	update.Withdrawn = withdrawnV6 && !unknownV6
+
+	if update.Ip != nil || update.Prefix != nil || update.Withdrawn {
+		updates = append(updates, &update)
+	}
+
+	return updates, errors.Join(errs...)
+}
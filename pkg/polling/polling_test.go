@@ -0,0 +1,199 @@
+package polling
+
+import (
+	"fmt"
+	"github.com/cromefire/fritzbox-cloudflare-dyndns/pkg/config"
+	"github.com/cromefire/fritzbox-cloudflare-dyndns/pkg/util"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeRouter answers the SOAP requests for the WAN addresses like a router,
+// an empty address is reported as missing.
+type fakeRouter struct {
+	lock   sync.Mutex
+	ipv4   string
+	ipv6   string
+	prefix string
+}
+
+func (f *fakeRouter) set(ipv4 string, ipv6 string, prefix string) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	f.ipv4, f.ipv6, f.prefix = ipv4, ipv6, prefix
+}
+
+func (f *fakeRouter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	action := r.Header.Get("SoapAction")
+	response := ""
+
+	switch {
+	case strings.HasSuffix(action, "#GetExternalIPAddress"):
+		// The router reports the unspecified address while disconnected
+		ipv4 := f.ipv4
+		if ipv4 == "" {
+			ipv4 = "0.0.0.0"
+		}
+
+		response = "<NewExternalIPAddress>" + ipv4 + "</NewExternalIPAddress>"
+	case strings.HasSuffix(action, "#X_AVM_DE_GetExternalIPv6Address"):
+		lifetime := "3600"
+		if f.ipv6 == "" {
+			lifetime = "0"
+		}
+
+		response = "<NewExternalIPv6Address>" + f.ipv6 + "</NewExternalIPv6Address><NewValidLifetime>" + lifetime + "</NewValidLifetime>"
+	case strings.HasSuffix(action, "#X_AVM_DE_GetIPv6Prefix"):
+		lifetime := "3600"
+		if f.prefix == "" {
+			lifetime = "0"
+		}
+
+		response = "<NewIPv6Prefix>" + f.prefix + "</NewIPv6Prefix><NewPrefixLength>56</NewPrefixLength><NewValidLifetime>" + lifetime + "</NewValidLifetime>"
+	default:
+		http.Error(w, "unknown action", http.StatusBadRequest)
+		return
+	}
+
+	_, _ = fmt.Fprintf(w, `<?xml version="1.0"?><s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/"><s:Body><u:Response>%s</u:Response></s:Body></s:Envelope>`, response)
+}
+
+func newFakeRouter(t *testing.T, name string, interval time.Duration) (*fakeRouter, config.Router) {
+	fake := &fakeRouter{}
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+
+	return fake, config.Router{Name: name, Url: server.URL, Interval: config.Duration{Duration: interval}}
+}
+
+func testLogger() *slog.Logger {
+	return slog.New(slog.NewTextHandler(io.Discard, nil))
+}
+
+// receive returns the next update, failing if there's none within a second.
+func receive(t *testing.T, updates <-chan *util.IpUpdate) *util.IpUpdate {
+	t.Helper()
+
+	select {
+	case update := <-updates:
+		return update
+	case <-time.After(time.Second):
+		t.Fatal("no update received")
+		return nil
+	}
+}
+
+func TestPollServerWithdrawsOnFirstPoll(t *testing.T) {
+	// The addresses are missing on the first poll, i.e. lost before a restart
+	_, router := newFakeRouter(t, "first-poll", time.Hour)
+	updates := make(chan *util.IpUpdate)
+
+	StartPollServer(updates, router, true, true, true, testLogger())
+
+	if update := receive(t, updates); update.IpVersion != 4 || !update.Withdrawn || update.Ip != nil {
+		t.Errorf("IPv4 update = %+v, want it withdrawn", update)
+	}
+
+	if update := receive(t, updates); update.IpVersion != 6 || !update.Withdrawn || update.Ip != nil || update.Prefix != nil {
+		t.Errorf("IPv6 update = %+v, want it withdrawn", update)
+	}
+}
+
+func TestPollServerWithdrawsOnce(t *testing.T) {
+	fake, router := newFakeRouter(t, "withdraws-once", 10*time.Millisecond)
+	fake.set("192.0.2.1", "", "2001:db8::")
+	updates := make(chan *util.IpUpdate)
+
+	StartPollServer(updates, router, true, false, true, testLogger())
+
+	if update := receive(t, updates); update.Withdrawn || update.Ip.String() != "192.0.2.1" {
+		t.Errorf("IPv4 update = %+v, want the address", update)
+	}
+
+	if update := receive(t, updates); update.Withdrawn || update.Prefix.String() != "2001:db8::/56" {
+		t.Errorf("IPv6 update = %+v, want the prefix", update)
+	}
+
+	fake.set("", "", "")
+
+	if update := receive(t, updates); update.IpVersion != 4 || !update.Withdrawn {
+		t.Errorf("IPv4 update = %+v, want it withdrawn", update)
+	}
+
+	if update := receive(t, updates); update.IpVersion != 6 || !update.Withdrawn {
+		t.Errorf("IPv6 update = %+v, want it withdrawn", update)
+	}
+
+	// The withdrawal isn't repeated by the following polls
+	select {
+	case update := <-updates:
+		t.Errorf("update = %+v, want none", update)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	fake.set("192.0.2.2", "", "")
+
+	if update := receive(t, updates); update.Withdrawn || update.Ip.String() != "192.0.2.2" {
+		t.Errorf("IPv4 update = %+v, want the new address", update)
+	}
+}
+
+func TestPollOnce(t *testing.T) {
+	fake, router := newFakeRouter(t, "once", time.Hour)
+	fake.set("192.0.2.1", "", "2001:db8::")
+
+	updates, err := PollOnce(router, true, true, true, testLogger())
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(updates) != 2 {
+		t.Fatalf("updates = %+v, want IPv4 and IPv6", updates)
+	}
+
+	if update := updates[0]; update.Withdrawn || update.Ip.String() != "192.0.2.1" {
+		t.Errorf("IPv4 update = %+v, want the address", update)
+	}
+
+	// The prefix is known but the WAN IPv6 is missing
+	if update := updates[1]; !update.Withdrawn || update.Ip != nil || update.Prefix.String() != "2001:db8::/56" {
+		t.Errorf("IPv6 update = %+v, want the prefix and the address withdrawn", update)
+	}
+}
+
+func TestPollOnceWithdrawn(t *testing.T) {
+	_, router := newFakeRouter(t, "once-withdrawn", time.Hour)
+
+	updates, err := PollOnce(router, true, true, true, testLogger())
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(updates) != 2 || !updates[0].Withdrawn || !updates[1].Withdrawn {
+		t.Errorf("updates = %+v, want both families withdrawn", updates)
+	}
+}
+
+func TestPollOnceUnknown(t *testing.T) {
+	_, router := newFakeRouter(t, "once-unknown", time.Hour)
+	// Nothing answers, so the addresses are unknown rather than missing
+	router.Url = "http://127.0.0.1:1"
+
+	updates, err := PollOnce(router, true, true, true, testLogger())
+
+	if err == nil || len(updates) != 0 {
+		t.Errorf("PollOnce = %+v, %v, want no updates and an error", updates, err)
+	}
+}
@@ -2,62 +2,52 @@ package polling
 
 import (
 	"github.com/cromefire/fritzbox-cloudflare-dyndns/pkg/avm"
+	"github.com/cromefire/fritzbox-cloudflare-dyndns/pkg/config"
 	"github.com/cromefire/fritzbox-cloudflare-dyndns/pkg/util"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
 	"log/slog"
 	"net"
-	"net/url"
-	"os"
 	"strings"
 	"time"
 )
 
-func StartPollServer(out chan<- *net.IP, localIp *net.IP, logger *slog.Logger) *util.PollStatus {
+// StartPollServer polls the WAN addresses from the router in the configured
+// interval and sends them to out whenever they change. useWanIpv6 polls the
+// IPv6 address of the router itself and usePrefix the IPv6 LAN prefix.
+func StartPollServer(out chan<- *util.IpUpdate, router config.Router, useIpv4 bool, useWanIpv6 bool, usePrefix bool, logger *slog.Logger) *util.PollStatus {
 	const subsystem = "fritzbox_polling"
-	logger = logger.With(util.SubsystemAttr(subsystem))
-	fritzbox := newFritzBox(logger)
+	logger = logger.With(util.SubsystemAttr(subsystem), slog.String("router", router.Name))
+	fritzbox := NewFritzBox(router, logger)
 
-	// Import endpoint polling interval duration
-	interval := os.Getenv("FRITZBOX_ENDPOINT_INTERVAL")
-	useIpv4 := os.Getenv("CLOUDFLARE_ZONES_IPV4") != ""
-	useIpv6 := os.Getenv("CLOUDFLARE_ZONES_IPV6") != ""
+	ticker := time.NewTicker(router.Interval.Duration)
 
-	var ticker *time.Ticker
-
-	if interval != "" {
-		v, err := time.ParseDuration(interval)
-
-		if err != nil {
-			logger.Warn("Failed to parse FRITZBOX_ENDPOINT_INTERVAL, using defaults", util.ErrorAttr(err))
-			ticker = time.NewTicker(300 * time.Second)
-		} else {
-			ticker = time.NewTicker(v)
-		}
-	} else {
-		logger.Info("Env FRITZBOX_ENDPOINT_INTERVAL not found, disabling polling")
-		return nil
-	}
-
-	status := util.PollStatus{Succeeded: true}
+	status := util.PollStatus{Router: router.Name, Succeeded: true}
 
 	go func() {
 		lastV4 := net.IP{}
 		lastV6 := net.IP{}
+		lastPrefix := net.IPNet{}
+		// The lost flags are set once the withdrawal of an address was sent.
+		// They start unset, so addresses missing on the first poll, i.e. lost
+		// while the poll server wasn't running, are withdrawn as well.
+		lostV4 := false
+		lostV6 := false
+		lostPrefix := false
 
 		pollExecutionsUnchanged := promauto.NewSummary(prometheus.SummaryOpts{
 			Subsystem:   util.MakePromSubsystem(subsystem),
 			Name:        "execution_seconds",
 			Help:        "A summary of the poll server executions",
 			Objectives:  map[float64]float64{0: 0, 0.5: 0.05, 0.9: 0.01, 0.99: 0.001, 1: 1},
-			ConstLabels: prometheus.Labels{"changed": "false"},
+			ConstLabels: prometheus.Labels{"changed": "false", "router": router.Name},
 		})
 		pollExecutionsChanged := promauto.NewSummary(prometheus.SummaryOpts{
 			Subsystem:   util.MakePromSubsystem(subsystem),
 			Name:        "execution_seconds",
 			Help:        "A summary of the poll server executions",
 			Objectives:  map[float64]float64{0: 0, 0.5: 0.05, 0.9: 0.01, 0.99: 0.001, 1: 1},
-			ConstLabels: prometheus.Labels{"changed": "true"},
+			ConstLabels: prometheus.Labels{"changed": "true", "router": router.Name},
 		})
 
 		poll := func() {
@@ -83,63 +73,90 @@ func StartPollServer(out chan<- *net.IP, localIp *net.IP, logger *slog.Logger) *
 				if err != nil {
 					logger.Warn("Failed to poll WAN IPv4 from router", util.ErrorAttr(err))
 					success = false
-				} else {
-					if !lastV4.Equal(ipv4) {
+				} else if ipv4 == nil || ipv4.IsUnspecified() {
+					// The router reports no or an unspecified address while disconnected
+					if !lostV4 {
 						changed = true
-						logger.Info("New WAN IPv4 found", slog.Any("ipv4", ipv4))
-						out <- &ipv4
-						lastV4 = ipv4
+						logger.Warn("WAN IPv4 withdrawn")
+						out <- &util.IpUpdate{Source: router.Name, IpVersion: 4, Withdrawn: true}
+						lastV4 = net.IP{}
+						lostV4 = true
 					}
+				} else if !lastV4.Equal(ipv4) {
+					changed = true
+					logger.Info("New WAN IPv4 found", slog.Any("ipv4", ipv4))
+					out <- &util.IpUpdate{Source: router.Name, IpVersion: 4, Ip: ipv4}
+					lastV4 = ipv4
+					lostV4 = false
 				}
 			}
 
-			if *localIp == nil && useIpv6 {
+			update := util.IpUpdate{Source: router.Name, IpVersion: 6}
+			changedV6 := false
+			// withdrawnV6 is set if an address was lost and unknownV6 if one
+			// couldn't be polled, which then might just as well be lost
+			withdrawnV6 := false
+			unknownV6 := false
+
+			if useWanIpv6 {
 				ipv6, err := fritzbox.GetwanIpv6()
 
 				if err != nil {
 					logger.Warn("Failed to poll WAN IPv6 from router", util.ErrorAttr(err))
 					success = false
+					unknownV6 = true
+				} else if ipv6 == nil {
+					if !lostV6 {
+						changedV6 = true
+						withdrawnV6 = true
+						logger.Warn("WAN IPv6 withdrawn")
+						lastV6 = net.IP{}
+						lostV6 = true
+					}
 				} else {
+					update.Ip = ipv6
+
 					if !lastV6.Equal(ipv6) {
-						changed = true
+						changedV6 = true
 						logger.Info("New WAN IPv6 found", slog.Any("ipv6", ipv6))
-						out <- &ipv6
 						lastV6 = ipv6
+						lostV6 = false
 					}
 				}
-			} else if useIpv6 {
+			}
+
+			if usePrefix {
 				prefix, err := fritzbox.GetIpv6Prefix()
 
 				if err != nil {
 					logger.Warn("Failed to poll IPv6 Prefix from router", util.ErrorAttr(err))
 					success = false
-				} else {
-					constructedIp := make(net.IP, net.IPv6len)
-					copy(constructedIp, prefix.IP)
-
-					maskLen, _ := prefix.Mask.Size()
-
-					for i := 0; i < net.IPv6len; i++ {
-						b := constructedIp[i]
-						lb := (*localIp)[i]
-						var mask byte = 0b00000000
-						for j := 0; j < 8; j++ {
-							if (i*8 + j) >= maskLen {
-								mask += 0b00000001 << (7 - j)
-							}
-						}
-						b += lb & mask
-						constructedIp[i] = b
+					unknownV6 = true
+				} else if prefix == nil {
+					if !lostPrefix {
+						changedV6 = true
+						withdrawnV6 = true
+						logger.Warn("IPv6 Prefix withdrawn")
+						lastPrefix = net.IPNet{}
+						lostPrefix = true
 					}
+				} else {
+					update.Prefix = prefix
 
-					if !lastV6.Equal(prefix.IP) {
-						changed = true
-						logger.Info("New IPv6 Prefix found", slog.Any("prefix", prefix), slog.Any("ipv6", constructedIp))
-						out <- &constructedIp
-						lastV6 = prefix.IP
+					if !lastPrefix.IP.Equal(prefix.IP) {
+						changedV6 = true
+						logger.Info("New IPv6 Prefix found", slog.Any("prefix", prefix))
+						lastPrefix = *prefix
+						lostPrefix = false
 					}
 				}
 			}
+
+			if changedV6 {
+				changed = true
+				update.Withdrawn = withdrawnV6 && !unknownV6
+				out <- &update
+			}
 		}
 
 		poll()
@@ -155,38 +172,13 @@ func StartPollServer(out chan<- *net.IP, localIp *net.IP, logger *slog.Logger) *
 	return &status
 }
 
-func newFritzBox(logger *slog.Logger) *avm.FritzBox {
+// NewFritzBox creates a client for the SOAP API of the router.
+func NewFritzBox(router config.Router, logger *slog.Logger) *avm.FritzBox {
 	fb := avm.NewFritzBox(logger)
+	fb.Url = strings.TrimRight(router.Url, "/")
 
-	// Import FritzBox endpoint url
-	endpointUrl := os.Getenv("FRITZBOX_ENDPOINT_URL")
-
-	if endpointUrl != "" {
-		v, err := url.ParseRequestURI(endpointUrl)
-
-		if err != nil {
-			logger.Error("Failed to parse env FRITZBOX_ENDPOINT_URL", util.ErrorAttr(err))
-			panic(err)
-		}
-
-		fb.Url = strings.TrimRight(v.String(), "/")
-		fb.Url = strings.TrimRight(v.String(), "/")
-	} else {
-		logger.Info("Env FRITZBOX_ENDPOINT_URL not found, disabling FritzBox polling")
-		return nil
-	}
-
-	// Import FritzBox endpoint timeout setting
-	endpointTimeout := os.Getenv("FRITZBOX_ENDPOINT_TIMEOUT")
-
-	if endpointTimeout != "" {
-		v, err := time.ParseDuration(endpointTimeout)
-
-		if err != nil {
-			logger.Warn("Failed to parse FRITZBOX_ENDPOINT_TIMEOUT, using defaults", util.ErrorAttr(err))
-		} else {
-			fb.Timeout = v
-		}
+	if router.Timeout.Duration > 0 {
+		fb.Timeout = router.Timeout.Duration
 	}
 
 	return fb
@@ -0,0 +1,48 @@
+package provider
+
+import (
+	"context"
+	"net"
+	"time"
+)
+
+// Record is a single DNS resource record as seen by a Provider.
+type Record struct {
+	Name    string `json:"name"`
+	Type    string `json:"type"`
+	Content string `json:"content"`
+	TTL     int    `json:"ttl,omitempty"`
+}
+
+// Provider is a DNS backend the generic Updater can publish addresses to.
+type Provider interface {
+	// List returns all records with the given name and type.
+	List(ctx context.Context, name string, recordType string) ([]Record, error)
+	// Upsert replaces all records with the name and type of the record by the given record.
+	Upsert(ctx context.Context, record Record) error
+	// Delete removes all records with the name and type of the given record.
+	Delete(ctx context.Context, record Record) error
+}
+
+// Normalizer is implemented by providers that publish another form of the
+// address, i.e. its prefix. Addresses with the same form aren't published
+// again. The prefix is the IPv6 LAN prefix of the update, nil if unknown.
+type Normalizer interface {
+	Normalize(recordType string, content string, prefix *net.IPNet) string
+}
+
+// RateLimiter is implemented by providers that know until when their API is
+// rate limited, i.e. from a Retry-After header. Failed updates aren't retried
+// before.
+type RateLimiter interface {
+	LimitedUntil() time.Time
+}
+
+// Replacer is implemented by providers whose records hold further entries the
+// updater doesn't manage, i.e. the networks of a Gateway location. The updater
+// then only compares the published contents and replaces the previous content
+// by the record, or removes it if the record has no content. The previous
+// content is empty if nothing was published before.
+type Replacer interface {
+	Replace(ctx context.Context, record Record, previous string) error
+}
@@ -0,0 +1,90 @@
+package provider
+
+import (
+	"fmt"
+	"github.com/cromefire/fritzbox-cloudflare-dyndns/pkg/util"
+	"log/slog"
+	"slices"
+)
+
+// PrepareReload compares the new records to the current ones. Nothing is
+// changed until the returned reload is applied.
+func (u *Updater) PrepareReload(records []RecordDefinition) (*util.Reload, error) {
+	current := make(map[string]*Action)
+	for _, action := range u.currentActions() {
+		current[actionKey(action.DnsRecord, action.IpVersion)] = action
+	}
+
+	reload := &util.Reload{Changes: make([]string, 0)}
+	next := make([]*Action, 0, len(records))
+	// pending actions have to be run against the last known addresses
+	pending := make([]*Action, 0)
+	added := make([]*Action, 0)
+
+	for _, record := range records {
+		key := actionKey(record.Name, record.IpVersion)
+		existing, ok := current[key]
+		delete(current, key)
+
+		a := u.newAction(record)
+
+		if ok && existing.TTL == a.TTL && existing.Source == a.Source && existing.InterfaceId.Equal(a.InterfaceId) &&
+			existing.Withdraw == a.Withdraw && existing.Fallback.Equal(a.Fallback) {
+			next = append(next, existing)
+			continue
+		}
+
+		if ok {
+			// Keep the metrics and status of the record
+			a.updates = existing.updates
+			a.status = existing.status
+			reload.Changes = append(reload.Changes, "changed "+key)
+		} else {
+			added = append(added, a)
+			reload.Changes = append(reload.Changes, "added "+key)
+		}
+
+		next = append(next, a)
+		pending = append(pending, a)
+	}
+
+	removed := make([]*Action, 0, len(current))
+	for key, action := range current {
+		removed = append(removed, action)
+		reload.Changes = append(reload.Changes, "removed "+key)
+	}
+
+	slices.Sort(reload.Changes)
+
+	reload.Apply = func() {
+		u.workLock.Lock()
+		defer u.workLock.Unlock()
+
+		u.actionsLock.Lock()
+		u.records = records
+		u.actions = next
+		u.actionsLock.Unlock()
+
+		for _, action := range removed {
+			u.registerer.Unregister(action.updates)
+		}
+
+		for _, action := range added {
+			err := u.registerer.Register(action.updates)
+
+			if err != nil {
+				u.log.Warn("Failed to register metrics", slog.String("record", action.DnsRecord), util.ErrorAttr(err))
+			}
+		}
+
+		for _, update := range u.lastUpdates {
+			u.handle(update, pending)
+		}
+	}
+
+	return reload, nil
+}
+
+func actionKey(name string, ipVersion uint8) string {
+	return fmt.Sprintf("%s/IPv%d", name, ipVersion)
+}
@@ -0,0 +1,107 @@
+package provider
+
+import (
+	"context"
+	"github.com/cromefire/fritzbox-cloudflare-dyndns/pkg/util"
+	"reflect"
+	"slices"
+	"testing"
+)
+
+// replacerProvider keeps a single set of entries, like the networks of a
+// Gateway location, and records the calls.
+type replacerProvider struct {
+	*memProvider
+	calls []string
+}
+
+func (p *replacerProvider) List(_ context.Context, name string, recordType string) ([]Record, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	return slices.Clone(p.records[name+"/"+recordType]), nil
+}
+
+func (p *replacerProvider) Replace(_ context.Context, record Record, previous string) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	p.calls = append(p.calls, "replace "+previous+" by "+record.Content)
+
+	key := record.Name + "/" + record.Type
+	p.records[key] = slices.DeleteFunc(p.records[key], func(r Record) bool {
+		return r.Content == previous || r.Content == record.Content
+	})
+
+	if record.Content != "" {
+		p.records[key] = append(p.records[key], record)
+	}
+
+	return nil
+}
+
+func (p *replacerProvider) contents(key string) []string {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	contents := make([]string, 0)
+	for _, record := range p.records[key] {
+		contents = append(contents, record.Content)
+	}
+
+	return contents
+}
+
+func TestUpdaterReplacer(t *testing.T) {
+	p := &replacerProvider{memProvider: newMemProvider()}
+	p.records["office/A"] = []Record{{Name: "office", Type: "A", Content: "198.51.100.1"}}
+
+	u := newTestUpdater(t, p, RecordDefinition{Name: "office", IpVersion: 4, Withdraw: util.WithdrawDelete})
+
+	u.Handle(ipv4Update("192.0.2.1"))
+	u.Handle(ipv4Update("192.0.2.2"))
+	u.Handle(&util.IpUpdate{Source: "home", IpVersion: 4, Withdrawn: true})
+
+	// Only the previously published address is replaced or removed
+	want := []string{"replace  by 192.0.2.1", "replace 192.0.2.1 by 192.0.2.2", "replace 192.0.2.2 by "}
+
+	if !reflect.DeepEqual(p.calls, want) {
+		t.Errorf("calls = %q, want %q", p.calls, want)
+	}
+
+	if contents := p.contents("office/A"); !reflect.DeepEqual(contents, []string{"198.51.100.1"}) {
+		t.Errorf("entries = %v, want the foreign one", contents)
+	}
+}
+
+func TestUpdaterReplacerPlan(t *testing.T) {
+	p := &replacerProvider{memProvider: newMemProvider()}
+	p.records["office/A"] = []Record{
+		{Name: "office", Type: "A", Content: "198.51.100.1"},
+		{Name: "office", Type: "A", Content: "192.0.2.1"},
+	}
+
+	u := newTestUpdater(t, p, RecordDefinition{Name: "office", IpVersion: 4})
+	action := u.actions[0]
+
+	// Other entries aren't duplicates of the published one
+	change, err := u.plan(context.Background(), action, "A", "192.0.2.1")
+
+	if err != nil || change.Action != util.ChangeNoop {
+		t.Errorf("plan = %+v, %v, want no change", change, err)
+	}
+
+	// Without a previous address nothing is withdrawn
+	change, err = u.plan(context.Background(), action, "A", "")
+
+	if err != nil || change.Action != util.ChangeNoop {
+		t.Errorf("plan = %+v, %v, want no change", change, err)
+	}
+
+	action.last = "192.0.2.1"
+	change, err = u.plan(context.Background(), action, "A", "192.0.2.2")
+
+	if err != nil || change.Action != util.ChangeUpdate {
+		t.Errorf("plan = %+v, %v, want an update", change, err)
+	}
+}
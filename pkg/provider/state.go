@@ -0,0 +1,52 @@
+package provider
+
+import (
+	"fmt"
+	"github.com/cromefire/fritzbox-cloudflare-dyndns/pkg/state"
+)
+
+// definition identifies the configuration of the action in the state, a
+// changed record is published again even if the address is the same.
+func (a *Action) definition() string {
+	return fmt.Sprintf("%s %v %d", a.Source, a.InterfaceId, a.TTL)
+}
+
+// restore continues with the state of the previous run.
+func (u *Updater) restore(action *Action) {
+	record, ok := u.store.Get(action.status.Provider, action.DnsRecord, "", action.IpVersion)
+
+	if !ok {
+		return
+	}
+
+	if record.Definition == action.definition() {
+		action.last = record.Last
+	}
+
+	action.status.LastSuccess = record.LastSuccess
+	action.status.LastFailure = record.LastFailure
+	action.status.Succeeded = !record.LastFailure.After(record.LastSuccess)
+
+	if action.status.Succeeded {
+		action.status.Last = record.LastSuccess
+	} else {
+		action.status.Last = record.LastFailure
+	}
+
+	if record.Retry != nil {
+		action.setRetry(record.Retry)
+	}
+}
+
+func (u *Updater) saveState(action *Action) {
+	u.store.Set(state.Record{
+		Provider:    action.status.Provider,
+		Domain:      action.DnsRecord,
+		IpVersion:   action.IpVersion,
+		Definition:  action.definition(),
+		Last:        action.last,
+		LastSuccess: action.status.LastSuccess,
+		LastFailure: action.status.LastFailure,
+		Retry:       action.retry,
+	})
+}
@@ -0,0 +1,82 @@
+package provider
+
+import (
+	"context"
+	"github.com/cromefire/fritzbox-cloudflare-dyndns/pkg/state"
+	"github.com/cromefire/fritzbox-cloudflare-dyndns/pkg/util"
+	"github.com/prometheus/client_golang/prometheus"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestUpdaterRestore(t *testing.T) {
+	store, err := state.Open(filepath.Join(t.TempDir(), "state.json"), testLogger())
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	success := time.Now().Add(-time.Hour)
+	failure := time.Now().Add(-time.Minute)
+
+	// The definition of the first record is the same, the second one's TTL changed
+	store.Set(state.Record{Provider: "test", Domain: "home.example.com", IpVersion: 4, Definition: " <nil> 120", Last: "192.0.2.1", LastSuccess: success})
+	store.Set(state.Record{Provider: "test", Domain: "vpn.example.com", IpVersion: 4, Definition: " <nil> 60", Last: "192.0.2.1", LastSuccess: success})
+	store.Set(state.Record{
+		Provider: "test", Domain: "nas.example.com", IpVersion: 4, Definition: " <nil> 120",
+		LastSuccess: success, LastFailure: failure,
+		Retry: &util.RetryStatus{Content: "192.0.2.2", Attempt: 3, Next: time.Now(), Error: "failed"},
+	})
+
+	p := newMemProvider()
+	u := NewUpdater(p, "test", testLogger(), "test")
+	u.SetRegisterer(prometheus.NewRegistry())
+	u.SetStore(store)
+
+	for _, name := range []string{"home.example.com", "vpn.example.com", "nas.example.com"} {
+		u.AddRecord(RecordDefinition{Name: name, IpVersion: 4})
+	}
+
+	u.Init()
+	home, vpn, nas := u.actions[0], u.actions[1], u.actions[2]
+
+	if home.last != "192.0.2.1" || !home.status.LastSuccess.Equal(success) || !home.status.Succeeded {
+		t.Errorf("home = last %q, status %+v, want the previous state", home.last, home.status)
+	}
+
+	if vpn.last != "" {
+		t.Errorf("vpn = last %q, want it published again with the changed definition", vpn.last)
+	}
+
+	if nas.retry == nil || nas.retry.Attempt != 3 || nas.status.Succeeded {
+		t.Fatalf("nas = retry %+v, status %+v, want the failed update and its retry", nas.retry, nas.status)
+	}
+
+	// The retry, which is due already, only runs once the worker is started
+	time.Sleep(50 * time.Millisecond)
+
+	if records, _ := p.List(context.Background(), "nas.example.com", "A"); len(records) != 0 {
+		t.Fatalf("retry ran before the worker was started: %v", records)
+	}
+
+	u.StartWorker()
+
+	// The result is kept for the next run
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if record, _ := store.Get("test", "nas.example.com", "", 4); record.Last == "192.0.2.2" && record.Retry == nil {
+			break
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatal("retry didn't run")
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if records, _ := p.List(context.Background(), "nas.example.com", "A"); len(records) != 1 || records[0].Content != "192.0.2.2" {
+		t.Errorf("records = %v, want the retried address", records)
+	}
+}
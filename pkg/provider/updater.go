@@ -0,0 +1,511 @@
+package provider
+
+import (
+	"context"
+	"fmt"
+	"github.com/cromefire/fritzbox-cloudflare-dyndns/pkg/notify"
+	"github.com/cromefire/fritzbox-cloudflare-dyndns/pkg/state"
+	"github.com/cromefire/fritzbox-cloudflare-dyndns/pkg/util"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"log/slog"
+	"net"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const DefaultTTL = 120
+
+type Action struct {
+	DnsRecord string
+	IpVersion uint8
+	TTL       int
+	// Source restricts the action to updates of one source, any if empty
+	Source string
+	// InterfaceId makes the action publish the address of a device in the IPv6 prefix
+	InterfaceId net.IP
+	// Withdraw is what happens to the records if the router loses the address
+	Withdraw util.WithdrawMode
+	// Fallback is the address published if the address is withdrawn
+	Fallback net.IP
+
+	// last is the most recently published address
+	last    string
+	updates prometheus.Summary
+	status  *util.UpdateStatus
+	// retry is the pending retry of a failed update
+	retry *util.RetryStatus
+	// retrying is whether there is a retry, for the metrics which are read
+	// without the workLock
+	retrying atomic.Bool
+}
+
+// RecordDefinition is a single record the updater maintains.
+type RecordDefinition struct {
+	Name      string
+	IpVersion uint8
+	// TTL of the record, the updater default if 0
+	TTL         int
+	Source      string
+	InterfaceId net.IP
+	Withdraw    util.WithdrawMode
+	Fallback    net.IP
+}
+
+// Updater publishes the received IPs to all configured records of a Provider.
+// It's the provider-agnostic counterpart of the Cloudflare updater.
+type Updater struct {
+	records []RecordDefinition
+
+	actions     []*Action
+	actionsLock sync.RWMutex
+	// workLock is held while updates are processed
+	workLock sync.Mutex
+	// lastUpdates holds the most recent update per source and IP version
+	lastUpdates map[string]*util.IpUpdate
+
+	isInit   bool
+	provider Provider
+	name     string
+	ttl      int
+	log      *slog.Logger
+	notifier *notify.Notifier
+	store    *state.Store
+
+	// dryRun only reports the changes without making them
+	dryRun   bool
+	onChange func(change util.Change)
+
+	In chan *util.IpUpdate
+
+	subsystem  string
+	registerer prometheus.Registerer
+}
+
+func NewUpdater(provider Provider, name string, log *slog.Logger, subsystem string) *Updater {
+	return &Updater{
+		isInit:      false,
+		In:          make(chan *util.IpUpdate, 10),
+		provider:    provider,
+		name:        name,
+		ttl:         DefaultTTL,
+		log:         log.With(slog.String("module", name)),
+		records:     make([]RecordDefinition, 0),
+		lastUpdates: make(map[string]*util.IpUpdate),
+		subsystem:   subsystem,
+		registerer:  prometheus.DefaultRegisterer,
+	}
+}
+
+// makeSummary creates the summary of an action, it has to be registered separately.
+func (u *Updater) makeSummary(labels prometheus.Labels) prometheus.Summary {
+	return prometheus.NewSummary(prometheus.SummaryOpts{
+		Subsystem:   util.MakePromSubsystem(u.subsystem),
+		Name:        "update_seconds",
+		Help:        "A summary of the provider updates",
+		Objectives:  map[float64]float64{0.5: 0.05, 0.9: 0.01, 0.99: 0.001},
+		ConstLabels: labels,
+	})
+}
+
+// SetRegisterer sets where the metrics are registered, the default registry if
+// not called. It has to be called before Init.
+func (u *Updater) SetRegisterer(registerer prometheus.Registerer) {
+	u.registerer = registerer
+}
+
+// AddRecord adds a record to update, it has to be called before Init.
+func (u *Updater) AddRecord(record RecordDefinition) {
+	u.records = append(u.records, record)
+}
+
+func (u *Updater) SetTTL(ttl int) {
+	u.ttl = ttl
+}
+
+func (u *Updater) SetNotifier(notifier *notify.Notifier) {
+	u.notifier = notifier
+}
+
+// SetStore sets where the state of the records is kept across restarts.
+func (u *Updater) SetStore(store *state.Store) {
+	u.store = store
+}
+
+// SetDryRun makes the updater only report the changes it would make.
+func (u *Updater) SetDryRun(dryRun bool) {
+	u.dryRun = dryRun
+}
+
+// SetChangeHandler sets a function called with every planned change.
+func (u *Updater) SetChangeHandler(handler func(change util.Change)) {
+	u.onChange = handler
+}
+
+func (u *Updater) Init() []*util.UpdateStatus {
+	statusVec := []*util.UpdateStatus{}
+
+	for _, record := range u.records {
+		a := u.newAction(record)
+		u.registerer.MustRegister(a.updates)
+		statusVec = append(statusVec, a.status)
+
+		u.actions = append(u.actions, a)
+	}
+
+	// The retries of the previous run are armed by StartWorker
+	for _, a := range u.actions {
+		u.restore(a)
+	}
+
+	promauto.With(u.registerer).NewGaugeFunc(prometheus.GaugeOpts{
+		Subsystem:   util.MakePromSubsystem(u.subsystem),
+		Name:        "pending_retries",
+		Help:        "The number of failed updates waiting for a retry",
+		ConstLabels: prometheus.Labels{"provider": u.name},
+	}, u.pendingRetries)
+
+	u.isInit = true
+
+	return statusVec
+}
+
+func (u *Updater) newAction(record RecordDefinition) *Action {
+	labels := prometheus.Labels{"provider": u.name, "record": record.Name, "ip_version": fmt.Sprint(record.IpVersion)}
+
+	ttl := record.TTL
+	if ttl == 0 {
+		ttl = u.ttl
+	}
+
+	return &Action{
+		DnsRecord:   record.Name,
+		IpVersion:   record.IpVersion,
+		TTL:         ttl,
+		Source:      record.Source,
+		InterfaceId: record.InterfaceId,
+		Withdraw:    record.Withdraw,
+		Fallback:    record.Fallback,
+		updates:     u.makeSummary(labels),
+		status:      &util.UpdateStatus{Provider: u.name, Domain: record.Name, IpVersion: record.IpVersion, Succeeded: true},
+	}
+}
+
+// Statuses returns the statuses of all current actions.
+func (u *Updater) Statuses() []*util.UpdateStatus {
+	u.actionsLock.RLock()
+	defer u.actionsLock.RUnlock()
+
+	statusVec := make([]*util.UpdateStatus, 0, len(u.actions))
+	for _, action := range u.actions {
+		statusVec = append(statusVec, action.status)
+	}
+
+	return statusVec
+}
+
+func (u *Updater) StartWorker() {
+	if !u.isInit {
+		return
+	}
+
+	// Retries of the previous run only run once the updater is set up
+	for _, action := range u.currentActions() {
+		if action.retry != nil {
+			u.armRetry(action, action.retry)
+		}
+	}
+
+	go u.spawnWorker()
+}
+
+func (u *Updater) spawnWorker() {
+	for {
+		select {
+		case update := <-u.In:
+			u.log.Info("Received update request", slog.String("source", update.Source), slog.Any("ip", update.Ip), slog.Any("prefix", update.Prefix))
+
+			u.Handle(update)
+		}
+	}
+}
+
+// Handle publishes the update to the records and returns once it's done.
+func (u *Updater) Handle(update *util.IpUpdate) {
+	u.workLock.Lock()
+	defer u.workLock.Unlock()
+
+	u.lastUpdates[fmt.Sprintf("%s/%d", update.Source, update.IpVersion)] = update
+	u.handle(update, u.currentActions())
+}
+
+// handle runs the actions matching the update, the caller has to hold the workLock.
+func (u *Updater) handle(update *util.IpUpdate, actions []*Action) {
+	for _, action := range actions {
+		if action.IpVersion != update.IpVersion || (action.Source != "" && action.Source != update.Source) {
+			continue
+		}
+
+		content, ok := update.Content(action.InterfaceId, action.Withdraw, action.Fallback)
+
+		if normalizer, isNormalizer := u.provider.(Normalizer); isNormalizer && content != "" {
+			content = normalizer.Normalize(action.recordType(), content, update.Prefix)
+		}
+
+		if !ok || (content != "" && action.last == content) {
+			continue
+		}
+
+		// A failed update of the same address is left to its retry
+		if action.retry != nil && action.retry.Content == content {
+			continue
+		}
+
+		u.publish(action, content)
+	}
+}
+
+// publish runs the action and schedules a retry if it fails, an empty content
+// deletes the records. The caller has to hold the workLock.
+func (u *Updater) publish(action *Action, content string) {
+	err := u.runAction(action, action.recordType(), content)
+	defer u.saveState(action)
+
+	if err != nil {
+		u.scheduleRetry(action, content, err)
+		return
+	}
+
+	// Supersedes the retry of an older address as well
+	action.setRetry(nil)
+	action.last = content
+}
+
+func (u *Updater) scheduleRetry(action *Action, content string, err error) {
+	var notBefore time.Time
+	if limiter, isLimiter := u.provider.(RateLimiter); isLimiter {
+		notBefore = limiter.LimitedUntil()
+	}
+
+	retry := util.NextRetry(action.retry, content, err, notBefore)
+	action.setRetry(retry)
+
+	u.log.Info("Retrying update", slog.String("domain", action.DnsRecord), slog.Int("attempt", retry.Attempt), slog.Time("next", retry.Next))
+
+	u.armRetry(action, retry)
+}
+
+// armRetry runs the retry when it's due.
+func (u *Updater) armRetry(action *Action, retry *util.RetryStatus) {
+	time.AfterFunc(time.Until(retry.Next), func() {
+		u.workLock.Lock()
+		defer u.workLock.Unlock()
+
+		// Skip retries that were superseded or whose record was removed
+		if action.retry != retry || !slices.Contains(u.currentActions(), action) {
+			return
+		}
+
+		u.publish(action, retry.Content)
+	})
+}
+
+// setRetry sets the pending retry of the action, nil if there is none. The
+// caller has to hold the workLock.
+func (a *Action) setRetry(retry *util.RetryStatus) {
+	a.retry = retry
+	a.status.Retry = retry
+	a.retrying.Store(retry != nil)
+}
+
+func (u *Updater) pendingRetries() float64 {
+	pending := 0
+
+	for _, action := range u.currentActions() {
+		if action.retrying.Load() {
+			pending++
+		}
+	}
+
+	return float64(pending)
+}
+
+func (a *Action) recordType() string {
+	if a.IpVersion == 6 {
+		return "AAAA"
+	}
+
+	return "A"
+}
+
+func (u *Updater) currentActions() []*Action {
+	u.actionsLock.RLock()
+	defer u.actionsLock.RUnlock()
+
+	return slices.Clone(u.actions)
+}
+
+func (u *Updater) runAction(action *Action, recordType string, content string) error {
+	timer := prometheus.NewTimer(action.updates)
+	alog := u.log.With(slog.String("domain", fmt.Sprintf("%s/IPv%d", action.DnsRecord, action.IpVersion)))
+
+	err := u.apply(alog, action, recordType, content)
+
+	action.status.Last = time.Now()
+	action.status.Succeeded = err == nil
+
+	if err == nil {
+		action.status.LastSuccess = action.status.Last
+	} else {
+		action.status.LastFailure = action.status.Last
+	}
+
+	event := notify.Event{
+		Provider:  u.name,
+		Domain:    action.DnsRecord,
+		IpVersion: action.IpVersion,
+		Content:   content,
+	}
+
+	if err != nil {
+		alog.Error("Action failed", util.ErrorAttr(err))
+		event.Type = notify.EventUpdateFailed
+		event.Error = err.Error()
+		u.notifier.Notify(event)
+		return err
+	}
+
+	event.Type = notify.EventUpdateSucceeded
+	if content == "" {
+		event.Type = notify.EventRecordsWithdrawn
+	}
+	u.notifier.Notify(event)
+
+	timer.ObserveDuration()
+
+	return nil
+}
+
+// plan compares the records of the action against the content.
+func (u *Updater) plan(ctx context.Context, action *Action, recordType string, content string) (util.Change, error) {
+	change := util.Change{Provider: u.name, Domain: action.DnsRecord, Type: recordType, Content: content, Action: util.ChangeUpdate}
+
+	records, err := u.provider.List(ctx, action.DnsRecord, recordType)
+
+	if err != nil {
+		return change, fmt.Errorf("could not research DNS records: %w", err)
+	}
+
+	// The other entries of a replacer aren't published by the updater
+	if _, isReplacer := u.provider.(Replacer); isReplacer {
+		records = slices.DeleteFunc(records, func(record Record) bool {
+			return record.Content != content && (action.last == "" || record.Content != action.last)
+		})
+	}
+
+	// An empty content withdraws the records
+	if content == "" {
+		change.Action = util.ChangeDelete
+		change.Details = []string{"address withdrawn"}
+
+		if len(records) == 0 {
+			change.Action = util.ChangeNoop
+		}
+
+		return change, nil
+	}
+
+	if len(records) == 0 {
+		change.Action = util.ChangeCreate
+		return change, nil
+	}
+
+	if len(records) > 1 {
+		change.Details = append(change.Details, fmt.Sprintf("duplicate records, %d in total", len(records)))
+		return change, nil
+	}
+
+	if records[0].Content != content {
+		change.Details = append(change.Details, fmt.Sprintf("content %s -> %s", records[0].Content, content))
+	}
+
+	// Providers not reporting the TTL return 0
+	if records[0].TTL != 0 && records[0].TTL != action.TTL {
+		change.Details = append(change.Details, fmt.Sprintf("ttl %d -> %d", records[0].TTL, action.TTL))
+	}
+
+	if len(change.Details) == 0 {
+		change.Action = util.ChangeNoop
+	}
+
+	return change, nil
+}
+
+func (u *Updater) apply(alog *slog.Logger, action *Action, recordType string, content string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	change, err := u.plan(ctx, action, recordType, content)
+
+	if err != nil {
+		return err
+	}
+
+	if u.onChange != nil {
+		u.onChange(change)
+	}
+
+	switch {
+	case change.Action == util.ChangeNoop:
+		alog.Info("DNS record is up to date")
+		return nil
+	case u.dryRun && change.Action == util.ChangeDelete:
+		alog.Info("Would delete DNS record", slog.Any("details", change.Details))
+		return nil
+	case change.Action == util.ChangeDelete:
+		alog.Info("Deleting DNS record", slog.Any("details", change.Details))
+
+		if replacer, isReplacer := u.provider.(Replacer); isReplacer {
+			err = replacer.Replace(ctx, Record{Name: action.DnsRecord, Type: recordType}, action.last)
+		} else {
+			err = u.provider.Delete(ctx, Record{Name: action.DnsRecord, Type: recordType})
+		}
+
+		if err != nil {
+			return fmt.Errorf("could not delete DNS record: %w", err)
+		}
+
+		return nil
+	case u.dryRun && change.Action == util.ChangeCreate:
+		alog.Info("Would create DNS record")
+		return nil
+	case u.dryRun:
+		alog.Info("Would update DNS record", slog.Any("details", change.Details))
+		return nil
+	case change.Action == util.ChangeCreate:
+		alog.Info("Creating DNS record")
+	default:
+		alog.Info("Updating DNS record", slog.Any("details", change.Details))
+	}
+
+	record := Record{
+		Name:    action.DnsRecord,
+		Type:    recordType,
+		Content: content,
+		TTL:     action.TTL,
+	}
+
+	if replacer, isReplacer := u.provider.(Replacer); isReplacer {
+		err = replacer.Replace(ctx, record, action.last)
+	} else {
+		err = u.provider.Upsert(ctx, record)
+	}
+
+	if err != nil {
+		return fmt.Errorf("could not upsert DNS record: %w", err)
+	}
+
+	return nil
+}
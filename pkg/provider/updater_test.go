@@ -0,0 +1,208 @@
+package provider
+
+import (
+	"context"
+	"errors"
+	"github.com/cromefire/fritzbox-cloudflare-dyndns/pkg/util"
+	"github.com/prometheus/client_golang/prometheus"
+	"io"
+	"log/slog"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// memProvider keeps the records in memory.
+type memProvider struct {
+	lock    sync.Mutex
+	records map[string][]Record
+	// err fails every request if set
+	err error
+	// until is the end of the rate limit
+	until time.Time
+}
+
+func newMemProvider() *memProvider {
+	return &memProvider{records: make(map[string][]Record)}
+}
+
+func (p *memProvider) List(_ context.Context, name string, recordType string) ([]Record, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if p.err != nil {
+		return nil, p.err
+	}
+
+	return p.records[name+"/"+recordType], nil
+}
+
+func (p *memProvider) Upsert(_ context.Context, record Record) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if p.err != nil {
+		return p.err
+	}
+
+	p.records[record.Name+"/"+record.Type] = []Record{record}
+
+	return nil
+}
+
+func (p *memProvider) Delete(_ context.Context, record Record) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if p.err != nil {
+		return p.err
+	}
+
+	delete(p.records, record.Name+"/"+record.Type)
+
+	return nil
+}
+
+func (p *memProvider) LimitedUntil() time.Time {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	return p.until
+}
+
+func (p *memProvider) fail(err error, until time.Time) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	p.err = err
+	p.until = until
+}
+
+func testLogger() *slog.Logger {
+	return slog.New(slog.NewTextHandler(io.Discard, nil))
+}
+
+func TestUpdaterMetrics(t *testing.T) {
+	registry := prometheus.NewRegistry()
+
+	// Two providers of the same type share the subsystem
+	for _, name := range []string{"route53-home", "route53-work"} {
+		u := NewUpdater(newMemProvider(), name, testLogger(), "route53")
+		u.SetRegisterer(registry)
+		u.AddRecord(RecordDefinition{Name: "home.example.com", IpVersion: 4})
+		u.Init()
+	}
+
+	families, err := registry.Gather()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	series := make(map[string]int)
+	for _, family := range families {
+		series[family.GetName()] = len(family.GetMetric())
+	}
+
+	for _, name := range []string{"dyndns_route53_update_seconds", "dyndns_route53_pending_retries"} {
+		if series[name] != 2 {
+			t.Errorf("%s has %d series, want 2", name, series[name])
+		}
+	}
+}
+
+// newTestUpdater creates an initialized updater with the records, its metrics
+// aren't registered anywhere.
+func newTestUpdater(t *testing.T, p Provider, records ...RecordDefinition) *Updater {
+	t.Helper()
+
+	u := NewUpdater(p, "test", testLogger(), "test")
+	u.SetRegisterer(prometheus.NewRegistry())
+
+	for _, record := range records {
+		u.AddRecord(record)
+	}
+
+	u.Init()
+
+	return u
+}
+
+func ipv4Update(ip string) *util.IpUpdate {
+	return &util.IpUpdate{Source: "home", IpVersion: 4, Ip: net.ParseIP(ip)}
+}
+
+func TestUpdaterRetry(t *testing.T) {
+	p := newMemProvider()
+	u := newTestUpdater(t, p, RecordDefinition{Name: "home.example.com", IpVersion: 4})
+	action := u.actions[0]
+
+	limited := time.Now().Add(time.Hour)
+	p.fail(errors.New("rate limited"), limited)
+	u.Handle(ipv4Update("192.0.2.1"))
+
+	if action.retry == nil || action.retry.Attempt != 1 || action.retry.Content != "192.0.2.1" {
+		t.Fatalf("retry = %+v, want the first attempt", action.retry)
+	}
+
+	if !action.retry.Next.Equal(limited) {
+		t.Errorf("retry at %s, want the end of the rate limit %s", action.retry.Next, limited)
+	}
+
+	if pending := u.pendingRetries(); pending != 1 {
+		t.Errorf("pendingRetries() = %v, want 1", pending)
+	}
+
+	// The same address is left to the retry
+	retry := action.retry
+	u.Handle(ipv4Update("192.0.2.1"))
+
+	if action.retry != retry {
+		t.Error("the same address replaced the retry")
+	}
+
+	// A newer address supersedes the retry
+	p.fail(nil, time.Time{})
+	u.Handle(ipv4Update("192.0.2.2"))
+
+	if action.retry != nil || action.status.Retry != nil || action.last != "192.0.2.2" {
+		t.Errorf("retry = %+v, last = %s, want the newer address published", action.retry, action.last)
+	}
+
+	if pending := u.pendingRetries(); pending != 0 {
+		t.Errorf("pendingRetries() = %v, want 0", pending)
+	}
+}
+
+func TestUpdaterRetryRuns(t *testing.T) {
+	p := newMemProvider()
+	u := newTestUpdater(t, p, RecordDefinition{Name: "home.example.com", IpVersion: 4})
+	action := u.actions[0]
+
+	p.fail(errors.New("unavailable"), time.Time{})
+	u.Handle(ipv4Update("192.0.2.1"))
+
+	u.workLock.Lock()
+	retry := action.retry
+	retry.Next = time.Now()
+	p.fail(nil, time.Time{})
+	u.armRetry(action, retry)
+	u.workLock.Unlock()
+
+	// The metrics are read without the workLock while the retry runs
+	deadline := time.Now().Add(5 * time.Second)
+	for u.pendingRetries() != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("retry didn't run")
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	records, _ := p.List(context.Background(), "home.example.com", "A")
+
+	if len(records) != 1 || records[0].Content != "192.0.2.1" {
+		t.Errorf("records = %v, want the retried address", records)
+	}
+}
@@ -0,0 +1,467 @@
+package route53
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"github.com/cromefire/fritzbox-cloudflare-dyndns/pkg/provider"
+	"github.com/cromefire/fritzbox-cloudflare-dyndns/pkg/util"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultEndpoint = "https://route53.amazonaws.com"
+	DefaultRegion   = "us-east-1"
+
+	apiVersion = "2013-04-01"
+	xmlns      = "https://route53.amazonaws.com/doc/" + apiVersion + "/"
+	service    = "route53"
+)
+
+// Client is a minimal Route 53 API client implementing provider.Provider.
+// The Endpoint can be pointed to a local stand-in (like moto or LocalStack)
+// for testing.
+type Client struct {
+	Endpoint    string
+	Region      string
+	Credentials Credentials
+	HTTPClient  *http.Client
+	// WaitForSync makes Upsert and Delete block until the change is INSYNC
+	WaitForSync bool
+	SyncTimeout time.Duration
+
+	log *slog.Logger
+
+	zonesLock sync.Mutex
+	zones     []hostedZone
+
+	// rateLimit is set by the Retry-After header of throttled requests
+	rateLimit util.RateLimit
+}
+
+type hostedZone struct {
+	Id     string `xml:"Id"`
+	Name   string `xml:"Name"`
+	Config struct {
+		PrivateZone bool `xml:"PrivateZone"`
+	} `xml:"Config"`
+}
+
+type resourceRecordSet struct {
+	Name            string           `xml:"Name"`
+	Type            string           `xml:"Type"`
+	SetIdentifier   string           `xml:"SetIdentifier,omitempty"`
+	TTL             int              `xml:"TTL,omitempty"`
+	ResourceRecords []resourceRecord `xml:"ResourceRecords>ResourceRecord"`
+	AliasTarget     *struct {
+		DNSName string `xml:"DNSName"`
+	} `xml:"AliasTarget,omitempty"`
+}
+
+type resourceRecord struct {
+	Value string `xml:"Value"`
+}
+
+type change struct {
+	Action            string            `xml:"Action"`
+	ResourceRecordSet resourceRecordSet `xml:"ResourceRecordSet"`
+}
+
+type changeResourceRecordSetsRequest struct {
+	XMLName xml.Name `xml:"ChangeResourceRecordSetsRequest"`
+	Xmlns   string   `xml:"xmlns,attr"`
+	Comment string   `xml:"ChangeBatch>Comment,omitempty"`
+	Changes []change `xml:"ChangeBatch>Changes>Change"`
+}
+
+type changeInfo struct {
+	Id     string `xml:"Id"`
+	Status string `xml:"Status"`
+}
+
+type changeInfoResponse struct {
+	ChangeInfo changeInfo `xml:"ChangeInfo"`
+}
+
+type listHostedZonesResponse struct {
+	HostedZones []hostedZone `xml:"HostedZones>HostedZone"`
+	IsTruncated bool         `xml:"IsTruncated"`
+	NextMarker  string       `xml:"NextMarker"`
+}
+
+type listResourceRecordSetsResponse struct {
+	ResourceRecordSets []resourceRecordSet `xml:"ResourceRecordSets>ResourceRecordSet"`
+}
+
+type errorResponse struct {
+	Code     string   `xml:"Error>Code"`
+	Message  string   `xml:"Error>Message"`
+	Messages []string `xml:"Messages>Message"`
+}
+
+// APIError is returned for any non-2xx response of the Route 53 API.
+type APIError struct {
+	StatusCode int
+	Code       string
+	Message    string
+}
+
+func (e *APIError) Error() string {
+	if e.Code == "" {
+		return fmt.Sprintf("route53: HTTP %d", e.StatusCode)
+	}
+
+	return fmt.Sprintf("route53: %s (HTTP %d): %s", e.Code, e.StatusCode, e.Message)
+}
+
+func NewClient(creds Credentials, log *slog.Logger) *Client {
+	return &Client{
+		Endpoint:    DefaultEndpoint,
+		Region:      DefaultRegion,
+		Credentials: creds,
+		HTTPClient:  &http.Client{Timeout: 30 * time.Second},
+		SyncTimeout: 5 * time.Minute,
+		log:         log.With(slog.String("module", "route53")),
+	}
+}
+
+// LimitedUntil returns until when the API is throttled, as far as it told.
+func (c *Client) LimitedUntil() time.Time {
+	return c.rateLimit.LimitedUntil()
+}
+
+func (c *Client) do(ctx context.Context, method string, path string, query url.Values, payload any, out any) error {
+	var body []byte
+
+	if payload != nil {
+		var err error
+		body, err = xml.Marshal(payload)
+
+		if err != nil {
+			return err
+		}
+
+		body = append([]byte(xml.Header), body...)
+	}
+
+	u := strings.TrimRight(c.Endpoint, "/") + "/" + apiVersion + path
+	if len(query) > 0 {
+		u += "?" + canonicalQuery(query)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, u, bytes.NewReader(body))
+
+	if err != nil {
+		return err
+	}
+
+	if payload != nil {
+		req.Header.Set("Content-Type", "application/xml")
+	}
+
+	signRequest(req, body, c.Credentials, c.Region, service, time.Now())
+
+	res, err := c.HTTPClient.Do(req)
+
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	data, err := io.ReadAll(res.Body)
+
+	if err != nil {
+		return err
+	}
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		if retryAfter := res.Header.Get("Retry-After"); retryAfter != "" {
+			c.rateLimit.Extend(util.ParseRetryAfter(retryAfter, time.Now()))
+		}
+
+		apiErr := &APIError{StatusCode: res.StatusCode}
+		parsed := errorResponse{}
+
+		if xml.Unmarshal(data, &parsed) == nil {
+			apiErr.Code = parsed.Code
+			apiErr.Message = parsed.Message
+
+			if apiErr.Message == "" {
+				apiErr.Message = strings.Join(parsed.Messages, "; ")
+			}
+		}
+
+		return apiErr
+	}
+
+	if out == nil {
+		return nil
+	}
+
+	return xml.Unmarshal(data, out)
+}
+
+func (c *Client) listHostedZones(ctx context.Context) ([]hostedZone, error) {
+	zones := make([]hostedZone, 0)
+	marker := ""
+
+	for {
+		query := url.Values{}
+		if marker != "" {
+			query.Set("marker", marker)
+		}
+
+		res := listHostedZonesResponse{}
+		err := c.do(ctx, http.MethodGet, "/hostedzone", query, nil, &res)
+
+		if err != nil {
+			return nil, err
+		}
+
+		zones = append(zones, res.HostedZones...)
+
+		if !res.IsTruncated || res.NextMarker == "" {
+			return zones, nil
+		}
+
+		marker = res.NextMarker
+	}
+}
+
+// findZone returns the public hosted zone with the longest suffix matching
+// the name. The zone list is fetched once and cached.
+func (c *Client) findZone(ctx context.Context, name string) (hostedZone, error) {
+	c.zonesLock.Lock()
+	defer c.zonesLock.Unlock()
+
+	if c.zones == nil {
+		zones, err := c.listHostedZones(ctx)
+
+		if err != nil {
+			return hostedZone{}, err
+		}
+
+		c.zones = zones
+	}
+
+	name = normalizeName(name)
+	best := hostedZone{}
+	bestLen := -1
+
+	for _, zone := range c.zones {
+		if zone.Config.PrivateZone {
+			continue
+		}
+
+		zoneName := normalizeName(zone.Name)
+
+		if name != zoneName && !strings.HasSuffix(name, "."+zoneName) {
+			continue
+		}
+
+		if len(zoneName) > bestLen {
+			best = zone
+			bestLen = len(zoneName)
+		}
+	}
+
+	if bestLen < 0 {
+		return hostedZone{}, errors.New("no hosted zone found for " + name)
+	}
+
+	return best, nil
+}
+
+// ResolveZones makes sure a hosted zone exists for every name.
+func (c *Client) ResolveZones(ctx context.Context, names []string) error {
+	for _, name := range names {
+		zone, err := c.findZone(ctx, name)
+
+		if err != nil {
+			return err
+		}
+
+		c.log.Info("Resolved hosted zone", slog.String("name", name), slog.String("zone", zone.Id))
+	}
+
+	return nil
+}
+
+func (c *Client) getRecordSet(ctx context.Context, zone hostedZone, name string, recordType string) (*resourceRecordSet, error) {
+	query := url.Values{}
+	query.Set("name", fqdn(name))
+	query.Set("type", recordType)
+	query.Set("maxitems", "10")
+
+	res := listResourceRecordSetsResponse{}
+	err := c.do(ctx, http.MethodGet, "/hostedzone/"+zoneId(zone.Id)+"/rrset", query, nil, &res)
+
+	if err != nil {
+		return nil, err
+	}
+
+	// The listing starts at the given name and type, so skip anything else
+	for _, set := range res.ResourceRecordSets {
+		if normalizeName(set.Name) != normalizeName(name) || set.Type != recordType {
+			continue
+		}
+
+		// Only simple routing is supported
+		if set.SetIdentifier != "" || set.AliasTarget != nil {
+			continue
+		}
+
+		return &set, nil
+	}
+
+	return nil, nil
+}
+
+func (c *Client) changeRecordSet(ctx context.Context, zone hostedZone, action string, set resourceRecordSet) error {
+	req := changeResourceRecordSetsRequest{
+		Xmlns:   xmlns,
+		Comment: "fritzbox-cloudflare-dyndns",
+		Changes: []change{{Action: action, ResourceRecordSet: set}},
+	}
+
+	res := changeInfoResponse{}
+	err := c.do(ctx, http.MethodPost, "/hostedzone/"+zoneId(zone.Id)+"/rrset", nil, req, &res)
+
+	if err != nil {
+		return err
+	}
+
+	if !c.WaitForSync {
+		return nil
+	}
+
+	return c.waitForChange(ctx, res.ChangeInfo)
+}
+
+func (c *Client) waitForChange(ctx context.Context, info changeInfo) error {
+	ctx, cancel := context.WithTimeout(ctx, c.SyncTimeout)
+	defer cancel()
+
+	for info.Status != "INSYNC" {
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("waiting for change %s: %w", info.Id, ctx.Err())
+		case <-time.After(5 * time.Second):
+		}
+
+		res := changeInfoResponse{}
+		err := c.do(ctx, http.MethodGet, "/change/"+strings.TrimPrefix(info.Id, "/change/"), nil, nil, &res)
+
+		if err != nil {
+			return err
+		}
+
+		info = res.ChangeInfo
+	}
+
+	return nil
+}
+
+func (c *Client) List(ctx context.Context, name string, recordType string) ([]provider.Record, error) {
+	zone, err := c.findZone(ctx, name)
+
+	if err != nil {
+		return nil, err
+	}
+
+	set, err := c.getRecordSet(ctx, zone, name, recordType)
+
+	if err != nil || set == nil {
+		return nil, err
+	}
+
+	records := make([]provider.Record, 0, len(set.ResourceRecords))
+	for _, rr := range set.ResourceRecords {
+		records = append(records, provider.Record{
+			Name:    name,
+			Type:    set.Type,
+			Content: rr.Value,
+			TTL:     set.TTL,
+		})
+	}
+
+	return records, nil
+}
+
+func (c *Client) Upsert(ctx context.Context, record provider.Record) error {
+	zone, err := c.findZone(ctx, record.Name)
+
+	if err != nil {
+		return err
+	}
+
+	ttl := record.TTL
+	if ttl <= 0 {
+		ttl = provider.DefaultTTL
+	}
+
+	return c.changeRecordSet(ctx, zone, "UPSERT", resourceRecordSet{
+		Name:            fqdn(record.Name),
+		Type:            record.Type,
+		TTL:             ttl,
+		ResourceRecords: []resourceRecord{{Value: record.Content}},
+	})
+}
+
+func (c *Client) Delete(ctx context.Context, record provider.Record) error {
+	zone, err := c.findZone(ctx, record.Name)
+
+	if err != nil {
+		return err
+	}
+
+	// Deletions have to match the existing record set exactly
+	set, err := c.getRecordSet(ctx, zone, record.Name, record.Type)
+
+	if err != nil || set == nil {
+		return err
+	}
+
+	return c.changeRecordSet(ctx, zone, "DELETE", *set)
+}
+
+func zoneId(id string) string {
+	return strings.TrimPrefix(id, "/hostedzone/")
+}
+
+func fqdn(name string) string {
+	return strings.TrimSuffix(name, ".") + "."
+}
+
+// normalizeName lowercases the name, strips the trailing dot and decodes the
+// octal escapes (like \052 for *) Route 53 uses in its responses.
+func normalizeName(name string) string {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+
+	if !strings.Contains(name, `\`) {
+		return name
+	}
+
+	var b strings.Builder
+	for i := 0; i < len(name); i++ {
+		if name[i] == '\\' && i+4 <= len(name) {
+			if v, err := strconv.ParseUint(name[i+1:i+4], 8, 8); err == nil {
+				b.WriteByte(byte(v))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(name[i])
+	}
+
+	return b.String()
+}
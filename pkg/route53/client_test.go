@@ -0,0 +1,475 @@
+package route53
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"github.com/cromefire/fritzbox-cloudflare-dyndns/pkg/provider"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeRoute53 is a minimal stand-in for the Route 53 API, serving the hosted
+// zones in pages and keeping the record sets in memory.
+type fakeRoute53 struct {
+	t        *testing.T
+	pageSize int
+
+	lock    sync.Mutex
+	zones   []hostedZone
+	sets    map[string][]resourceRecordSet
+	markers []string
+	changes []change
+	// fail answers every change with the error
+	fail *errorResponse
+	// retryAfter is the Retry-After header of the errors
+	retryAfter string
+}
+
+func newFakeRoute53(t *testing.T, zones ...hostedZone) (*fakeRoute53, *Client) {
+	fake := &fakeRoute53{t: t, pageSize: 2, zones: zones, sets: map[string][]resourceRecordSet{}}
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+
+	client := NewClient(testCredentials, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	client.Endpoint = server.URL
+	client.HTTPClient = server.Client()
+
+	return fake, client
+}
+
+func publicZone(id string, name string) hostedZone {
+	return hostedZone{Id: "/hostedzone/" + id, Name: name}
+}
+
+func privateZone(id string, name string) hostedZone {
+	zone := publicZone(id, name)
+	zone.Config.PrivateZone = true
+	return zone
+}
+
+func (f *fakeRoute53) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if !strings.HasPrefix(r.Header.Get("Authorization"), sigV4Algorithm+" Credential="+testCredentials.AccessKeyID+"/") {
+		f.error(w, http.StatusForbidden, errorResponse{Code: "MissingAuthenticationToken", Message: "unsigned request"})
+		return
+	}
+
+	path := strings.TrimPrefix(r.URL.Path, "/"+apiVersion)
+
+	switch {
+	case r.Method == http.MethodGet && path == "/hostedzone":
+		f.listZones(w, r.URL.Query().Get("marker"))
+	case strings.HasPrefix(path, "/hostedzone/") && strings.HasSuffix(path, "/rrset"):
+		id := strings.TrimSuffix(strings.TrimPrefix(path, "/hostedzone/"), "/rrset")
+
+		if !f.hasZone(id) {
+			f.error(w, http.StatusNotFound, errorResponse{Code: "NoSuchHostedZone", Message: "No hosted zone found with ID: " + id})
+			return
+		}
+
+		if r.Method == http.MethodPost {
+			f.change(w, r, id)
+		} else {
+			f.write(w, listResourceRecordSetsResponse{ResourceRecordSets: f.sets[id]})
+		}
+	default:
+		f.t.Errorf("unexpected request %s %s", r.Method, r.URL)
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func (f *fakeRoute53) hasZone(id string) bool {
+	for _, zone := range f.zones {
+		if zoneId(zone.Id) == id {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (f *fakeRoute53) listZones(w http.ResponseWriter, marker string) {
+	f.markers = append(f.markers, marker)
+
+	start := 0
+	for i, zone := range f.zones {
+		if zoneId(zone.Id) == marker {
+			start = i
+		}
+	}
+
+	res := listHostedZonesResponse{HostedZones: f.zones[start:]}
+
+	if len(res.HostedZones) > f.pageSize {
+		res.IsTruncated = true
+		res.NextMarker = zoneId(res.HostedZones[f.pageSize].Id)
+		res.HostedZones = res.HostedZones[:f.pageSize]
+	}
+
+	f.write(w, res)
+}
+
+func (f *fakeRoute53) change(w http.ResponseWriter, r *http.Request, id string) {
+	req := changeResourceRecordSetsRequest{}
+	err := xml.NewDecoder(r.Body).Decode(&req)
+
+	if err != nil {
+		f.error(w, http.StatusBadRequest, errorResponse{Code: "MalformedInput", Message: err.Error()})
+		return
+	}
+
+	if f.fail != nil {
+		f.error(w, http.StatusBadRequest, *f.fail)
+		return
+	}
+
+	for _, c := range req.Changes {
+		f.changes = append(f.changes, c)
+		sets := make([]resourceRecordSet, 0)
+		found := false
+
+		for _, set := range f.sets[id] {
+			if set.Name != c.ResourceRecordSet.Name || set.Type != c.ResourceRecordSet.Type {
+				sets = append(sets, set)
+				continue
+			}
+
+			// Deletions have to match the existing record set exactly
+			if c.Action == "DELETE" && !reflect.DeepEqual(set, c.ResourceRecordSet) {
+				f.error(w, http.StatusBadRequest, errorResponse{Messages: []string{"Tried to delete resource record set but the values provided do not match the current values"}})
+				return
+			}
+
+			found = true
+		}
+
+		if c.Action == "DELETE" && !found {
+			f.error(w, http.StatusBadRequest, errorResponse{Messages: []string{"Tried to delete resource record set but it was not found"}})
+			return
+		}
+
+		if c.Action == "UPSERT" {
+			sets = append(sets, c.ResourceRecordSet)
+		}
+
+		f.sets[id] = sets
+	}
+
+	f.write(w, changeInfoResponse{ChangeInfo: changeInfo{Id: "/change/C1", Status: "PENDING"}})
+}
+
+func (f *fakeRoute53) write(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "text/xml")
+
+	err := xml.NewEncoder(w).Encode(v)
+
+	if err != nil {
+		f.t.Error(err)
+	}
+}
+
+func (f *fakeRoute53) error(w http.ResponseWriter, status int, res errorResponse) {
+	if f.retryAfter != "" {
+		w.Header().Set("Retry-After", f.retryAfter)
+	}
+
+	w.WriteHeader(status)
+
+	if res.Code != "" {
+		_, _ = fmt.Fprintf(w, "<ErrorResponse><Error><Code>%s</Code><Message>%s</Message></Error></ErrorResponse>", res.Code, res.Message)
+	} else {
+		_, _ = fmt.Fprintf(w, "<InvalidChangeBatch><Messages><Message>%s</Message></Messages></InvalidChangeBatch>", strings.Join(res.Messages, "</Message><Message>"))
+	}
+}
+
+func TestListHostedZonesPagination(t *testing.T) {
+	tests := []struct {
+		name    string
+		zones   int
+		markers []string
+	}{
+		{"single page", 2, []string{""}},
+		{"two pages", 3, []string{"", "Z3"}},
+		{"three pages", 5, []string{"", "Z3", "Z5"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			zones := make([]hostedZone, 0)
+			for i := 1; i <= tt.zones; i++ {
+				zones = append(zones, publicZone(fmt.Sprintf("Z%d", i), fmt.Sprintf("zone%d.example.", i)))
+			}
+
+			fake, client := newFakeRoute53(t, zones...)
+			got, err := client.listHostedZones(context.Background())
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !reflect.DeepEqual(got, zones) {
+				t.Errorf("listHostedZones() = %v, want %v", got, zones)
+			}
+
+			if !reflect.DeepEqual(fake.markers, tt.markers) {
+				t.Errorf("markers = %q, want %q", fake.markers, tt.markers)
+			}
+		})
+	}
+}
+
+func TestFindZone(t *testing.T) {
+	fake, client := newFakeRoute53(t,
+		publicZone("Z1", "example.com."),
+		publicZone("Z2", "sub.example.com."),
+		privateZone("Z3", "home.example.com."),
+		publicZone("Z4", "other.example."),
+		publicZone("Z5", "ample.com."),
+	)
+
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"example.com", "/hostedzone/Z1"},
+		{"www.example.com.", "/hostedzone/Z1"},
+		{"WWW.Example.COM", "/hostedzone/Z1"},
+		{"sub.example.com", "/hostedzone/Z2"},
+		{"a.b.sub.example.com", "/hostedzone/Z2"},
+		{`\052.sub.example.com.`, "/hostedzone/Z2"},
+		{"notsub.example.com", "/hostedzone/Z1"},
+		// Private zones are skipped in favor of the public parent
+		{"nas.home.example.com", "/hostedzone/Z1"},
+		{"ample.com", "/hostedzone/Z5"},
+		{"www.other.example", "/hostedzone/Z4"},
+		{"example.org", ""},
+		{"other.example.com.au", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			zone, err := client.findZone(context.Background(), tt.name)
+
+			if tt.want == "" {
+				if err == nil {
+					t.Errorf("findZone() = %s, want an error", zone.Id)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if zone.Id != tt.want {
+				t.Errorf("findZone() = %s, want %s", zone.Id, tt.want)
+			}
+		})
+	}
+
+	// The zones are only listed once
+	if markers := []string{"", "Z3", "Z5"}; !reflect.DeepEqual(fake.markers, markers) {
+		t.Errorf("markers = %q, want %q", fake.markers, markers)
+	}
+}
+
+func TestClientRecords(t *testing.T) {
+	fake, client := newFakeRoute53(t, publicZone("Z1", "example.com."))
+	ctx := context.Background()
+
+	// Records of other names, of other types and with other routing policies
+	// are ignored
+	fake.sets["Z1"] = []resourceRecordSet{
+		{Name: "home.example.com.", Type: "AAAA", TTL: 300, ResourceRecords: []resourceRecord{{Value: "2001:db8::1"}}},
+		{Name: "home.example.com.", Type: "A", SetIdentifier: "weighted", TTL: 300, ResourceRecords: []resourceRecord{{Value: "192.0.2.9"}}},
+		{Name: "vpn.example.com.", Type: "A", TTL: 300, ResourceRecords: []resourceRecord{{Value: "192.0.2.8"}}},
+		{Name: `\052.example.com.`, Type: "A", TTL: 60, ResourceRecords: []resourceRecord{{Value: "192.0.2.7"}}},
+	}
+
+	steps := []struct {
+		name    string
+		apply   func() error
+		list    provider.Record
+		records []provider.Record
+	}{
+		{
+			name:    "nothing yet",
+			list:    provider.Record{Name: "home.example.com", Type: "A"},
+			records: nil,
+		},
+		{
+			name:    "wildcard",
+			list:    provider.Record{Name: "*.example.com", Type: "A"},
+			records: []provider.Record{{Name: "*.example.com", Type: "A", Content: "192.0.2.7", TTL: 60}},
+		},
+		{
+			name: "created with the default TTL",
+			apply: func() error {
+				return client.Upsert(ctx, provider.Record{Name: "home.example.com", Type: "A", Content: "192.0.2.1"})
+			},
+			list:    provider.Record{Name: "home.example.com", Type: "A"},
+			records: []provider.Record{{Name: "home.example.com", Type: "A", Content: "192.0.2.1", TTL: provider.DefaultTTL}},
+		},
+		{
+			name: "replaced",
+			apply: func() error {
+				return client.Upsert(ctx, provider.Record{Name: "home.example.com.", Type: "A", Content: "192.0.2.2", TTL: 60})
+			},
+			list:    provider.Record{Name: "home.example.com", Type: "A"},
+			records: []provider.Record{{Name: "home.example.com", Type: "A", Content: "192.0.2.2", TTL: 60}},
+		},
+		{
+			name: "deleted",
+			apply: func() error {
+				return client.Delete(ctx, provider.Record{Name: "home.example.com", Type: "A", Content: "192.0.2.2"})
+			},
+			list:    provider.Record{Name: "home.example.com", Type: "A"},
+			records: nil,
+		},
+		{
+			name: "deleting a missing record",
+			apply: func() error {
+				return client.Delete(ctx, provider.Record{Name: "home.example.com", Type: "A", Content: "192.0.2.2"})
+			},
+			list:    provider.Record{Name: "home.example.com", Type: "AAAA"},
+			records: []provider.Record{{Name: "home.example.com", Type: "AAAA", Content: "2001:db8::1", TTL: 300}},
+		},
+	}
+
+	for _, step := range steps {
+		if step.apply != nil {
+			err := step.apply()
+
+			if err != nil {
+				t.Fatalf("%s: %v", step.name, err)
+			}
+		}
+
+		records, err := client.List(ctx, step.list.Name, step.list.Type)
+
+		if err != nil {
+			t.Fatalf("%s: %v", step.name, err)
+		}
+
+		if (len(records) > 0 || len(step.records) > 0) && !reflect.DeepEqual(records, step.records) {
+			t.Errorf("%s: List() = %v, want %v", step.name, records, step.records)
+		}
+	}
+
+	want := []change{
+		{Action: "UPSERT", ResourceRecordSet: resourceRecordSet{Name: "home.example.com.", Type: "A", TTL: provider.DefaultTTL, ResourceRecords: []resourceRecord{{Value: "192.0.2.1"}}}},
+		{Action: "UPSERT", ResourceRecordSet: resourceRecordSet{Name: "home.example.com.", Type: "A", TTL: 60, ResourceRecords: []resourceRecord{{Value: "192.0.2.2"}}}},
+		{Action: "DELETE", ResourceRecordSet: resourceRecordSet{Name: "home.example.com.", Type: "A", TTL: 60, ResourceRecords: []resourceRecord{{Value: "192.0.2.2"}}}},
+	}
+
+	if !reflect.DeepEqual(fake.changes, want) {
+		t.Errorf("changes = %+v, want %+v", fake.changes, want)
+	}
+}
+
+func TestAPIError(t *testing.T) {
+	tests := []struct {
+		name  string
+		fail  *errorResponse
+		want  APIError
+		error string
+	}{
+		{
+			name:  "error code",
+			fail:  &errorResponse{Code: "Throttling", Message: "Rate exceeded"},
+			want:  APIError{StatusCode: http.StatusBadRequest, Code: "Throttling", Message: "Rate exceeded"},
+			error: "route53: Throttling (HTTP 400): Rate exceeded",
+		},
+		{
+			name:  "invalid change batch",
+			fail:  &errorResponse{Messages: []string{"first", "second"}},
+			want:  APIError{StatusCode: http.StatusBadRequest, Message: "first; second"},
+			error: "route53: HTTP 400",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake, client := newFakeRoute53(t, publicZone("Z1", "example.com."))
+			fake.fail = tt.fail
+
+			err := client.Upsert(context.Background(), provider.Record{Name: "www.example.com", Type: "A", Content: "192.0.2.1"})
+
+			apiErr := &APIError{}
+			if !errors.As(err, &apiErr) {
+				t.Fatalf("Upsert() = %v, want an APIError", err)
+			}
+
+			if *apiErr != tt.want {
+				t.Errorf("Upsert() = %+v, want %+v", *apiErr, tt.want)
+			}
+
+			if apiErr.Error() != tt.error {
+				t.Errorf("Error() = %q, want %q", apiErr.Error(), tt.error)
+			}
+		})
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	fake, client := newFakeRoute53(t, publicZone("Z1", "example.com."))
+	fake.fail = &errorResponse{Code: "Throttling", Message: "Rate exceeded"}
+	record := provider.Record{Name: "www.example.com", Type: "A", Content: "192.0.2.1"}
+
+	// Without the header the backoff alone decides
+	if err := client.Upsert(context.Background(), record); err == nil || !client.LimitedUntil().IsZero() {
+		t.Fatalf("Upsert() = %v, limited until %s, want an error without a limit", err, client.LimitedUntil())
+	}
+
+	fake.retryAfter = "60"
+	before := time.Now()
+	_ = client.Upsert(context.Background(), record)
+
+	if until := client.LimitedUntil(); until.Before(before.Add(time.Minute)) || until.After(time.Now().Add(time.Minute)) {
+		t.Errorf("LimitedUntil() = %s, want a minute from now", until)
+	}
+}
+
+func TestUnsignedRequest(t *testing.T) {
+	_, client := newFakeRoute53(t, publicZone("Z1", "example.com."))
+	client.Credentials = Credentials{AccessKeyID: "OTHER", SecretAccessKey: "secret"}
+
+	err := client.ResolveZones(context.Background(), []string{"example.com"})
+
+	apiErr := &APIError{}
+	if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusForbidden {
+		t.Errorf("ResolveZones() = %v, want HTTP 403", err)
+	}
+}
+
+func TestNormalizeName(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{"example.com", "example.com"},
+		{"Example.COM.", "example.com"},
+		{`\052.example.com.`, "*.example.com"},
+		{`a\100b.example.com`, "a@b.example.com"},
+		// Incomplete or invalid escapes are kept
+		{`a\9.example.com`, `a\9.example.com`},
+		{`a\05`, `a\05`},
+	}
+
+	for _, tt := range tests {
+		if got := normalizeName(tt.in); got != tt.want {
+			t.Errorf("normalizeName(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,95 @@
+package route53
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+type Credentials struct {
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string
+}
+
+// LoadSharedCredentials reads a profile from an AWS shared credentials file
+// (the INI format used by ~/.aws/credentials). An empty path uses the default
+// location and an empty profile the "default" one.
+func LoadSharedCredentials(path string, profile string) (Credentials, error) {
+	if path == "" {
+		home, err := os.UserHomeDir()
+
+		if err != nil {
+			return Credentials{}, err
+		}
+
+		path = filepath.Join(home, ".aws", "credentials")
+	}
+
+	if profile == "" {
+		profile = "default"
+	}
+
+	f, err := os.Open(path)
+
+	if err != nil {
+		return Credentials{}, err
+	}
+	defer f.Close()
+
+	creds := Credentials{}
+	found := false
+	section := ""
+	scanner := bufio.NewScanner(f)
+
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, ";") {
+			continue
+		}
+
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			section = strings.TrimSpace(line[1 : len(line)-1])
+			if section == profile {
+				found = true
+			}
+			continue
+		}
+
+		if section != profile {
+			continue
+		}
+
+		key, value, ok := strings.Cut(line, "=")
+		if !ok {
+			continue
+		}
+
+		switch strings.ToLower(strings.TrimSpace(key)) {
+		case "aws_access_key_id":
+			creds.AccessKeyID = strings.TrimSpace(value)
+		case "aws_secret_access_key":
+			creds.SecretAccessKey = strings.TrimSpace(value)
+		case "aws_session_token":
+			creds.SessionToken = strings.TrimSpace(value)
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return Credentials{}, err
+	}
+
+	if !found {
+		return Credentials{}, fmt.Errorf("profile %q not found in %s", profile, path)
+	}
+
+	if creds.AccessKeyID == "" || creds.SecretAccessKey == "" {
+		return Credentials{}, errors.New("profile " + profile + " is missing aws_access_key_id or aws_secret_access_key")
+	}
+
+	return creds, nil
+}
@@ -0,0 +1,146 @@
+package route53
+
+import (
+	"encoding/xml"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// The example key of the AWS documentation, the expected signatures were
+// computed independently of this implementation
+var testCredentials = Credentials{
+	AccessKeyID:     "AKIDEXAMPLE",
+	SecretAccessKey: "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY",
+}
+
+func TestSignRequest(t *testing.T) {
+	now := time.Date(2015, 8, 30, 12, 36, 0, 0, time.UTC)
+
+	tests := []struct {
+		name          string
+		method        string
+		url           string
+		contentType   string
+		body          string
+		sessionToken  string
+		authorization string
+	}{
+		{
+			name:   "get with query",
+			method: http.MethodGet,
+			url:    "https://route53.amazonaws.com/2013-04-01/hostedzone?marker=Z2%2FNEXT",
+			authorization: "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/route53/aws4_request, " +
+				"SignedHeaders=host;x-amz-content-sha256;x-amz-date, " +
+				"Signature=b4766b66d7a8c07da2aba1f119d5ba3895105a6796f89d6d2e63f572a931ac0d",
+		},
+		{
+			name:         "post with body and session token",
+			method:       http.MethodPost,
+			url:          "https://route53.amazonaws.com/2013-04-01/hostedzone/Z1/rrset",
+			contentType:  "application/xml",
+			body:         xml.Header + "<ChangeResourceRecordSetsRequest/>",
+			sessionToken: "session",
+			authorization: "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/route53/aws4_request, " +
+				"SignedHeaders=content-type;host;x-amz-content-sha256;x-amz-date;x-amz-security-token, " +
+				"Signature=14d6aa859c15e6492facf125235faef851aa1c219e3554d6f52655241e941a02",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := http.NewRequest(tt.method, tt.url, strings.NewReader(tt.body))
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if tt.contentType != "" {
+				req.Header.Set("Content-Type", tt.contentType)
+			}
+
+			creds := testCredentials
+			creds.SessionToken = tt.sessionToken
+
+			// The time zone of the clock doesn't matter
+			signRequest(req, []byte(tt.body), creds, "us-east-1", "route53", now.In(time.FixedZone("CEST", 2*60*60)))
+
+			if got := req.Header.Get("Authorization"); got != tt.authorization {
+				t.Errorf("Authorization = %q, want %q", got, tt.authorization)
+			}
+
+			if got := req.Header.Get("X-Amz-Date"); got != "20150830T123600Z" {
+				t.Errorf("X-Amz-Date = %q", got)
+			}
+
+			if got := req.Header.Get("X-Amz-Content-Sha256"); got != hashHex([]byte(tt.body)) {
+				t.Errorf("X-Amz-Content-Sha256 = %q", got)
+			}
+
+			if got := req.Header.Get("X-Amz-Security-Token"); got != tt.sessionToken {
+				t.Errorf("X-Amz-Security-Token = %q, want %q", got, tt.sessionToken)
+			}
+		})
+	}
+}
+
+func TestUriEncode(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{"", ""},
+		{"AZaz09-_.~", "AZaz09-_.~"},
+		{"a b", "a%20b"},
+		{"a+b", "a%2Bb"},
+		{"Z2/NEXT", "Z2%2FNEXT"},
+		{"*.example.com.", "%2A.example.com."},
+		{"ä", "%C3%A4"},
+	}
+
+	for _, tt := range tests {
+		if got := uriEncode(tt.in); got != tt.want {
+			t.Errorf("uriEncode(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestCanonicalQuery(t *testing.T) {
+	tests := []struct {
+		name  string
+		query url.Values
+		want  string
+	}{
+		{"empty", url.Values{}, ""},
+		{"sorted by key", url.Values{"type": {"A"}, "name": {"home.example.com."}, "maxitems": {"10"}}, "maxitems=10&name=home.example.com.&type=A"},
+		{"sorted by value", url.Values{"a": {"2", "1"}}, "a=1&a=2"},
+		{"escaped", url.Values{"marker": {"Z2/NEXT PAGE"}}, "marker=Z2%2FNEXT%20PAGE"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := canonicalQuery(tt.query); got != tt.want {
+				t.Errorf("canonicalQuery() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCanonicalPath(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{"", "/"},
+		{"/", "/"},
+		{"/2013-04-01/hostedzone", "/2013-04-01/hostedzone"},
+	}
+
+	for _, tt := range tests {
+		if got := canonicalPath(tt.in); got != tt.want {
+			t.Errorf("canonicalPath(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,161 @@
+package state
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/cromefire/fritzbox-cloudflare-dyndns/pkg/util"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Record is the state of a single record of a provider.
+type Record struct {
+	Provider  string `json:"provider"`
+	Domain    string `json:"domain"`
+	IpVersion uint8  `json:"ipVersion"`
+	// Type is the record type if it isn't the A or AAAA record of the IP version
+	Type string `json:"type,omitempty"`
+	// Definition identifies the configuration the address was published with
+	Definition string `json:"definition"`
+	// Last is the most recently published address
+	Last string `json:"last,omitempty"`
+	// RecordIds are the IDs of the records at the provider, if it has any
+	RecordIds   []string          `json:"recordIds,omitempty"`
+	LastSuccess time.Time         `json:"lastSuccess"`
+	LastFailure time.Time         `json:"lastFailure"`
+	Retry       *util.RetryStatus `json:"retry,omitempty"`
+}
+
+func (r Record) key() string {
+	if r.Type != "" {
+		return fmt.Sprintf("%s/%s/%s/%d", r.Provider, r.Domain, r.Type, r.IpVersion)
+	}
+
+	return fmt.Sprintf("%s/%s/%d", r.Provider, r.Domain, r.IpVersion)
+}
+
+type file struct {
+	Records []Record `json:"records"`
+}
+
+// Store keeps the state of the records in a JSON file, which is replaced
+// atomically on every change. A nil Store keeps nothing.
+type Store struct {
+	path string
+	log  *slog.Logger
+
+	lock    sync.Mutex
+	records map[string]Record
+}
+
+// Open reads the state from the file, which doesn't have to exist yet.
+func Open(path string, log *slog.Logger) (*Store, error) {
+	s := &Store{
+		path:    path,
+		log:     log.With(slog.String("module", "state")),
+		records: make(map[string]Record),
+	}
+
+	data, err := os.ReadFile(path)
+
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	f := file{}
+	err = json.Unmarshal(data, &f)
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse state file %s: %w", path, err)
+	}
+
+	for _, record := range f.Records {
+		s.records[record.key()] = record
+	}
+
+	return s, nil
+}
+
+// Get returns the state of the record, ok is false if there is none. The
+// record type is empty for the A or AAAA record of the IP version.
+func (s *Store) Get(provider string, domain string, recordType string, ipVersion uint8) (Record, bool) {
+	if s == nil {
+		return Record{}, false
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	record, ok := s.records[Record{Provider: provider, Domain: domain, Type: recordType, IpVersion: ipVersion}.key()]
+
+	return record, ok
+}
+
+// Set replaces the state of the record and writes the file.
+func (s *Store) Set(record Record) {
+	if s == nil {
+		return
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.records[record.key()] = record
+
+	err := s.write()
+
+	if err != nil {
+		s.log.Error("Failed to write state file", util.ErrorAttr(err))
+	}
+}
+
+// write replaces the file with the current state, the caller has to hold the lock.
+func (s *Store) write() error {
+	f := file{Records: make([]Record, 0, len(s.records))}
+
+	for _, record := range s.records {
+		f.Records = append(f.Records, record)
+	}
+
+	// Keep the file stable for diffs
+	slices.SortFunc(f.Records, func(a Record, b Record) int {
+		return strings.Compare(a.key(), b.key())
+	})
+
+	data, err := json.MarshalIndent(f, "", "  ")
+
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".*.tmp")
+
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = tmp.Write(data)
+
+	if err == nil {
+		err = tmp.Sync()
+	}
+
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), s.path)
+}
@@ -0,0 +1,81 @@
+package state
+
+import (
+	"github.com/cromefire/fritzbox-cloudflare-dyndns/pkg/util"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func testLogger() *slog.Logger {
+	return slog.New(slog.NewTextHandler(io.Discard, nil))
+}
+
+func TestStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+
+	s, err := Open(path, testLogger())
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := s.Get("cloudflare", "home.example.com", "", 4); ok {
+		t.Error("Get() found a record in a new store")
+	}
+
+	success := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	records := []Record{
+		{Provider: "cloudflare", Domain: "home.example.com", IpVersion: 4, Definition: "a", Last: "192.0.2.1", RecordIds: []string{"1"}, LastSuccess: success},
+		{Provider: "cloudflare", Domain: "home.example.com", IpVersion: 4, Type: "HTTPS", Definition: "b", Last: "192.0.2.1"},
+		{Provider: "route53", Domain: "home.example.com", IpVersion: 4, Definition: "c", Retry: &util.RetryStatus{Content: "192.0.2.2", Attempt: 2, Next: success, Error: "failed"}},
+	}
+
+	for _, record := range records {
+		s.Set(record)
+	}
+
+	// The records are kept apart by provider and type, and survive a restart
+	reopened, err := Open(path, testLogger())
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, record := range records {
+		got, ok := reopened.Get(record.Provider, record.Domain, record.Type, record.IpVersion)
+
+		if !ok || !reflect.DeepEqual(got, record) {
+			t.Errorf("Get(%s) = %+v, want %+v", record.key(), got, record)
+		}
+	}
+
+	// No temporary files are left behind
+	entries, _ := os.ReadDir(filepath.Dir(path))
+
+	if len(entries) != 1 {
+		t.Errorf("state directory has %d files, want 1", len(entries))
+	}
+}
+
+func TestStoreInvalidFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+	_ = os.WriteFile(path, []byte("{"), 0o600)
+
+	if _, err := Open(path, testLogger()); err == nil {
+		t.Error("Open() of an invalid file succeeded")
+	}
+}
+
+func TestNilStore(t *testing.T) {
+	var s *Store
+	s.Set(Record{Provider: "cloudflare", Domain: "home.example.com", IpVersion: 4})
+
+	if _, ok := s.Get("cloudflare", "home.example.com", "", 4); ok {
+		t.Error("Get() of a nil store found a record")
+	}
+}
@@ -0,0 +1,29 @@
+package util
+
+const (
+	ChangeCreate = "create"
+	ChangeUpdate = "update"
+	ChangeNoop   = "noop"
+	// ChangeConflict is a record that matches but isn't owned by the updater
+	ChangeConflict = "conflict"
+	// ChangeDelete removes a duplicate record
+	ChangeDelete = "delete"
+	// ChangeDuplicate is a duplicate record left untouched as the update fails
+	ChangeDuplicate = "duplicate"
+	// ChangeAdopt marks an existing record as owned by the updater
+	ChangeAdopt = "adopt"
+)
+
+// Change is a modification of a DNS record an updater makes or, in dry-run
+// mode, would make.
+type Change struct {
+	Action   string `json:"action"`
+	Provider string `json:"provider"`
+	Domain   string `json:"domain"`
+	Type     string `json:"type"`
+	Content  string `json:"content"`
+	// RecordId is the ID of the updated record, if the provider has one
+	RecordId string `json:"recordId,omitempty"`
+	// Details describe why a record is changed or differences that are kept
+	Details []string `json:"details,omitempty"`
+}
@@ -0,0 +1,61 @@
+package util
+
+import "net"
+
+// SourcePush is the source name used for updates received by the push server.
+const SourcePush = "push"
+
+// IpUpdate is sent by the sources (push server and router polling) to the
+// updaters whenever the WAN address of an IP family changes.
+type IpUpdate struct {
+	// Source is the name of the router or SourcePush
+	Source    string
+	IpVersion uint8
+	// Ip is the WAN address, for IPv6 it's nil if only the prefix is known
+	Ip net.IP
+	// Prefix is the IPv6 LAN prefix, nil if unknown
+	Prefix *net.IPNet
+	// Withdrawn marks the addresses missing in the update as lost by the
+	// router instead of unknown
+	Withdrawn bool
+}
+
+// Address returns the address a record should point to: the WAN address, or
+// if an interface ID is given, the address of that device within the prefix.
+// It returns nil if the required information is missing.
+func (u *IpUpdate) Address(interfaceId net.IP) net.IP {
+	if interfaceId == nil {
+		return u.Ip
+	}
+
+	if u.Prefix == nil {
+		return nil
+	}
+
+	return CombineIPv6(u.Prefix, interfaceId)
+}
+
+// CombineIPv6 builds an address from the network part of the prefix and the
+// host part of the interface ID.
+func CombineIPv6(prefix *net.IPNet, interfaceId net.IP) net.IP {
+	constructedIp := make(net.IP, net.IPv6len)
+	copy(constructedIp, prefix.IP.To16())
+
+	maskLen, _ := prefix.Mask.Size()
+	localIp := interfaceId.To16()
+
+	for i := 0; i < net.IPv6len; i++ {
+		b := constructedIp[i]
+		lb := localIp[i]
+		var mask byte = 0b00000000
+		for j := 0; j < 8; j++ {
+			if (i*8 + j) >= maskLen {
+				mask += 0b00000001 << (7 - j)
+			}
+		}
+		b += lb & mask
+		constructedIp[i] = b
+	}
+
+	return constructedIp
+}
@@ -7,9 +7,15 @@ func MakePromSubsystem(subsystem string) string {
 }
 
 type Status struct {
-	Push    *PushStatus     `json:"push"`
+	Push *PushStatus `json:"push"`
+	// Poll is the status of the first router, kept for compatibility
 	Poll    *PollStatus     `json:"poll"`
+	Routers []*PollStatus   `json:"routers"`
 	Updates []*UpdateStatus `json:"updates"`
+	// Credentials are the statuses of the provider credentials, if they report any
+	Credentials []*CredentialStatus `json:"credentials,omitempty"`
+	// Zones are the permissions of the credentials in the zones, if verified
+	Zones []*ZoneStatus `json:"zones,omitempty"`
 }
 
 type PushStatus struct {
@@ -18,13 +24,46 @@ type PushStatus struct {
 }
 
 type PollStatus struct {
+	Router    string    `json:"router"`
 	Last      time.Time `json:"last"`
 	Succeeded bool      `json:"succeeded"`
 }
 
 type UpdateStatus struct {
 	Last      time.Time `json:"last"`
+	Provider  string    `json:"provider"`
 	Domain    string    `json:"domain"`
 	IpVersion uint8     `json:"ipVersion"`
+	// Type is the record type if it isn't the A or AAAA record of the IP version
+	Type      string `json:"type,omitempty"`
+	Succeeded bool   `json:"succeeded"`
+	// LastSuccess and LastFailure are the times of the last update with the result
+	LastSuccess time.Time `json:"lastSuccess"`
+	LastFailure time.Time `json:"lastFailure"`
+	// Retry is the pending retry of the last failed update
+	Retry *RetryStatus `json:"retry,omitempty"`
+}
+
+// CredentialStatus tells whether the last request with a provider credential
+// was authorized.
+type CredentialStatus struct {
+	Last      time.Time `json:"last"`
+	Provider  string    `json:"provider"`
+	Name      string    `json:"name"`
 	Succeeded bool      `json:"succeeded"`
+	Error     string    `json:"error,omitempty"`
+}
+
+// ZoneStatus tells whether a provider credential has the permissions the
+// records of a zone need.
+type ZoneStatus struct {
+	Last       time.Time `json:"last"`
+	Provider   string    `json:"provider"`
+	Credential string    `json:"credential"`
+	Zone       string    `json:"zone"`
+	Read       bool      `json:"read"`
+	// Write is nil if the write access wasn't probed
+	Write     *bool  `json:"write,omitempty"`
+	Succeeded bool   `json:"succeeded"`
+	Error     string `json:"error,omitempty"`
 }
@@ -0,0 +1,10 @@
+package util
+
+// Reload is a validated change of the records of an updater that's ready to
+// be applied.
+type Reload struct {
+	// Changes describes the changed records in a human-readable way
+	Changes []string
+	// Apply swaps the records, it waits for the update in progress to finish
+	Apply func()
+}
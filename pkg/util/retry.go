@@ -0,0 +1,101 @@
+package util
+
+import (
+	"math/rand/v2"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// RetryMinDelay is the delay before the first retry of a failed update
+	RetryMinDelay = 10 * time.Second
+	// RetryMaxDelay caps the exponential backoff
+	RetryMaxDelay = 30 * time.Minute
+)
+
+// RetryStatus is a pending retry of a failed update.
+type RetryStatus struct {
+	Content string    `json:"content"`
+	Attempt int       `json:"attempt"`
+	Next    time.Time `json:"next"`
+	Error   string    `json:"error"`
+}
+
+// NextRetry returns the retry after a failed attempt to publish content. It
+// continues the backoff of the previous retry of the same content and starts
+// over otherwise. The retry isn't scheduled before notBefore, i.e. the end of
+// a rate limit.
+func NextRetry(previous *RetryStatus, content string, err error, notBefore time.Time) *RetryStatus {
+	retry := &RetryStatus{Content: content, Attempt: 1, Error: err.Error()}
+
+	if previous != nil && previous.Content == content {
+		retry.Attempt = previous.Attempt + 1
+	}
+
+	retry.Next = time.Now().Add(RetryDelay(retry.Attempt))
+
+	if retry.Next.Before(notBefore) {
+		retry.Next = notBefore
+	}
+
+	return retry
+}
+
+// RetryDelay returns the exponential backoff with jitter before the attempt,
+// starting at 1.
+func RetryDelay(attempt int) time.Duration {
+	delay := RetryMaxDelay
+
+	if attempt < 20 {
+		delay = min(RetryMinDelay<<(attempt-1), RetryMaxDelay)
+	}
+
+	// The jitter only spreads the upper half to keep the delay growing
+	return delay/2 + rand.N(delay/2+1)
+}
+
+// RateLimit remembers until when an API is rate limited, so retries aren't
+// scheduled before. A nil RateLimit is never limited.
+type RateLimit struct {
+	lock  sync.Mutex
+	until time.Time
+}
+
+// Extend makes the rate limit last until the time, unless it lasts longer
+// already.
+func (r *RateLimit) Extend(until time.Time) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if until.After(r.until) {
+		r.until = until
+	}
+}
+
+// LimitedUntil returns the end of the last rate limit.
+func (r *RateLimit) LimitedUntil() time.Time {
+	if r == nil {
+		return time.Time{}
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	return r.until
+}
+
+// ParseRetryAfter parses the seconds or the date of a Retry-After header, the
+// zero time if it's invalid.
+func ParseRetryAfter(value string, now time.Time) time.Time {
+	if seconds, err := strconv.Atoi(value); err == nil {
+		return now.Add(time.Duration(seconds) * time.Second)
+	}
+
+	if date, err := http.ParseTime(value); err == nil {
+		return date
+	}
+
+	return time.Time{}
+}
@@ -0,0 +1,89 @@
+package util
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestRetryDelay(t *testing.T) {
+	tests := []struct {
+		attempt int
+		max     time.Duration
+	}{
+		{attempt: 1, max: RetryMinDelay},
+		{attempt: 2, max: 2 * RetryMinDelay},
+		{attempt: 5, max: 16 * RetryMinDelay},
+		{attempt: 12, max: RetryMaxDelay},
+		{attempt: 100, max: RetryMaxDelay},
+	}
+
+	for _, tt := range tests {
+		for range 100 {
+			if delay := RetryDelay(tt.attempt); delay < tt.max/2 || delay > tt.max {
+				t.Fatalf("RetryDelay(%d) = %s, want between %s and %s", tt.attempt, delay, tt.max/2, tt.max)
+			}
+		}
+	}
+}
+
+func TestNextRetry(t *testing.T) {
+	err := errors.New("failed")
+
+	first := NextRetry(nil, "192.0.2.1", err, time.Time{})
+
+	if first.Attempt != 1 || first.Content != "192.0.2.1" || first.Error != "failed" {
+		t.Errorf("NextRetry() = %+v, want the first attempt", first)
+	}
+
+	if second := NextRetry(first, "192.0.2.1", err, time.Time{}); second.Attempt != 2 {
+		t.Errorf("NextRetry() of the same content = attempt %d, want 2", second.Attempt)
+	}
+
+	if other := NextRetry(first, "192.0.2.2", err, time.Time{}); other.Attempt != 1 {
+		t.Errorf("NextRetry() of another content = attempt %d, want 1", other.Attempt)
+	}
+
+	limited := time.Now().Add(time.Hour)
+
+	if retry := NextRetry(first, "192.0.2.1", err, limited); !retry.Next.Equal(limited) {
+		t.Errorf("NextRetry() = %s, want the end of the rate limit %s", retry.Next, limited)
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	var none *RateLimit
+
+	if !none.LimitedUntil().IsZero() {
+		t.Error("a nil rate limit is limited")
+	}
+
+	now := time.Now()
+	limit := &RateLimit{}
+	limit.Extend(now.Add(time.Minute))
+	limit.Extend(now.Add(time.Second))
+
+	if until := limit.LimitedUntil(); !until.Equal(now.Add(time.Minute)) {
+		t.Errorf("LimitedUntil() = %s, want the longer limit", until)
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		value string
+		want  time.Time
+	}{
+		{value: "120", want: now.Add(2 * time.Minute)},
+		{value: "Wed, 01 May 2024 12:05:00 GMT", want: now.Add(5 * time.Minute)},
+		{value: ""},
+		{value: "soon"},
+	}
+
+	for _, tt := range tests {
+		if got := ParseRetryAfter(tt.value, now); !got.Equal(tt.want) {
+			t.Errorf("ParseRetryAfter(%q) = %s, want %s", tt.value, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,51 @@
+package util
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// WithdrawMode controls what happens to a record when the router loses the
+// address it points to.
+type WithdrawMode string
+
+const (
+	// WithdrawKeep leaves the record with the last address
+	WithdrawKeep WithdrawMode = "keep"
+	// WithdrawDelete deletes the record
+	WithdrawDelete WithdrawMode = "delete"
+	// WithdrawFallback points the record to a fallback address
+	WithdrawFallback WithdrawMode = "fallback"
+)
+
+func ParseWithdrawMode(value string) (WithdrawMode, error) {
+	switch strings.ToLower(value) {
+	case "", "keep":
+		return WithdrawKeep, nil
+	case "delete":
+		return WithdrawDelete, nil
+	case "fallback":
+		return WithdrawFallback, nil
+	default:
+		return WithdrawKeep, fmt.Errorf("invalid withdraw mode %q, has to be keep, delete or fallback", value)
+	}
+}
+
+// Content returns the content a record should have after the update, empty if
+// it should be deleted as its address was withdrawn, and false if the update
+// lacks the information.
+func (u *IpUpdate) Content(interfaceId net.IP, withdraw WithdrawMode, fallback net.IP) (string, bool) {
+	ip := u.Address(interfaceId)
+
+	switch {
+	case ip != nil:
+		return ip.String(), true
+	case !u.Withdrawn || withdraw == WithdrawKeep || withdraw == "":
+		return "", false
+	case withdraw == WithdrawFallback:
+		return fallback.String(), true
+	default:
+		return "", true
+	}
+}
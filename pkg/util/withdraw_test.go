@@ -0,0 +1,61 @@
+package util
+
+import (
+	"net"
+	"testing"
+)
+
+func TestParseWithdrawMode(t *testing.T) {
+	tests := map[string]WithdrawMode{
+		"":         WithdrawKeep,
+		"keep":     WithdrawKeep,
+		"Delete":   WithdrawDelete,
+		"fallback": WithdrawFallback,
+	}
+
+	for value, want := range tests {
+		got, err := ParseWithdrawMode(value)
+
+		if err != nil || got != want {
+			t.Errorf("ParseWithdrawMode(%q) = %q, %v, want %q", value, got, err, want)
+		}
+	}
+
+	if _, err := ParseWithdrawMode("clear"); err == nil {
+		t.Error("ParseWithdrawMode(clear) succeeded, want an error")
+	}
+}
+
+func TestContent(t *testing.T) {
+	_, prefix, _ := net.ParseCIDR("2001:db8::/56")
+	interfaceId := net.ParseIP("::1")
+	fallback := net.ParseIP("2001:db8:ffff::1")
+
+	tests := []struct {
+		name        string
+		update      IpUpdate
+		interfaceId net.IP
+		withdraw    WithdrawMode
+		want        string
+		wantOk      bool
+	}{
+		{name: "address", update: IpUpdate{Ip: net.ParseIP("2001:db8::2")}, withdraw: WithdrawDelete, want: "2001:db8::2", wantOk: true},
+		{name: "device in prefix", update: IpUpdate{Prefix: prefix}, interfaceId: interfaceId, want: "2001:db8::1", wantOk: true},
+		{name: "unknown", update: IpUpdate{Prefix: prefix}, withdraw: WithdrawDelete},
+		{name: "withdrawn and kept", update: IpUpdate{Withdrawn: true}, withdraw: WithdrawKeep},
+		{name: "withdrawn without mode", update: IpUpdate{Withdrawn: true}},
+		{name: "withdrawn and deleted", update: IpUpdate{Withdrawn: true}, withdraw: WithdrawDelete, wantOk: true},
+		{name: "withdrawn with fallback", update: IpUpdate{Withdrawn: true}, withdraw: WithdrawFallback, want: "2001:db8:ffff::1", wantOk: true},
+		{name: "prefix withdrawn", update: IpUpdate{Ip: net.ParseIP("2001:db8::2"), Withdrawn: true}, interfaceId: interfaceId, withdraw: WithdrawDelete, wantOk: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, ok := test.update.Content(test.interfaceId, test.withdraw, fallback)
+
+			if got != test.want || ok != test.wantOk {
+				t.Errorf("Content = %q, %v, want %q, %v", got, ok, test.want, test.wantOk)
+			}
+		})
+	}
+}
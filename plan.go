@@ -0,0 +1,113 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/cromefire/fritzbox-cloudflare-dyndns/pkg/config"
+	"github.com/cromefire/fritzbox-cloudflare-dyndns/pkg/util"
+	"log/slog"
+	"os"
+	"strings"
+)
+
+// runPlan prints the changes a sync would make without making them and
+// returns the exit code.
+func runPlan(args []string) int {
+	flags := flag.NewFlagSet("plan", flag.ExitOnError)
+	configPath := flags.String("config", os.Getenv("CONFIG_FILE"), "path to a YAML or TOML config file")
+	jsonOutput := flags.Bool("json", false, "print the changes as JSON")
+	ipv4 := flags.String("ipv4", "", "IPv4 address to plan with instead of polling the routers")
+	ipv6 := flags.String("ipv6", "", "IPv6 address to plan with instead of polling the routers")
+	prefix := flags.String("prefix", "", "IPv6 prefix to plan with instead of polling the routers")
+	_ = flags.Parse(args)
+
+	logger := slog.Default()
+
+	cfg, err := config.Load(*configPath)
+
+	if err != nil {
+		logger.Error("Failed to load configuration", util.ErrorAttr(err))
+		return exitInvalidConfig
+	}
+
+	updates, code := collectUpdates(cfg, *ipv4, *ipv6, *prefix, logger)
+
+	if code == exitInvalidConfig {
+		return code
+	}
+
+	changes := make([]util.Change, 0)
+	opts := updaterOptions{
+		dryRun: true,
+		onChange: func(change util.Change) {
+			changes = append(changes, change)
+		},
+	}
+
+	updaters, err := startUpdaters(cfg, opts, logger)
+
+	if err != nil {
+		logger.Error("Failed to start updaters", util.ErrorAttr(err))
+		return exitFailed
+	}
+
+	for _, u := range updaters {
+		for _, update := range updates {
+			u.handle(update)
+		}
+
+		for _, status := range u.statuses() {
+			if !status.Succeeded {
+				code = exitFailed
+			}
+		}
+	}
+
+	printChanges(changes, *jsonOutput)
+
+	return code
+}
+
+// printChanges prints the changes with a summary, or as JSON.
+func printChanges(changes []util.Change, jsonOutput bool) {
+	if jsonOutput {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		_ = encoder.Encode(changes)
+		return
+	}
+
+	symbols := map[string]string{util.ChangeCreate: "+", util.ChangeUpdate: "~", util.ChangeNoop: "=", util.ChangeConflict: "!", util.ChangeAdopt: "@", util.ChangeDelete: "-", util.ChangeDuplicate: "*"}
+	counts := make(map[string]int)
+
+	for _, change := range changes {
+		counts[change.Action]++
+
+		line := fmt.Sprintf("%s %-8s  %s  %s %s %s", symbols[change.Action], change.Action, change.Provider, change.Domain, change.Type, change.Content)
+		if change.RecordId != "" {
+			line += " (" + change.RecordId + ")"
+		}
+		if len(change.Details) > 0 {
+			line += ": " + strings.Join(change.Details, ", ")
+		}
+
+		fmt.Println(line)
+	}
+
+	summary := fmt.Sprintf("%d to create, %d to update, %d up to date", counts[util.ChangeCreate], counts[util.ChangeUpdate], counts[util.ChangeNoop])
+	if counts[util.ChangeDelete] > 0 {
+		summary += fmt.Sprintf(", %d duplicates to delete", counts[util.ChangeDelete])
+	}
+	if counts[util.ChangeDuplicate] > 0 {
+		summary += fmt.Sprintf(", %d duplicates failing", counts[util.ChangeDuplicate])
+	}
+	if counts[util.ChangeConflict] > 0 {
+		summary += fmt.Sprintf(", %d not owned", counts[util.ChangeConflict])
+	}
+	if counts[util.ChangeAdopt] > 0 {
+		summary += fmt.Sprintf(", %d to adopt", counts[util.ChangeAdopt])
+	}
+
+	fmt.Println(summary)
+}
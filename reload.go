@@ -0,0 +1,176 @@
+package main
+
+import (
+	"github.com/cromefire/fritzbox-cloudflare-dyndns/pkg/config"
+	"github.com/cromefire/fritzbox-cloudflare-dyndns/pkg/util"
+	"log/slog"
+	"os"
+	"reflect"
+	"sync"
+	"time"
+)
+
+// reloader applies the records of a changed configuration at runtime. Only
+// the records and devices are reloaded, other changes need a restart.
+type reloader struct {
+	path     string
+	cfg      *config.Config
+	updaters []*runningUpdater
+	log      *slog.Logger
+
+	lock sync.Mutex
+}
+
+func newReloader(path string, cfg *config.Config, updaters []*runningUpdater, logger *slog.Logger) *reloader {
+	return &reloader{
+		path:     path,
+		cfg:      cfg,
+		updaters: updaters,
+		log:      logger.With(util.SubsystemAttr("reload")),
+	}
+}
+
+// Reload reads the configuration again and applies it if it's valid for all
+// updaters. The current configuration is kept otherwise.
+func (r *reloader) Reload(reason string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	logger := r.log.With(slog.String("reason", reason))
+	logger.Info("Reloading configuration")
+
+	cfg, err := config.Load(r.path)
+
+	if err != nil {
+		logger.Error("Rejected new configuration", util.ErrorAttr(err))
+		return
+	}
+
+	r.warnRestartRequired(logger, cfg)
+
+	reloads := make(map[*runningUpdater]*util.Reload)
+
+	for _, u := range r.updaters {
+		if cfg.Provider(u.provider) == nil {
+			logger.Error("Rejected new configuration, removing a provider requires a restart", slog.String("provider", u.provider))
+			return
+		}
+
+		reload, err := u.prepare(cfg, cfg.RecordsOf(u.provider))
+
+		if err != nil {
+			logger.Error("Rejected new configuration", slog.String("provider", u.provider), util.ErrorAttr(err))
+			return
+		}
+
+		reloads[u] = reload
+	}
+
+	changes := 0
+	for _, u := range r.updaters {
+		reload := reloads[u]
+
+		for _, change := range reload.Changes {
+			logger.Info("Record "+change, slog.String("provider", u.provider))
+		}
+
+		changes += len(reload.Changes)
+		reload.Apply()
+	}
+
+	r.cfg = cfg
+
+	logger.Info("Configuration reloaded", slog.Int("changes", changes))
+}
+
+// warnRestartRequired logs the changes that are ignored by a reload.
+func (r *reloader) warnRestartRequired(logger *slog.Logger, cfg *config.Config) {
+	if !reflect.DeepEqual(r.cfg.Sources, cfg.Sources) {
+		logger.Warn("Changes of the sources require a restart")
+	}
+
+	if !reflect.DeepEqual(r.cfg.Providers, cfg.Providers) {
+		logger.Warn("Changes of the providers require a restart")
+	}
+
+	if !reflect.DeepEqual(r.cfg.Metrics, cfg.Metrics) {
+		logger.Warn("Changes of the metrics require a restart")
+	}
+
+	if !reflect.DeepEqual(r.cfg.Notifications, cfg.Notifications) {
+		logger.Warn("Changes of the notifications require a restart")
+	}
+
+	if (cfg.UsesIpVersion(4) && !r.cfg.UsesIpVersion(4)) || (cfg.UsesWanIpv6() && !r.cfg.UsesWanIpv6()) || (cfg.UsesPrefix() && !r.cfg.UsesPrefix()) {
+		logger.Warn("The new records need addresses the routers aren't polled for until a restart")
+	}
+
+	for _, p := range cfg.Providers {
+		running := false
+		for _, u := range r.updaters {
+			running = running || u.provider == p.Name
+		}
+
+		if !running && len(cfg.RecordsOf(p.Name)) > 0 {
+			logger.Warn("The records of a provider without records before are only updated after a restart", slog.String("provider", p.Name))
+		}
+	}
+}
+
+// Watch reloads the configuration whenever the file is modified.
+func (r *reloader) Watch(interval time.Duration) {
+	last, _ := os.Stat(r.path)
+
+	for range time.Tick(interval) {
+		info, err := os.Stat(r.path)
+
+		if err != nil {
+			r.log.Warn("Failed to check configuration file", util.ErrorAttr(err))
+			continue
+		}
+
+		if last != nil && info.ModTime().Equal(last.ModTime()) && info.Size() == last.Size() {
+			continue
+		}
+
+		last = info
+		r.Reload("file changed")
+	}
+}
+
+// Statuses returns the statuses of the records of all updaters.
+func (r *reloader) Statuses() []*util.UpdateStatus {
+	statuses := make([]*util.UpdateStatus, 0)
+
+	for _, u := range r.updaters {
+		statuses = append(statuses, u.statuses()...)
+	}
+
+	return statuses
+}
+
+// CredentialStatuses returns the statuses of the credentials of all updaters.
+func (r *reloader) CredentialStatuses() []*util.CredentialStatus {
+	statuses := make([]*util.CredentialStatus, 0)
+
+	for _, u := range r.updaters {
+		if u.credentials != nil {
+			statuses = append(statuses, u.credentials()...)
+		}
+	}
+
+	return statuses
+}
+
+// ZoneStatuses returns the verified permissions in the zones of all updaters.
+func (r *reloader) ZoneStatuses() []*util.ZoneStatus {
+	statuses := make([]*util.ZoneStatus, 0)
+
+	for _, u := range r.updaters {
+		if u.zones != nil {
+			statuses = append(statuses, u.zones()...)
+		}
+	}
+
+	return statuses
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/cromefire/fritzbox-cloudflare-dyndns/pkg/config"
+	"github.com/cromefire/fritzbox-cloudflare-dyndns/pkg/polling"
+	"github.com/cromefire/fritzbox-cloudflare-dyndns/pkg/util"
+	"log/slog"
+	"net"
+	"os"
+)
+
+// runSync publishes the current addresses once and returns the exit code.
+// The addresses are polled from the routers unless they are passed as flags.
+func runSync(args []string) int {
+	flags := flag.NewFlagSet("sync", flag.ExitOnError)
+	configPath := flags.String("config", os.Getenv("CONFIG_FILE"), "path to a YAML or TOML config file")
+	jsonOutput := flags.Bool("json", false, "print the results as JSON")
+	ipv4 := flags.String("ipv4", "", "IPv4 address to publish instead of polling the routers")
+	ipv6 := flags.String("ipv6", "", "IPv6 address to publish instead of polling the routers")
+	prefix := flags.String("prefix", "", "IPv6 prefix to publish instead of polling the routers")
+	_ = flags.Parse(args)
+
+	logger := slog.Default()
+
+	cfg, err := config.Load(*configPath)
+
+	if err != nil {
+		logger.Error("Failed to load configuration", util.ErrorAttr(err))
+		return exitInvalidConfig
+	}
+
+	updates, code := collectUpdates(cfg, *ipv4, *ipv6, *prefix, logger)
+
+	if code == exitInvalidConfig {
+		return code
+	}
+
+	updaters, err := startUpdaters(cfg, updaterOptions{}, logger)
+
+	if err != nil {
+		logger.Error("Failed to start updaters", util.ErrorAttr(err))
+		return exitFailed
+	}
+
+	statuses := make([]*util.UpdateStatus, 0)
+
+	for _, u := range updaters {
+		for _, update := range updates {
+			u.handle(update)
+		}
+
+		statuses = append(statuses, u.statuses()...)
+	}
+
+	for _, status := range statuses {
+		if !status.Succeeded {
+			code = exitFailed
+		}
+	}
+
+	if *jsonOutput {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		_ = encoder.Encode(statuses)
+	} else {
+		for _, status := range statuses {
+			state := "OK"
+			if status.Last.IsZero() {
+				state = "SKIP"
+			} else if !status.Succeeded {
+				state = "FAIL"
+			}
+
+			fmt.Printf("%-4s  %s  %s/IPv%d\n", state, status.Provider, status.Domain, status.IpVersion)
+		}
+	}
+
+	return code
+}
+
+// collectUpdates returns the addresses passed as flags or polls them from the
+// routers. A failed poll returns the updates of the other routers and
+// exitFailed.
+func collectUpdates(cfg *config.Config, ipv4 string, ipv6 string, prefix string, logger *slog.Logger) ([]*util.IpUpdate, int) {
+	if ipv4 != "" || ipv6 != "" || prefix != "" {
+		updates, err := manualUpdates(cfg, ipv4, ipv6, prefix)
+
+		if err != nil {
+			logger.Error("Invalid address", util.ErrorAttr(err))
+			return nil, exitInvalidConfig
+		}
+
+		return updates, exitSucceeded
+	}
+
+	if len(cfg.Sources.Routers) == 0 {
+		logger.Error("No routers configured, pass the addresses via -ipv4, -ipv6 and -prefix")
+		return nil, exitInvalidConfig
+	}
+
+	code := exitSucceeded
+	updates := make([]*util.IpUpdate, 0)
+
+	for _, router := range cfg.Sources.Routers {
+		u, err := polling.PollOnce(router, cfg.UsesIpVersion(4), cfg.UsesWanIpv6(), cfg.UsesPrefix(), logger)
+
+		if err != nil {
+			logger.Error("Failed to poll router", slog.String("router", router.Name), util.ErrorAttr(err))
+			code = exitFailed
+		}
+
+		updates = append(updates, u...)
+	}
+
+	return updates, code
+}
+
+// manualUpdates creates the updates for the addresses passed as flags. They
+// are sent as every source, so records restricted to a source are updated as
+// well.
+func manualUpdates(cfg *config.Config, ipv4 string, ipv6 string, prefix string) ([]*util.IpUpdate, error) {
+	sources := []string{util.SourcePush}
+	for _, router := range cfg.Sources.Routers {
+		sources = append(sources, router.Name)
+	}
+
+	var v4 net.IP
+	v6 := util.IpUpdate{IpVersion: 6}
+
+	if ipv4 != "" {
+		v4 = net.ParseIP(ipv4).To4()
+
+		if v4 == nil {
+			return nil, fmt.Errorf("%s is not an IPv4 address", ipv4)
+		}
+	}
+
+	if ipv6 != "" {
+		v6.Ip = net.ParseIP(ipv6)
+
+		if v6.Ip == nil || v6.Ip.To4() != nil {
+			return nil, fmt.Errorf("%s is not an IPv6 address", ipv6)
+		}
+	}
+
+	if prefix != "" {
+		_, ipNet, err := net.ParseCIDR(prefix)
+
+		if err != nil {
+			return nil, err
+		}
+
+		v6.Prefix = ipNet
+	}
+
+	updates := make([]*util.IpUpdate, 0)
+
+	for _, source := range sources {
+		if v4 != nil {
+			updates = append(updates, &util.IpUpdate{Source: source, IpVersion: 4, Ip: v4})
+		}
+
+		if v6.Ip != nil || v6.Prefix != nil {
+			update := v6
+			update.Source = source
+			updates = append(updates, &update)
+		}
+	}
+
+	return updates, nil
+}
@@ -0,0 +1,536 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	cf "github.com/cloudflare/cloudflare-go"
+	"github.com/cromefire/fritzbox-cloudflare-dyndns/pkg/cloudflare"
+	"github.com/cromefire/fritzbox-cloudflare-dyndns/pkg/config"
+	"github.com/cromefire/fritzbox-cloudflare-dyndns/pkg/notify"
+	"github.com/cromefire/fritzbox-cloudflare-dyndns/pkg/plugin"
+	"github.com/cromefire/fritzbox-cloudflare-dyndns/pkg/provider"
+	"github.com/cromefire/fritzbox-cloudflare-dyndns/pkg/route53"
+	"github.com/cromefire/fritzbox-cloudflare-dyndns/pkg/state"
+	"github.com/cromefire/fritzbox-cloudflare-dyndns/pkg/util"
+	"log/slog"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+// runningUpdater is the updater of a provider.
+type runningUpdater struct {
+	provider string
+	in       chan<- *util.IpUpdate
+	statuses func() []*util.UpdateStatus
+	// credentials returns the statuses of the credentials, nil if the provider
+	// doesn't report any
+	credentials func() []*util.CredentialStatus
+	// zones returns the verified permissions in the zones, nil if the provider
+	// doesn't verify any
+	zones func() []*util.ZoneStatus
+	// handle publishes an update synchronously
+	handle func(update *util.IpUpdate)
+	// prepare validates the records of a new config and prepares their reload
+	prepare func(cfg *config.Config, records []config.Record) (*util.Reload, error)
+	// adopt takes ownership of the existing records with the names, nil if the
+	// provider doesn't support ownership
+	adopt func(names []string) error
+}
+
+// updaterOptions are applied to all updaters.
+type updaterOptions struct {
+	notifier *notify.Notifier
+	store    *state.Store
+	// dryRun makes the updaters only report the changes
+	dryRun   bool
+	onChange func(change util.Change)
+}
+
+type configurableUpdater interface {
+	SetNotifier(notifier *notify.Notifier)
+	SetStore(store *state.Store)
+	SetDryRun(dryRun bool)
+	SetChangeHandler(handler func(change util.Change))
+}
+
+func (o updaterOptions) applyTo(u configurableUpdater) {
+	u.SetNotifier(o.notifier)
+	u.SetStore(o.store)
+	u.SetDryRun(o.dryRun)
+	u.SetChangeHandler(o.onChange)
+}
+
+// startUpdaters creates and starts an updater for every provider with records,
+// the caller decides how to handle a provider that fails to start.
+func startUpdaters(cfg *config.Config, opts updaterOptions, logger *slog.Logger) ([]*runningUpdater, error) {
+	updaters := make([]*runningUpdater, 0)
+
+	for _, p := range cfg.Providers {
+		records := cfg.RecordsOf(p.Name)
+
+		if len(records) == 0 {
+			logger.Warn("No records configured for provider, disabling its updates", slog.String("provider", p.Name))
+			continue
+		}
+
+		var u *runningUpdater
+		var err error
+
+		switch p.Type {
+		case config.ProviderCloudflare:
+			u, err = newUpdater(cfg, p, records, opts, logger)
+		case config.ProviderCloudflareList:
+			u, err = cloudflareLists.newUpdater(cfg, p, records, opts, logger)
+		case config.ProviderCloudflareGateway:
+			u, err = cloudflareGateway.newUpdater(cfg, p, records, opts, logger)
+		case config.ProviderCloudflareLB:
+			u, err = cloudflareLB.newUpdater(cfg, p, records, opts, logger)
+		case config.ProviderRoute53:
+			u, err = newRoute53Updater(cfg, p, records, opts, logger)
+		case config.ProviderPlugin:
+			u, err = newPluginUpdater(cfg, p, records, opts, logger)
+		}
+
+		if err != nil {
+			return updaters, fmt.Errorf("provider %s: %w", p.Name, err)
+		}
+
+		u.provider = p.Name
+		updaters = append(updaters, u)
+	}
+
+	return updaters, nil
+}
+
+func newUpdater(cfg *config.Config, p config.Provider, records []config.Record, opts updaterOptions, logger *slog.Logger) (*runningUpdater, error) {
+	const subsystem = "cf_updater"
+	logger = logger.With(util.SubsystemAttr(subsystem))
+	u := cloudflare.NewUpdater(slog.Default().With(util.SubsystemAttr(subsystem)), p.Name, subsystem)
+	opts.applyTo(u)
+	u.SetWorkers(p.Workers)
+	u.SetTimeout(p.Timeout.Duration)
+	u.SetZoneRefreshInterval(p.ZoneRefreshInterval.Duration)
+
+	ownership, err := cloudflare.ParseOwnership(p.Ownership)
+
+	if err != nil {
+		return nil, err
+	}
+
+	u.SetOwnership(ownership, p.OwnerId)
+	u.SetVerification(p.WriteProbe, p.FailOnMissingPermissions)
+
+	for _, credential := range cloudflareCredentials(p) {
+		if credential.Token == "" {
+			logger.Warn("Using deprecated credentials via the API key", slog.String("credential", credential.Name))
+		}
+
+		err = u.AddCredential(credential)
+
+		if err != nil {
+			return nil, fmt.Errorf("invalid credential: %w", err)
+		}
+	}
+
+	cfRecords, err := cloudflareRecords(cfg, records)
+
+	if err != nil {
+		return nil, err
+	}
+
+	for _, record := range cfRecords {
+		u.AddRecord(record)
+	}
+
+	u.SetReconcileInterval(p.ReconcileInterval.Duration)
+
+	if p.Heartbeat != "" {
+		u.SetHeartbeat(p.Heartbeat, p.HeartbeatInterval.Duration, instanceName(p))
+	}
+
+	err, _ = u.Init()
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to init Cloudflare updater: %w", err)
+	}
+
+	u.StartWorker()
+
+	return &runningUpdater{
+		in:          u.In,
+		statuses:    u.Statuses,
+		credentials: u.CredentialStatuses,
+		zones:       u.ZoneStatuses,
+		handle:      u.Handle,
+		prepare: func(cfg *config.Config, records []config.Record) (*util.Reload, error) {
+			cfRecords, err := cloudflareRecords(cfg, records)
+
+			if err != nil {
+				return nil, err
+			}
+
+			return u.PrepareReload(cfRecords)
+		},
+		adopt: u.Adopt,
+	}, nil
+}
+
+// cloudflareCredentials returns the token or key of the provider as the
+// default credential followed by the named credentials.
+func cloudflareCredentials(p config.Provider) []cloudflare.Credential {
+	credentials := make([]cloudflare.Credential, 0, len(p.Credentials)+1)
+
+	if p.Token != "" || p.Key != "" {
+		credentials = append(credentials, cloudflare.Credential{Name: config.DefaultCredential, Token: p.Token, Email: p.Email, Key: p.Key})
+	}
+
+	for _, credential := range p.Credentials {
+		credentials = append(credentials, cloudflare.Credential(credential))
+	}
+
+	return credentials
+}
+
+// cloudflareRecords converts the configured records to Cloudflare records.
+func cloudflareRecords(cfg *config.Config, records []config.Record) ([]cloudflare.Record, error) {
+	cfRecords := make([]cloudflare.Record, 0, len(records))
+
+	for _, record := range records {
+		proxied, err := cloudflare.ParseProxiedMode(record.Proxied)
+
+		if err != nil {
+			return nil, fmt.Errorf("invalid record %s: %w", record.Name, err)
+		}
+
+		duplicates, err := cloudflare.ParseDuplicatePolicy(record.Duplicates)
+
+		if err != nil {
+			return nil, fmt.Errorf("invalid record %s: %w", record.Name, err)
+		}
+
+		withdraw, err := util.ParseWithdrawMode(record.Withdraw)
+
+		if err != nil {
+			return nil, fmt.Errorf("invalid record %s: %w", record.Name, err)
+		}
+
+		for _, ipVersion := range record.IpVersions() {
+			cfRecords = append(cfRecords, cloudflare.Record{
+				Name:        record.Name,
+				IpVersion:   ipVersion,
+				Type:        strings.ToUpper(record.Type),
+				Source:      record.Source,
+				InterfaceId: interfaceIdOf(cfg, record, ipVersion),
+				Zone:        record.Zone,
+				Credential:  record.Credential,
+				RecordOptions: cloudflare.RecordOptions{
+					TTL:        int(record.TTL),
+					Proxied:    proxied,
+					Comment:    record.Comment,
+					Tags:       record.Tags,
+					Enforce:    record.Enforce,
+					Duplicates: duplicates,
+					Withdraw:   withdraw,
+					Fallback:   record.Fallback(ipVersion),
+					Ptr:        record.Ptr && ipVersion == 6,
+				},
+			})
+		}
+	}
+
+	return cfRecords, nil
+}
+
+// instanceName names the updater in the heartbeat records, by its owner ID or
+// else the host name.
+func instanceName(p config.Provider) string {
+	if p.OwnerId != "" {
+		return p.OwnerId
+	}
+
+	hostname, err := os.Hostname()
+
+	if err != nil {
+		return cloudflare.DefaultOwnerId
+	}
+
+	return hostname
+}
+
+// accountProvider describes a provider of account-level Cloudflare resources,
+// whose records name resources that have to exist already.
+type accountProvider[P provider.Provider] struct {
+	subsystem string
+	// resources names the resources in the check report
+	resources string
+	create    func(api *cf.API, rateLimit *util.RateLimit, p config.Provider, logger *slog.Logger) P
+	// resolve makes sure a resource exists for every name
+	resolve func(provider P, ctx context.Context, names []string) error
+}
+
+var cloudflareLists = accountProvider[*cloudflare.ListProvider]{
+	subsystem: "cf_list_updater",
+	resources: "lists",
+	create: func(api *cf.API, rateLimit *util.RateLimit, p config.Provider, logger *slog.Logger) *cloudflare.ListProvider {
+		return cloudflare.NewListProvider(api, rateLimit, p.AccountId, p.OwnerId, logger)
+	},
+	resolve: (*cloudflare.ListProvider).ResolveLists,
+}
+
+var cloudflareGateway = accountProvider[*cloudflare.GatewayProvider]{
+	subsystem: "cf_gateway_updater",
+	resources: "locations",
+	create: func(api *cf.API, rateLimit *util.RateLimit, p config.Provider, logger *slog.Logger) *cloudflare.GatewayProvider {
+		return cloudflare.NewGatewayProvider(api, rateLimit, p.AccountId, logger)
+	},
+	resolve: (*cloudflare.GatewayProvider).ResolveLocations,
+}
+
+var cloudflareLB = accountProvider[*cloudflare.PoolProvider]{
+	subsystem: "cf_lb_updater",
+	resources: "origins",
+	create: func(api *cf.API, rateLimit *util.RateLimit, p config.Provider, logger *slog.Logger) *cloudflare.PoolProvider {
+		return cloudflare.NewPoolProvider(api, rateLimit, p.AccountId, logger)
+	},
+	resolve: (*cloudflare.PoolProvider).ResolveOrigins,
+}
+
+func (a accountProvider[P]) newUpdater(cfg *config.Config, p config.Provider, records []config.Record, opts updaterOptions, logger *slog.Logger) (*runningUpdater, error) {
+	logger = logger.With(util.SubsystemAttr(a.subsystem), slog.String("provider", p.Name))
+
+	resources, err := a.newProvider(p, logger)
+
+	if err != nil {
+		return nil, err
+	}
+
+	u := provider.NewUpdater(resources, p.Name, logger, a.subsystem)
+	opts.applyTo(u)
+	definitions := providerRecords(cfg, records)
+
+	for _, definition := range definitions {
+		u.AddRecord(definition)
+	}
+
+	err = a.resolveRecords(resources, definitions)
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve the %s: %w", a.resources, err)
+	}
+
+	u.Init()
+	u.StartWorker()
+
+	return &runningUpdater{
+		in:       u.In,
+		statuses: u.Statuses,
+		handle:   u.Handle,
+		prepare: func(cfg *config.Config, records []config.Record) (*util.Reload, error) {
+			definitions := providerRecords(cfg, records)
+
+			err := a.resolveRecords(resources, definitions)
+
+			if err != nil {
+				return nil, err
+			}
+
+			return u.PrepareReload(definitions)
+		},
+	}, nil
+}
+
+// newProvider creates the provider with the credentials of the provider.
+func (a accountProvider[P]) newProvider(p config.Provider, logger *slog.Logger) (P, error) {
+	api, rateLimit, err := cloudflare.NewAPI(p.Token, p.Email, p.Key)
+
+	if err != nil {
+		var none P
+		return none, err
+	}
+
+	return a.create(api, rateLimit, p, logger), nil
+}
+
+func (a accountProvider[P]) resolveRecords(resources P, definitions []provider.RecordDefinition) error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	names := make([]string, 0, len(definitions))
+	for _, definition := range definitions {
+		names = append(names, definition.Name)
+	}
+
+	return a.resolve(resources, ctx, names)
+}
+
+func newRoute53Updater(cfg *config.Config, p config.Provider, records []config.Record, opts updaterOptions, logger *slog.Logger) (*runningUpdater, error) {
+	const subsystem = "route53_updater"
+	logger = logger.With(util.SubsystemAttr(subsystem), slog.String("provider", p.Name))
+
+	client, err := newRoute53Client(p, logger)
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to load AWS credentials: %w", err)
+	}
+
+	u := provider.NewUpdater(client, p.Name, logger, subsystem)
+	opts.applyTo(u)
+	definitions := providerRecords(cfg, records)
+
+	for _, definition := range definitions {
+		u.AddRecord(definition)
+	}
+
+	err = resolveRoute53Zones(client, definitions)
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to init Route 53 updater: %w", err)
+	}
+
+	u.Init()
+	u.StartWorker()
+
+	return &runningUpdater{
+		in:       u.In,
+		statuses: u.Statuses,
+		handle:   u.Handle,
+		prepare: func(cfg *config.Config, records []config.Record) (*util.Reload, error) {
+			definitions := providerRecords(cfg, records)
+
+			err := resolveRoute53Zones(client, definitions)
+
+			if err != nil {
+				return nil, err
+			}
+
+			return u.PrepareReload(definitions)
+		},
+	}, nil
+}
+
+// newRoute53Client creates a Route 53 client with the credentials of the provider.
+func newRoute53Client(p config.Provider, logger *slog.Logger) (*route53.Client, error) {
+	var creds route53.Credentials
+
+	if p.AccessKeyId != "" {
+		creds = route53.Credentials{
+			AccessKeyID:     p.AccessKeyId,
+			SecretAccessKey: p.SecretAccessKey,
+			SessionToken:    p.SessionToken,
+		}
+	} else {
+		var err error
+		creds, err = route53.LoadSharedCredentials(p.CredentialsFile, p.Profile)
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	client := route53.NewClient(creds, logger)
+
+	if p.Endpoint != "" {
+		client.Endpoint = p.Endpoint
+	}
+
+	if p.Region != "" {
+		client.Region = p.Region
+	}
+
+	client.WaitForSync = p.WaitForSync
+
+	return client, nil
+}
+
+func resolveRoute53Zones(client *route53.Client, definitions []provider.RecordDefinition) error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	names := make([]string, 0, len(definitions))
+	for _, definition := range definitions {
+		names = append(names, definition.Name)
+	}
+
+	return client.ResolveZones(ctx, names)
+}
+
+func newPluginUpdater(cfg *config.Config, p config.Provider, records []config.Record, opts updaterOptions, logger *slog.Logger) (*runningUpdater, error) {
+	const subsystem = "plugin_updater"
+	logger = logger.With(util.SubsystemAttr(subsystem), slog.String("provider", p.Name))
+
+	pl := newPlugin(p, logger)
+
+	u := provider.NewUpdater(pl, p.Name, logger, subsystem)
+	opts.applyTo(u)
+
+	for _, definition := range providerRecords(cfg, records) {
+		u.AddRecord(definition)
+	}
+
+	u.Init()
+	u.StartWorker()
+
+	return &runningUpdater{
+		in:       u.In,
+		statuses: u.Statuses,
+		handle:   u.Handle,
+		prepare: func(cfg *config.Config, records []config.Record) (*util.Reload, error) {
+			return u.PrepareReload(providerRecords(cfg, records))
+		},
+	}, nil
+}
+
+func newPlugin(p config.Provider, logger *slog.Logger) *plugin.Plugin {
+	pl := plugin.NewPlugin(p.Command[0], p.Command[1:], logger)
+	pl.Env = p.Env
+
+	return pl
+}
+
+// providerRecords converts the configured records to generic updater records.
+func providerRecords(cfg *config.Config, records []config.Record) []provider.RecordDefinition {
+	definitions := make([]provider.RecordDefinition, 0, len(records))
+
+	for _, record := range records {
+		// Validated by the config
+		withdraw, _ := util.ParseWithdrawMode(record.Withdraw)
+
+		for _, ipVersion := range record.IpVersions() {
+			definitions = append(definitions, provider.RecordDefinition{
+				Name:        record.Name,
+				IpVersion:   ipVersion,
+				TTL:         int(record.TTL),
+				Source:      record.Source,
+				InterfaceId: interfaceIdOf(cfg, record, ipVersion),
+				Withdraw:    withdraw,
+				Fallback:    record.Fallback(ipVersion),
+			})
+		}
+	}
+
+	return definitions
+}
+
+// interfaceIdOf returns the interface ID of the device of an AAAA record.
+func interfaceIdOf(cfg *config.Config, record config.Record, ipVersion uint8) net.IP {
+	if ipVersion != 6 || record.Device == "" {
+		return nil
+	}
+
+	return net.ParseIP(cfg.Device(record.Device).InterfaceId)
+}
+
+func newNotifier(cfg *config.Config, logger *slog.Logger) *notify.Notifier {
+	if len(cfg.Notifications) == 0 {
+		return nil
+	}
+
+	hooks := make([]notify.Webhook, 0, len(cfg.Notifications))
+	for _, n := range cfg.Notifications {
+		hooks = append(hooks, notify.Webhook{Url: n.Url, Events: n.Events})
+	}
+
+	return notify.NewNotifier(hooks, logger)
+}